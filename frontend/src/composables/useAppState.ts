@@ -5,6 +5,7 @@ import { cleanLog } from '../utils/logUtils'
 import { getModeColor } from '../utils/modeColors'
 
 const running = ref(false)
+const hasDashboard = ref(false)
 const coreExists = ref(true)
 const msg = ref("READY")
 const tunMode = ref(false)
@@ -114,6 +115,7 @@ export function useAppState() {
   const refreshData = async () => {
     const data = await Backend.GetInitData()
     running.value = data.running
+    hasDashboard.value = data.hasDashboard
     coreExists.value = data.coreExists
     if (!data.coreExists) msg.value = "Kernel Missing"
     tunMode.value = data.tunMode
@@ -356,6 +358,10 @@ export function useAppState() {
 
     unsubscribeStatus = EventsOn("status", (isRunning: boolean) => {
       running.value = isRunning
+      hasDashboard.value = false
+      if (isRunning) {
+        Backend.HasDashboard().then(has => { hasDashboard.value = has })
+      }
 
       if (!isRunning) {
         if (msg.value !== "STANDBY" && msg.value !== "NET TIMEOUT") {
@@ -406,7 +412,7 @@ export function useAppState() {
   })
 
   return {
-    running, coreExists, msg, tunMode, sysProxy, isProcessing,
+    running, hasDashboard, coreExists, msg, tunMode, sysProxy, isProcessing,
     errorLog, startOnBoot, autoConnectState,
     mirrorUrl, mirrorEnabled, ipv6Enabled, preRelease, logLevel, logToFile, closeBehavior,
     showErrorAlert, errorAlertMessage,
@@ -11,7 +11,8 @@ const updateState = ref("idle")
 const downloadProgress = ref(0)
 
 const showEditor = ref(false)
-const editingType = ref<"tun" | "mixed" | "mirror">("tun")
+const editingType = ref<"tun" | "mixed" | "dns" | "split" | "mirror">("tun")
+const editingProfileId = ref("") // Empty edits the global override
 const editorContent = ref("")
 const editorOriginalContent = ref("")
 const editorDefaultContent = ref("")
@@ -68,15 +69,16 @@ export function useKernelUpdate() {
     }
   }
 
-  const openEditor = async (type: "tun" | "mixed" | "mirror") => {
+  const openEditor = async (type: "tun" | "mixed" | "dns" | "split" | "mirror", profileId = "") => {
     editingType.value = type
+    editingProfileId.value = profileId
     saveBtnText.value = "Save"
     if (type === 'mirror') {
       editorContent.value = appState.mirrorUrl.value
       editorOriginalContent.value = appState.mirrorUrl.value
       editorDefaultContent.value = "https://gh-proxy.com/"
     } else {
-      const content = await Backend.GetOverride(type)
+      const content = await Backend.GetOverride(type, editingProfileId.value)
       const defaultContentRaw = await Backend.GetDefaultOverride(type)
       try {
         const obj = JSON.parse(content)
@@ -121,7 +123,7 @@ export function useKernelUpdate() {
         showErrorAlert.value = true
         return
       }
-      res = await Backend.SaveOverride(editingType.value as string, editorContent.value)
+      res = await Backend.SaveOverride(editingType.value as string, editingProfileId.value, editorContent.value)
       if (res === "Success") {
         editorOriginalContent.value = editorContent.value
       }
@@ -148,9 +150,9 @@ export function useKernelUpdate() {
     if (editingType.value === 'mirror') {
       editorContent.value = "https://gh-proxy.com/"
     } else {
-      const res = await Backend.ResetOverride(editingType.value)
+      const res = await Backend.ResetOverride(editingType.value, editingProfileId.value)
       try {
-        const content = res === "Success" ? await Backend.GetOverride(editingType.value) : "{}"
+        const content = res === "Success" ? await Backend.GetOverride(editingType.value, editingProfileId.value) : "{}"
         const obj = JSON.parse(content)
         editorContent.value = JSON.stringify(obj, null, 2)
       } catch {
@@ -162,7 +164,7 @@ export function useKernelUpdate() {
   const switchEditorTab = async (type: "tun" | "mixed") => {
     editingType.value = type
     saveBtnText.value = "Save"
-    const content = await Backend.GetOverride(type)
+    const content = await Backend.GetOverride(type, editingProfileId.value)
     const defaultContentRaw = await Backend.GetDefaultOverride(type)
     try {
       const obj = JSON.parse(content)
@@ -202,7 +204,7 @@ export function useKernelUpdate() {
 
   return {
     localVer, remoteVer, updateState, downloadProgress,
-    showEditor, editingType, editorContent, editorOriginalContent, editorDefaultContent, isEditorChanged, saveBtnText,
+    showEditor, editingType, editingProfileId, editorContent, editorOriginalContent, editorDefaultContent, isEditorChanged, saveBtnText,
     showResetConfirm, showErrorAlert, errorAlertMessage,
     checkUpdate, performUpdate, openEditor, saveEditor, resetEditor, confirmReset, switchEditorTab
   }
@@ -82,17 +82,20 @@ export function useProfiles() {
       const original = profiles.value.find(p => p.id === draft.id)
       if (original) {
         if (original.name !== draft.name || original.url !== draft.url) {
-          if (!draft.name || !draft.url) {
+          const isRemote = !draft.type || draft.type === 'remote'
+          if (!draft.name || (isRemote && !draft.url)) {
             hasError = true
             lastError = "Name and URL cannot be empty"
             continue
           }
-          try {
-            new URL(draft.url)
-          } catch {
-            hasError = true
-            lastError = `Invalid URL: ${draft.name}`
-            continue
+          if (isRemote) {
+            try {
+              new URL(draft.url)
+            } catch {
+              hasError = true
+              lastError = `Invalid URL: ${draft.name}`
+              continue
+            }
           }
           const res = await Backend.EditProfile(draft.id, draft.name, draft.url)
           if (res !== "Success") {
@@ -101,10 +104,10 @@ export function useProfiles() {
           }
         }
       } else if (draft.id.startsWith('new_')) {
-        // 3. Add new profiles
-        if (!draft.name || !draft.url) {
+        // 3. Add new profiles (the backend names unnamed profiles after the provider's filename)
+        if (!draft.url) {
           hasError = true
-          lastError = "Name and URL cannot be empty"
+          lastError = "URL cannot be empty"
           continue
         }
         try {
@@ -46,6 +46,7 @@ type App struct {
 	uwpLoopbackManager *UWPLoopbackManager
 	storage            *Storage
 	httpClient         *HTTPClient
+	resourceCache      *ResourceCache
 	appLogger          *AppLogger
 	iconData           []byte
 	trayIcons          *TrayIcons
@@ -54,6 +55,9 @@ type App struct {
 
 	stateMutex         sync.Mutex
 	isAutoConnecting   bool
+
+	schedulerStop      chan struct{}
+	schedulerFailures  map[string]time.Time
 }
 
 // NewApp creates a new App application struct
@@ -89,6 +93,7 @@ func (a *App) Startup(ctx context.Context) {
 
 	// Initialize managers
 	a.httpClient = NewHTTPClient()
+	a.resourceCache = NewResourceCache(appDir, a.httpClient)
 	a.storage = NewStorage(filepath.Join(appDir, "data", "config"))
 	a.coreManager = NewCoreManager(appDir, ctx)
 	a.profileManager = NewProfileManager(a.storage, a.httpClient, a.coreManager, appDir)
@@ -103,6 +108,11 @@ func (a *App) Startup(ctx context.Context) {
 	os.WriteFile(kernelLogPath, []byte(""), 0644)
 
 	a.appLogger.Info("Application started")
+	a.startProfileScheduler()
+	go func() {
+		time.Sleep(5 * time.Second)
+		a.checkSubscriptionWarnings()
+	}()
 	
 	go func() {
 		time.Sleep(2 * time.Second)
@@ -155,7 +165,9 @@ func (a *App) Startup(ctx context.Context) {
 	}
 
 	modeChanged := (prevSysProxy && !meta.SysProxy) || (prevTunMode && !meta.TunMode)
-	a.storage.SaveMeta(meta)
+
+	// Write the defaults on first run
+	a.storage.Update(func(*MetaData) error { return nil })
 
 	a.StartTray()
 
@@ -181,13 +193,13 @@ func (a *App) Startup(ctx context.Context) {
 		if prevSysProxy {
 			go func() {
 				time.Sleep(1 * time.Second)
-				tempMeta := *meta
-				tempMeta.SysProxy = true
-				a.storage.SaveMeta(&tempMeta)
+				a.storage.Update(func(m *MetaData) error {
+					m.SysProxy = true
+					return nil
+				})
 				a.startCore()
 				time.Sleep(500 * time.Millisecond)
 				a.stopCore()
-				a.storage.SaveMeta(meta)
 			}()
 		}
 		wailsRuntime.EventsEmit(a.ctx, "status", false)
@@ -196,6 +208,7 @@ func (a *App) Startup(ctx context.Context) {
 
 // OnShutdown is called when the app is shutting down
 func (a *App) OnShutdown(ctx context.Context) {
+	a.stopProfileScheduler()
 	a.storage.Flush()
 	a.stopCore()
 	a.appLogger.Info("Application shutdown")
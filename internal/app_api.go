@@ -1,6 +1,8 @@
 package internal
 
 import (
+	"encoding/json"
+	"fmt"
 	"os"
 	"path/filepath"
 	"strings"
@@ -10,9 +12,168 @@ import (
 )
 
 func (a *App) AddProfile(name, url string) string {
-	if err := a.profileManager.Add(name, url); err != nil {
+	id, err := a.profileManager.Add(name, url, nil)
+	if err != nil {
+		return "Error: " + err.Error()
+	}
+	a.checkSubscriptionWarnings(id)
+	a.prefetchResources(a.profileManager.profilePath(id))
+	return "Success"
+}
+
+func (a *App) AddProfileWithOptions(name, url string, opts FetchOptions) string {
+	id, err := a.profileManager.Add(name, url, &opts)
+	if err != nil {
+		return "Error: " + err.Error()
+	}
+	a.checkSubscriptionWarnings(id)
+	a.prefetchResources(a.profileManager.profilePath(id))
+	return "Success"
+}
+
+func (a *App) SetProfileFetchOptions(id string, opts FetchOptions) string {
+	if err := a.profileManager.SetFetchOptions(id, &opts); err != nil {
+		return "Error: " + err.Error()
+	}
+	return "Success"
+}
+
+func (a *App) SetProfileFilter(id string, filter NodeFilter) string {
+	if err := a.profileManager.SetFilter(id, &filter); err != nil {
+		return "Error: " + err.Error()
+	}
+
+	meta, err := a.storage.LoadMeta()
+	if err != nil {
+		return "Error: " + err.Error()
+	}
+	for _, p := range meta.Profiles {
+		if p.ID == id && p.Type != ProfileTypeInline {
+			return a.UpdateProfile(id)
+		}
+	}
+	return "Success"
+}
+
+func (a *App) SetProfileProviders(id string, rules []ProviderRule) string {
+	if err := a.profileManager.SetProviders(id, rules); err != nil {
+		return "Error: " + err.Error()
+	}
+
+	if meta, err := a.storage.LoadMeta(); err == nil && meta.ActiveID == id && a.coreManager.IsRunning() {
+		return a.RestartCore()
+	}
+	return "Success"
+}
+
+func (a *App) SetProfileRegionGroups(id, mode string) string {
+	if err := a.profileManager.SetRegionGroups(id, mode); err != nil {
+		return "Error: " + err.Error()
+	}
+
+	if meta, err := a.storage.LoadMeta(); err == nil && meta.ActiveID == id && a.coreManager.IsRunning() {
+		return a.RestartCore()
+	}
+	return "Success"
+}
+
+func (a *App) LocateProfileNodes(id string) []NodeGeo {
+	meta, err := a.storage.LoadMeta()
+	if err != nil {
+		return []NodeGeo{}
+	}
+
+	nodes, err := a.profileManager.LocateNodes(id, meta.Regions)
+	if err != nil {
+		a.appLogger.Error("Failed to locate nodes: " + err.Error())
+		return []NodeGeo{}
+	}
+	return nodes
+}
+
+func (a *App) GetProfileNodeLocations(id string) []NodeGeo {
+	nodes, err := a.profileManager.GetNodeLocations(id)
+	if err != nil {
+		return []NodeGeo{}
+	}
+	return nodes
+}
+
+func (a *App) ImportProfileFile(name, path string) string {
+	if err := a.profileManager.ImportFile(name, path); err != nil {
+		return "Error: " + err.Error()
+	}
+	return "Success"
+}
+
+func (a *App) ImportProfileContent(name, content string) string {
+	if err := a.profileManager.ImportContent(name, content); err != nil {
+		return "Error: " + err.Error()
+	}
+	return "Success"
+}
+
+func (a *App) SelectProfileFile() string {
+	path, err := wailsRuntime.OpenFileDialog(a.ctx, wailsRuntime.OpenDialogOptions{
+		Title: "Import Profile",
+		Filters: []wailsRuntime.FileFilter{
+			{DisplayName: "Config Files (*.json;*.yaml;*.yml)", Pattern: "*.json;*.yaml;*.yml"},
+		},
+	})
+	if err != nil {
+		return ""
+	}
+	return path
+}
+
+func (a *App) GetProfileContent(id string) string {
+	content, err := a.profileManager.GetContent(id)
+	if err != nil {
+		return "Error: " + err.Error()
+	}
+	return content
+}
+
+func (a *App) SaveProfileContent(id, content string) string {
+	if err := a.profileManager.SaveContent(id, content); err != nil {
+		return "Error: " + err.Error()
+	}
+
+	if meta, err := a.storage.LoadMeta(); err == nil && usesProfile(meta, id) && a.coreManager.IsRunning() {
+		return a.RestartCore()
+	}
+	return "Success"
+}
+
+func (a *App) ListProfileRevisions(id string) []ProfileRevision {
+	revisions, err := a.profileManager.ListRevisions(id)
+	if err != nil {
+		a.appLogger.Error("Failed to list profile revisions: " + err.Error())
+		return []ProfileRevision{}
+	}
+	return revisions
+}
+
+func (a *App) DiffProfileRevisions(id, from, to string) map[string]interface{} {
+	diff, err := a.profileManager.DiffRevisions(id, from, to)
+	if err != nil {
+		return map[string]interface{}{"error": err.Error()}
+	}
+	return map[string]interface{}{
+		"added":   diff.Added,
+		"removed": diff.Removed,
+	}
+}
+
+func (a *App) RollbackProfile(id, revision string) string {
+	if err := a.profileManager.Rollback(id, revision); err != nil {
 		return "Error: " + err.Error()
 	}
+	a.appLogger.Info("Profile rolled back to revision " + revision)
+
+	if meta, err := a.storage.LoadMeta(); err == nil && usesProfile(meta, id) && a.coreManager.IsRunning() {
+		return a.RestartCore()
+	}
 	return "Success"
 }
 
@@ -44,7 +205,72 @@ func (a *App) SelectProfile(id string) string {
 }
 
 func (a *App) UpdateActiveProfile() string {
-	if err := a.profileManager.Update(); err != nil {
+	meta, err := a.storage.LoadMeta()
+	if err != nil {
+		return "Error: " + err.Error()
+	}
+	if meta.ActiveID == "" {
+		return "Error: no active profile"
+	}
+	return a.UpdateProfile(meta.ActiveID)
+}
+
+func (a *App) UpdateProfile(id string) string {
+	changed, err := a.profileManager.UpdateByID(id)
+	if err != nil {
+		return "Error: " + err.Error()
+	}
+	a.checkSubscriptionWarnings(id)
+
+	if !changed {
+		return "Success"
+	}
+	a.prefetchResources(a.profileManager.profilePath(id))
+	if meta, err := a.storage.LoadMeta(); err == nil && usesProfile(meta, id) && a.coreManager.IsRunning() {
+		return a.RestartCore()
+	}
+	return "Success"
+}
+
+func (a *App) UpdateAllProfiles() []ProfileUpdateResult {
+	results, err := a.profileManager.UpdateAll()
+	if err != nil {
+		a.appLogger.Error("Update all profiles failed: " + err.Error())
+		return []ProfileUpdateResult{}
+	}
+
+	meta, _ := a.storage.LoadMeta()
+	activeUpdated := false
+	failed := 0
+	var updated, changed []string
+	for _, r := range results {
+		if !r.Success {
+			failed++
+			a.appLogger.Warn("Profile update failed for " + r.Name + ": " + r.Error)
+			continue
+		}
+		updated = append(updated, r.ID)
+		if r.Changed {
+			changed = append(changed, a.profileManager.profilePath(r.ID))
+		}
+		if r.Changed && usesProfile(meta, r.ID) {
+			activeUpdated = true
+		}
+	}
+	if len(updated) > 0 {
+		a.checkSubscriptionWarnings(updated...)
+	}
+	a.prefetchResources(changed...)
+	a.appLogger.Info(fmt.Sprintf("Updated %d profiles, %d failed", len(results)-failed, failed))
+
+	if activeUpdated && a.coreManager.IsRunning() {
+		a.RestartCore()
+	}
+	return results
+}
+
+func (a *App) SetProfileUpdateInterval(id string, minutes int) string {
+	if err := a.profileManager.SetUpdateInterval(id, minutes); err != nil {
 		return "Error: " + err.Error()
 	}
 	return "Success"
@@ -57,8 +283,8 @@ func (a *App) EditProfile(id, name, url string) string {
 	return "Success"
 }
 
-func (a *App) GetOverride(name string) string {
-	result, _ := a.settingsManager.GetOverride(name)
+func (a *App) GetOverride(name, profileID string) string {
+	result, _ := a.settingsManager.GetOverride(name, profileID)
 	return result
 }
 
@@ -68,29 +294,202 @@ func (a *App) GetDefaultOverride(name string) string {
 		return DefaultTunConfig
 	case "mixed":
 		return DefaultMixedConfig
+	case "dns":
+		return DefaultDNSConfig
+	case "split":
+		return DefaultSplitConfig
 	default:
 		return ""
 	}
 }
 
-func (a *App) SaveOverride(name, content string) string {
-	if err := a.settingsManager.SaveOverride(name, content); err != nil {
+func (a *App) SaveOverride(name, profileID, content string) string {
+	if name == "tun" || name == "mixed" {
+		migrated, rewrites, err := migrateInbound(content, a.coreManager.GetLocalVersion())
+		if err != nil {
+			return "Error: invalid JSON"
+		}
+		for _, rewrite := range rewrites {
+			a.appLogger.Info("Override migrated: " + rewrite)
+		}
+		content = migrated
+	}
+
+	if err := a.settingsManager.SaveOverride(name, profileID, content); err != nil {
 		return "Error: " + err.Error()
 	}
 	return "Success"
 }
 
-func (a *App) ResetOverride(name string) string {
+func (a *App) ResetOverride(name, profileID string) string {
+	if profileID != "" {
+		if err := a.settingsManager.ClearProfileOverride(name, profileID); err != nil {
+			return "Error: " + err.Error()
+		}
+		return "Success"
+	}
+
 	var content string
 	switch name {
 	case "tun":
 		content = DefaultTunConfig
 	case "mixed":
 		content = DefaultMixedConfig
+	case "dns":
+		content = DefaultDNSConfig
+	case "split":
+		content = DefaultSplitConfig
 	default:
 		return "Unknown type"
 	}
-	return a.SaveOverride(name, content)
+	return a.SaveOverride(name, "", content)
+}
+
+func (a *App) PreviewConfig(req PreviewRequest) map[string]interface{} {
+	meta, err := a.storage.LoadMeta()
+	if err != nil {
+		return map[string]interface{}{"error": err.Error()}
+	}
+	if !hasProfile(meta, req.ProfileID) {
+		return map[string]interface{}{"error": "profile not found"}
+	}
+
+	profilePath := filepath.Join(a.getAppDir(), "data", "profiles", req.ProfileID+".json")
+	opts := a.runtimeOptions(meta, req.ProfileID, profilePath)
+	opts.TunMode = req.TunMode
+	opts.SysProxy = req.SysProxy
+	for _, o := range []struct {
+		name, content string
+		target        *string
+	}{
+		{"tun", req.TunConfig, &opts.TunConfig},
+		{"mixed", req.MixedConfig, &opts.MixedConfig},
+		{"dns", req.DNSConfig, &opts.DNSConfig},
+		{"split", req.SplitConfig, &opts.SplitConfig},
+	} {
+		if o.content == "" {
+			continue
+		}
+		if !json.Valid([]byte(o.content)) {
+			return map[string]interface{}{"error": "invalid JSON in " + o.name + " override"}
+		}
+		*o.target = o.content
+	}
+
+	preview, err := a.coreManager.Preview(opts)
+	if err != nil {
+		return map[string]interface{}{"error": err.Error()}
+	}
+	return map[string]interface{}{
+		"config":   preview.Config,
+		"valid":    preview.Valid,
+		"check":    preview.Check,
+		"changes":  preview.Changes,
+		"warnings": preview.Warnings,
+		"rewrites": preview.Rewrites,
+	}
+}
+
+func (a *App) GetPatches() []ConfigPatch {
+	meta, err := a.storage.LoadMeta()
+	if err != nil || meta.Patches == nil {
+		return []ConfigPatch{}
+	}
+	return meta.Patches
+}
+
+func (a *App) SavePatches(patches []ConfigPatch) string {
+	if err := a.settingsManager.SavePatches(patches); err != nil {
+		return "Error: " + err.Error()
+	}
+	return "Success"
+}
+
+func (a *App) SetPatchEnabled(id string, enabled bool) string {
+	if err := a.settingsManager.SetPatchEnabled(id, enabled); err != nil {
+		return "Error: " + err.Error()
+	}
+	return "Success"
+}
+
+func (a *App) GetRouteRules() []RouteRule {
+	meta, err := a.storage.LoadMeta()
+	if err != nil || meta.RouteRules == nil {
+		return []RouteRule{}
+	}
+	return meta.RouteRules
+}
+
+func (a *App) SaveRouteRules(rules []RouteRule) string {
+	if err := a.profileManager.CheckActiveRouteRules(rules); err != nil {
+		return "Error: " + err.Error()
+	}
+	if err := a.settingsManager.SaveRouteRules(rules); err != nil {
+		return "Error: " + err.Error()
+	}
+	return "Success"
+}
+
+func (a *App) CheckRouteRules(profileID string) []string {
+	meta, err := a.storage.LoadMeta()
+	if err != nil {
+		return []string{}
+	}
+
+	missing, err := a.profileManager.CheckRouteRules(profileID, meta.RouteRules)
+	if err != nil || missing == nil {
+		return []string{}
+	}
+	return missing
+}
+
+func (a *App) GetInbounds() []ManagedInbound {
+	meta, err := a.storage.LoadMeta()
+	if err != nil || meta.Inbounds == nil {
+		return []ManagedInbound{}
+	}
+	return meta.Inbounds
+}
+
+func (a *App) SaveInbounds(inbounds []ManagedInbound) string {
+	if err := a.settingsManager.SaveInbounds(inbounds); err != nil {
+		return "Error: " + err.Error()
+	}
+	return "Success"
+}
+
+func (a *App) SetInboundEnabled(id string, enabled bool) string {
+	if err := a.settingsManager.SetInboundEnabled(id, enabled); err != nil {
+		return "Error: " + err.Error()
+	}
+	return "Success"
+}
+
+func (a *App) GetRegions() []RegionRule {
+	meta, err := a.storage.LoadMeta()
+	if err != nil {
+		return DefaultRegions()
+	}
+	return meta.Regions
+}
+
+func (a *App) SaveRegions(regions []RegionRule) string {
+	if err := a.settingsManager.SaveRegions(regions); err != nil {
+		return "Error: " + err.Error()
+	}
+
+	if meta, err := a.storage.LoadMeta(); err == nil && a.coreManager.IsRunning() {
+		for _, p := range meta.Profiles {
+			if p.ID == meta.ActiveID && p.RegionGroups != RegionGroupsOff {
+				return a.RestartCore()
+			}
+		}
+	}
+	return "Success"
+}
+
+func (a *App) ResetRegions() string {
+	return a.SaveRegions(DefaultRegions())
 }
 
 func (a *App) SaveSettings(mirror string, enabled bool) string {
@@ -135,6 +534,61 @@ func (a *App) ToggleIPv6(enabled bool) string {
 	return "Success"
 }
 
+func (a *App) SetStrictPorts(enabled bool) string {
+	if err := a.settingsManager.SetStrictPorts(enabled); err != nil {
+		return "Error: " + err.Error()
+	}
+	return "Success"
+}
+
+func (a *App) SetAllowLAN(enabled bool, port int) string {
+	if err := a.settingsManager.SetAllowLAN(enabled, port); err != nil {
+		return "Error: " + err.Error()
+	}
+
+	if a.coreManager.IsRunning() {
+		return a.RestartCore()
+	}
+	return "Success"
+}
+
+func (a *App) ResetLANCredentials() string {
+	if err := a.settingsManager.ResetLANCredentials(); err != nil {
+		return "Error: " + err.Error()
+	}
+
+	meta, err := a.storage.LoadMeta()
+	if err == nil && meta.AllowLAN && a.coreManager.IsRunning() {
+		return a.RestartCore()
+	}
+	return "Success"
+}
+
+func (a *App) GetLANInfo() map[string]interface{} {
+	meta, err := a.storage.LoadMeta()
+	if err != nil {
+		return map[string]interface{}{"error": err.Error()}
+	}
+
+	// The port may have been moved at launch if it was taken
+	port := meta.LAN.Port
+	if a.coreManager.IsRunning() {
+		if content, err := os.ReadFile(filepath.Join(a.getAppDir(), "data", "core", "config.json")); err == nil {
+			if p := lanListenPort(content); p > 0 {
+				port = p
+			}
+		}
+	}
+
+	return map[string]interface{}{
+		"enabled":   meta.AllowLAN,
+		"addresses": lanAddresses(),
+		"port":      port,
+		"username":  meta.LAN.Username,
+		"password":  meta.LAN.Password,
+	}
+}
+
 func (a *App) SetLogConfig(level string, toFile bool) string {
 	if err := a.settingsManager.SetLogConfig(level, toFile); err != nil {
 		return "Error: " + err.Error()
@@ -186,7 +640,7 @@ func (a *App) ClearKernelLog() string {
 			a.appLogger.Warn("Failed to clear kernel log file: " + err.Error())
 		}
 	}
-
+	
 	if a.coreManager != nil {
 		a.coreManager.ClearLogBuffer()
 	}
@@ -195,7 +649,21 @@ func (a *App) ClearKernelLog() string {
 }
 
 func (a *App) OpenDashboard() {
-	wailsRuntime.BrowserOpenURL(a.ctx, "http://127.0.0.1:9090/ui")
+	if !a.coreManager.IsRunning() {
+		wailsRuntime.EventsEmit(a.ctx, "log", "Error: Core is not running")
+		return
+	}
+	dashboard := a.coreManager.GetAPI().DashboardURL()
+	if dashboard == "" {
+		wailsRuntime.EventsEmit(a.ctx, "log", "Error: Profile has no external UI")
+		return
+	}
+	wailsRuntime.BrowserOpenURL(a.ctx, dashboard)
+}
+
+// HasDashboard reports whether the running config serves a web UI
+func (a *App) HasDashboard() bool {
+	return a.coreManager.IsRunning() && a.coreManager.GetAPI().DashboardURL() != ""
 }
 
 func (a *App) RestartCore() string {
@@ -227,7 +695,7 @@ func (a *App) RestartCore() string {
 	if !ready {
 		a.appLogger.Warn("Core restart probe timed out, but proceeding anyway.")
 	}
-	
+
 	wailsRuntime.EventsEmit(a.ctx, "status", true)
 	a.emitStateSync(meta)
 
@@ -262,12 +730,14 @@ func (a *App) GetInitData() map[string]interface{} {
 
 	return map[string]interface{}{
 		"running":           a.coreManager.IsRunning(),
+		"hasDashboard":      a.HasDashboard(),
 		"coreExists":        a.coreManager.GetLocalVersion() != "Not Installed",
 		"localVersion":      a.coreManager.GetLocalVersion(),
 		"tunMode":           meta.TunMode,
 		"sysProxy":          meta.SysProxy,
 		"profiles":          meta.Profiles,
 		"activeProfile":     active,
+		"subscription":      active.Subscription,
 		"mirror":            meta.Mirror,
 		"mirrorEnabled":     meta.MirrorEnabled,
 		"startOnBoot":       meta.StartOnBoot,
@@ -275,6 +745,8 @@ func (a *App) GetInitData() map[string]interface{} {
 		"themeMode":         meta.ThemeMode,
 		"accentColor":       meta.AccentColor,
 		"ipv6_enabled":      meta.IPv6Enabled,
+		"strict_ports":      meta.StrictPorts,
+		"allow_lan":         meta.AllowLAN,
 		"pre_release":       meta.PreRelease,
 		"log_level":         meta.LogLevel,
 		"log_to_file":       meta.LogToFile,
@@ -45,27 +45,28 @@ func (a *App) startCore() string {
 	}
 
 	a.appLogger.Info("Starting core...")
-	err = a.coreManager.Start(
-		activeProfilePath,
-		meta.TunMode,
-		meta.SysProxy,
-		meta.TunConfig,
-		meta.MixedConfig,
-		meta.IPv6Enabled,
-		meta.LogLevel,
-		meta.LogToFile,
-	)
+	err = a.coreManager.Start(a.runtimeOptions(meta, meta.ActiveID, activeProfilePath))
 	if err != nil {
 		a.appLogger.Error("Core start failed: " + err.Error())
 		return "Error: " + err.Error()
 	}
 	a.appLogger.Info("Core started successfully")
+	for _, rewrite := range a.coreManager.GetRewrites() {
+		a.appLogger.Info("Config migrated: " + rewrite)
+	}
+	for _, warning := range a.coreManager.GetWarnings() {
+		a.appLogger.Warn(warning)
+	}
+	// Remote resources left in the runtime config are not cached yet
+	a.prefetchResources(filepath.Join(a.getAppDir(), "data", "core", "config.json"))
 
-	apiURL := a.coreManager.GetAPIURL()
-	if apiURL != "" {
-		if a.trafficMonitor == nil {
-			a.trafficMonitor = NewTrafficMonitor(a.ctx, apiURL)
+	// The controller port and secret change on every start
+	api := a.coreManager.GetAPI()
+	if api.URL != "" {
+		if a.trafficMonitor != nil && a.trafficMonitor.IsRunning() {
+			a.trafficMonitor.Stop()
 		}
+		a.trafficMonitor = NewTrafficMonitor(a.ctx, api)
 		a.trafficMonitor.Start()
 	}
 
@@ -138,9 +139,7 @@ func (a *App) ApplyState(targetTun bool, targetProxy bool) string {
 		return res
 	}
 
-	meta.TunMode = targetTun
-	meta.SysProxy = targetProxy
-	a.storage.SaveMeta(meta)
+	a.settingsManager.SaveMode(targetTun, targetProxy)
 
 	if needsRestart {
 		wailsRuntime.EventsEmit(a.ctx, "core-starting")
@@ -186,6 +185,43 @@ func (a *App) findActiveProfilePath(meta *MetaData) (string, error) {
 	return "", os.ErrNotExist
 }
 
+// runtimeOptions collects the inputs for the runtime config of a profile
+func (a *App) runtimeOptions(meta *MetaData, profileID, profilePath string) RuntimeOptions {
+	opts := RuntimeOptions{
+		ProfilePath:   profilePath,
+		ProviderPaths: make(map[string]string),
+		TunMode:       meta.TunMode,
+		SysProxy:      meta.SysProxy,
+		TunConfig:     meta.Override("tun", profileID),
+		MixedConfig:   meta.Override("mixed", profileID),
+		DNSConfig:     meta.Override("dns", profileID),
+		SplitConfig:   meta.Override("split", profileID),
+		IPv6Enabled:   meta.IPv6Enabled,
+		StrictPorts:   meta.StrictPorts,
+		LogLevel:      meta.LogLevel,
+		LogToFile:     meta.LogToFile,
+		Regions:       meta.Regions,
+		RouteRules:    meta.RouteRules,
+		Patches:       meta.Patches,
+		Inbounds:      meta.Inbounds,
+		Resources:     a.resourceCache,
+	}
+
+	if meta.AllowLAN {
+		lan := meta.LAN
+		opts.LAN = &lan
+	}
+
+	for _, p := range meta.Profiles {
+		if p.ID == profileID {
+			opts.Providers = p.Providers
+			opts.RegionGroups = p.RegionGroups
+		}
+		opts.ProviderPaths[p.ID] = filepath.Join(a.getAppDir(), "data", "profiles", p.ID+".json")
+	}
+	return opts
+}
+
 func (a *App) emitStateSync(meta *MetaData) {
 	wailsRuntime.EventsEmit(a.ctx, "state-sync", map[string]interface{}{
 		"tunMode":  meta.TunMode,
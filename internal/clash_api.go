@@ -0,0 +1,106 @@
+package internal
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+// ClashAPI is the controller WinBox injects into the runtime config
+type ClashAPI struct {
+	URL    string // Base URL, e.g. http://127.0.0.1:52345
+	Secret string
+	UI     bool // Whether the config serves an external UI under /ui
+}
+
+// authorize adds the controller secret to a request
+func (c ClashAPI) authorize(header http.Header) {
+	if c.Secret != "" {
+		header.Set("Authorization", "Bearer "+c.Secret)
+	}
+}
+
+// DashboardURL returns the URL of the external UI with the controller
+// address and secret filled in, so the dashboard connects without setup. It
+// is empty when the config has no external UI. The secret only goes in the
+// fragment, which browsers do not send to the server or keep in request logs.
+func (c ClashAPI) DashboardURL() string {
+	if !c.UI {
+		return ""
+	}
+	u, err := url.Parse(c.URL)
+	if err != nil {
+		return ""
+	}
+	params := url.Values{}
+	params.Set("hostname", u.Hostname())
+	params.Set("port", u.Port())
+	query := params.Encode()
+	params.Set("secret", c.Secret)
+	// yacd reads the query string, metacubexd and zashboard the setup route
+	return c.URL + "/ui/?" + query + "#/setup?" + params.Encode()
+}
+
+// injectClashAPI replaces the controller address and secret of the config
+// with a localhost port and a fresh secret, keeping the profile's other
+// clash_api options such as external_ui. It returns a warning when the
+// profile itself exposed the controller on all interfaces without a secret.
+func injectClashAPI(content []byte) ([]byte, ClashAPI, []string, error) {
+	var warnings []string
+	original := gjson.GetBytes(content, "experimental.clash_api")
+	if controller := original.Get("external_controller").String(); controller != "" && original.Get("secret").String() == "" {
+		if host, _, err := net.SplitHostPort(controller); err == nil && isUnspecifiedHost(host) {
+			warnings = append(warnings, fmt.Sprintf("profile exposes the Clash API on %s without a secret, replaced by a local controller", controller))
+		}
+	}
+
+	port, err := freeListenPort("tcp", "127.0.0.1")
+	if err != nil {
+		return nil, ClashAPI{}, nil, fmt.Errorf("no free port for Clash API: %w", err)
+	}
+	secret, err := randomSecret()
+	if err != nil {
+		return nil, ClashAPI{}, nil, err
+	}
+
+	addr := net.JoinHostPort("127.0.0.1", strconv.Itoa(port))
+	if content, err = sjson.SetBytes(content, "experimental.clash_api.external_controller", addr); err != nil {
+		return nil, ClashAPI{}, nil, err
+	}
+	if content, err = sjson.SetBytes(content, "experimental.clash_api.secret", secret); err != nil {
+		return nil, ClashAPI{}, nil, err
+	}
+
+	api := ClashAPI{
+		URL:    "http://" + addr,
+		Secret: secret,
+		UI:     gjson.GetBytes(content, "experimental.clash_api.external_ui").String() != "",
+	}
+	return content, api, warnings, nil
+}
+
+// isUnspecifiedHost reports whether a listen host binds all interfaces
+func isUnspecifiedHost(host string) bool {
+	if host == "" {
+		return true
+	}
+	ip := net.ParseIP(strings.Trim(host, "[]"))
+	return ip != nil && ip.IsUnspecified()
+}
+
+// randomSecret returns a random hex string for the controller secret
+func randomSecret() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("generate secret failed: %w", err)
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,88 @@
+package internal
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/tidwall/gjson"
+)
+
+func TestDashboardURL(t *testing.T) {
+	if got := (ClashAPI{URL: "http://127.0.0.1:9090", Secret: "s3cret"}).DashboardURL(); got != "" {
+		t.Errorf("DashboardURL() without an external UI = %q", got)
+	}
+
+	api := ClashAPI{URL: "http://127.0.0.1:9090", Secret: "s3cret&x", UI: true}
+	u, err := url.Parse(api.DashboardURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Scheme != "http" || u.Host != "127.0.0.1:9090" || u.Path != "/ui/" {
+		t.Errorf("DashboardURL() = %s", u)
+	}
+	if strings.Contains(u.RawQuery, "secret") || u.Query().Get("hostname") != "127.0.0.1" || u.Query().Get("port") != "9090" {
+		t.Errorf("query = %q, want the address without the secret", u.RawQuery)
+	}
+
+	route, query, _ := strings.Cut(u.EscapedFragment(), "?")
+	params, _ := url.ParseQuery(query)
+	if route != "/setup" || params.Get("secret") != "s3cret&x" || params.Get("hostname") != "127.0.0.1" || params.Get("port") != "9090" {
+		t.Errorf("fragment = %q", u.Fragment)
+	}
+}
+
+func TestInjectClashAPI(t *testing.T) {
+	content := `{"experimental": {"clash_api": {"external_controller": "0.0.0.0:9090", "external_ui": "ui", "default_mode": "rule"}}}`
+	out, api, warnings, err := injectClashAPI([]byte(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clash := gjson.GetBytes(out, "experimental.clash_api")
+	host, _, _ := net.SplitHostPort(clash.Get("external_controller").String())
+	if host != "127.0.0.1" || api.URL != "http://"+clash.Get("external_controller").String() {
+		t.Errorf("controller = %s, api = %+v", clash.Raw, api)
+	}
+	if len(api.Secret) != 32 || clash.Get("secret").String() != api.Secret {
+		t.Errorf("secret = %q, config = %s", api.Secret, clash.Get("secret"))
+	}
+	if clash.Get("external_ui").String() != "ui" || clash.Get("default_mode").String() != "rule" || !api.UI {
+		t.Errorf("profile options lost: %s", clash.Raw)
+	}
+	if len(warnings) != 1 || !strings.Contains(warnings[0], "0.0.0.0:9090") {
+		t.Errorf("warnings = %v", warnings)
+	}
+
+	// Secrets are fresh on every start, and there is no dashboard without a UI
+	_, again, warnings, _ := injectClashAPI([]byte(`{"experimental": {"clash_api": {"external_controller": "127.0.0.1:9090"}}}`))
+	if again.Secret == api.Secret || again.UI || again.DashboardURL() != "" || len(warnings) != 0 {
+		t.Errorf("second injection = %+v, %v", again, warnings)
+	}
+	_, _, warnings, _ = injectClashAPI([]byte(`{"experimental": {"clash_api": {"external_controller": ":9090", "secret": "x"}}}`))
+	if len(warnings) != 0 {
+		t.Errorf("warned about a controller with a secret: %v", warnings)
+	}
+}
+
+func TestClashAPIAuthorize(t *testing.T) {
+	header := http.Header{}
+	ClashAPI{}.authorize(header)
+	if header.Get("Authorization") != "" {
+		t.Error("authorize() set a header without a secret")
+	}
+	ClashAPI{Secret: "abc"}.authorize(header)
+	if header.Get("Authorization") != "Bearer abc" {
+		t.Errorf("Authorization = %q", header.Get("Authorization"))
+	}
+}
+
+func TestIsUnspecifiedHost(t *testing.T) {
+	for host, want := range map[string]bool{"": true, "0.0.0.0": true, "::": true, "[::]": true, "127.0.0.1": false, "localhost": false, "192.168.1.2": false} {
+		if got := isUnspecifiedHost(host); got != want {
+			t.Errorf("isUnspecifiedHost(%q) = %v, want %v", host, got, want)
+		}
+	}
+}
@@ -0,0 +1,728 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	geoipRuleSetURL   = "https://raw.githubusercontent.com/SagerNet/sing-geoip/rule-set/geoip-%s.srs"
+	geositeRuleSetURL = "https://raw.githubusercontent.com/SagerNet/sing-geosite/rule-set/geosite-%s.srs"
+)
+
+// clashMatchFields maps Clash rule types to sing-box route rule fields
+var clashMatchFields = map[string]string{
+	"DOMAIN":         "domain",
+	"DOMAIN-SUFFIX":  "domain_suffix",
+	"DOMAIN-KEYWORD": "domain_keyword",
+	"DOMAIN-REGEX":   "domain_regex",
+	"IP-CIDR":        "ip_cidr",
+	"IP-CIDR6":       "ip_cidr",
+	"SRC-IP-CIDR":    "source_ip_cidr",
+	"PROCESS-NAME":   "process_name",
+	"PROCESS-PATH":   "process_path",
+}
+
+// clashMap is a generic YAML mapping from a Clash profile
+type clashMap map[string]interface{}
+
+func (m clashMap) str(key string) string {
+	switch v := m[key].(type) {
+	case string:
+		return v
+	case int:
+		return strconv.Itoa(v)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(v)
+	}
+	return ""
+}
+
+func (m clashMap) num(key string) int {
+	n, _ := strconv.Atoi(m.str(key))
+	return n
+}
+
+func (m clashMap) boolean(key string) bool {
+	return isTruthy(m.str(key))
+}
+
+func (m clashMap) sub(key string) clashMap {
+	if v, ok := m[key].(map[string]interface{}); ok {
+		return clashMap(v)
+	}
+	return clashMap{}
+}
+
+func (m clashMap) list(key string) []interface{} {
+	if v, ok := m[key].([]interface{}); ok {
+		return v
+	}
+	return nil
+}
+
+func (m clashMap) strList(key string) []string {
+	var out []string
+	for _, v := range m.list(key) {
+		out = append(out, fmt.Sprint(v))
+	}
+	return out
+}
+
+// parseClashConfig reports whether content is a Clash YAML profile
+func parseClashConfig(content []byte) (clashMap, bool) {
+	var m map[string]interface{}
+	if err := yaml.Unmarshal(content, &m); err != nil || m == nil {
+		return nil, false
+	}
+	if _, ok := m["proxies"]; ok {
+		return clashMap(m), true
+	}
+	if _, ok := m["proxy-providers"]; ok {
+		return clashMap(m), true
+	}
+	return nil, false
+}
+
+// clashConverter holds the state of a single Clash to sing-box translation
+type clashConverter struct {
+	fetch    func(url string) ([]byte, error)
+	warnings []string
+
+	targets   map[string]bool // proxy and group names that exist as outbounds
+	ruleSets  []interface{}
+	ruleSetOK map[string]bool
+}
+
+func (cc *clashConverter) warn(format string, args ...interface{}) {
+	cc.warnings = append(cc.warnings, fmt.Sprintf(format, args...))
+}
+
+// convertClash translates a Clash / Clash.Meta profile into a sing-box config
+func convertClash(c clashMap, fetch func(url string) ([]byte, error)) ([]byte, []string, error) {
+	cc := &clashConverter{
+		fetch:     fetch,
+		targets:   map[string]bool{directTag: true},
+		ruleSetOK: make(map[string]bool),
+	}
+
+	var proxies []map[string]interface{}
+	var proxyNames []string
+	for _, raw := range c.list("proxies") {
+		p, ok := raw.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		name := clashMap(p).str("name")
+		outbound, err := convertClashProxy(clashMap(p))
+		if err != nil {
+			cc.warn("proxy %q: %v", name, err)
+			continue
+		}
+		proxies = append(proxies, outbound)
+		proxyNames = append(proxyNames, name)
+		cc.targets[name] = true
+	}
+
+	if len(c.sub("proxy-providers")) > 0 {
+		cc.warn("proxy-providers are not supported; groups keep only their static proxies")
+	}
+	if len(proxies) == 0 {
+		return nil, cc.warnings, fmt.Errorf("no supported proxies found in clash profile")
+	}
+
+	groups := cc.convertGroups(c.list("proxy-groups"), proxyNames)
+
+	outbounds := make([]interface{}, 0, len(groups)+len(proxies)+2)
+	final := selectorTag
+	if len(groups) == 0 {
+		outbounds = append(outbounds,
+			map[string]interface{}{"type": "selector", "tag": selectorTag, "outbounds": append([]string{urltestTag}, proxyNames...), "default": urltestTag},
+			map[string]interface{}{"type": "urltest", "tag": urltestTag, "outbounds": proxyNames, "url": urltestURL, "interval": "3m"},
+		)
+	} else {
+		final = groups[0]["tag"].(string)
+		for _, g := range groups {
+			outbounds = append(outbounds, g)
+		}
+	}
+	for _, p := range proxies {
+		outbounds = append(outbounds, p)
+	}
+
+	providers := c.sub("rule-providers")
+	providerNames := make([]string, 0, len(providers))
+	for name := range providers {
+		providerNames = append(providerNames, name)
+	}
+	sort.Strings(providerNames)
+	for _, name := range providerNames {
+		if p, ok := providers[name].(map[string]interface{}); ok {
+			cc.convertRuleProvider(name, clashMap(p))
+		}
+	}
+
+	rules, matchTarget := cc.convertRules(c.strList("rules"))
+	if matchTarget != "" {
+		final = matchTarget
+	}
+
+	if _, ok := c["dns"]; ok {
+		cc.warn("dns section is not mapped; default DNS servers are used")
+	}
+	if _, ok := c["hosts"]; ok {
+		cc.warn("hosts section is not mapped")
+	}
+
+	config := buildBaseConfig(outbounds, rules, final)
+	if len(cc.ruleSets) > 0 {
+		config["route"].(map[string]interface{})["rule_set"] = cc.ruleSets
+	}
+
+	out, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		return nil, cc.warnings, err
+	}
+	return out, cc.warnings, nil
+}
+
+// convertGroups maps proxy-groups to selector and urltest outbounds
+func (cc *clashConverter) convertGroups(rawGroups []interface{}, proxyNames []string) []map[string]interface{} {
+	var groupDefs []clashMap
+	for _, raw := range rawGroups {
+		if g, ok := raw.(map[string]interface{}); ok && clashMap(g).str("name") != "" {
+			groupDefs = append(groupDefs, clashMap(g))
+			cc.targets[clashMap(g).str("name")] = true
+		}
+	}
+
+	groups := make([]map[string]interface{}, 0, len(groupDefs))
+	for _, g := range groupDefs {
+		name := g.str("name")
+
+		var members []string
+		for _, member := range g.strList("proxies") {
+			switch strings.ToUpper(member) {
+			case "DIRECT":
+				members = append(members, directTag)
+			case "REJECT", "REJECT-DROP", "PASS":
+				cc.warn("group %q: member %s is not supported", name, member)
+			default:
+				if cc.targets[member] {
+					members = append(members, member)
+				} else {
+					cc.warn("group %q: unknown member %q removed", name, member)
+				}
+			}
+		}
+
+		if g.boolean("include-all") || g.boolean("include-all-proxies") {
+			pool := proxyNames
+			if filter := g.str("filter"); filter != "" {
+				re, err := regexp.Compile(filter)
+				if err != nil {
+					cc.warn("group %q: invalid filter: %v", name, err)
+				} else {
+					pool = nil
+					for _, n := range proxyNames {
+						if re.MatchString(n) {
+							pool = append(pool, n)
+						}
+					}
+				}
+			}
+			members = append(members, pool...)
+		}
+		if len(g.list("use")) > 0 {
+			cc.warn("group %q: proxy-provider members are not supported", name)
+		}
+		if len(members) == 0 {
+			cc.warn("group %q has no usable members; falling back to direct", name)
+			members = []string{directTag}
+		}
+
+		group := map[string]interface{}{
+			"tag":       name,
+			"outbounds": members,
+		}
+		switch g.str("type") {
+		case "select":
+			group["type"] = "selector"
+		case "url-test", "fallback", "load-balance":
+			if g.str("type") != "url-test" {
+				cc.warn("group %q: %s is approximated with urltest", name, g.str("type"))
+			}
+			group["type"] = "urltest"
+			if u := g.str("url"); u != "" {
+				group["url"] = u
+			} else {
+				group["url"] = urltestURL
+			}
+			if interval := g.num("interval"); interval > 0 {
+				group["interval"] = fmt.Sprintf("%ds", interval)
+			}
+			if tolerance := g.num("tolerance"); tolerance > 0 {
+				group["tolerance"] = tolerance
+			}
+		default:
+			cc.warn("group %q: type %q is approximated with selector", name, g.str("type"))
+			group["type"] = "selector"
+		}
+		groups = append(groups, group)
+	}
+	return groups
+}
+
+// convertRuleProvider maps a rule-provider to a sing-box rule_set entry
+func (cc *clashConverter) convertRuleProvider(name string, p clashMap) {
+	providerURL := p.str("url")
+	format := p.str("format")
+
+	switch {
+	case p.str("type") == "http" && strings.HasSuffix(providerURL, ".srs"):
+		cc.addRuleSet(name, map[string]interface{}{"type": "remote", "tag": name, "format": "binary", "url": providerURL})
+		return
+	case p.str("type") == "http" && strings.HasSuffix(providerURL, ".json"):
+		cc.addRuleSet(name, map[string]interface{}{"type": "remote", "tag": name, "format": "source", "url": providerURL})
+		return
+	case format == "mrs":
+		cc.warn("rule-provider %q: mrs format is not supported", name)
+		return
+	}
+
+	var payload []string
+	switch p.str("type") {
+	case "http":
+		if cc.fetch == nil {
+			cc.warn("rule-provider %q: cannot be downloaded", name)
+			return
+		}
+		data, err := cc.fetch(providerURL)
+		if err != nil {
+			cc.warn("rule-provider %q: download failed: %v", name, err)
+			return
+		}
+		payload = parseProviderPayload(data, format)
+	case "inline":
+		payload = p.strList("payload")
+	default:
+		cc.warn("rule-provider %q: type %q is not supported", name, p.str("type"))
+		return
+	}
+
+	rules := cc.providerRules(name, p.str("behavior"), payload)
+	if len(rules) == 0 {
+		cc.warn("rule-provider %q: no usable entries", name)
+		return
+	}
+	cc.addRuleSet(name, map[string]interface{}{"type": "inline", "tag": name, "rules": rules})
+}
+
+func (cc *clashConverter) addRuleSet(tag string, ruleSet map[string]interface{}) {
+	if cc.ruleSetOK[tag] {
+		return
+	}
+	cc.ruleSetOK[tag] = true
+	cc.ruleSets = append(cc.ruleSets, ruleSet)
+}
+
+// parseProviderPayload extracts payload entries from a YAML or text rule-provider
+func parseProviderPayload(data []byte, format string) []string {
+	if format != "text" {
+		var doc struct {
+			Payload []string `yaml:"payload"`
+		}
+		if yaml.Unmarshal(data, &doc) == nil && len(doc.Payload) > 0 {
+			return doc.Payload
+		}
+	}
+	var entries []string
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && !strings.HasPrefix(line, "#") {
+			entries = append(entries, line)
+		}
+	}
+	return entries
+}
+
+// providerRules builds headless rules from provider entries, one rule per match field
+func (cc *clashConverter) providerRules(name, behavior string, payload []string) []interface{} {
+	fields := make(map[string][]interface{})
+	var order []string
+	add := func(field string, value interface{}) {
+		if _, ok := fields[field]; !ok {
+			order = append(order, field)
+		}
+		switch v := value.(type) {
+		case []string:
+			for _, item := range v {
+				fields[field] = append(fields[field], item)
+			}
+		case []int:
+			for _, item := range v {
+				fields[field] = append(fields[field], item)
+			}
+		default:
+			fields[field] = append(fields[field], v)
+		}
+	}
+
+	for _, entry := range payload {
+		entry = strings.Trim(entry, "'\"")
+		switch behavior {
+		case "domain":
+			switch {
+			case strings.HasPrefix(entry, "+."):
+				add("domain_suffix", entry[2:])
+			case strings.HasPrefix(entry, "*."), strings.HasPrefix(entry, "."):
+				add("domain_suffix", strings.TrimLeft(entry, "*."))
+			default:
+				add("domain", entry)
+			}
+		case "ipcidr":
+			add("ip_cidr", entry)
+		default:
+			parts := strings.Split(entry, ",")
+			if len(parts) < 2 {
+				continue
+			}
+			match, err := clashRuleMatch(parts[0], strings.TrimSpace(parts[1]))
+			if err != nil {
+				cc.warn("rule-provider %q: %s: %v", name, parts[0], err)
+				continue
+			}
+			for field, value := range match {
+				add(field, value)
+			}
+		}
+	}
+
+	rules := make([]interface{}, 0, len(order))
+	for _, field := range order {
+		rules = append(rules, map[string]interface{}{field: fields[field]})
+	}
+	return rules
+}
+
+// convertRules maps Clash rules to route rules and returns the MATCH target
+func (cc *clashConverter) convertRules(lines []string) ([]interface{}, string) {
+	var rules []interface{}
+	final := ""
+
+	for _, line := range lines {
+		parts := strings.Split(line, ",")
+		for i := range parts {
+			parts[i] = strings.TrimSpace(parts[i])
+		}
+		ruleType := strings.ToUpper(parts[0])
+
+		if ruleType == "MATCH" || ruleType == "FINAL" {
+			if len(parts) < 2 {
+				continue
+			}
+			if target, ok := cc.resolveTarget(parts[1]); ok && target["outbound"] != nil {
+				final = target["outbound"].(string)
+			} else {
+				cc.warn("rule %q: unsupported final target", line)
+			}
+			continue
+		}
+
+		if len(parts) < 3 {
+			cc.warn("rule %q is not supported", line)
+			continue
+		}
+
+		var match map[string]interface{}
+		var err error
+		switch ruleType {
+		case "GEOIP":
+			match = cc.geoMatch("geoip", parts[1])
+		case "GEOSITE":
+			match = cc.geoMatch("geosite", parts[1])
+		case "RULE-SET":
+			if !cc.ruleSetOK[parts[1]] {
+				err = fmt.Errorf("rule-provider %q is unavailable", parts[1])
+			}
+			match = map[string]interface{}{"rule_set": parts[1]}
+		default:
+			match, err = clashRuleMatch(ruleType, parts[1])
+		}
+		if err != nil {
+			cc.warn("rule %q: %v", line, err)
+			continue
+		}
+
+		target, ok := cc.resolveTarget(parts[2])
+		if !ok {
+			cc.warn("rule %q: unknown target %q", line, parts[2])
+			continue
+		}
+		for k, v := range target {
+			match[k] = v
+		}
+		rules = append(rules, match)
+	}
+	return rules, final
+}
+
+// geoMatch maps GEOIP / GEOSITE rules to remote rule sets
+func (cc *clashConverter) geoMatch(kind, code string) map[string]interface{} {
+	code = strings.ToLower(code)
+	if kind == "geoip" && code == "lan" {
+		return map[string]interface{}{"ip_is_private": true}
+	}
+
+	tag := kind + "-" + code
+	urlFormat := geoipRuleSetURL
+	if kind == "geosite" {
+		urlFormat = geositeRuleSetURL
+	}
+	cc.addRuleSet(tag, map[string]interface{}{
+		"type":   "remote",
+		"tag":    tag,
+		"format": "binary",
+		"url":    fmt.Sprintf(urlFormat, code),
+	})
+	return map[string]interface{}{"rule_set": tag}
+}
+
+// resolveTarget maps a Clash rule target to outbound or action fields
+func (cc *clashConverter) resolveTarget(target string) (map[string]interface{}, bool) {
+	switch strings.ToUpper(target) {
+	case "DIRECT":
+		return map[string]interface{}{"outbound": directTag}, true
+	case "REJECT", "REJECT-DROP":
+		return map[string]interface{}{"action": "reject"}, true
+	}
+	if cc.targets[target] {
+		return map[string]interface{}{"outbound": target}, true
+	}
+	return nil, false
+}
+
+// clashRuleMatch maps a Clash rule type and value to sing-box match fields
+func clashRuleMatch(ruleType, value string) (map[string]interface{}, error) {
+	ruleType = strings.ToUpper(strings.TrimSpace(ruleType))
+	if field, ok := clashMatchFields[ruleType]; ok {
+		return map[string]interface{}{field: []string{value}}, nil
+	}
+
+	switch ruleType {
+	case "DST-PORT", "SRC-PORT":
+		field, rangeField := "port", "port_range"
+		if ruleType == "SRC-PORT" {
+			field, rangeField = "source_port", "source_port_range"
+		}
+		if strings.Contains(value, "-") {
+			return map[string]interface{}{rangeField: []string{strings.Replace(value, "-", ":", 1)}}, nil
+		}
+		port, err := strconv.Atoi(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid port %q", value)
+		}
+		return map[string]interface{}{field: []int{port}}, nil
+	case "NETWORK":
+		return map[string]interface{}{"network": []string{strings.ToLower(value)}}, nil
+	}
+	return nil, fmt.Errorf("rule type is not supported")
+}
+
+// convertClashProxy maps a single Clash proxy to a sing-box outbound
+func convertClashProxy(p clashMap) (map[string]interface{}, error) {
+	name := p.str("name")
+	server := p.str("server")
+	port := p.num("port")
+	if name == "" || server == "" || port == 0 {
+		return nil, fmt.Errorf("missing name, server or port")
+	}
+
+	out := map[string]interface{}{
+		"tag":         name,
+		"server":      server,
+		"server_port": port,
+	}
+
+	switch p.str("type") {
+	case "ss":
+		out["type"] = "shadowsocks"
+		out["method"] = p.str("cipher")
+		out["password"] = p.str("password")
+		if plugin := p.str("plugin"); plugin != "" {
+			opts := p.sub("plugin-opts")
+			switch plugin {
+			case "obfs":
+				out["plugin"] = "obfs-local"
+				out["plugin_opts"] = fmt.Sprintf("obfs=%s;obfs-host=%s", opts.str("mode"), opts.str("host"))
+			case "v2ray-plugin":
+				pluginOpts := []string{"mode=" + opts.str("mode")}
+				if opts.boolean("tls") {
+					pluginOpts = append(pluginOpts, "tls")
+				}
+				if host := opts.str("host"); host != "" {
+					pluginOpts = append(pluginOpts, "host="+host)
+				}
+				if path := opts.str("path"); path != "" {
+					pluginOpts = append(pluginOpts, "path="+path)
+				}
+				out["plugin"] = "v2ray-plugin"
+				out["plugin_opts"] = strings.Join(pluginOpts, ";")
+			default:
+				return nil, fmt.Errorf("plugin %q is not supported", plugin)
+			}
+		}
+	case "vmess":
+		out["type"] = "vmess"
+		out["uuid"] = p.str("uuid")
+		out["alter_id"] = p.num("alterId")
+		out["security"] = p.str("cipher")
+		if out["security"] == "" {
+			out["security"] = "auto"
+		}
+		applyClashTransport(out, p)
+		if p.boolean("tls") {
+			out["tls"] = clashTLS(p)
+		}
+	case "vless":
+		out["type"] = "vless"
+		out["uuid"] = p.str("uuid")
+		if flow := p.str("flow"); flow != "" {
+			out["flow"] = flow
+		}
+		applyClashTransport(out, p)
+		if p.boolean("tls") || len(p.sub("reality-opts")) > 0 {
+			out["tls"] = clashTLS(p)
+		}
+	case "trojan":
+		out["type"] = "trojan"
+		out["password"] = p.str("password")
+		applyClashTransport(out, p)
+		out["tls"] = clashTLS(p)
+	case "hysteria2":
+		out["type"] = "hysteria2"
+		out["password"] = p.str("password")
+		out["tls"] = clashTLS(p)
+		if obfs := p.str("obfs"); obfs != "" {
+			out["obfs"] = map[string]interface{}{"type": obfs, "password": p.str("obfs-password")}
+		}
+		if up := parseMbps(p.str("up")); up > 0 {
+			out["up_mbps"] = up
+		}
+		if down := parseMbps(p.str("down")); down > 0 {
+			out["down_mbps"] = down
+		}
+	case "hysteria":
+		out["type"] = "hysteria"
+		out["auth_str"] = p.str("auth-str")
+		out["up_mbps"] = parseMbps(p.str("up"))
+		out["down_mbps"] = parseMbps(p.str("down"))
+		if obfs := p.str("obfs"); obfs != "" {
+			out["obfs"] = obfs
+		}
+		out["tls"] = clashTLS(p)
+	case "tuic":
+		if p.str("token") != "" {
+			return nil, fmt.Errorf("tuic v4 is not supported")
+		}
+		out["type"] = "tuic"
+		out["uuid"] = p.str("uuid")
+		out["password"] = p.str("password")
+		if cc := p.str("congestion-controller"); cc != "" {
+			out["congestion_control"] = cc
+		}
+		if mode := p.str("udp-relay-mode"); mode != "" {
+			out["udp_relay_mode"] = mode
+		}
+		out["tls"] = clashTLS(p)
+	case "socks5":
+		if p.boolean("tls") {
+			return nil, fmt.Errorf("socks5 over tls is not supported")
+		}
+		out["type"] = "socks"
+		out["version"] = "5"
+		if user := p.str("username"); user != "" {
+			out["username"] = user
+			out["password"] = p.str("password")
+		}
+	case "http":
+		out["type"] = "http"
+		if user := p.str("username"); user != "" {
+			out["username"] = user
+			out["password"] = p.str("password")
+		}
+		if p.boolean("tls") {
+			out["tls"] = clashTLS(p)
+		}
+	default:
+		return nil, fmt.Errorf("type %q is not supported", p.str("type"))
+	}
+	return out, nil
+}
+
+// applyClashTransport maps network and *-opts fields to a sing-box transport
+func applyClashTransport(out map[string]interface{}, p clashMap) {
+	var transport map[string]interface{}
+	switch p.str("network") {
+	case "ws":
+		opts := p.sub("ws-opts")
+		host := opts.sub("headers").str("Host")
+		if opts.boolean("v2ray-http-upgrade") {
+			transport = buildTransport("httpupgrade", host, opts.str("path"), "")
+		} else {
+			transport = buildTransport("ws", host, opts.str("path"), "")
+		}
+	case "grpc":
+		transport = buildTransport("grpc", "", "", p.sub("grpc-opts").str("grpc-service-name"))
+	case "h2":
+		opts := p.sub("h2-opts")
+		transport = buildTransport("http", strings.Join(opts.strList("host"), ","), opts.str("path"), "")
+	case "http":
+		opts := p.sub("http-opts")
+		path := ""
+		if paths := opts.strList("path"); len(paths) > 0 {
+			path = paths[0]
+		}
+		transport = buildTransport("http", strings.Join(opts.sub("headers").strList("Host"), ","), path, "")
+	}
+	if transport != nil {
+		out["transport"] = transport
+	}
+}
+
+// clashTLS builds an outbound TLS block from Clash TLS fields
+func clashTLS(p clashMap) map[string]interface{} {
+	sni := p.str("servername")
+	if sni == "" {
+		sni = p.str("sni")
+	}
+	reality := p.sub("reality-opts")
+	return buildTLS(sni, strings.Join(p.strList("alpn"), ","), p.str("client-fingerprint"),
+		p.boolean("skip-cert-verify"), reality.str("public-key"), reality.str("short-id"))
+}
+
+// parseMbps parses bandwidth values such as "100", "100 Mbps" or "1 Gbps"
+func parseMbps(s string) int {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if s == "" {
+		return 0
+	}
+	multiplier := 1
+	if strings.HasSuffix(s, "gbps") {
+		multiplier = 1000
+	}
+	digits := strings.TrimRight(s, "abcdefghijklmnopqrstuvwxyz /")
+	n, err := strconv.Atoi(strings.TrimSpace(digits))
+	if err != nil {
+		return 0
+	}
+	return n * multiplier
+}
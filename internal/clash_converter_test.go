@@ -0,0 +1,375 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/tidwall/gjson"
+	"gopkg.in/yaml.v3"
+)
+
+func convertClashFixture(t *testing.T, content []byte) ([]byte, []string) {
+	t.Helper()
+	clash, ok := parseClashConfig(content)
+	if !ok {
+		t.Fatal("fixture not recognized as a clash profile")
+	}
+	fetch := func(url string) ([]byte, error) {
+		return nil, fmt.Errorf("offline")
+	}
+	config, warnings, err := convertClash(clash, fetch)
+	if err != nil {
+		t.Fatalf("convertClash() error = %v", err)
+	}
+	checkConfig(t, config)
+	return config, warnings
+}
+
+func hasWarning(warnings []string, substr string) bool {
+	for _, w := range warnings {
+		if strings.Contains(w, substr) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestConvertClashProfile(t *testing.T) {
+	content, err := os.ReadFile("testdata/clash_profile.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, warnings := convertClashFixture(t, content)
+
+	t.Run("groups", func(t *testing.T) {
+		groups := map[string]struct {
+			typ     string
+			members []string
+		}{
+			"Proxy": {"selector", []string{"Auto", "HK", directTag}},
+			"Auto":  {"urltest", []string{"HK 01", "HK 02", "US 01"}},
+			"HK":    {"urltest", []string{"HK 01", "HK 02"}},
+			"Empty": {"selector", []string{directTag}},
+		}
+		for tag, want := range groups {
+			g := gjson.GetBytes(config, `outbounds.#(tag=="`+tag+`")`)
+			if got := g.Get("type").String(); got != want.typ {
+				t.Errorf("group %s type = %q, want %q", tag, got, want.typ)
+			}
+			var members []string
+			for _, m := range g.Get("outbounds").Array() {
+				members = append(members, m.String())
+			}
+			if !reflect.DeepEqual(members, want.members) {
+				t.Errorf("group %s members = %v, want %v", tag, members, want.members)
+			}
+		}
+
+		auto := gjson.GetBytes(config, `outbounds.#(tag=="Auto")`)
+		if auto.Get("interval").String() != "300s" || auto.Get("tolerance").Int() != 50 || auto.Get("url").String() != urltestURL {
+			t.Errorf("url-test options not kept: %s", auto.Raw)
+		}
+		if got := gjson.GetBytes(config, "outbounds.0.tag").String(); got != "Proxy" {
+			t.Errorf("first outbound = %q, want the first group", got)
+		}
+		if gjson.GetBytes(config, `outbounds.#(tag=="Legacy")`).Exists() {
+			t.Error("unsupported proxy was converted")
+		}
+	})
+
+	t.Run("rules", func(t *testing.T) {
+		want := []string{
+			`{"action":"sniff"}`,
+			`{"action":"hijack-dns","protocol":"dns"}`,
+			`{"action":"reject","rule_set":"ads"}`,
+			`{"outbound":"Proxy","rule_set":"remote-srs"}`,
+			`{"outbound":"direct","port_range":["6000:6100"]}`,
+			`{"outbound":"Proxy","port":[443]}`,
+			`{"ip_is_private":true,"outbound":"direct"}`,
+			`{"outbound":"direct","rule_set":"geoip-cn"}`,
+			`{"outbound":"Proxy","rule_set":"geosite-google"}`,
+			`{"domain_suffix":["example.org"],"outbound":"HK"}`,
+			`{"ip_cidr":["10.0.0.0/8"],"outbound":"direct"}`,
+		}
+		rules := gjson.GetBytes(config, "route.rules").Array()
+		if len(rules) != len(want) {
+			t.Fatalf("got %d rules, want %d: %s", len(rules), len(want), gjson.GetBytes(config, "route.rules").Raw)
+		}
+		for i, r := range rules {
+			if got := normalizeJSON(t, r.Raw); got != normalizeJSON(t, want[i]) {
+				t.Errorf("rule %d = %s, want %s", i, got, want[i])
+			}
+		}
+		if got := gjson.GetBytes(config, "route.final").String(); got != "Proxy" {
+			t.Errorf("route.final = %q, want the MATCH target", got)
+		}
+	})
+
+	t.Run("rule sets", func(t *testing.T) {
+		var tags []string
+		for _, tag := range gjson.GetBytes(config, "route.rule_set.#.tag").Array() {
+			tags = append(tags, tag.String())
+		}
+		if want := []string{"ads", "remote-srs", "geoip-cn", "geosite-google"}; !reflect.DeepEqual(tags, want) {
+			t.Errorf("rule sets = %v, want %v", tags, want)
+		}
+		ads := gjson.GetBytes(config, `route.rule_set.#(tag=="ads")`)
+		if ads.Get("type").String() != "inline" ||
+			normalizeJSON(t, ads.Get("rules").Raw) != normalizeJSON(t, `[{"domain_suffix":["ads.example.com"]},{"domain":["tracker.example.com"]}]`) {
+			t.Errorf("inline provider = %s", ads.Raw)
+		}
+		srs := gjson.GetBytes(config, `route.rule_set.#(tag=="remote-srs")`)
+		if srs.Get("type").String() != "remote" || srs.Get("format").String() != "binary" {
+			t.Errorf("srs provider = %s", srs.Raw)
+		}
+		geoip := gjson.GetBytes(config, `route.rule_set.#(tag=="geoip-cn").url`).String()
+		if geoip != fmt.Sprintf(geoipRuleSetURL, "cn") {
+			t.Errorf("geoip-cn url = %q", geoip)
+		}
+	})
+
+	t.Run("warnings", func(t *testing.T) {
+		for _, want := range []string{
+			`proxy "Legacy"`,
+			`member REJECT is not supported`,
+			`unknown member "Missing"`,
+			`group "HK": fallback is approximated`,
+			`group "Empty" has no usable members`,
+			`rule-provider "offline": download failed`,
+			`rule-provider "binary": mrs format`,
+			`rule-provider "offline" is unavailable`,
+			`rule-provider "missing" is unavailable`,
+			`invalid port "abc"`,
+			`unknown target "Unknown"`,
+		} {
+			if !hasWarning(warnings, want) {
+				t.Errorf("missing warning %q in %v", want, warnings)
+			}
+		}
+	})
+}
+
+func normalizeJSON(t *testing.T, raw string) string {
+	t.Helper()
+	var v interface{}
+	if err := json.Unmarshal([]byte(raw), &v); err != nil {
+		t.Fatalf("invalid JSON %s: %v", raw, err)
+	}
+	return fmt.Sprint(v)
+}
+
+func TestConvertClashFinal(t *testing.T) {
+	proxies := `
+proxies:
+  - {name: A, type: trojan, server: a.example.com, port: 443, password: pw}
+`
+	groups := `
+proxy-groups:
+  - {name: First, type: select, proxies: [A]}
+  - {name: Second, type: select, proxies: [A, DIRECT]}
+`
+	tests := []struct {
+		name  string
+		yaml  string
+		final string
+	}{
+		{"MATCH", proxies + groups + "rules:\n  - MATCH,Second\n", "Second"},
+		{"FINAL", proxies + groups + "rules:\n  - FINAL,DIRECT\n", directTag},
+		{"first group without MATCH", proxies + groups + "rules:\n  - DOMAIN,a.com,Second\n", "First"},
+		{"generated selector without groups", proxies, selectorTag},
+		{"unsupported MATCH target", proxies + groups + "rules:\n  - MATCH,Nowhere\n", "First"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config, _ := convertClashFixture(t, []byte(tt.yaml))
+			if got := gjson.GetBytes(config, "route.final").String(); got != tt.final {
+				t.Errorf("route.final = %q, want %q", got, tt.final)
+			}
+		})
+	}
+}
+
+func TestConvertClashProxy(t *testing.T) {
+	uuid := "b831381d-6324-4d53-ad4f-8cda48b30811"
+	tests := []struct {
+		name string
+		yaml string
+		want string
+	}{
+		{
+			"ss obfs",
+			`{name: a, type: ss, server: s.com, port: 8388, cipher: aes-256-gcm, password: pw, plugin: obfs, plugin-opts: {mode: http, host: bing.com}}`,
+			`{"tag":"a","type":"shadowsocks","server":"s.com","server_port":8388,"method":"aes-256-gcm","password":"pw","plugin":"obfs-local","plugin_opts":"obfs=http;obfs-host=bing.com"}`,
+		},
+		{
+			"ss v2ray-plugin",
+			`{name: a, type: ss, server: s.com, port: 443, cipher: none, password: pw, plugin: v2ray-plugin, plugin-opts: {mode: websocket, tls: true, host: h.com, path: /p}}`,
+			`{"tag":"a","type":"shadowsocks","server":"s.com","server_port":443,"method":"none","password":"pw","plugin":"v2ray-plugin","plugin_opts":"mode=websocket;tls;host=h.com;path=/p"}`,
+		},
+		{
+			"vmess h2",
+			`{name: a, type: vmess, server: v.com, port: 443, uuid: ` + uuid + `, alterId: 1, tls: true, servername: sni.com, network: h2, h2-opts: {host: [h.com], path: /h2}}`,
+			`{"tag":"a","type":"vmess","server":"v.com","server_port":443,"uuid":"` + uuid + `","alter_id":1,"security":"auto","transport":{"type":"http","host":["h.com"],"path":"/h2"},"tls":{"enabled":true,"server_name":"sni.com"}}`,
+		},
+		{
+			"vless reality grpc",
+			`{name: a, type: vless, server: 1.2.3.4, port: 443, uuid: ` + uuid + `, flow: xtls-rprx-vision, network: grpc, grpc-opts: {grpc-service-name: svc}, servername: m.com, client-fingerprint: chrome, reality-opts: {public-key: pk, short-id: ab}}`,
+			`{"tag":"a","type":"vless","server":"1.2.3.4","server_port":443,"uuid":"` + uuid + `","flow":"xtls-rprx-vision","transport":{"type":"grpc","service_name":"svc"},"tls":{"enabled":true,"server_name":"m.com","utls":{"enabled":true,"fingerprint":"chrome"},"reality":{"enabled":true,"public_key":"pk","short_id":"ab"}}}`,
+		},
+		{
+			"trojan ws upgrade",
+			`{name: a, type: trojan, server: t.com, port: 443, password: pw, skip-cert-verify: true, alpn: [h2], network: ws, ws-opts: {path: /u, v2ray-http-upgrade: true, headers: {Host: h.com}}}`,
+			`{"tag":"a","type":"trojan","server":"t.com","server_port":443,"password":"pw","transport":{"type":"httpupgrade","host":"h.com","path":"/u"},"tls":{"enabled":true,"alpn":["h2"],"insecure":true}}`,
+		},
+		{
+			"hysteria2",
+			`{name: a, type: hysteria2, server: h.com, port: 443, password: pw, sni: h.com, obfs: salamander, obfs-password: ob, up: 50 Mbps, down: 1 Gbps}`,
+			`{"tag":"a","type":"hysteria2","server":"h.com","server_port":443,"password":"pw","tls":{"enabled":true,"server_name":"h.com"},"obfs":{"type":"salamander","password":"ob"},"up_mbps":50,"down_mbps":1000}`,
+		},
+		{
+			"hysteria",
+			`{name: a, type: hysteria, server: h.com, port: 443, auth-str: au, up: "20", down: "100", obfs: xp}`,
+			`{"tag":"a","type":"hysteria","server":"h.com","server_port":443,"auth_str":"au","up_mbps":20,"down_mbps":100,"obfs":"xp","tls":{"enabled":true}}`,
+		},
+		{
+			"tuic",
+			`{name: a, type: tuic, server: t.com, port: 443, uuid: ` + uuid + `, password: pw, congestion-controller: bbr, udp-relay-mode: quic, alpn: [h3]}`,
+			`{"tag":"a","type":"tuic","server":"t.com","server_port":443,"uuid":"` + uuid + `","password":"pw","congestion_control":"bbr","udp_relay_mode":"quic","tls":{"enabled":true,"alpn":["h3"]}}`,
+		},
+		{
+			"socks5",
+			`{name: a, type: socks5, server: 127.0.0.1, port: 1080, username: u, password: p}`,
+			`{"tag":"a","type":"socks","server":"127.0.0.1","server_port":1080,"version":"5","username":"u","password":"p"}`,
+		},
+		{
+			"http tls",
+			`{name: a, type: http, server: p.com, port: 443, tls: true, sni: p.com}`,
+			`{"tag":"a","type":"http","server":"p.com","server_port":443,"tls":{"enabled":true,"server_name":"p.com"}}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var p map[string]interface{}
+			if err := yaml.Unmarshal([]byte(tt.yaml), &p); err != nil {
+				t.Fatal(err)
+			}
+			got, err := convertClashProxy(clashMap(p))
+			if err != nil {
+				t.Fatalf("convertClashProxy() error = %v", err)
+			}
+			if g, w := fmt.Sprint(normalize(t, got)), normalizeJSON(t, tt.want); g != w {
+				t.Errorf("convertClashProxy()\n got %s\nwant %s", g, w)
+			}
+		})
+	}
+
+	for _, bad := range []string{
+		`{name: a, type: tuic, server: t.com, port: 443, token: v4}`,
+		`{name: a, type: socks5, server: s.com, port: 1080, tls: true}`,
+		`{name: a, type: ss, server: s.com, port: 1, cipher: none, password: p, plugin: kcptun}`,
+		`{name: a, type: snell, server: s.com, port: 1}`,
+		`{name: a, type: ss, server: s.com}`,
+	} {
+		var p map[string]interface{}
+		if err := yaml.Unmarshal([]byte(bad), &p); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := convertClashProxy(clashMap(p)); err == nil {
+			t.Errorf("convertClashProxy(%s) succeeded, want error", bad)
+		}
+	}
+}
+
+func TestClashRuleMatch(t *testing.T) {
+	tests := []struct {
+		ruleType, value string
+		want            string
+		wantErr         bool
+	}{
+		{"DOMAIN-SUFFIX", "example.com", `{"domain_suffix":["example.com"]}`, false},
+		{"ip-cidr6", "2001:db8::/32", `{"ip_cidr":["2001:db8::/32"]}`, false},
+		{"DST-PORT", "80", `{"port":[80]}`, false},
+		{"DST-PORT", "8000-9000", `{"port_range":["8000:9000"]}`, false},
+		{"SRC-PORT", "1000-2000", `{"source_port_range":["1000:2000"]}`, false},
+		{"SRC-PORT", "53", `{"source_port":[53]}`, false},
+		{"NETWORK", "UDP", `{"network":["udp"]}`, false},
+		{"DST-PORT", "http", "", true},
+		{"SCRIPT", "x", "", true},
+	}
+	for _, tt := range tests {
+		got, err := clashRuleMatch(tt.ruleType, tt.value)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("clashRuleMatch(%s, %s) error = %v", tt.ruleType, tt.value, err)
+			continue
+		}
+		if !tt.wantErr && fmt.Sprint(normalize(t, got)) != normalizeJSON(t, tt.want) {
+			t.Errorf("clashRuleMatch(%s, %s) = %v, want %s", tt.ruleType, tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestProviderRules(t *testing.T) {
+	cc := &clashConverter{}
+	rules := cc.providerRules("p", "classical", []string{
+		"DOMAIN,a.com", "IP-CIDR,1.1.1.0/24,no-resolve", "DST-PORT,80", "USER-AGENT,x", "DOMAIN,b.com", "broken",
+	})
+	want := `[{"domain":["a.com","b.com"]},{"ip_cidr":["1.1.1.0/24"]},{"port":[80]}]`
+	if fmt.Sprint(normalize(t, rules)) != normalizeJSON(t, want) {
+		t.Errorf("classical rules = %v, want %s", normalize(t, rules), want)
+	}
+	if !hasWarning(cc.warnings, "USER-AGENT") {
+		t.Errorf("unsupported entry not reported: %v", cc.warnings)
+	}
+
+	rules = cc.providerRules("p", "domain", []string{"+.a.com", "*.b.com", ".c.com", "'d.com'"})
+	want = `[{"domain_suffix":["a.com","b.com","c.com"]},{"domain":["d.com"]}]`
+	if fmt.Sprint(normalize(t, rules)) != normalizeJSON(t, want) {
+		t.Errorf("domain rules = %v, want %s", normalize(t, rules), want)
+	}
+}
+
+func TestParseProviderPayload(t *testing.T) {
+	yamlPayload := "payload:\n  - '+.a.com'\n  - b.com\n"
+	if got := parseProviderPayload([]byte(yamlPayload), ""); !reflect.DeepEqual(got, []string{"+.a.com", "b.com"}) {
+		t.Errorf("yaml payload = %v", got)
+	}
+	text := "# comment\n1.0.0.0/8\n\n2.0.0.0/8\n"
+	if got := parseProviderPayload([]byte(text), "text"); !reflect.DeepEqual(got, []string{"1.0.0.0/8", "2.0.0.0/8"}) {
+		t.Errorf("text payload = %v", got)
+	}
+}
+
+func TestParseMbps(t *testing.T) {
+	tests := map[string]int{
+		"":         0,
+		"100":      100,
+		"100 Mbps": 100,
+		"50mbps":   50,
+		"1 Gbps":   1000,
+		"fast":     0,
+	}
+	for in, want := range tests {
+		if got := parseMbps(in); got != want {
+			t.Errorf("parseMbps(%q) = %d, want %d", in, got, want)
+		}
+	}
+}
+
+func TestParseClashConfig(t *testing.T) {
+	for body, want := range map[string]bool{
+		"proxies: []\n":           true,
+		"proxy-providers: {}\n":   true,
+		"mixed-port: 7890\n":      false,
+		"just some text":          false,
+		"- a\n- b\n":              false,
+		"vless://a@b.com:443#x\n": false,
+	} {
+		if _, got := parseClashConfig([]byte(body)); got != want {
+			t.Errorf("parseClashConfig(%q) = %v, want %v", body, got, want)
+		}
+	}
+}
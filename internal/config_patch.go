@@ -0,0 +1,62 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	jsonpatch "github.com/evanphx/json-patch/v5"
+)
+
+// Validate checks that the patch has a name and a well-formed document of its type
+func (p *ConfigPatch) Validate() error {
+	if strings.TrimSpace(p.Name) == "" {
+		return fmt.Errorf("patch name cannot be empty")
+	}
+
+	switch p.Type {
+	case PatchTypeJSONPatch:
+		if _, err := jsonpatch.DecodePatch([]byte(p.Content)); err != nil {
+			return fmt.Errorf("patch %q: invalid JSON Patch: %w", p.Name, err)
+		}
+	case PatchTypeMergePatch:
+		var doc map[string]interface{}
+		if err := json.Unmarshal([]byte(p.Content), &doc); err != nil {
+			return fmt.Errorf("patch %q: merge patch must be a JSON object", p.Name)
+		}
+	default:
+		return fmt.Errorf("patch %q: unknown type %q", p.Name, p.Type)
+	}
+	return nil
+}
+
+// apply applies the patch to a config document
+func (p *ConfigPatch) apply(content []byte) ([]byte, error) {
+	switch p.Type {
+	case PatchTypeJSONPatch:
+		patch, err := jsonpatch.DecodePatch([]byte(p.Content))
+		if err != nil {
+			return nil, err
+		}
+		return patch.Apply(content)
+	case PatchTypeMergePatch:
+		return jsonpatch.MergePatch(content, []byte(p.Content))
+	default:
+		return nil, fmt.Errorf("unknown type %q", p.Type)
+	}
+}
+
+// applyPatches applies the enabled patches to a config in order
+func applyPatches(content []byte, patches []ConfigPatch) ([]byte, error) {
+	for i := range patches {
+		if !patches[i].Enabled {
+			continue
+		}
+		patched, err := patches[i].apply(content)
+		if err != nil {
+			return nil, fmt.Errorf("patch %q failed: %w", patches[i].Name, err)
+		}
+		content = patched
+	}
+	return content, nil
+}
@@ -0,0 +1,117 @@
+package internal
+
+import (
+	"strings"
+	"testing"
+)
+
+const patchBase = `{"log":{"level":"info"},"outbounds":[{"type":"direct","tag":"direct"}],"route":{"final":"direct","auto_detect_interface":true}}`
+
+func TestApplyPatches(t *testing.T) {
+	tests := []struct {
+		name    string
+		patches []ConfigPatch
+		want    string
+	}{
+		{
+			"json patch",
+			[]ConfigPatch{{Name: "a", Type: PatchTypeJSONPatch, Enabled: true, Content: `[
+				{"op": "add", "path": "/outbounds/-", "value": {"type": "block", "tag": "block"}},
+				{"op": "replace", "path": "/log/level", "value": "debug"},
+				{"op": "remove", "path": "/route/auto_detect_interface"}
+			]`}},
+			`{"log":{"level":"debug"},"outbounds":[{"type":"direct","tag":"direct"},{"type":"block","tag":"block"}],"route":{"final":"direct"}}`,
+		},
+		{
+			// Merge patches replace arrays and delete keys set to null
+			"merge patch",
+			[]ConfigPatch{{Name: "a", Type: PatchTypeMergePatch, Enabled: true, Content: `{"log":{"timestamp":true},"outbounds":[{"type":"block","tag":"block"}],"route":{"auto_detect_interface":null}}`}},
+			`{"log":{"level":"info","timestamp":true},"outbounds":[{"type":"block","tag":"block"}],"route":{"final":"direct"}}`,
+		},
+		{
+			// Later patches see the output of earlier ones
+			"order",
+			[]ConfigPatch{
+				{Name: "level", Type: PatchTypeMergePatch, Enabled: true, Content: `{"log":{"level":"warn"}}`},
+				{Name: "check", Type: PatchTypeJSONPatch, Enabled: true, Content: `[
+					{"op": "test", "path": "/log/level", "value": "warn"},
+					{"op": "copy", "from": "/log/level", "path": "/log/copied"}
+				]`},
+				{Name: "last", Type: PatchTypeMergePatch, Enabled: true, Content: `{"log":{"level":"error"}}`},
+			},
+			`{"log":{"level":"error","copied":"warn"},"outbounds":[{"type":"direct","tag":"direct"}],"route":{"final":"direct","auto_detect_interface":true}}`,
+		},
+		{
+			"disabled patches skipped",
+			[]ConfigPatch{
+				{Name: "off", Type: PatchTypeMergePatch, Content: `{"log":{"level":"trace"}}`},
+				{Name: "broken", Type: PatchTypeJSONPatch, Content: `[{"op": "remove", "path": "/missing"}]`},
+			},
+			patchBase,
+		},
+		{"no patches", nil, patchBase},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := applyPatches([]byte(patchBase), tt.patches)
+			if err != nil {
+				t.Fatalf("applyPatches() error = %v", err)
+			}
+			if normalizeJSON(t, string(got)) != normalizeJSON(t, tt.want) {
+				t.Errorf("applyPatches() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestApplyPatchesFailure(t *testing.T) {
+	patches := []ConfigPatch{
+		{Name: "first", Type: PatchTypeMergePatch, Enabled: true, Content: `{"log":{"level":"warn"}}`},
+		{Name: "strict", Type: PatchTypeJSONPatch, Enabled: true, Content: `[{"op": "test", "path": "/log/level", "value": "info"}]`},
+		{Name: "never", Type: PatchTypeMergePatch, Enabled: true, Content: `{"log":{"level":"trace"}}`},
+	}
+	got, err := applyPatches([]byte(patchBase), patches)
+	if err == nil || !strings.Contains(err.Error(), `patch "strict" failed`) {
+		t.Fatalf("applyPatches() = %s, %v, want the strict patch to fail", got, err)
+	}
+
+	for _, content := range []string{
+		`[{"op": "remove", "path": "/dns"}]`,
+		`[{"op": "replace", "path": "/outbounds/5", "value": {}}]`,
+		`[{"op": "move", "from": "/nothing", "path": "/x"}]`,
+	} {
+		p := []ConfigPatch{{Name: "bad", Type: PatchTypeJSONPatch, Enabled: true, Content: content}}
+		if _, err := applyPatches([]byte(patchBase), p); err == nil {
+			t.Errorf("applyPatches(%s) succeeded", content)
+		}
+	}
+	p := []ConfigPatch{{Name: "odd", Type: "yaml", Enabled: true, Content: "{}"}}
+	if _, err := applyPatches([]byte(patchBase), p); err == nil {
+		t.Error("applyPatches() accepted an unknown type")
+	}
+}
+
+func TestConfigPatchValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		patch   ConfigPatch
+		wantErr bool
+	}{
+		{"json patch", ConfigPatch{Name: "a", Type: PatchTypeJSONPatch, Content: `[{"op": "add", "path": "/a", "value": 1}]`}, false},
+		{"empty json patch", ConfigPatch{Name: "a", Type: PatchTypeJSONPatch, Content: `[]`}, false},
+		{"json patch object", ConfigPatch{Name: "a", Type: PatchTypeJSONPatch, Content: `{"op": "add"}`}, true},
+		{"json patch syntax", ConfigPatch{Name: "a", Type: PatchTypeJSONPatch, Content: `[{"op": `}, true},
+		{"merge patch", ConfigPatch{Name: "a", Type: PatchTypeMergePatch, Content: `{"log": null}`}, false},
+		{"merge patch array", ConfigPatch{Name: "a", Type: PatchTypeMergePatch, Content: `[]`}, true},
+		{"merge patch syntax", ConfigPatch{Name: "a", Type: PatchTypeMergePatch, Content: `{`}, true},
+		{"no name", ConfigPatch{Name: " ", Type: PatchTypeMergePatch, Content: `{}`}, true},
+		{"unknown type", ConfigPatch{Name: "a", Type: "yaml", Content: `{}`}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.patch.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
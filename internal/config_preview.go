@@ -0,0 +1,231 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Preview generates the runtime config for opts without starting the core,
+// checks it with sing-box and compares it with the original profile
+func (cm *CoreManager) Preview(opts RuntimeOptions) (*ConfigPreview, error) {
+	original, err := os.ReadFile(opts.ProfilePath)
+	if err != nil {
+		return nil, err
+	}
+
+	// A running core holds its own ports, so they would all look taken
+	running := cm.IsRunning()
+	result, err := cm.buildConfig(opts, !running)
+	if err != nil {
+		return nil, err
+	}
+	if running {
+		result.Warnings = append(result.Warnings, "port conflicts are not checked while the core is running")
+	}
+
+	changes, err := diffConfig(original, result.Content)
+	if err != nil {
+		return nil, err
+	}
+
+	preview := &ConfigPreview{
+		Config:   string(result.Content),
+		Valid:    true,
+		Changes:  changes,
+		Warnings: result.Warnings,
+		Rewrites: result.Rewrites,
+	}
+	if preview.Warnings == nil {
+		preview.Warnings = []string{}
+	}
+	if preview.Rewrites == nil {
+		preview.Rewrites = []string{}
+	}
+
+	// Check next to the runtime config so relative paths resolve the same way,
+	// in a file of its own, so concurrent previews do not overwrite each other
+	dir := filepath.Join(cm.appDir, "data", "core")
+	os.MkdirAll(dir, 0755)
+	file, err := os.CreateTemp(dir, "preview-*.json")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(file.Name())
+	_, err = file.Write(result.Content)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := cm.CheckConfig(file.Name()); err != nil {
+		preview.Valid = false
+		preview.Check = err.Error()
+	}
+	return preview, nil
+}
+
+// diffConfig lists the changes between two configs. Elements of arrays of
+// tagged objects, such as outbounds, are matched by tag; other array
+// elements are matched by content.
+func diffConfig(from, to []byte) ([]ConfigChange, error) {
+	var a, b interface{}
+	if err := decodeJSON(from, &a); err != nil {
+		return nil, fmt.Errorf("parse original failed: %w", err)
+	}
+	if err := decodeJSON(to, &b); err != nil {
+		return nil, fmt.Errorf("parse generated failed: %w", err)
+	}
+
+	changes := []ConfigChange{}
+	diffValue("", a, b, &changes)
+	return changes, nil
+}
+
+func decodeJSON(data []byte, v interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	return decoder.Decode(v)
+}
+
+func diffValue(path string, a, b interface{}, changes *[]ConfigChange) {
+	switch av := a.(type) {
+	case map[string]interface{}:
+		if bv, ok := b.(map[string]interface{}); ok {
+			diffObject(path, av, bv, changes)
+			return
+		}
+	case []interface{}:
+		if bv, ok := b.([]interface{}); ok {
+			if tagged(av) && tagged(bv) {
+				diffTagged(path, av, bv, changes)
+			} else {
+				diffList(path, av, bv, changes)
+			}
+			return
+		}
+	}
+	if !reflect.DeepEqual(a, b) {
+		*changes = append(*changes, ConfigChange{Path: path, Op: ChangeReplace, Old: a, New: b})
+	}
+}
+
+func diffObject(path string, a, b map[string]interface{}, changes *[]ConfigChange) {
+	keys := make([]string, 0, len(a)+len(b))
+	for k := range a {
+		keys = append(keys, k)
+	}
+	for k := range b {
+		if _, ok := a[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		child := joinPath(path, k)
+		av, inA := a[k]
+		bv, inB := b[k]
+		switch {
+		case !inA:
+			*changes = append(*changes, ConfigChange{Path: child, Op: ChangeAdd, New: bv})
+		case !inB:
+			*changes = append(*changes, ConfigChange{Path: child, Op: ChangeRemove, Old: av})
+		default:
+			diffValue(child, av, bv, changes)
+		}
+	}
+}
+
+// tagged reports whether every element of a list is an object with a unique tag
+func tagged(list []interface{}) bool {
+	seen := make(map[string]bool, len(list))
+	for _, item := range list {
+		obj, ok := item.(map[string]interface{})
+		if !ok {
+			return false
+		}
+		tag, ok := obj["tag"].(string)
+		if !ok || seen[tag] {
+			return false
+		}
+		seen[tag] = true
+	}
+	return true
+}
+
+func diffTagged(path string, a, b []interface{}, changes *[]ConfigChange) {
+	index := make(map[string]interface{}, len(b))
+	for _, item := range b {
+		index[item.(map[string]interface{})["tag"].(string)] = item
+	}
+
+	for _, item := range a {
+		tag := item.(map[string]interface{})["tag"].(string)
+		child := path + "[" + tag + "]"
+		if other, ok := index[tag]; ok {
+			diffValue(child, item, other, changes)
+			delete(index, tag)
+		} else {
+			*changes = append(*changes, ConfigChange{Path: child, Op: ChangeRemove, Old: item})
+		}
+	}
+	for _, item := range b {
+		tag := item.(map[string]interface{})["tag"].(string)
+		if _, ok := index[tag]; ok {
+			*changes = append(*changes, ConfigChange{Path: path + "[" + tag + "]", Op: ChangeAdd, New: item})
+		}
+	}
+}
+
+// diffList matches list elements by their longest common subsequence, so an
+// inserted rule shows up as one addition instead of every later rule changing
+func diffList(path string, a, b []interface{}, changes *[]ConfigChange) {
+	n, m := len(a), len(b)
+	lcs := make([][]int, n+1)
+	for i := range lcs {
+		lcs[i] = make([]int, m+1)
+	}
+	for i := n - 1; i >= 0; i-- {
+		for j := m - 1; j >= 0; j-- {
+			if reflect.DeepEqual(a[i], b[j]) {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	i, j := 0, 0
+	for i < n || j < m {
+		switch {
+		case i < n && j < m && reflect.DeepEqual(a[i], b[j]):
+			i++
+			j++
+		case j < m && (i == n || lcs[i][j+1] >= lcs[i+1][j]):
+			*changes = append(*changes, ConfigChange{Path: path + "[" + strconv.Itoa(j) + "]", Op: ChangeAdd, New: b[j]})
+			j++
+		default:
+			*changes = append(*changes, ConfigChange{Path: path + "[" + strconv.Itoa(i) + "]", Op: ChangeRemove, Old: a[i]})
+			i++
+		}
+	}
+}
+
+func joinPath(path, key string) string {
+	if strings.ContainsAny(key, ".[]") {
+		key = strconv.Quote(key)
+	}
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
@@ -0,0 +1,127 @@
+package internal
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// changeSummary returns "op path" for each change
+func changeSummary(changes []ConfigChange) []string {
+	out := []string{}
+	for _, c := range changes {
+		out = append(out, c.Op+" "+c.Path)
+	}
+	return out
+}
+
+func TestDiffConfig(t *testing.T) {
+	tests := []struct {
+		name     string
+		from, to string
+		want     []string
+	}{
+		{"identical", `{"a": 1, "b": [1, 2]}`, `{"b": [1, 2], "a": 1}`, []string{}},
+		{"keys sorted", `{"z": 1, "a": 1, "m": 1}`, `{"z": 2, "b": 1, "m": 1}`, []string{"remove a", "add b", "replace z"}},
+		{"nested", `{"log": {"level": "info"}}`, `{"log": {"level": "debug", "output": "x"}}`, []string{"replace log.level", "add log.output"}},
+		{"numbers keep precision", `{"n": 9007199254740993}`, `{"n": 9007199254740992}`, []string{"replace n"}},
+		{"type change", `{"a": [1]}`, `{"a": {"x": 1}}`, []string{"replace a"}},
+		{
+			"tagged by tag",
+			`{"outbounds": [{"tag": "a", "type": "direct"}, {"tag": "b", "type": "block"}, {"tag": "c", "type": "dns"}]}`,
+			`{"outbounds": [{"tag": "c", "type": "dns"}, {"tag": "a", "type": "trojan"}, {"tag": "d", "type": "direct"}]}`,
+			[]string{"replace outbounds[a].type", "remove outbounds[b]", "add outbounds[d]"},
+		},
+		{
+			// Rules have no tags, an inserted rule is a single addition
+			"list insert",
+			`{"rules": [{"x": 1}, {"x": 2}, {"x": 3}]}`,
+			`{"rules": [{"x": 1}, {"x": 9}, {"x": 2}, {"x": 3}]}`,
+			[]string{"add rules[1]"},
+		},
+		{"list remove and add", `{"l": [1, 2, 3]}`, `{"l": [1, 3, 4]}`, []string{"remove l[1]", "add l[2]"}},
+		{
+			// Duplicate tags fall back to matching by content
+			"duplicate tags",
+			`{"l": [{"tag": "a", "v": 1}, {"tag": "a", "v": 2}]}`,
+			`{"l": [{"tag": "a", "v": 2}]}`,
+			[]string{"remove l[0]"},
+		},
+		{"quoted keys", `{"a.b": 1, "c[0]": 1}`, `{"a.b": 2}`, []string{`replace "a.b"`, `remove "c[0]"`}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			changes, err := diffConfig([]byte(tt.from), []byte(tt.to))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := changeSummary(changes); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("diffConfig() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	if _, err := diffConfig([]byte("{"), []byte("{}")); err == nil {
+		t.Error("diffConfig() accepted an invalid original")
+	}
+	if _, err := diffConfig([]byte("{}"), []byte("[")); err == nil {
+		t.Error("diffConfig() accepted an invalid generated config")
+	}
+}
+
+func TestDiffConfigValues(t *testing.T) {
+	changes, _ := diffConfig([]byte(`{"a": "x", "b": 1}`), []byte(`{"a": "y", "c": true}`))
+	want := []ConfigChange{
+		{Path: "a", Op: ChangeReplace, Old: "x", New: "y"},
+		{Path: "b", Op: ChangeRemove, Old: 1},
+		{Path: "c", Op: ChangeAdd, New: true},
+	}
+	if !reflect.DeepEqual(normalize(t, changes), normalize(t, want)) {
+		t.Errorf("diffConfig() = %+v, want %+v", changes, want)
+	}
+}
+
+func TestPreview(t *testing.T) {
+	appDir := t.TempDir()
+	installFakeKernel(t, appDir, "1.12.0")
+	cm := NewCoreManager(appDir, context.Background())
+
+	profile := filepath.Join(appDir, "profile.json")
+	os.WriteFile(profile, []byte(`{"outbounds": [{"type": "direct", "tag": "direct"}]}`), 0644)
+	opts := RuntimeOptions{
+		ProfilePath: profile,
+		SysProxy:    true,
+		MixedConfig: DefaultMixedConfig,
+		DNSConfig:   DefaultDNSConfig,
+		SplitConfig: DefaultSplitConfig,
+	}
+
+	preview, err := cm.Preview(opts)
+	if err != nil {
+		t.Fatalf("Preview() error = %v", err)
+	}
+	if !preview.Valid || preview.Check != "" || len(preview.Changes) == 0 {
+		t.Errorf("preview = %+v", preview)
+	}
+
+	// The check sees exactly the generated config
+	opts.Patches = []ConfigPatch{{Name: "break", Type: PatchTypeJSONPatch, Enabled: true,
+		Content: `[{"op": "add", "path": "/outbounds/-", "value": {"type": "invalid", "tag": "x"}}]`}}
+	preview, err = cm.Preview(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if preview.Valid || preview.Check == "" {
+		t.Errorf("invalid config passed the check: %+v", preview)
+	}
+
+	// No preview files are left next to the runtime config
+	entries, _ := os.ReadDir(filepath.Join(appDir, "data", "core"))
+	for _, e := range entries {
+		if e.Name() != "sing-box.exe" {
+			t.Errorf("left behind %s", e.Name())
+		}
+	}
+}
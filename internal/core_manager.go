@@ -16,7 +16,6 @@ import (
 	"time"
 	"unsafe"
 
-	"github.com/tidwall/gjson"
 	"github.com/tidwall/sjson"
 	wailsRuntime "github.com/wailsapp/wails/v2/pkg/runtime"
 	"golang.org/x/sys/windows"
@@ -30,7 +29,9 @@ type CoreManager struct {
 	ctx        context.Context
 	appDir     string
 	logBuffer  *LogBuffer // Buffer for real-time logs
-	apiURL     string     // Clash API URL if available
+	api        ClashAPI   // Clash API injected into the running config
+	warnings   []string   // Warnings from the last config generation
+	rewrites   []string   // Migrations applied by the last config generation
 }
 
 // LogBuffer stores recent log lines in memory using a ring buffer
@@ -96,8 +97,32 @@ func NewCoreManager(appDir string, ctx context.Context) *CoreManager {
 	}
 }
 
+// RuntimeOptions holds the inputs used to generate the runtime config
+type RuntimeOptions struct {
+	ProfilePath   string
+	Providers     []ProviderRule    // Provider rules if the profile is a template
+	ProviderPaths map[string]string // Config path of each provider profile by ID
+	RegionGroups  string            // Region group mode of the profile
+	Regions       []RegionRule      // Region mapping table
+	RouteRules    []RouteRule       // Custom rules placed ahead of the profile's rules
+	Patches       []ConfigPatch     // Applied in order after all other changes
+	Resources     *ResourceCache    // Replaces remote rule sets and the external UI with cached copies
+	TunMode       bool
+	SysProxy      bool
+	TunConfig     string
+	MixedConfig   string
+	Inbounds      []ManagedInbound // Extra listeners added in every mode
+	LAN           *LANSharing      // LAN sharing listener, nil when LAN sharing is off
+	DNSConfig     string           // Content of the "dns" override
+	SplitConfig   string           // Content of the "split" override, used in TUN mode
+	IPv6Enabled   bool
+	StrictPorts   bool // Fail on port conflicts instead of picking a free port
+	LogLevel      string
+	LogToFile     bool
+}
+
 // Start starts the core process with thread safety
-func (cm *CoreManager) Start(profilePath string, tunMode, sysProxy bool, tunConfig, mixedConfig string, ipv6Enabled bool, logLevel string, logToFile bool) error {
+func (cm *CoreManager) Start(opts RuntimeOptions) error {
 	cm.mu.Lock()
 	defer cm.mu.Unlock()
 
@@ -113,12 +138,14 @@ func (cm *CoreManager) Start(profilePath string, tunMode, sysProxy bool, tunConf
 		return fmt.Errorf("kernel missing")
 	}
 
-	// Process config and extract API URL
-	apiURL, err := cm.processConfig(profilePath, runtimeConfig, tunMode, sysProxy, tunConfig, mixedConfig, ipv6Enabled, logLevel, logToFile)
+	// Process config and inject the Clash API
+	result, err := cm.processConfig(opts, runtimeConfig)
 	if err != nil {
 		return fmt.Errorf("config gen error: %w", err)
 	}
-	cm.apiURL = apiURL
+	cm.api = result.API
+	cm.warnings = result.Warnings
+	cm.rewrites = result.Rewrites
 
 	cm.cmd = exec.Command(coreExe, "run", "-c", "config.json")
 	cm.cmd.Dir = coreDir
@@ -278,27 +305,85 @@ func (cm *CoreManager) CheckConfig(configPath string) error {
 	return nil
 }
 
-// processConfig processes the configuration file and returns API URL
-func (cm *CoreManager) processConfig(srcPath, dstPath string, enableTun bool, enableProxy bool, tunConfig, mixedConfig string, ipv6Enabled bool, logLevel string, logToFile bool) (string, error) {
-	content, err := os.ReadFile(srcPath)
+// runtimeResult describes a generated runtime config
+type runtimeResult struct {
+	Content  []byte
+	API      ClashAPI
+	Warnings []string
+	Rewrites []string // Deprecated constructs migrated for the installed kernel
+}
+
+// processConfig generates the runtime config, writes it to dstPath and returns the injected Clash API
+func (cm *CoreManager) processConfig(opts RuntimeOptions, dstPath string) (runtimeResult, error) {
+	result, err := cm.buildConfig(opts, true)
+	if err != nil {
+		return result, err
+	}
+
+	os.MkdirAll(filepath.Dir(dstPath), 0755)
+
+	if err := os.WriteFile(dstPath, result.Content, 0644); err != nil {
+		return result, err
+	}
+
+	return result, nil
+}
+
+// buildConfig generates the runtime config from a profile. Port conflicts
+// are only checked when checkPorts is set.
+func (cm *CoreManager) buildConfig(opts RuntimeOptions, checkPorts bool) (runtimeResult, error) {
+	var result runtimeResult
+	content, err := os.ReadFile(opts.ProfilePath)
 	if err != nil {
-		return "", err
+		return result, err
 	}
 
-	// Extract API URL before modifying config
-	apiURL := cm.extractAPIURL(content)
+	content, err = composeProviders(content, opts.Providers, opts.ProviderPaths)
+	if err != nil {
+		return result, err
+	}
+
+	var warnings []string
+	content, warnings, err = addRegionGroups(content, opts.RegionGroups, opts.Regions)
+	if err != nil {
+		return result, err
+	}
+	result.Warnings = append(result.Warnings, warnings...)
+
+	content, warnings, err = applyRouteRules(content, opts.RouteRules)
+	if err != nil {
+		return result, err
+	}
+	result.Warnings = append(result.Warnings, warnings...)
+
+	content, warnings, err = applyDNSOverride(content, opts.DNSConfig, opts.TunMode)
+	if err != nil {
+		return result, err
+	}
+	result.Warnings = append(result.Warnings, warnings...)
+
+	var split *splitTunnel
+	if opts.TunMode {
+		if split, err = parseSplitTunnel(opts.SplitConfig); err != nil {
+			return result, err
+		}
+		// After the custom route rules so that per-application rules come first
+		if content, err = applySplitTunnel(content, split); err != nil {
+			return result, err
+		}
+	}
 
 	// Process inbounds
 	newInbounds := make([]interface{}, 0)
 
-	if enableTun {
+	if opts.TunMode {
 		var tunMap map[string]interface{}
-		if json.Unmarshal([]byte(tunConfig), &tunMap) == nil {
+		if json.Unmarshal([]byte(opts.TunConfig), &tunMap) == nil {
 			// Handle IPv6 support dynamically
 			if addresses, ok := tunMap["address"].([]interface{}); ok {
 				ipv6Addr := "fdfe:dcba:9876::1/126"
 				
-				if ipv6Enabled {
+				if opts.IPv6Enabled {
 					hasIPv6 := false
 					for _, addr := range addresses {
 						if addrStr, ok := addr.(string); ok && addrStr == ipv6Addr {
@@ -320,60 +405,95 @@ func (cm *CoreManager) processConfig(srcPath, dstPath string, enableTun bool, en
 				}
 				tunMap["address"] = addresses
 			}
+			excludeTunAddresses(tunMap, split.ExcludeAddress)
 			newInbounds = append(newInbounds, tunMap)
 		}
 	}
 
-	if enableProxy {
+	if opts.SysProxy {
 		var mixedMap map[string]interface{}
-		if json.Unmarshal([]byte(mixedConfig), &mixedMap) == nil {
+		if json.Unmarshal([]byte(opts.MixedConfig), &mixedMap) == nil {
+			// Other devices connect through the authenticated LAN listener
+			// only; older defaults saved the mixed inbound on 0.0.0.0
+			mixedMap["listen"] = "127.0.0.1"
 			newInbounds = append(newInbounds, mixedMap)
 		}
 	}
 
+	if opts.LAN != nil {
+		newInbounds = append(newInbounds, lanInbound(*opts.LAN))
+	}
+
+	extra, err := managedInbounds(opts.Inbounds, newInbounds)
+	if err != nil {
+		return result, err
+	}
+	newInbounds = append(newInbounds, extra...)
+
 	content, err = sjson.SetBytes(content, "inbounds", newInbounds)
 	if err != nil {
-		return "", err
+		return result, err
 	}
 
 	// Process log configuration
 	logConfig := map[string]interface{}{
-		"level":     logLevel,
+		"level":     opts.LogLevel,
 		"timestamp": true,
 	}
-	if logToFile {
+	if opts.LogToFile {
 		logConfig["output"] = "box.log"
 	}
 
 	content, err = sjson.SetBytes(content, "log", logConfig)
 	if err != nil {
-		return "", err
+		return result, err
 	}
 
-	var prettyJSON bytes.Buffer
-	if err := json.Indent(&prettyJSON, content, "", "  "); err == nil {
-		content = prettyJSON.Bytes()
+	// Migrate before patches, which are written against the installed kernel
+	content, result.Rewrites, warnings, err = migrateConfig(content, cm.GetLocalVersion())
+	if err != nil {
+		return result, err
 	}
+	result.Warnings = append(result.Warnings, warnings...)
 
-	os.MkdirAll(filepath.Dir(dstPath), 0755)
-
-	if err := os.WriteFile(dstPath, content, 0644); err != nil {
-		return "", err
+	content, err = applyPatches(content, opts.Patches)
+	if err != nil {
+		return result, err
 	}
 
-	return apiURL, nil
-}
+	if opts.Resources != nil {
+		var missing []resourceRef
+		content, missing, err = opts.Resources.localizeResources(content)
+		if err != nil {
+			return result, err
+		}
+		for _, ref := range missing {
+			result.Warnings = append(result.Warnings, "not cached yet, the core downloads it: "+ref.URL)
+		}
+	}
 
-// extractAPIURL extracts the Clash API URL from config
-func (cm *CoreManager) extractAPIURL(content []byte) string {
-	externalController := gjson.GetBytes(content, "experimental.clash_api.external_controller").String()
-	if externalController != "" {
-		if externalController[0] == ':' {
-			return "http://127.0.0.1" + externalController
+	if checkPorts {
+		content, warnings, err = resolvePortConflicts(content, opts.StrictPorts)
+		if err != nil {
+			return result, err
 		}
-		return "http://" + externalController
+		result.Warnings = append(result.Warnings, warnings...)
+	}
+
+	// The controller is always WinBox's own, whatever the profile or patches set
+	content, result.API, warnings, err = injectClashAPI(content)
+	if err != nil {
+		return result, err
 	}
-	return "http://127.0.0.1:9090" // default fallback
+	result.Warnings = append(result.Warnings, warnings...)
+
+	var prettyJSON bytes.Buffer
+	if err := json.Indent(&prettyJSON, content, "", "  "); err == nil {
+		content = prettyJSON.Bytes()
+	}
+
+	result.Content = content
+	return result, nil
 }
 
 // monitorProcess monitors the core process and emits events
@@ -420,27 +540,46 @@ func (cm *CoreManager) ClearLogBuffer() {
 	cm.logBuffer.Clear()
 }
 
-// GetAPIURL returns the Clash API URL if available
-func (cm *CoreManager) GetAPIURL() string {
+// GetAPI returns the Clash API of the running config
+func (cm *CoreManager) GetAPI() ClashAPI {
 	cm.mu.RLock()
 	defer cm.mu.RUnlock()
-	return cm.apiURL
+	return cm.api
 }
 
+// GetWarnings returns the warnings from the last config generation
+func (cm *CoreManager) GetWarnings() []string {
+	cm.mu.RLock()
+	defer cm.mu.RUnlock()
+	return cm.warnings
+}
+
+// GetRewrites returns the migrations applied by the last config generation
+func (cm *CoreManager) GetRewrites() []string {
+	cm.mu.RLock()
+	defer cm.mu.RUnlock()
+	return cm.rewrites
+}
+	
 // WaitForReady polls the core to check if it has fully started.
 // It checks the API URL if available, otherwise it falls back to scanning the logs.
 func (cm *CoreManager) WaitForReady(timeout time.Duration) bool {
-	api := cm.GetAPIURL()
+	api := cm.GetAPI()
 	
 	start := time.Now()
 	
-	if api != "" {
+	if api.URL != "" {
 		client := &http.Client{Timeout: 200 * time.Millisecond}
+		req, err := http.NewRequest("GET", api.URL, nil)
+		if err != nil {
+			return false
+		}
+		api.authorize(req.Header)
 		for time.Since(start) < timeout {
 			if !cm.IsRunning() {
 				return false
 			}
-			resp, err := client.Get(api)
+			resp, err := client.Do(req)
 			if err == nil {
 				resp.Body.Close()
 				return true
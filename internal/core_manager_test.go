@@ -0,0 +1,105 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fakeKernelEnv makes the test binary act as sing-box when set to a version
+const fakeKernelEnv = "WINBOX_FAKE_KERNEL"
+
+func TestMain(m *testing.M) {
+	if version := os.Getenv(fakeKernelEnv); version != "" {
+		os.Exit(runFakeKernel(version, os.Args[1:]))
+	}
+	os.Exit(m.Run())
+}
+
+// runFakeKernel implements "version" and "check -c <path>". Configs fail the
+// check if they are not JSON or contain an outbound of type "invalid".
+func runFakeKernel(version string, args []string) int {
+	if len(args) > 0 && args[0] == "version" {
+		fmt.Printf("sing-box version %s\n", version)
+		return 0
+	}
+	if len(args) == 3 && args[0] == "check" && args[1] == "-c" {
+		data, err := os.ReadFile(args[2])
+		if err != nil {
+			fmt.Println(err)
+			return 1
+		}
+		var config struct {
+			Outbounds []struct {
+				Type string `json:"type"`
+			} `json:"outbounds"`
+		}
+		if err := json.Unmarshal(data, &config); err != nil {
+			fmt.Println("decode config:", err)
+			return 1
+		}
+		for _, ob := range config.Outbounds {
+			if ob.Type == "invalid" {
+				fmt.Println("unknown outbound type: invalid")
+				return 1
+			}
+		}
+		return 0
+	}
+	fmt.Println("unsupported arguments:", strings.Join(args, " "))
+	return 1
+}
+
+// installFakeKernel copies the test binary to appDir as sing-box.exe
+func installFakeKernel(t *testing.T, appDir, version string) {
+	t.Helper()
+	t.Setenv(fakeKernelEnv, version)
+
+	self, err := os.Open(os.Args[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer self.Close()
+
+	exe := filepath.Join(appDir, "data", "core", "sing-box.exe")
+	os.MkdirAll(filepath.Dir(exe), 0755)
+	out, err := os.OpenFile(exe, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+	if _, err := io.Copy(out, self); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFakeKernel(t *testing.T) {
+	appDir := t.TempDir()
+	cm := NewCoreManager(appDir, context.Background())
+	if got := cm.GetLocalVersion(); got != "Not Installed" {
+		t.Errorf("GetLocalVersion() = %q before install", got)
+	}
+	if err := cm.CheckConfig("x.json"); err == nil {
+		t.Error("CheckConfig() succeeded without a kernel")
+	}
+
+	installFakeKernel(t, appDir, "1.12.4")
+	if got := cm.GetLocalVersion(); got != "1.12.4" {
+		t.Errorf("GetLocalVersion() = %q, want 1.12.4", got)
+	}
+
+	path := filepath.Join(appDir, "config.json")
+	os.WriteFile(path, []byte(`{"outbounds":[{"type":"direct"}]}`), 0644)
+	if err := cm.CheckConfig(path); err != nil {
+		t.Errorf("CheckConfig() error = %v", err)
+	}
+	os.WriteFile(path, []byte(`{"outbounds":[{"type":"invalid"}]}`), 0644)
+	if err := cm.CheckConfig(path); err == nil {
+		t.Error("CheckConfig() accepted an invalid config")
+	}
+}
@@ -0,0 +1,268 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"slices"
+	"strings"
+
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+// DNS override modes for servers and rules
+const (
+	DNSModeExtend  = "extend"  // Add to the profile's servers and rules
+	DNSModeReplace = "replace" // Use only the override's servers and rules
+)
+
+// Tags of the DNS servers generated by the override
+const (
+	dnsHostsTag  = "hosts-override"
+	dnsFakeIPTag = "fakeip-override"
+)
+
+var dnsStrategies = []string{"", "prefer_ipv4", "prefer_ipv6", "ipv4_only", "ipv6_only"}
+
+// dnsOverride is the content of the "dns" override
+type dnsOverride struct {
+	Mode     string                   `json:"mode"`
+	Servers  []map[string]interface{} `json:"servers"`
+	Rules    []map[string]interface{} `json:"rules"`
+	Strategy string                   `json:"strategy"`
+	FakeIP   bool                     `json:"fakeip"`
+	Hosts    map[string][]string      `json:"hosts"` // Domain -> addresses
+}
+
+// parseDNSOverride parses and validates the content of a "dns" override
+func parseDNSOverride(content string) (*dnsOverride, error) {
+	var o dnsOverride
+	if err := json.Unmarshal([]byte(content), &o); err != nil {
+		return nil, fmt.Errorf("invalid DNS override: %w", err)
+	}
+
+	if o.Mode != "" && o.Mode != DNSModeExtend && o.Mode != DNSModeReplace {
+		return nil, fmt.Errorf("unknown DNS mode %q", o.Mode)
+	}
+	if !slices.Contains(dnsStrategies, o.Strategy) {
+		return nil, fmt.Errorf("unknown DNS strategy %q", o.Strategy)
+	}
+
+	tags := make(map[string]bool)
+	for _, s := range o.Servers {
+		tag, _ := s["tag"].(string)
+		if tag == "" {
+			return nil, fmt.Errorf("DNS server without a tag")
+		}
+		if _, ok := s["type"].(string); !ok {
+			return nil, fmt.Errorf("DNS server %q has no type", tag)
+		}
+		if tags[tag] {
+			return nil, fmt.Errorf("duplicate DNS server %q", tag)
+		}
+		tags[tag] = true
+	}
+	if o.Mode == DNSModeReplace && len(o.Servers) == 0 {
+		return nil, fmt.Errorf("replace mode needs at least one DNS server")
+	}
+
+	for _, r := range o.Rules {
+		if server, ok := r["server"].(string); ok && o.Mode == DNSModeReplace && !tags[server] {
+			return nil, fmt.Errorf("DNS rule uses unknown server %q", server)
+		}
+	}
+
+	for domain, addrs := range o.Hosts {
+		if strings.TrimSpace(domain) == "" || len(addrs) == 0 {
+			return nil, fmt.Errorf("invalid hosts entry %q", domain)
+		}
+		for _, addr := range addrs {
+			if _, err := netip.ParseAddr(addr); err != nil {
+				return nil, fmt.Errorf("invalid address %q for %s", addr, domain)
+			}
+		}
+	}
+	return &o, nil
+}
+
+// applyDNSOverride merges a "dns" override into a config. In extend mode the
+// override's rules take priority over the profile's and its servers replace
+// profile servers with the same tag. Hosts entries are answered before any
+// other rule, and fake IPs are handed out for remaining A and AAAA queries
+// in TUN mode; without the TUN no traffic reaches the fake addresses. In
+// replace mode references to removed profile servers are redirected to the
+// first override server.
+func applyDNSOverride(content []byte, override string, tunMode bool) ([]byte, []string, error) {
+	o, err := parseDNSOverride(override)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var warnings []string
+	servers := o.Servers
+	rules := o.Rules
+	if o.Mode != DNSModeReplace {
+		overridden := make(map[string]bool)
+		for _, s := range o.Servers {
+			overridden[s["tag"].(string)] = true
+		}
+		for i, s := range gjson.GetBytes(content, "dns.servers").Array() {
+			server, ok := s.Value().(map[string]interface{})
+			if !ok {
+				warnings = append(warnings, fmt.Sprintf("profile DNS server %d is not an object, skipped", i))
+				continue
+			}
+			if !overridden[s.Get("tag").String()] {
+				servers = append(servers, server)
+			}
+		}
+		for i, r := range gjson.GetBytes(content, "dns.rules").Array() {
+			rule, ok := r.Value().(map[string]interface{})
+			if !ok {
+				warnings = append(warnings, fmt.Sprintf("profile DNS rule %d is not an object, skipped", i))
+				continue
+			}
+			rules = append(rules, rule)
+		}
+	}
+
+	if len(o.Hosts) > 0 {
+		domains := make([]string, 0, len(o.Hosts))
+		for domain := range o.Hosts {
+			domains = append(domains, domain)
+		}
+		slices.Sort(domains)
+		servers = append(servers, map[string]interface{}{
+			"type":       "hosts",
+			"tag":        dnsHostsTag,
+			"predefined": o.Hosts,
+		})
+		rules = append([]map[string]interface{}{{"domain": domains, "server": dnsHostsTag}}, rules...)
+	}
+
+	if o.FakeIP && !tunMode {
+		warnings = append(warnings, "fake IP needs TUN mode, skipped")
+	} else if o.FakeIP {
+		servers = append(servers, map[string]interface{}{
+			"type":        "fakeip",
+			"tag":         dnsFakeIPTag,
+			"inet4_range": "198.18.0.0/15",
+			"inet6_range": "fc00::/18",
+		})
+		rules = append(rules, map[string]interface{}{
+			"query_type": []string{"A", "AAAA"},
+			"server":     dnsFakeIPTag,
+		})
+	}
+
+	if len(servers) == 0 && len(rules) == 0 && o.Strategy == "" {
+		return content, warnings, nil
+	}
+
+	if len(servers) > 0 {
+		if content, err = sjson.SetBytes(content, "dns.servers", servers); err != nil {
+			return nil, nil, err
+		}
+	}
+	if len(rules) > 0 || o.Mode == DNSModeReplace {
+		if rules == nil {
+			rules = []map[string]interface{}{}
+		}
+		if content, err = sjson.SetBytes(content, "dns.rules", rules); err != nil {
+			return nil, nil, err
+		}
+	}
+	if o.Strategy != "" {
+		if content, err = sjson.SetBytes(content, "dns.strategy", o.Strategy); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if o.Mode == DNSModeReplace {
+		// References to the profile's servers no longer resolve
+		first := o.Servers[0]["tag"].(string)
+		tags := make(map[string]bool)
+		for _, s := range o.Servers {
+			tags[s["tag"].(string)] = true
+		}
+		for _, ref := range dnsServerRefs(content) {
+			if tags[ref.server] {
+				continue
+			}
+			// A DNS server cannot resolve its own address
+			target := first
+			for i := 0; target == ref.self; i++ {
+				if i == len(o.Servers) {
+					target = ""
+					break
+				}
+				target = o.Servers[i]["tag"].(string)
+			}
+			if target == "" {
+				if content, err = sjson.DeleteBytes(content, ref.path); err != nil {
+					return nil, nil, err
+				}
+				warnings = append(warnings, fmt.Sprintf("%s uses DNS server %q, which the override removes; dropped", ref.owner, ref.server))
+				continue
+			}
+			if content, err = sjson.SetBytes(content, ref.path, target); err != nil {
+				return nil, nil, err
+			}
+			if ref.path != "dns.final" {
+				warnings = append(warnings, fmt.Sprintf("%s uses DNS server %q, which the override removes; using %q", ref.owner, ref.server, target))
+			}
+		}
+	}
+
+	return content, warnings, nil
+}
+
+// dnsServerRef is a reference to a DNS server by tag
+type dnsServerRef struct {
+	path   string // Path of the tag in the config
+	server string
+	owner  string // Describes the referencing item for warnings
+	self   string // Tag of the referencing DNS server, if any
+}
+
+// dnsServerRefs returns the references to DNS servers outside the DNS rules:
+// the final server, domain resolvers of the route, outbounds, endpoints and
+// DNS servers, and the server of route resolve actions
+func dnsServerRefs(content []byte) []dnsServerRef {
+	var refs []dnsServerRef
+	add := func(path, owner, self string) {
+		ref := gjson.GetBytes(content, path)
+		if ref.IsObject() {
+			// A resolver may be given as {"server": ...} with extra options
+			path += ".server"
+			ref = ref.Get("server")
+		}
+		if ref.Type == gjson.String {
+			refs = append(refs, dnsServerRef{path: path, server: ref.String(), owner: owner, self: self})
+		}
+	}
+
+	add("dns.final", "dns.final", "")
+	add("route.default_domain_resolver", "the default domain resolver", "")
+	for _, list := range []string{"outbounds", "endpoints"} {
+		gjson.GetBytes(content, list).ForEach(func(i, ob gjson.Result) bool {
+			add(fmt.Sprintf("%s.%d.domain_resolver", list, i.Int()), fmt.Sprintf("outbound %q", ob.Get("tag").String()), "")
+			return true
+		})
+	}
+	gjson.GetBytes(content, "dns.servers").ForEach(func(i, s gjson.Result) bool {
+		tag := s.Get("tag").String()
+		for _, key := range []string{"domain_resolver", "address_resolver"} {
+			add(fmt.Sprintf("dns.servers.%d.%s", i.Int(), key), fmt.Sprintf("DNS server %q", tag), tag)
+		}
+		return true
+	})
+	gjson.GetBytes(content, "route.rules").ForEach(func(i, r gjson.Result) bool {
+		if r.Get("action").String() == "resolve" {
+			add(fmt.Sprintf("route.rules.%d.server", i.Int()), fmt.Sprintf("route rule %d", i.Int()), "")
+		}
+		return true
+	})
+	return refs
+}
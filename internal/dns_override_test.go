@@ -0,0 +1,247 @@
+package internal
+
+import (
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/tidwall/gjson"
+)
+
+const dnsFixture = `{
+  "dns": {
+    "servers": [
+      {"type": "udp", "tag": "local", "server": "223.5.5.5"},
+      {"type": "tls", "tag": "remote", "server": "8.8.8.8", "detour": "Proxy"}
+    ],
+    "rules": [{"rule_set": "geosite-cn", "server": "local"}],
+    "final": "remote"
+  },
+  "route": {"default_domain_resolver": "local"}
+}`
+
+// dnsTags returns the tags of the DNS servers and the server of each DNS rule
+func dnsTags(content []byte) (servers, rules []string) {
+	for _, s := range gjson.GetBytes(content, "dns.servers").Array() {
+		servers = append(servers, s.Get("tag").String())
+	}
+	for _, r := range gjson.GetBytes(content, "dns.rules").Array() {
+		rules = append(rules, r.Get("server").String())
+	}
+	return servers, rules
+}
+
+func TestParseDNSOverride(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		wantErr string
+	}{
+		{"default", DefaultDNSConfig, ""},
+		{"empty", `{}`, ""},
+		{"extend", `{"mode": "extend", "servers": [{"type": "https", "tag": "doh", "server": "1.1.1.1"}], "rules": [{"domain": ["a.com"], "server": "local"}]}`, ""},
+		{"replace", `{"mode": "replace", "servers": [{"type": "https", "tag": "doh"}], "rules": [{"domain": ["a.com"], "server": "doh"}]}`, ""},
+		{"hosts", `{"hosts": {"nas.lan": ["192.168.1.2", "fd00::2"]}}`, ""},
+		{"invalid json", `{`, "invalid DNS override"},
+		{"unknown mode", `{"mode": "merge"}`, "unknown DNS mode"},
+		{"unknown strategy", `{"strategy": "ipv4"}`, "unknown DNS strategy"},
+		{"server without tag", `{"servers": [{"type": "udp"}]}`, "without a tag"},
+		{"server without type", `{"servers": [{"tag": "x"}]}`, "has no type"},
+		{"duplicate server", `{"servers": [{"type": "udp", "tag": "x"}, {"type": "tls", "tag": "x"}]}`, "duplicate"},
+		{"replace without servers", `{"mode": "replace"}`, "at least one"},
+		{"replace with profile server", `{"mode": "replace", "servers": [{"type": "udp", "tag": "x"}], "rules": [{"server": "local"}]}`, "unknown server"},
+		{"hosts without addresses", `{"hosts": {"a.lan": []}}`, "invalid hosts entry"},
+		{"hosts blank domain", `{"hosts": {" ": ["1.1.1.1"]}}`, "invalid hosts entry"},
+		{"hosts bad address", `{"hosts": {"a.lan": ["1.1.1"]}}`, "invalid address"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseDNSOverride(tt.content)
+			if tt.wantErr == "" && err != nil {
+				t.Errorf("parseDNSOverride() error = %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("parseDNSOverride() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestApplyDNSOverrideExtend(t *testing.T) {
+	override := `{
+		"servers": [{"type": "https", "tag": "remote", "server": "1.1.1.1"}, {"type": "quic", "tag": "extra", "server": "9.9.9.9"}],
+		"rules": [{"domain": ["a.example.com"], "server": "extra"}],
+		"strategy": "prefer_ipv4"
+	}`
+	out, warnings, err := applyDNSOverride([]byte(dnsFixture), override, false)
+	if err != nil || len(warnings) != 0 {
+		t.Fatalf("applyDNSOverride() = %v, %v", warnings, err)
+	}
+
+	// Override servers replace profile servers with the same tag, override rules go first
+	servers, rules := dnsTags(out)
+	if !reflect.DeepEqual(servers, []string{"remote", "extra", "local"}) || !reflect.DeepEqual(rules, []string{"extra", "local"}) {
+		t.Errorf("servers = %v, rules = %v", servers, rules)
+	}
+	if got := gjson.GetBytes(out, "dns.servers.0.server").String(); got != "1.1.1.1" {
+		t.Errorf("remote server = %s, want the override's", got)
+	}
+	if gjson.GetBytes(out, "dns.strategy").String() != "prefer_ipv4" || gjson.GetBytes(out, "dns.final").String() != "remote" {
+		t.Errorf("dns = %s", gjson.GetBytes(out, "dns").Raw)
+	}
+
+	// An empty override keeps the profile's DNS as is
+	out, _, err = applyDNSOverride([]byte(dnsFixture), DefaultDNSConfig, true)
+	if err != nil || normalizeJSON(t, string(out)) != normalizeJSON(t, dnsFixture) {
+		t.Errorf("default override changed the config: %s", out)
+	}
+}
+
+func TestApplyDNSOverrideReplace(t *testing.T) {
+	override := `{"mode": "replace", "servers": [{"type": "https", "tag": "doh", "server": "1.1.1.1"}, {"type": "udp", "tag": "plain", "server": "9.9.9.9"}]}`
+	out, _, err := applyDNSOverride([]byte(dnsFixture), override, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	servers, rules := dnsTags(out)
+	if !reflect.DeepEqual(servers, []string{"doh", "plain"}) || len(rules) != 0 || !gjson.GetBytes(out, "dns.rules").IsArray() {
+		t.Errorf("servers = %v, rules = %s", servers, gjson.GetBytes(out, "dns.rules").Raw)
+	}
+	// References to removed profile servers point at the first override server
+	if gjson.GetBytes(out, "dns.final").String() != "doh" || gjson.GetBytes(out, "route.default_domain_resolver").String() != "doh" {
+		t.Errorf("references = %s, %s", gjson.GetBytes(out, "dns.final").Raw, gjson.GetBytes(out, "route.default_domain_resolver").Raw)
+	}
+
+	// Object resolvers keep their options, and valid references are kept
+	content := strings.Replace(dnsFixture, `"default_domain_resolver": "local"`, `"default_domain_resolver": {"server": "local", "strategy": "ipv4_only"}`, 1)
+	content = strings.Replace(content, `"final": "remote"`, `"final": "plain"`, 1)
+	out, _, _ = applyDNSOverride([]byte(content), override, false)
+	resolver := gjson.GetBytes(out, "route.default_domain_resolver")
+	if resolver.Get("server").String() != "doh" || resolver.Get("strategy").String() != "ipv4_only" {
+		t.Errorf("resolver = %s", resolver.Raw)
+	}
+	if gjson.GetBytes(out, "dns.final").String() != "plain" {
+		t.Errorf("final = %s, want plain", gjson.GetBytes(out, "dns.final").Raw)
+	}
+}
+
+func TestApplyDNSOverrideReplaceResolvers(t *testing.T) {
+	content := `{
+		"dns": {
+			"servers": [
+				{"type": "udp", "tag": "local", "server": "223.5.5.5"},
+				{"type": "https", "tag": "remote", "server": "dns.example.com", "domain_resolver": "local"}
+			]
+		},
+		"outbounds": [
+			{"type": "trojan", "tag": "HK", "server": "hk.example.com", "server_port": 443, "password": "p", "domain_resolver": "local"},
+			{"type": "trojan", "tag": "JP", "server": "jp.example.com", "server_port": 443, "password": "p", "domain_resolver": {"server": "remote", "strategy": "ipv4_only"}},
+			{"type": "trojan", "tag": "US", "server": "us.example.com", "server_port": 443, "password": "p", "domain_resolver": "plain"}
+		],
+		"route": {"rules": [{"action": "resolve", "server": "local"}, {"action": "resolve"}]}
+	}`
+	override := `{"mode": "replace", "servers": [{"type": "https", "tag": "doh", "server": "dns.example.org", "domain_resolver": "local"}, {"type": "udp", "tag": "plain", "server": "9.9.9.9"}]}`
+	out, warnings, err := applyDNSOverride([]byte(content), override, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkConfig(t, out)
+
+	for path, want := range map[string]string{
+		"outbounds.0.domain_resolver":          "doh",
+		"outbounds.1.domain_resolver.server":   "doh",
+		"outbounds.1.domain_resolver.strategy": "ipv4_only",
+		"outbounds.2.domain_resolver":          "plain",
+		"dns.servers.0.domain_resolver":        "plain",
+		"route.rules.0.server":                 "doh",
+	} {
+		if got := gjson.GetBytes(out, path).String(); got != want {
+			t.Errorf("%s = %q, want %q", path, got, want)
+		}
+	}
+	if gjson.GetBytes(out, "route.rules.1.server").Exists() {
+		t.Error("server added to a resolve action without one")
+	}
+	if len(warnings) != 4 || !strings.Contains(warnings[0], `outbound "HK" uses DNS server "local"`) {
+		t.Errorf("warnings = %q", warnings)
+	}
+
+	// A lone override server cannot resolve itself, so its resolver is dropped
+	override = `{"mode": "replace", "servers": [{"type": "https", "tag": "doh", "server": "dns.example.org", "address_resolver": "local"}]}`
+	out, _, err = applyDNSOverride([]byte(content), override, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gjson.GetBytes(out, "dns.servers.0.address_resolver").Exists() {
+		t.Errorf("self-referencing resolver kept: %s", gjson.GetBytes(out, "dns.servers.0").Raw)
+	}
+}
+
+func TestApplyDNSOverrideHosts(t *testing.T) {
+	override := `{"hosts": {"nas.lan": ["192.168.1.2"], "b.lan": ["10.0.0.2", "fd00::2"]}}`
+	out, _, err := applyDNSOverride([]byte(dnsFixture), override, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	servers, rules := dnsTags(out)
+	if !reflect.DeepEqual(servers, []string{"local", "remote", dnsHostsTag}) || !reflect.DeepEqual(rules, []string{dnsHostsTag, "local"}) {
+		t.Errorf("servers = %v, rules = %v", servers, rules)
+	}
+	hosts := gjson.GetBytes(out, "dns.servers.2")
+	if hosts.Get("type").String() != "hosts" || hosts.Get("predefined.b\\.lan.1").String() != "fd00::2" {
+		t.Errorf("hosts server = %s", hosts.Raw)
+	}
+	// Domains are sorted for a stable config
+	if got := gjson.GetBytes(out, "dns.rules.0.domain").Raw; got != `["b.lan","nas.lan"]` {
+		t.Errorf("hosts rule domains = %s", got)
+	}
+}
+
+func TestApplyDNSOverrideFakeIP(t *testing.T) {
+	override := `{"fakeip": true, "rules": [{"domain": ["a.example.com"], "server": "local"}]}`
+
+	out, warnings, err := applyDNSOverride([]byte(dnsFixture), override, true)
+	if err != nil || len(warnings) != 0 {
+		t.Fatalf("applyDNSOverride() = %v, %v", warnings, err)
+	}
+	servers, rules := dnsTags(out)
+	// The fake IP rule comes last so that it only takes the remaining queries
+	if !reflect.DeepEqual(servers, []string{"local", "remote", dnsFakeIPTag}) || !reflect.DeepEqual(rules, []string{"local", "local", dnsFakeIPTag}) {
+		t.Errorf("servers = %v, rules = %v", servers, rules)
+	}
+	if got := gjson.GetBytes(out, "dns.rules.2.query_type").Raw; got != `["A","AAAA"]` {
+		t.Errorf("fake IP query types = %s", got)
+	}
+
+	// Without the TUN it is skipped with a warning
+	out, warnings, err = applyDNSOverride([]byte(dnsFixture), override, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(warnings) != 1 || !strings.Contains(warnings[0], "TUN") {
+		t.Errorf("warnings = %v", warnings)
+	}
+	if servers, _ := dnsTags(out); slices.Contains(servers, dnsFakeIPTag) {
+		t.Error("fake IP server added outside TUN mode")
+	}
+}
+
+func TestApplyDNSOverrideMalformedProfile(t *testing.T) {
+	content := `{"dns": {"servers": ["8.8.8.8", {"type": "udp", "tag": "local"}], "rules": [{"server": "local"}, "bad"]}}`
+	out, warnings, err := applyDNSOverride([]byte(content), `{"servers": [{"type": "tls", "tag": "x"}]}`, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(warnings) != 2 || !strings.Contains(warnings[0], "server 0") || !strings.Contains(warnings[1], "rule 1") {
+		t.Errorf("warnings = %v", warnings)
+	}
+	servers, rules := dnsTags(out)
+	if !reflect.DeepEqual(servers, []string{"x", "local"}) || !reflect.DeepEqual(rules, []string{"local"}) {
+		t.Errorf("servers = %v, rules = %v", servers, rules)
+	}
+
+	if _, _, err := applyDNSOverride([]byte(content), `{"mode": "bad"}`, false); err == nil {
+		t.Error("applyDNSOverride() accepted an invalid override")
+	}
+}
@@ -0,0 +1,374 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/oschwald/maxminddb-golang"
+	"github.com/tidwall/gjson"
+	wailsRuntime "github.com/wailsapp/wails/v2/pkg/runtime"
+)
+
+// geoIPRepo publishes GeoLite2 databases as GitHub release assets
+const geoIPRepo = "https://api.github.com/repos/P3TERX/GeoLite.mmdb"
+
+// GeoIP database files in data/geoip
+const (
+	geoCountryDB = "GeoLite2-Country.mmdb"
+	geoASNDB     = "GeoLite2-ASN.mmdb"
+)
+
+// maxConcurrentLookups bounds the DNS lookups made while locating nodes
+const maxConcurrentLookups = 8
+
+// geoIPDir returns the directory holding the GeoIP databases
+func geoIPDir(appDir string) string {
+	return filepath.Join(appDir, "data", "geoip")
+}
+
+// UpdateGeoIP downloads the GeoIP country and ASN databases
+func (a *App) UpdateGeoIP(mirrorUrl string) string {
+	dir := geoIPDir(a.getAppDir())
+	os.MkdirAll(dir, 0755)
+
+	wailsRuntime.EventsEmit(a.ctx, "log", "Fetching GeoIP release info...")
+
+	res, err := a.httpClient.GetLatestRelease(geoIPRepo, false)
+	if err != nil {
+		return "Error: " + err.Error()
+	}
+
+	if mirrorUrl != "" && !strings.HasSuffix(mirrorUrl, "/") {
+		mirrorUrl += "/"
+	}
+
+	for _, name := range []string{geoCountryDB, geoASNDB} {
+		var downloadUrl string
+		for _, asset := range res.Assets {
+			if asset.Name == name {
+				downloadUrl = asset.BrowserDownloadUrl
+				break
+			}
+		}
+		if downloadUrl == "" {
+			return "Error: No matching asset found"
+		}
+
+		wailsRuntime.EventsEmit(a.ctx, "log", "Downloading "+name+"...")
+		wailsRuntime.EventsEmit(a.ctx, "download-progress", 0)
+
+		if err := a.httpClient.DownloadVerified(mirrorUrl+downloadUrl, filepath.Join(dir, name), a.ctx, verifyGeoIPDatabase); err != nil {
+			return "Error: " + name + ": " + err.Error()
+		}
+	}
+
+	wailsRuntime.EventsEmit(a.ctx, "log", "GeoIP Update Complete")
+	return "Success"
+}
+
+// verifyGeoIPDatabase checks that a downloaded file is a readable database
+func verifyGeoIPDatabase(path string) error {
+	reader, err := maxminddb.Open(path)
+	if err != nil {
+		return fmt.Errorf("invalid database: %w", err)
+	}
+	return reader.Close()
+}
+
+// GetGeoIPStatus reports whether the GeoIP databases are installed and when they were downloaded
+func (a *App) GetGeoIPStatus() map[string]interface{} {
+	info, err := os.Stat(filepath.Join(geoIPDir(a.getAppDir()), geoCountryDB))
+	if err != nil {
+		return map[string]interface{}{"installed": false}
+	}
+	return map[string]interface{}{
+		"installed": true,
+		"updated":   info.ModTime(),
+	}
+}
+
+// geoDir returns the directory holding the node locations of each profile
+func (pm *ProfileManager) geoDir() string {
+	return filepath.Join(pm.appDir, "data", "profiles", "geo")
+}
+
+// LocateNodes looks up the country and ASN of every node of a profile in the
+// local GeoIP databases and stores the result as the profile's node metadata
+func (pm *ProfileManager) LocateNodes(id string, regions []RegionRule) ([]NodeGeo, error) {
+	if _, err := pm.findProfile(id); err != nil {
+		return nil, err
+	}
+
+	content, err := os.ReadFile(pm.profilePath(id))
+	if err != nil {
+		return nil, fmt.Errorf("read profile failed: %w", err)
+	}
+
+	nodes, err := locateNodes(content, geoIPDir(pm.appDir), regions, resolveServer)
+	if err != nil {
+		return nil, err
+	}
+	pm.rememberResolved(nodes)
+
+	data, err := json.MarshalIndent(nodes, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := atomicWrite(filepath.Join(pm.geoDir(), id+".json"), data); err != nil {
+		return nil, fmt.Errorf("save node locations failed: %w", err)
+	}
+	return nodes, nil
+}
+
+// GetNodeLocations returns the node metadata stored by the last LocateNodes call
+func (pm *ProfileManager) GetNodeLocations(id string) ([]NodeGeo, error) {
+	data, err := os.ReadFile(filepath.Join(pm.geoDir(), id+".json"))
+	if os.IsNotExist(err) {
+		return []NodeGeo{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var nodes []NodeGeo
+	if err := json.Unmarshal(data, &nodes); err != nil {
+		return nil, err
+	}
+	return nodes, nil
+}
+
+// geoReader looks up addresses in the country and ASN databases
+type geoReader struct {
+	country *maxminddb.Reader
+	asn     *maxminddb.Reader
+}
+
+// openGeoReader opens the GeoIP databases in dir. The ASN database is optional.
+func openGeoReader(dir string) (*geoReader, error) {
+	country, err := maxminddb.Open(filepath.Join(dir, geoCountryDB))
+	if err != nil {
+		return nil, fmt.Errorf("GeoIP database not installed")
+	}
+	r := &geoReader{country: country}
+	if asn, err := maxminddb.Open(filepath.Join(dir, geoASNDB)); err == nil {
+		r.asn = asn
+	}
+	return r, nil
+}
+
+func (r *geoReader) Close() {
+	r.country.Close()
+	if r.asn != nil {
+		r.asn.Close()
+	}
+}
+
+// lookup fills the country and ASN of n from its IP
+func (r *geoReader) lookup(n *NodeGeo) {
+	ip := net.ParseIP(n.IP)
+	if ip == nil {
+		return
+	}
+
+	var country struct {
+		Country struct {
+			ISOCode string `maxminddb:"iso_code"`
+		} `maxminddb:"country"`
+	}
+	if r.country.Lookup(ip, &country) == nil {
+		n.Country = country.Country.ISOCode
+	}
+
+	if r.asn != nil {
+		var asn struct {
+			Number uint   `maxminddb:"autonomous_system_number"`
+			Org    string `maxminddb:"autonomous_system_organization"`
+		}
+		if r.asn.Lookup(ip, &asn) == nil {
+			n.ASN = asn.Number
+			n.Org = asn.Org
+		}
+	}
+}
+
+// locateNodes resolves the server of every node in a config and looks it up
+// in the GeoIP databases in dir. The region a tag claims is detected from its
+// flag emoji or the region table. resolve maps a server to its address.
+func locateNodes(content []byte, dir string, regions []RegionRule, resolve func(server string) string) ([]NodeGeo, error) {
+	reader, err := openGeoReader(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	var nodes []NodeGeo
+	gjson.GetBytes(content, "outbounds").ForEach(func(_, ob gjson.Result) bool {
+		server := ob.Get("server").String()
+		if server != "" && !slices.Contains(nonNodeTypes, ob.Get("type").String()) {
+			nodes = append(nodes, NodeGeo{Tag: ob.Get("tag").String(), Server: server})
+		}
+		return true
+	})
+
+	sem := make(chan struct{}, maxConcurrentLookups)
+	var wg sync.WaitGroup
+	for i := range nodes {
+		wg.Add(1)
+		go func(n *NodeGeo) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			n.IP = resolve(n.Server)
+			reader.lookup(n)
+			n.Claimed = claimedRegion(n.Tag, regions)
+			n.Mismatch = n.Claimed != "" && n.Country != "" && n.Claimed != n.Country
+		}(&nodes[i])
+	}
+	wg.Wait()
+
+	if nodes == nil {
+		nodes = []NodeGeo{}
+	}
+	return nodes, nil
+}
+
+// resolveServer returns the first address of a server, or "" if it cannot be resolved
+func resolveServer(server string) string {
+	if ip := net.ParseIP(server); ip != nil {
+		return ip.String()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, server)
+	if err != nil || len(addrs) == 0 {
+		return ""
+	}
+	// Prefer IPv4, which the GeoLite databases cover best
+	for _, addr := range addrs {
+		if addr.IP.To4() != nil {
+			return addr.IP.String()
+		}
+	}
+	return addrs[0].IP.String()
+}
+
+// claimedRegion returns the country code a tag claims by flag emoji or region
+// keyword. Regions without a country code claim nothing.
+func claimedRegion(tag string, regions []RegionRule) string {
+	if code := flagCountry(tag); code != "" {
+		return code
+	}
+	for i := range regions {
+		if code := regions[i].country(); code != "" && regions[i].matches(tag) {
+			return code
+		}
+	}
+	return ""
+}
+
+// flagCountry returns the country code of the first flag emoji in s
+func flagCountry(s string) string {
+	runes := []rune(s)
+	for i := 0; i+1 < len(runes); i++ {
+		if isRegionalIndicator(runes[i]) && isRegionalIndicator(runes[i+1]) {
+			return string([]rune{runes[i] - 0x1F1E6 + 'A', runes[i+1] - 0x1F1E6 + 'A'})
+		}
+	}
+	return ""
+}
+
+// countryFlag returns the flag emoji of a country code
+func countryFlag(code string) string {
+	if len(code) != 2 {
+		return ""
+	}
+	code = strings.ToUpper(code)
+	return string([]rune{rune(code[0]-'A') + 0x1F1E6, rune(code[1]-'A') + 0x1F1E6})
+}
+
+func isRegionalIndicator(r rune) bool {
+	return r >= 0x1F1E6 && r <= 0x1F1FF
+}
+
+// rememberResolved stores the addresses of located nodes for later relabeling
+func (pm *ProfileManager) rememberResolved(nodes []NodeGeo) {
+	pm.resolvedMu.Lock()
+	defer pm.resolvedMu.Unlock()
+	for _, n := range nodes {
+		if n.IP != "" {
+			pm.resolved[n.Server] = n.IP
+		}
+	}
+}
+
+// resolveCached resolves a server once and returns the same address on later
+// calls, so that DNS round robin or GeoDNS cannot flip a node's flag, and with
+// it the profile's content hash, between updates
+func (pm *ProfileManager) resolveCached(server string) string {
+	pm.resolvedMu.Lock()
+	ip, ok := pm.resolved[server]
+	pm.resolvedMu.Unlock()
+	if ok {
+		return ip
+	}
+
+	ip = resolveServer(server)
+	if ip == "" {
+		return ""
+	}
+	pm.resolvedMu.Lock()
+	defer pm.resolvedMu.Unlock()
+	if cached, ok := pm.resolved[server]; ok {
+		return cached
+	}
+	pm.resolved[server] = ip
+	return ip
+}
+
+// geoRelabeler returns a function that corrects the flag of node tags to the
+// country the node actually resolves to. A wrong flag is replaced; tags
+// without a flag get one prefixed. Nodes that cannot be located keep their
+// tag. Servers resolve to the address stored by the profile's last
+// LocateNodes, or to the first address seen since startup.
+func (pm *ProfileManager) geoRelabeler(id string, content []byte) (func(tag string) string, error) {
+	if stored, err := pm.GetNodeLocations(id); err == nil {
+		pm.resolvedMu.Lock()
+		for _, n := range stored {
+			if _, ok := pm.resolved[n.Server]; !ok && n.IP != "" {
+				pm.resolved[n.Server] = n.IP
+			}
+		}
+		pm.resolvedMu.Unlock()
+	}
+
+	nodes, err := locateNodes(content, geoIPDir(pm.appDir), nil, pm.resolveCached)
+	if err != nil {
+		return nil, err
+	}
+
+	countries := make(map[string]string, len(nodes))
+	for _, n := range nodes {
+		countries[n.Tag] = n.Country
+	}
+
+	return func(tag string) string {
+		flag := countryFlag(countries[tag])
+		if flag == "" {
+			return tag
+		}
+		if claimed := flagCountry(tag); claimed != "" {
+			return strings.Replace(tag, countryFlag(claimed), flag, 1)
+		}
+		return flag + " " + tag
+	}, nil
+}
@@ -0,0 +1,89 @@
+package internal
+
+import "testing"
+
+func TestFlagCountry(t *testing.T) {
+	tests := []struct {
+		tag  string
+		want string
+	}{
+		{"🇭🇰 Hong Kong 01", "HK"},
+		{"Node 🇯🇵", "JP"},
+		{"🇺🇸🇬🇧 multi", "US"},
+		{"HK 01", ""},
+		{"🇭", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := flagCountry(tt.tag); got != tt.want {
+			t.Errorf("flagCountry(%q) = %q, want %q", tt.tag, got, tt.want)
+		}
+	}
+
+	for _, code := range []string{"HK", "jp", "US"} {
+		if got := flagCountry(countryFlag(code)); got != map[string]string{"HK": "HK", "jp": "JP", "US": "US"}[code] {
+			t.Errorf("countryFlag(%q) round trip = %q", code, got)
+		}
+	}
+	if countryFlag("") != "" || countryFlag("USA") != "" {
+		t.Error("countryFlag() accepted an invalid code")
+	}
+}
+
+func TestClaimedRegion(t *testing.T) {
+	regions := DefaultRegions()
+	tests := []struct {
+		tag  string
+		want string
+	}{
+		{"🇸🇬 Hong Kong", "SG"}, // The flag wins over keywords
+		{"Hong Kong 01", "HK"},
+		{"東京", ""},
+		{"Tokyo 01", "JP"},
+		{"Node", ""},
+	}
+	for _, tt := range tests {
+		if got := claimedRegion(tt.tag, regions); got != tt.want {
+			t.Errorf("claimedRegion(%q) = %q, want %q", tt.tag, got, tt.want)
+		}
+	}
+
+	// User regions claim their country code or flag, never their name
+	custom := []RegionRule{
+		{Name: "UK", Keywords: []string{"London"}, Country: "gb"},
+		{Name: "Hong Kong", Flag: "🇭🇰", Keywords: []string{"HKG"}},
+		{Name: "Asia", Keywords: []string{"Asia"}},
+	}
+	for tag, want := range map[string]string{"London 01": "GB", "HKG 02": "HK", "Asia 03": ""} {
+		if got := claimedRegion(tag, custom); got != want {
+			t.Errorf("claimedRegion(%q) with user regions = %q, want %q", tag, got, want)
+		}
+	}
+}
+
+func TestResolveCached(t *testing.T) {
+	pm := &ProfileManager{resolved: map[string]string{}}
+
+	if got := pm.resolveCached("203.0.113.7"); got != "203.0.113.7" {
+		t.Errorf("resolveCached() of an IP = %q", got)
+	}
+	if got := pm.resolveCached("2001:db8::0:1"); got != "2001:db8::1" {
+		t.Errorf("resolveCached() of an IPv6 address = %q", got)
+	}
+
+	// A remembered address is reused instead of resolving again
+	pm.rememberResolved([]NodeGeo{{Server: "node.invalid", IP: "198.51.100.1"}, {Server: "gone.invalid"}})
+	for i := 0; i < 2; i++ {
+		if got := pm.resolveCached("node.invalid"); got != "198.51.100.1" {
+			t.Errorf("resolveCached() = %q, want the remembered address", got)
+		}
+	}
+
+	// Failed resolutions are not cached, so a later attempt can succeed
+	if got := pm.resolveCached("gone.invalid"); got != "" {
+		t.Errorf("resolveCached() of an unresolvable server = %q", got)
+	}
+	if _, ok := pm.resolved["gone.invalid"]; ok {
+		t.Error("failed resolution was cached")
+	}
+}
@@ -2,11 +2,16 @@ package internal
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 	"os"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -15,6 +20,15 @@ type HTTPClient struct {
 	client     *http.Client
 	maxRetries int
 	retryDelay time.Duration
+
+	tlsMu      sync.Mutex
+	tlsClients map[tlsClientKey]*http.Client // Clients for custom TLS settings, reused across requests
+}
+
+// tlsClientKey identifies the TLS settings of a cached client
+type tlsClientKey struct {
+	caCert   string
+	insecure bool
 }
 
 // NewHTTPClient creates a new HTTP client with timeout settings
@@ -30,13 +44,23 @@ func NewHTTPClient() *HTTPClient {
 		},
 		maxRetries: 3,
 		retryDelay: 2 * time.Second,
+		tlsClients: make(map[tlsClientKey]*http.Client),
 	}
 }
 
 // Get performs HTTP GET with retry logic
 func (hc *HTTPClient) Get(url string) (*http.Response, error) {
+	return hc.GetWithOptions(url, nil)
+}
+
+// GetWithOptions performs HTTP GET with retry logic, applying per-profile fetch options
+func (hc *HTTPClient) GetWithOptions(url string, opts *FetchOptions) (*http.Response, error) {
+	client, err := hc.clientFor(opts)
+	if err != nil {
+		return nil, err
+	}
+
 	var resp *http.Response
-	var err error
 
 	for i := 0; i < hc.maxRetries; i++ {
 		req, reqErr := http.NewRequest("GET", url, nil)
@@ -44,7 +68,10 @@ func (hc *HTTPClient) Get(url string) (*http.Response, error) {
 			return nil, reqErr
 		}
 		req.Header.Set("User-Agent", "sing-box")
-		resp, err = hc.client.Do(req)
+		if opts != nil {
+			opts.applyTo(req)
+		}
+		resp, err = client.Do(req)
 		if err == nil && resp.StatusCode < 500 {
 			return resp, nil
 		}
@@ -61,6 +88,90 @@ func (hc *HTTPClient) Get(url string) (*http.Response, error) {
 	return nil, fmt.Errorf("failed after %d retries: %w", hc.maxRetries, err)
 }
 
+// clientFor returns the shared client, or a cached one when opts need custom
+// TLS settings. Cached clients share the base transport's settings.
+func (hc *HTTPClient) clientFor(opts *FetchOptions) (*http.Client, error) {
+	if opts == nil || (opts.CACert == "" && !opts.Insecure) {
+		return hc.client, nil
+	}
+
+	key := tlsClientKey{caCert: opts.CACert, insecure: opts.Insecure}
+	hc.tlsMu.Lock()
+	defer hc.tlsMu.Unlock()
+	if client, ok := hc.tlsClients[key]; ok {
+		return client, nil
+	}
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: opts.Insecure}
+	if opts.CACert != "" {
+		pool, err := opts.certPool()
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	transport := hc.client.Transport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	client := &http.Client{Timeout: hc.client.Timeout, Transport: transport}
+	hc.tlsClients[key] = client
+	return client, nil
+}
+
+// Validate checks that the fetch options are usable
+func (o *FetchOptions) Validate() error {
+	for name := range o.Headers {
+		if name == "" || strings.ContainsAny(name, " :\r\n") {
+			return fmt.Errorf("invalid header name %q", name)
+		}
+	}
+	for _, u := range o.FallbackURLs {
+		if parsed, err := url.Parse(u); err != nil || parsed.Scheme == "" || parsed.Host == "" {
+			return fmt.Errorf("invalid fallback url %q", u)
+		}
+	}
+	if o.CACert != "" {
+		if _, err := o.certPool(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applyTo sets the user agent, extra headers and basic auth on a request
+func (o *FetchOptions) applyTo(req *http.Request) {
+	if o.UserAgent != "" {
+		req.Header.Set("User-Agent", o.UserAgent)
+	}
+	for name, value := range o.Headers {
+		req.Header.Set(name, value)
+	}
+	if o.Username != "" {
+		req.SetBasicAuth(o.Username, o.Password)
+	}
+}
+
+// certPool builds a pool from the system roots plus CACert, given as PEM or a file path
+func (o *FetchOptions) certPool() (*x509.CertPool, error) {
+	pem := []byte(o.CACert)
+	if !strings.Contains(o.CACert, "-----BEGIN") {
+		data, err := os.ReadFile(o.CACert)
+		if err != nil {
+			return nil, fmt.Errorf("read ca cert failed: %w", err)
+		}
+		pem = data
+	}
+
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no valid certificate in ca cert")
+	}
+	return pool, nil
+}
+
 // Download downloads a file with progress tracking
 func (hc *HTTPClient) Download(url, dest string, ctx context.Context) error {
 	resp, err := hc.Get(url)
@@ -90,6 +201,24 @@ func (hc *HTTPClient) Download(url, dest string, ctx context.Context) error {
 	return err
 }
 
+// DownloadVerified downloads a file next to dest and replaces dest with it
+// once verify, if not nil, accepts the download. dest is left untouched when
+// the download or the verification fails.
+func (hc *HTTPClient) DownloadVerified(url, dest string, ctx context.Context, verify func(path string) error) error {
+	tmpFile := dest + ".tmp"
+	defer os.Remove(tmpFile)
+
+	if err := hc.Download(url, tmpFile, ctx); err != nil {
+		return err
+	}
+	if verify != nil {
+		if err := verify(tmpFile); err != nil {
+			return err
+		}
+	}
+	return os.Rename(tmpFile, dest)
+}
+
 // GetLatestRelease fetches the latest release info from a github repo
 func (hc *HTTPClient) GetLatestRelease(repoURL string, allowPreRelease bool) (*ReleaseInfo, error) {
 	apiURL := repoURL + "/releases/latest"
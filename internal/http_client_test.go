@@ -0,0 +1,210 @@
+package internal
+
+import (
+	"context"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// serverCAPEM returns the certificate of a TLS test server as PEM
+func serverCAPEM(server *httptest.Server) string {
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}))
+}
+
+func TestFetchOptionsValidate(t *testing.T) {
+	server := httptest.NewTLSServer(http.NotFoundHandler())
+	defer server.Close()
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	os.WriteFile(caFile, []byte(serverCAPEM(server)), 0644)
+
+	tests := []struct {
+		name    string
+		opts    FetchOptions
+		wantErr bool
+	}{
+		{"empty", FetchOptions{}, false},
+		{"headers", FetchOptions{Headers: map[string]string{"X-Token": "abc", "Accept": "*/*"}}, false},
+		{"empty header name", FetchOptions{Headers: map[string]string{"": "x"}}, true},
+		{"header name with colon", FetchOptions{Headers: map[string]string{"X-A:": "x"}}, true},
+		{"header name with space", FetchOptions{Headers: map[string]string{"X A": "x"}}, true},
+		{"header name with newline", FetchOptions{Headers: map[string]string{"X\r\nA": "x"}}, true},
+		{"fallback urls", FetchOptions{FallbackURLs: []string{"https://a.example.com/sub", "http://1.2.3.4:8080/x"}}, false},
+		{"fallback without scheme", FetchOptions{FallbackURLs: []string{"a.example.com/sub"}}, true},
+		{"fallback without host", FetchOptions{FallbackURLs: []string{"https:///sub"}}, true},
+		{"bad fallback", FetchOptions{FallbackURLs: []string{"https://ok.example.com", "://"}}, true},
+		{"inline ca", FetchOptions{CACert: serverCAPEM(server)}, false},
+		{"ca file", FetchOptions{CACert: caFile}, false},
+		{"missing ca file", FetchOptions{CACert: filepath.Join(t.TempDir(), "missing.pem")}, true},
+		{"bad inline ca", FetchOptions{CACert: "-----BEGIN CERTIFICATE-----\nnot base64\n-----END CERTIFICATE-----"}, true},
+		{"insecure", FetchOptions{Insecure: true}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.opts.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestClientForReusesTLSClients(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "ok")
+	}))
+	defer server.Close()
+
+	hc := NewHTTPClient()
+	base := hc.client.Transport.(*http.Transport)
+
+	if c, _ := hc.clientFor(nil); c != hc.client {
+		t.Error("clientFor(nil) did not return the shared client")
+	}
+	if c, _ := hc.clientFor(&FetchOptions{UserAgent: "x"}); c != hc.client {
+		t.Error("options without TLS settings did not use the shared client")
+	}
+
+	ca := &FetchOptions{CACert: serverCAPEM(server)}
+	first, err := hc.clientFor(ca)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, _ := hc.clientFor(&FetchOptions{CACert: ca.CACert, UserAgent: "other"})
+	if first != second {
+		t.Error("same CA got a new client")
+	}
+	insecure, _ := hc.clientFor(&FetchOptions{Insecure: true})
+	both, _ := hc.clientFor(&FetchOptions{CACert: ca.CACert, Insecure: true})
+	if insecure == first || both == first || both == insecure {
+		t.Error("different TLS settings share a client")
+	}
+
+	transport := first.Transport.(*http.Transport)
+	if transport.MaxIdleConns != base.MaxIdleConns || transport.IdleConnTimeout != base.IdleConnTimeout || first.Timeout != hc.client.Timeout {
+		t.Error("TLS client does not keep the base transport settings")
+	}
+
+	// The CA is trusted by the cached client, but not by the shared one
+	resp, err := hc.GetWithOptions(server.URL, ca)
+	if err != nil {
+		t.Fatalf("GetWithOptions() with CA error = %v", err)
+	}
+	resp.Body.Close()
+	hc.maxRetries = 1
+	if _, err := hc.Get(server.URL); err == nil {
+		t.Error("shared client trusted the test CA")
+	}
+
+	if _, err := hc.clientFor(&FetchOptions{CACert: "-----BEGIN garbage"}); err == nil {
+		t.Error("clientFor() accepted a bad CA")
+	}
+}
+
+func TestDownloadFallbackOrder(t *testing.T) {
+	var mu sync.Mutex
+	var hits []string
+	serve := func(name string, status int) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			hits = append(hits, name)
+			mu.Unlock()
+			w.WriteHeader(status)
+			if status == http.StatusOK {
+				w.Write(nodeConfig(name))
+			}
+		}))
+	}
+
+	broken := serve("broken", http.StatusBadGateway)
+	missing := serve("missing", http.StatusNotFound)
+	mirror := serve("mirror", http.StatusOK)
+	unused := serve("unused", http.StatusOK)
+	for _, s := range []*httptest.Server{broken, missing, mirror, unused} {
+		defer s.Close()
+	}
+
+	pm := newTestProfileManager(t, Profile{ID: "p", Type: ProfileTypeRemote})
+	pm.httpClient.retryDelay = 0
+
+	opts := &FetchOptions{FallbackURLs: []string{missing.URL, mirror.URL, unused.URL}}
+	result, err := pm.download("p", broken.URL, opts, nil)
+	if err != nil {
+		t.Fatalf("download() error = %v", err)
+	}
+	if !result.Changed {
+		t.Error("download() did not install the mirror's config")
+	}
+
+	// Server errors are retried before moving on, other failures are not
+	want := []string{"broken", "broken", "broken", "missing", "mirror"}
+	if !reflect.DeepEqual(hits, want) {
+		t.Errorf("requests = %v, want %v", hits, want)
+	}
+	live, _ := os.ReadFile(pm.profilePath("p"))
+	if !strings.Contains(string(live), `"tag":"mirror"`) {
+		t.Errorf("installed config = %s", live)
+	}
+
+	hits = nil
+	if _, err := pm.download("p", broken.URL, &FetchOptions{FallbackURLs: []string{missing.URL}}, nil); err == nil {
+		t.Error("download() succeeded with every URL failing")
+	}
+	if want := []string{"broken", "broken", "broken", "missing"}; !reflect.DeepEqual(hits, want) {
+		t.Errorf("requests = %v, want %v", hits, want)
+	}
+}
+
+func TestDownloadVerified(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			http.NotFound(w, r)
+			return
+		}
+		w.(http.Flusher).Flush() // No content length, so no progress events are emitted
+		fmt.Fprint(w, "new")
+	}))
+	defer server.Close()
+
+	hc := NewHTTPClient()
+	hc.maxRetries = 1
+	dest := filepath.Join(t.TempDir(), "db.mmdb")
+	os.WriteFile(dest, []byte("old"), 0644)
+	content := func() string {
+		data, _ := os.ReadFile(dest)
+		return string(data)
+	}
+
+	reject := func(string) error { return fmt.Errorf("invalid database") }
+	if err := hc.DownloadVerified(server.URL, dest, context.Background(), reject); err == nil {
+		t.Error("DownloadVerified() ignored the failed verification")
+	}
+	if err := hc.DownloadVerified(server.URL+"/missing", dest, context.Background(), nil); err == nil {
+		t.Error("DownloadVerified() accepted a 404")
+	}
+	if content() != "old" {
+		t.Errorf("failed downloads replaced the file with %q", content())
+	}
+
+	var verified string
+	accept := func(path string) error {
+		data, _ := os.ReadFile(path)
+		verified = string(data)
+		return nil
+	}
+	if err := hc.DownloadVerified(server.URL, dest, context.Background(), accept); err != nil {
+		t.Fatalf("DownloadVerified() error = %v", err)
+	}
+	if verified != "new" || content() != "new" {
+		t.Errorf("verified %q, installed %q", verified, content())
+	}
+	if _, err := os.Stat(dest + ".tmp"); !os.IsNotExist(err) {
+		t.Error("temporary file left behind")
+	}
+}
@@ -0,0 +1,74 @@
+package internal
+
+import (
+	"net"
+
+	"github.com/tidwall/gjson"
+)
+
+// lanInboundTag is the tag of the authenticated listener added when LAN sharing is on
+const lanInboundTag = "lan-in"
+
+// lanUsername is the user name of generated LAN credentials
+const lanUsername = "winbox"
+
+// lanInbound returns the listener other devices on the LAN connect to. It is
+// separate from the mixed inbound because the Windows system proxy cannot
+// send credentials: the mixed inbound stays on localhost without users, and
+// only this listener requires them.
+func lanInbound(lan LANSharing) map[string]interface{} {
+	return map[string]interface{}{
+		"type":        "mixed",
+		"tag":         lanInboundTag,
+		"listen":      "0.0.0.0",
+		"listen_port": lan.Port,
+		"users": []map[string]string{
+			{"username": lan.Username, "password": lan.Password},
+		},
+	}
+}
+
+// newLANCredentials generates a password for LAN sharing
+func newLANCredentials(lan *LANSharing) error {
+	password, err := randomSecret()
+	if err != nil {
+		return err
+	}
+	lan.Username = lanUsername
+	lan.Password = password
+	return nil
+}
+
+// lanAddresses returns the IPv4 addresses of the active network interfaces
+func lanAddresses() []string {
+	addresses := []string{}
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return addresses
+	}
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			ipNet, ok := addr.(*net.IPNet)
+			if !ok {
+				continue
+			}
+			if ip := ipNet.IP.To4(); ip != nil && !ip.IsLinkLocalUnicast() {
+				addresses = append(addresses, ip.String())
+			}
+		}
+	}
+	return addresses
+}
+
+// lanListenPort returns the port of the LAN listener in a runtime config,
+// which differs from the saved one when it was moved at launch
+func lanListenPort(content []byte) int {
+	return int(gjson.GetBytes(content, `inbounds.#(tag=="`+lanInboundTag+`").listen_port`).Int())
+}
@@ -0,0 +1,112 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/tidwall/gjson"
+)
+
+func lanTestOptions(t *testing.T, mixedConfig string) (*CoreManager, RuntimeOptions) {
+	t.Helper()
+	appDir := t.TempDir()
+	installFakeKernel(t, appDir, "1.12.0")
+	profile := filepath.Join(appDir, "profile.json")
+	if err := os.WriteFile(profile, []byte(`{"outbounds": [{"type": "direct", "tag": "direct"}]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return NewCoreManager(appDir, context.Background()), RuntimeOptions{
+		ProfilePath: profile,
+		SysProxy:    true,
+		MixedConfig: mixedConfig,
+		DNSConfig:   DefaultDNSConfig,
+		SplitConfig: DefaultSplitConfig,
+	}
+}
+
+func TestBuildConfigLAN(t *testing.T) {
+	mixedConfig := `{"type": "mixed", "tag": "mixed-in", "listen": "0.0.0.0", "listen_port": 7893}`
+	cm, opts := lanTestOptions(t, mixedConfig)
+
+	// Without LAN sharing the mixed inbound stays on localhost too
+	result, err := cm.buildConfig(opts, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := gjson.GetBytes(result.Content, `inbounds.#(tag=="mixed-in").listen`).String(); got != "127.0.0.1" {
+		t.Errorf("mixed listen without LAN sharing = %q, want 127.0.0.1", got)
+	}
+	if gjson.GetBytes(result.Content, `inbounds.#(tag=="`+lanInboundTag+`")`).Exists() {
+		t.Error("LAN listener added with LAN sharing off")
+	}
+
+	// With LAN sharing the mixed inbound moves to localhost and the
+	// authenticated listener takes the LAN
+	opts.LAN = &LANSharing{Port: 7894, Username: lanUsername, Password: "secret"}
+	result, err = cm.buildConfig(opts, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := gjson.GetBytes(result.Content, `inbounds.#(tag=="mixed-in").listen`).String(); got != "127.0.0.1" {
+		t.Errorf("mixed listen with LAN sharing = %q, want 127.0.0.1", got)
+	}
+	lan := gjson.GetBytes(result.Content, `inbounds.#(tag=="`+lanInboundTag+`")`)
+	if lan.Get("listen").String() != "0.0.0.0" || lan.Get("users.0.password").String() != "secret" {
+		t.Errorf("LAN listener = %s", lan.Raw)
+	}
+	if port := lanListenPort(result.Content); port != 7894 {
+		t.Errorf("lanListenPort() = %d, want 7894", port)
+	}
+}
+
+func TestBuildConfigSavedWildcardListen(t *testing.T) {
+	// A mixed.json saved with the old 0.0.0.0 default
+	configDir := t.TempDir()
+	os.MkdirAll(filepath.Join(configDir, "overrides"), 0755)
+	saved := `{"type": "mixed", "tag": "mixed-in", "listen": "0.0.0.0", "listen_port": 7893, "set_system_proxy": true}`
+	if err := os.WriteFile(filepath.Join(configDir, "overrides", "mixed.json"), []byte(saved), 0644); err != nil {
+		t.Fatal(err)
+	}
+	storage := NewStorage(configDir)
+	t.Cleanup(storage.Flush)
+	meta, err := storage.LoadMeta()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.AllowLAN {
+		t.Fatal("LAN sharing on by default")
+	}
+
+	cm, opts := lanTestOptions(t, meta.Override("mixed", ""))
+	result, err := cm.buildConfig(opts, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := gjson.GetBytes(result.Content, `inbounds.#(tag=="mixed-in").listen`).String(); got != "127.0.0.1" {
+		t.Errorf("mixed listen = %q, want 127.0.0.1", got)
+	}
+}
+
+func TestBuildConfigLANPortConflict(t *testing.T) {
+	port := freePort(t)
+	cm, opts := lanTestOptions(t, fmt.Sprintf(`{"type": "mixed", "tag": "mixed-in", "listen_port": %d}`, port))
+	opts.LAN = &LANSharing{Port: port, Username: lanUsername, Password: "secret"}
+
+	opts.StrictPorts = true
+	if _, err := cm.buildConfig(opts, true); err == nil || !strings.Contains(err.Error(), `inbound "`+lanInboundTag+`"`) {
+		t.Errorf("strict buildConfig() error = %v, want a LAN port conflict", err)
+	}
+
+	opts.StrictPorts = false
+	result, err := cm.buildConfig(opts, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if moved := lanListenPort(result.Content); moved == port || moved == 0 {
+		t.Errorf("LAN listener kept the mixed port: %d", moved)
+	}
+}
@@ -0,0 +1,134 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/tidwall/gjson"
+)
+
+// Validate checks that the inbound is a listener WinBox can add next to the TUN and mixed inbounds
+func (in *ManagedInbound) Validate() error {
+	if strings.TrimSpace(in.Name) == "" {
+		return fmt.Errorf("inbound name cannot be empty")
+	}
+	if !json.Valid([]byte(in.Content)) || !gjson.Parse(in.Content).IsObject() {
+		return fmt.Errorf("inbound %q: content must be a JSON object", in.Name)
+	}
+
+	content := gjson.Parse(in.Content)
+	typ := content.Get("type").String()
+	switch typ {
+	case "":
+		return fmt.Errorf("inbound %q: type is required", in.Name)
+	case "tun":
+		return fmt.Errorf("inbound %q: TUN is configured by the tun override", in.Name)
+	}
+	if content.Get("tag").String() == "" {
+		return fmt.Errorf("inbound %q: tag is required", in.Name)
+	}
+	if port := content.Get("listen_port").Int(); port < 1 || port > 65535 {
+		return fmt.Errorf("inbound %q: listen_port must be between 1 and 65535", in.Name)
+	}
+	return nil
+}
+
+// checkInboundConflicts reports enabled inbounds that share a tag or a port
+// with each other, with the LAN sharing listener, or with the mixed inbound of
+// any profile. Profiles never run together, so their mixed inbounds are each
+// checked on their own.
+func checkInboundConflicts(inbounds []ManagedInbound, meta *MetaData) error {
+	mixedConfigs := []string{meta.Override("mixed", "")}
+	owners := []string{"the mixed inbound"}
+	for _, p := range meta.Profiles {
+		if _, ok := meta.ProfileOverrides[p.ID]["mixed"]; ok {
+			mixedConfigs = append(mixedConfigs, meta.Override("mixed", p.ID))
+			owners = append(owners, fmt.Sprintf("the mixed inbound of profile %q", p.Name))
+		}
+	}
+
+	for i, mixedConfig := range mixedConfigs {
+		tags := make(map[string]string)  // Tag -> owner
+		ports := make(map[string]string) // network/port -> owner
+
+		if mixed := gjson.Parse(mixedConfig); mixed.IsObject() {
+			tags[mixed.Get("tag").String()] = owners[i]
+			if port := mixed.Get("listen_port").Int(); port > 0 {
+				for _, network := range listenNetworks("mixed") {
+					ports[fmt.Sprintf("%s/%d", network, port)] = owners[i]
+				}
+			}
+		}
+
+		if meta.AllowLAN {
+			const owner = "the LAN sharing listener"
+			if other, ok := tags[lanInboundTag]; ok {
+				return fmt.Errorf("%s uses tag %q, already used by %s", owner, lanInboundTag, other)
+			}
+			tags[lanInboundTag] = owner
+			for _, network := range listenNetworks("mixed") {
+				key := fmt.Sprintf("%s/%d", network, meta.LAN.Port)
+				if other, ok := ports[key]; ok {
+					return fmt.Errorf("%s uses port %d, already used by %s", owner, meta.LAN.Port, other)
+				}
+				ports[key] = owner
+			}
+		}
+
+		for _, in := range inbounds {
+			if !in.Enabled {
+				continue
+			}
+			content := gjson.Parse(in.Content)
+			owner := fmt.Sprintf("inbound %q", in.Name)
+
+			tag := content.Get("tag").String()
+			if other, ok := tags[tag]; ok {
+				return fmt.Errorf("%s uses tag %q, already used by %s", owner, tag, other)
+			}
+			tags[tag] = owner
+
+			port := content.Get("listen_port").Int()
+			for _, network := range listenNetworks(content.Get("type").String()) {
+				key := fmt.Sprintf("%s/%d", network, port)
+				if other, ok := ports[key]; ok {
+					return fmt.Errorf("%s uses port %d, already used by %s", owner, port, other)
+				}
+				ports[key] = owner
+			}
+		}
+	}
+	return nil
+}
+
+// managedInbounds decodes the enabled inbounds for the runtime config.
+// Tags already taken by the TUN or mixed inbound are rejected.
+func managedInbounds(inbounds []ManagedInbound, existing []interface{}) ([]interface{}, error) {
+	used := make(map[string]bool)
+	for _, in := range existing {
+		if m, ok := in.(map[string]interface{}); ok {
+			if tag, _ := m["tag"].(string); tag != "" {
+				used[tag] = true
+			}
+		}
+	}
+
+	var result []interface{}
+	for _, in := range inbounds {
+		if !in.Enabled {
+			continue
+		}
+		var inbound map[string]interface{}
+		if err := decodeJSON([]byte(in.Content), &inbound); err != nil {
+			return nil, fmt.Errorf("inbound %q: %w", in.Name, err)
+		}
+		tag, _ := inbound["tag"].(string)
+		if used[tag] {
+			return nil, fmt.Errorf("inbound %q: tag %q is already used", in.Name, tag)
+		}
+		used[tag] = true
+		result = append(result, inbound)
+	}
+	return result, nil
+}
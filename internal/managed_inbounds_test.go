@@ -0,0 +1,134 @@
+package internal
+
+import (
+	"strings"
+	"testing"
+)
+
+func managedInbound(name, content string) ManagedInbound {
+	return ManagedInbound{ID: name, Name: name, Enabled: true, Content: content}
+}
+
+func TestCheckInboundConflicts(t *testing.T) {
+	profileMixed := `{"type": "mixed", "tag": "mixed-in", "listen_port": 8000}`
+	meta := &MetaData{
+		Profiles: []Profile{{ID: "a", Name: "Work"}, {ID: "b", Name: "Home"}},
+		ProfileOverrides: map[string]map[string]string{
+			"a": {"mixed": profileMixed},
+			"b": {"tun": DefaultTunConfig},
+		},
+		LAN: LANSharing{Port: 7894},
+	}
+
+	tests := []struct {
+		name     string
+		inbounds []ManagedInbound
+		allowLAN bool
+		want     string // Error substring, empty for none
+	}{
+		{"distinct", []ManagedInbound{
+			managedInbound("http", `{"type": "http", "tag": "http-in", "listen_port": 1080}`),
+			managedInbound("hy2", `{"type": "hysteria2", "tag": "hy2-in", "listen_port": 1080}`),
+		}, true, ""},
+		{"shared UDP port", []ManagedInbound{
+			managedInbound("ss", `{"type": "shadowsocks", "tag": "ss-in", "listen_port": 1080}`),
+			managedInbound("hy2", `{"type": "hysteria2", "tag": "hy2-in", "listen_port": 1080}`),
+		}, false, `inbound "hy2" uses port 1080, already used by inbound "ss"`},
+		{"mixed UDP port", []ManagedInbound{
+			managedInbound("tuic", `{"type": "tuic", "tag": "tuic-in", "listen_port": 7893}`),
+		}, false, `uses port 7893, already used by the mixed inbound`},
+		{"duplicate tag", []ManagedInbound{
+			managedInbound("one", `{"type": "socks", "tag": "dup", "listen_port": 1080}`),
+			managedInbound("two", `{"type": "http", "tag": "dup", "listen_port": 1081}`),
+		}, false, `inbound "two" uses tag "dup", already used by inbound "one"`},
+		{"duplicate port", []ManagedInbound{
+			managedInbound("one", `{"type": "socks", "tag": "a", "listen_port": 1080}`),
+			managedInbound("two", `{"type": "http", "tag": "b", "listen_port": 1080}`),
+		}, false, `inbound "two" uses port 1080, already used by inbound "one"`},
+		{"disabled inbounds are ignored", []ManagedInbound{
+			managedInbound("one", `{"type": "socks", "tag": "a", "listen_port": 1080}`),
+			{ID: "two", Name: "two", Content: `{"type": "http", "tag": "a", "listen_port": 1080}`},
+		}, false, ""},
+		{"global mixed port", []ManagedInbound{
+			managedInbound("http", `{"type": "http", "tag": "http-in", "listen_port": 7893}`),
+		}, false, `uses port 7893, already used by the mixed inbound`},
+		{"global mixed tag", []ManagedInbound{
+			managedInbound("http", `{"type": "http", "tag": "mixed-in", "listen_port": 1080}`),
+		}, false, `uses tag "mixed-in", already used by the mixed inbound`},
+		{"profile mixed port", []ManagedInbound{
+			managedInbound("http", `{"type": "http", "tag": "http-in", "listen_port": 8000}`),
+		}, false, `uses port 8000, already used by the mixed inbound of profile "Work"`},
+		{"LAN port", []ManagedInbound{
+			managedInbound("http", `{"type": "http", "tag": "http-in", "listen_port": 7894}`),
+		}, true, `uses port 7894, already used by the LAN sharing listener`},
+		{"LAN tag", []ManagedInbound{
+			managedInbound("http", `{"type": "http", "tag": "lan-in", "listen_port": 1080}`),
+		}, true, `uses tag "lan-in", already used by the LAN sharing listener`},
+		{"LAN off", []ManagedInbound{
+			managedInbound("http", `{"type": "http", "tag": "lan-in", "listen_port": 7894}`),
+		}, false, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := *meta
+			m.AllowLAN = tt.allowLAN
+			err := checkInboundConflicts(tt.inbounds, &m)
+			if tt.want == "" {
+				if err != nil {
+					t.Errorf("checkInboundConflicts() = %v, want nil", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("checkInboundConflicts() = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckInboundConflictsLANPort(t *testing.T) {
+	meta := &MetaData{AllowLAN: true, LAN: LANSharing{Port: 7893}}
+	err := checkInboundConflicts(nil, meta)
+	if err == nil || !strings.Contains(err.Error(), "the LAN sharing listener uses port 7893, already used by the mixed inbound") {
+		t.Errorf("checkInboundConflicts() = %v", err)
+	}
+}
+
+func TestSettingsRejectInboundConflicts(t *testing.T) {
+	s := newTestStorage(t)
+	sm := NewSettingsManager(s)
+	if err := s.Update(func(meta *MetaData) error {
+		meta.Profiles = []Profile{{ID: "a", Name: "Work"}}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	inbound := managedInbound("http", `{"type": "http", "tag": "http-in", "listen_port": 8000}`)
+	if err := sm.SaveInbounds([]ManagedInbound{inbound}); err != nil {
+		t.Fatal(err)
+	}
+
+	// A profile's mixed inbound and the LAN listener cannot take the port afterwards
+	if err := sm.SaveOverride("mixed", "a", `{"type": "mixed", "tag": "mixed-in", "listen_port": 8000}`); err == nil {
+		t.Error("SaveOverride() accepted a profile mixed port used by an inbound")
+	}
+	if err := sm.SaveOverride("mixed", "", `{"type": "mixed", "tag": "http-in", "listen_port": 7893}`); err == nil {
+		t.Error("SaveOverride() accepted a global mixed tag used by an inbound")
+	}
+	if err := sm.SetAllowLAN(true, 8000); err == nil {
+		t.Error("SetAllowLAN() accepted a port used by an inbound")
+	}
+
+	meta, err := s.LoadMeta()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.AllowLAN || meta.ProfileOverrides["a"]["mixed"] != "" || meta.Override("mixed", "") != DefaultMixedConfig {
+		t.Errorf("rejected changes were saved: allow_lan=%v, overrides=%v", meta.AllowLAN, meta.ProfileOverrides)
+	}
+	if err := sm.SetAllowLAN(true, 8001); err != nil {
+		t.Errorf("SetAllowLAN() = %v", err)
+	}
+}
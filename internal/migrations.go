@@ -0,0 +1,474 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// migration rewrites a deprecated construct into the form newer kernels expect
+type migration struct {
+	since   string // First kernel version the rewrite is applied for
+	inbound bool   // Only touches inbounds, so it can also run on a lone inbound override
+	apply   func(config map[string]interface{}) []string
+}
+
+// migrations run in order; each returns a description of every rewrite it made.
+// The geo rewrite waits for 1.12, which removed the geo databases: older
+// kernels still accept geoip and geosite, and the rule sets would need to be
+// downloaded for profiles that work as they are.
+var migrations = []migration{
+	{since: "1.12.0", apply: migrateGeoRules},
+	{since: "1.10.0", inbound: true, apply: migrateTunAddresses},
+	{since: "1.11.0", apply: migrateInboundSniff},
+	{since: "1.11.0", apply: migrateSpecialOutbounds},
+}
+
+// migrateConfig applies the migrations due for the kernel version to a full
+// config and returns the rewrites it made. An unknown version applies none
+// and returns a warning instead.
+func migrateConfig(content []byte, version string) ([]byte, []string, []string, error) {
+	var config map[string]interface{}
+	if err := decodeJSON(content, &config); err != nil {
+		return nil, nil, nil, err
+	}
+	if parseVersion(version) == nil {
+		return content, nil, []string{fmt.Sprintf("kernel version %q unknown, config not migrated", version)}, nil
+	}
+
+	rewrites := runMigrations(config, version, false)
+	if len(rewrites) == 0 {
+		return content, nil, nil, nil
+	}
+	out, err := json.Marshal(config)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return out, rewrites, nil, nil
+}
+
+// migrateInbound applies the inbound migrations due for the kernel version to
+// a single inbound. An unknown version applies none.
+func migrateInbound(content, version string) (string, []string, error) {
+	var inbound map[string]interface{}
+	if err := decodeJSON([]byte(content), &inbound); err != nil {
+		return "", nil, err
+	}
+
+	config := map[string]interface{}{"inbounds": []interface{}{inbound}}
+	rewrites := runMigrations(config, version, true)
+	if len(rewrites) == 0 {
+		return content, nil, nil
+	}
+	out, err := json.MarshalIndent(inbound, "", "  ")
+	if err != nil {
+		return "", nil, err
+	}
+	return string(out), rewrites, nil
+}
+
+func runMigrations(config map[string]interface{}, version string, inboundOnly bool) []string {
+	if parseVersion(version) == nil {
+		return nil
+	}
+
+	var rewrites []string
+	for _, m := range migrations {
+		if inboundOnly && !m.inbound {
+			continue
+		}
+		if versionBefore(version, m.since) {
+			continue
+		}
+		rewrites = append(rewrites, m.apply(config)...)
+	}
+	return rewrites
+}
+
+var versionPattern = regexp.MustCompile(`^v?(\d+)\.(\d+)(?:\.(\d+))?`)
+
+// versionBefore reports whether version is older than since. Versions that
+// cannot be parsed, such as "Not Installed", are never older.
+func versionBefore(version, since string) bool {
+	v := parseVersion(version)
+	s := parseVersion(since)
+	if v == nil || s == nil {
+		return false
+	}
+	for i := range v {
+		if v[i] != s[i] {
+			return v[i] < s[i]
+		}
+	}
+	return false
+}
+
+func parseVersion(version string) []int {
+	m := versionPattern.FindStringSubmatch(version)
+	if m == nil {
+		return nil
+	}
+	parts := make([]int, 3)
+	for i := range parts {
+		parts[i], _ = strconv.Atoi(m[i+1])
+	}
+	return parts
+}
+
+// objects returns the object elements of a JSON list
+func objects(v interface{}) []map[string]interface{} {
+	list, _ := v.([]interface{})
+	var result []map[string]interface{}
+	for _, item := range list {
+		if obj, ok := item.(map[string]interface{}); ok {
+			result = append(result, obj)
+		}
+	}
+	return result
+}
+
+// stringList returns a JSON string or list of strings as a slice
+func stringList(v interface{}) []string {
+	switch val := v.(type) {
+	case string:
+		return []string{val}
+	case []interface{}:
+		var result []string
+		for _, item := range val {
+			if s, ok := item.(string); ok {
+				result = append(result, s)
+			}
+		}
+		return result
+	}
+	return nil
+}
+
+func inboundName(in map[string]interface{}) string {
+	if tag, _ := in["tag"].(string); tag != "" {
+		return tag
+	}
+	typ, _ := in["type"].(string)
+	return typ
+}
+
+// migrateTunAddresses merges the split inet4/inet6 tun address fields into
+// the combined fields introduced in sing-box 1.10
+func migrateTunAddresses(config map[string]interface{}) []string {
+	fields := []struct{ v4, v6, combined string }{
+		{"inet4_address", "inet6_address", "address"},
+		{"inet4_route_address", "inet6_route_address", "route_address"},
+		{"inet4_route_exclude_address", "inet6_route_exclude_address", "route_exclude_address"},
+	}
+
+	var rewrites []string
+	for _, in := range objects(config["inbounds"]) {
+		if in["type"] != "tun" {
+			continue
+		}
+		for _, f := range fields {
+			_, hasV4 := in[f.v4]
+			_, hasV6 := in[f.v6]
+			if !hasV4 && !hasV6 {
+				continue
+			}
+			merged := stringList(in[f.combined])
+			merged = append(merged, stringList(in[f.v4])...)
+			merged = append(merged, stringList(in[f.v6])...)
+			delete(in, f.v4)
+			delete(in, f.v6)
+			in[f.combined] = merged
+			rewrites = append(rewrites, fmt.Sprintf("inbound %q: %s and %s merged into %s", inboundName(in), f.v4, f.v6, f.combined))
+		}
+	}
+	return rewrites
+}
+
+// migrateInboundSniff replaces the sniff and domain_strategy fields of
+// inbounds with the sniff and resolve rule actions of sing-box 1.11
+func migrateInboundSniff(config map[string]interface{}) []string {
+	var rewrites []string
+	var rules []interface{}
+	for _, in := range objects(config["inbounds"]) {
+		_, hasSniff := in["sniff"]
+		_, hasStrategy := in["domain_strategy"]
+		if !hasSniff && !hasStrategy {
+			continue
+		}
+
+		match := map[string]interface{}{}
+		if tag, _ := in["tag"].(string); tag != "" {
+			match["inbound"] = []string{tag}
+		}
+		if sniff, _ := in["sniff"].(bool); sniff {
+			rule := map[string]interface{}{"action": "sniff"}
+			for k, v := range match {
+				rule[k] = v
+			}
+			if timeout, ok := in["sniff_timeout"]; ok {
+				rule["timeout"] = timeout
+			}
+			rules = append(rules, rule)
+		}
+		if strategy, _ := in["domain_strategy"].(string); strategy != "" {
+			rule := map[string]interface{}{"action": "resolve", "strategy": strategy}
+			for k, v := range match {
+				rule[k] = v
+			}
+			rules = append(rules, rule)
+		}
+
+		for _, field := range []string{"sniff", "sniff_override_destination", "sniff_timeout", "domain_strategy"} {
+			delete(in, field)
+		}
+		rewrites = append(rewrites, fmt.Sprintf("inbound %q: sniff and domain_strategy fields replaced by route rule actions", inboundName(in)))
+	}
+
+	if len(rules) > 0 {
+		route, _ := config["route"].(map[string]interface{})
+		if route == nil {
+			route = map[string]interface{}{}
+			config["route"] = route
+		}
+		existing, _ := route["rules"].([]interface{})
+		route["rules"] = append(rules, existing...)
+	}
+	return rewrites
+}
+
+// migrateSpecialOutbounds replaces block and dns outbounds with the reject
+// and hijack-dns rule actions of sing-box 1.11. Detours through them, which
+// never worked, are dropped.
+func migrateSpecialOutbounds(config map[string]interface{}) []string {
+	actions := make(map[string]string) // Outbound tag -> replacing action
+	var kept []interface{}
+	list, _ := config["outbounds"].([]interface{})
+	for _, item := range list {
+		ob, _ := item.(map[string]interface{})
+		tag, _ := ob["tag"].(string)
+		switch ob["type"] {
+		case "block":
+			actions[tag] = "reject"
+		case "dns":
+			actions[tag] = "hijack-dns"
+		default:
+			kept = append(kept, item)
+		}
+	}
+	if len(actions) == 0 {
+		return nil
+	}
+	config["outbounds"] = kept
+
+	var rewrites []string
+	for tag, action := range actions {
+		rewrites = append(rewrites, fmt.Sprintf("outbound %q replaced by the %s rule action", tag, action))
+	}
+	slices.Sort(rewrites)
+
+	route, _ := config["route"].(map[string]interface{})
+	if route != nil {
+		for _, rule := range objects(route["rules"]) {
+			tag, _ := rule["outbound"].(string)
+			if action, ok := actions[tag]; ok {
+				delete(rule, "outbound")
+				rule["action"] = action
+			}
+		}
+		if final, _ := route["final"].(string); actions[final] != "" {
+			delete(route, "final")
+			rewrites = append(rewrites, fmt.Sprintf("route.final %q removed", final))
+		}
+	}
+
+	// Groups can no longer select the removed outbounds
+	for _, ob := range objects(config["outbounds"]) {
+		members, ok := ob["outbounds"].([]interface{})
+		if !ok {
+			continue
+		}
+		filtered := make([]interface{}, 0, len(members))
+		for _, m := range members {
+			if tag, _ := m.(string); actions[tag] == "" {
+				filtered = append(filtered, m)
+			}
+		}
+		ob["outbounds"] = filtered
+		if def, _ := ob["default"].(string); actions[def] != "" {
+			delete(ob, "default")
+		}
+	}
+
+	var detoured []map[string]interface{}
+	detoured = append(detoured, objects(config["outbounds"])...)
+	if dns, _ := config["dns"].(map[string]interface{}); dns != nil {
+		detoured = append(detoured, objects(dns["servers"])...)
+	}
+	for _, obj := range detoured {
+		if detour, _ := obj["detour"].(string); actions[detour] != "" {
+			delete(obj, "detour")
+			tag, _ := obj["tag"].(string)
+			rewrites = append(rewrites, fmt.Sprintf("%q: detour %q removed", tag, detour))
+		}
+	}
+	return rewrites
+}
+
+// migrateGeoRules replaces the geoip and geosite conditions of route and DNS
+// rules with the equivalent SagerNet rule sets, removed in sing-box 1.12
+func migrateGeoRules(config map[string]interface{}) []string {
+	var added []string
+	sets := make(map[string]string) // Rule set tag -> URL
+	var rewrites []string
+
+	for _, section := range []string{"route", "dns"} {
+		obj, _ := config[section].(map[string]interface{})
+		if obj == nil {
+			continue
+		}
+		count := 0
+		var rules []interface{}
+		for _, rule := range objects(obj["rules"]) {
+			if private := splitPrivate(rule); private != nil {
+				migrateGeoRule(private, sets)
+				rules = append(rules, private)
+			}
+			if migrateGeoRule(rule, sets) {
+				count++
+			}
+			rules = append(rules, rule)
+		}
+		if count > 0 {
+			obj["rules"] = rules
+			rewrites = append(rewrites, fmt.Sprintf("%s rules: geoip/geosite conditions replaced by rule sets (%d rules)", section, count))
+		}
+	}
+
+	route, _ := config["route"].(map[string]interface{})
+	if route != nil {
+		for _, field := range []string{"geoip", "geosite"} {
+			if _, ok := route[field]; ok {
+				delete(route, field)
+				rewrites = append(rewrites, fmt.Sprintf("route.%s removed", field))
+			}
+		}
+	}
+	if len(sets) == 0 {
+		return rewrites
+	}
+
+	if route == nil {
+		route = map[string]interface{}{}
+		config["route"] = route
+	}
+	existing, _ := route["rule_set"].([]interface{})
+	defined := make(map[string]bool)
+	for _, rs := range objects(existing) {
+		tag, _ := rs["tag"].(string)
+		defined[tag] = true
+	}
+	for tag := range sets {
+		if defined[tag] {
+			continue
+		}
+		added = append(added, tag)
+	}
+	slices.Sort(added)
+	for _, tag := range added {
+		existing = append(existing, map[string]interface{}{
+			"type":   "remote",
+			"tag":    tag,
+			"format": "binary",
+			"url":    sets[tag],
+		})
+	}
+	route["rule_set"] = existing
+	if len(added) > 0 {
+		rewrites = append(rewrites, "rule sets added: "+strings.Join(added, ", "))
+	}
+	return rewrites
+}
+
+// splitPrivate moves the "private" code of a geoip condition listed with
+// other codes into a copy of the rule. It becomes an ip_is_private condition,
+// which would otherwise have to match together with the other codes' rule set.
+func splitPrivate(rule map[string]interface{}) map[string]interface{} {
+	for _, field := range []string{"geoip", "source_geoip"} {
+		codes := stringList(rule[field])
+		i := slices.IndexFunc(codes, func(c string) bool { return strings.EqualFold(c, "private") })
+		if i < 0 || len(codes) == 1 {
+			continue
+		}
+
+		private := make(map[string]interface{}, len(rule))
+		for k, v := range rule {
+			private[k] = v
+		}
+		private[field] = []interface{}{"private"}
+		rest := make([]interface{}, 0, len(codes)-1)
+		for j, c := range codes {
+			if j != i {
+				rest = append(rest, c)
+			}
+		}
+		rule[field] = rest
+		return private
+	}
+	return nil
+}
+
+// migrateGeoRule rewrites the geo conditions of one rule, including the
+// sub-rules of a logical rule, and records the rule sets it references
+func migrateGeoRule(rule map[string]interface{}, sets map[string]string) bool {
+	changed := false
+	for _, sub := range objects(rule["rules"]) {
+		if migrateGeoRule(sub, sets) {
+			changed = true
+		}
+	}
+
+	var ruleSets []string
+	for _, field := range []string{"geosite", "geoip", "source_geoip"} {
+		if _, ok := rule[field]; !ok {
+			continue
+		}
+		codes := stringList(rule[field])
+		delete(rule, field)
+		changed = true
+
+		for _, code := range codes {
+			code = strings.ToLower(code)
+			switch {
+			case field == "geosite":
+				tag := "geosite-" + code
+				sets[tag] = fmt.Sprintf(geositeRuleSetURL, code)
+				ruleSets = append(ruleSets, tag)
+			case code == "private" && field == "geoip":
+				rule["ip_is_private"] = true
+			case code == "private":
+				rule["source_ip_is_private"] = true
+			default:
+				tag := "geoip-" + code
+				sets[tag] = fmt.Sprintf(geoipRuleSetURL, code)
+				ruleSets = append(ruleSets, tag)
+				if field == "source_geoip" {
+					rule["rule_set_ip_cidr_match_source"] = true
+				}
+			}
+		}
+	}
+
+	if len(ruleSets) > 0 {
+		merged := stringList(rule["rule_set"])
+		for _, tag := range ruleSets {
+			if !slices.Contains(merged, tag) {
+				merged = append(merged, tag)
+			}
+		}
+		rule["rule_set"] = merged
+	}
+	return changed
+}
@@ -0,0 +1,248 @@
+package internal
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// migrated runs one migration on a config and returns it with the rewrites
+func migrated(t *testing.T, apply func(map[string]interface{}) []string, content string) (string, []string) {
+	t.Helper()
+	var config map[string]interface{}
+	if err := decodeJSON([]byte(content), &config); err != nil {
+		t.Fatal(err)
+	}
+	rewrites := apply(config)
+	return fmt.Sprint(normalize(t, config)), rewrites
+}
+
+func TestVersionBefore(t *testing.T) {
+	tests := []struct {
+		version, since string
+		want           bool
+	}{
+		{"1.11.4", "1.12.0", true},
+		{"1.12.0", "1.12.0", false},
+		{"1.12.0-beta.3", "1.12.0", false},
+		{"v1.9", "1.10.0", true},
+		{"1.10", "1.10.0", false},
+		{"2.0.0", "1.12.0", false},
+		{"1.9.10", "1.10.0", true},
+		{"Not Installed", "1.12.0", false},
+		{"Unknown", "1.8.0", false},
+	}
+	for _, tt := range tests {
+		if got := versionBefore(tt.version, tt.since); got != tt.want {
+			t.Errorf("versionBefore(%q, %q) = %v, want %v", tt.version, tt.since, got, tt.want)
+		}
+	}
+}
+
+func TestMigrateConfigVersions(t *testing.T) {
+	content := `{
+		"inbounds": [{"type": "tun", "tag": "tun-in", "inet4_address": "172.19.0.1/30", "sniff": true}],
+		"outbounds": [{"type": "direct", "tag": "direct"}, {"type": "block", "tag": "block"}],
+		"route": {"rules": [{"geosite": "cn", "outbound": "direct"}, {"port": 853, "outbound": "block"}]}
+	}`
+
+	tests := []struct {
+		version string
+		want    []string // Substrings of the rewrites, in order
+	}{
+		{"1.9.0", nil},
+		{"1.10.1", []string{"inet4_address"}},
+		{"1.11.0", []string{"inet4_address", "sniff", `outbound "block"`}},
+		{"1.12.0", []string{"geoip/geosite", "rule sets added", "inet4_address", "sniff", `outbound "block"`}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.version, func(t *testing.T) {
+			out, rewrites, warnings, err := migrateConfig([]byte(content), tt.version)
+			if err != nil || len(warnings) != 0 {
+				t.Fatalf("migrateConfig() = %v, %v", warnings, err)
+			}
+			if len(rewrites) != len(tt.want) {
+				t.Fatalf("rewrites = %v, want %v", rewrites, tt.want)
+			}
+			for i := range tt.want {
+				if !strings.Contains(rewrites[i], tt.want[i]) {
+					t.Errorf("rewrite %d = %q, want %q", i, rewrites[i], tt.want[i])
+				}
+			}
+			if len(rewrites) == 0 && string(out) != content {
+				t.Error("config changed without rewrites")
+			}
+		})
+	}
+
+	// Unknown versions migrate nothing and say so
+	for _, version := range []string{"Not Installed", "Unknown", ""} {
+		out, rewrites, warnings, err := migrateConfig([]byte(content), version)
+		if err != nil || rewrites != nil || string(out) != content {
+			t.Errorf("migrateConfig(%q) = %v, %v", version, rewrites, err)
+		}
+		if len(warnings) != 1 || !strings.Contains(warnings[0], "not migrated") {
+			t.Errorf("migrateConfig(%q) warnings = %v", version, warnings)
+		}
+	}
+
+	if _, _, _, err := migrateConfig([]byte("{"), "1.12.0"); err == nil {
+		t.Error("migrateConfig() accepted invalid JSON")
+	}
+}
+
+func TestMigrateInbound(t *testing.T) {
+	content := `{"type": "tun", "tag": "tun-in", "inet4_address": "172.19.0.1/30", "inet6_address": ["fdfe::1/126"], "sniff": true}`
+
+	out, rewrites, err := migrateInbound(content, "1.12.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Only inbound migrations run; sniff needs the route and is left alone
+	if len(rewrites) != 1 || !strings.Contains(out, `"address"`) || !strings.Contains(out, `"sniff": true`) {
+		t.Errorf("migrateInbound() = %s, %v", out, rewrites)
+	}
+
+	for _, version := range []string{"1.9.0", "Not Installed"} {
+		if out, rewrites, _ := migrateInbound(content, version); out != content || rewrites != nil {
+			t.Errorf("migrateInbound(%q) = %s, %v", version, out, rewrites)
+		}
+	}
+}
+
+func TestMigrateTunAddresses(t *testing.T) {
+	got, rewrites := migrated(t, migrateTunAddresses, `{"inbounds": [
+		{"type": "tun", "address": ["10.0.0.1/30"], "inet4_address": "172.19.0.1/30", "inet6_address": ["fdfe::1/126"],
+		 "inet4_route_exclude_address": ["192.168.0.0/16"]},
+		{"type": "mixed", "inet4_address": "kept"}
+	]}`)
+	want := `{"inbounds": [
+		{"type": "tun", "address": ["10.0.0.1/30", "172.19.0.1/30", "fdfe::1/126"], "route_exclude_address": ["192.168.0.0/16"]},
+		{"type": "mixed", "inet4_address": "kept"}
+	]}`
+	if got != normalizeJSON(t, want) {
+		t.Errorf("migrateTunAddresses() = %s", got)
+	}
+	if len(rewrites) != 2 || !strings.Contains(rewrites[0], `inbound "tun"`) {
+		t.Errorf("rewrites = %v", rewrites)
+	}
+}
+
+func TestMigrateInboundSniff(t *testing.T) {
+	got, rewrites := migrated(t, migrateInboundSniff, `{
+		"inbounds": [
+			{"type": "mixed", "tag": "mixed-in", "sniff": true, "sniff_override_destination": true, "sniff_timeout": "300ms", "domain_strategy": "prefer_ipv4"},
+			{"type": "socks", "sniff": true},
+			{"type": "http", "tag": "http-in", "sniff": false}
+		],
+		"route": {"rules": [{"port": 53, "outbound": "dns-out"}]}
+	}`)
+	want := `{
+		"inbounds": [{"type": "mixed", "tag": "mixed-in"}, {"type": "socks"}, {"type": "http", "tag": "http-in"}],
+		"route": {"rules": [
+			{"action": "sniff", "inbound": ["mixed-in"], "timeout": "300ms"},
+			{"action": "resolve", "inbound": ["mixed-in"], "strategy": "prefer_ipv4"},
+			{"action": "sniff"},
+			{"port": 53, "outbound": "dns-out"}
+		]}
+	}`
+	if got != normalizeJSON(t, want) {
+		t.Errorf("migrateInboundSniff() = %s", got)
+	}
+	if len(rewrites) != 3 {
+		t.Errorf("rewrites = %v", rewrites)
+	}
+
+	// A config without route gets one
+	got, _ = migrated(t, migrateInboundSniff, `{"inbounds": [{"type": "mixed", "sniff": true}]}`)
+	if got != normalizeJSON(t, `{"inbounds": [{"type": "mixed"}], "route": {"rules": [{"action": "sniff"}]}}`) {
+		t.Errorf("migrateInboundSniff() without route = %s", got)
+	}
+}
+
+func TestMigrateSpecialOutbounds(t *testing.T) {
+	got, rewrites := migrated(t, migrateSpecialOutbounds, `{
+		"dns": {"servers": [{"tag": "remote", "address": "8.8.8.8", "detour": "block"}, {"tag": "local", "address": "local", "detour": "direct"}]},
+		"outbounds": [
+			{"type": "selector", "tag": "Proxy", "outbounds": ["HK", "block", "direct"], "default": "block"},
+			{"type": "trojan", "tag": "HK", "detour": "dns-out"},
+			{"type": "direct", "tag": "direct"},
+			{"type": "block", "tag": "block"},
+			{"type": "dns", "tag": "dns-out"}
+		],
+		"route": {"rules": [{"protocol": "dns", "outbound": "dns-out"}, {"port": 853, "outbound": "block"}, {"port": 80, "outbound": "HK"}], "final": "block"}
+	}`)
+	want := `{
+		"dns": {"servers": [{"tag": "remote", "address": "8.8.8.8"}, {"tag": "local", "address": "local", "detour": "direct"}]},
+		"outbounds": [
+			{"type": "selector", "tag": "Proxy", "outbounds": ["HK", "direct"]},
+			{"type": "trojan", "tag": "HK"},
+			{"type": "direct", "tag": "direct"}
+		],
+		"route": {"rules": [{"protocol": "dns", "action": "hijack-dns"}, {"port": 853, "action": "reject"}, {"port": 80, "outbound": "HK"}]}
+	}`
+	if got != normalizeJSON(t, want) {
+		t.Errorf("migrateSpecialOutbounds() = %s", got)
+	}
+	wantRewrites := []string{
+		`outbound "block" replaced by the reject rule action`,
+		`outbound "dns-out" replaced by the hijack-dns rule action`,
+		`route.final "block" removed`,
+		`"HK": detour "dns-out" removed`,
+		`"remote": detour "block" removed`,
+	}
+	if !reflect.DeepEqual(rewrites, wantRewrites) {
+		t.Errorf("rewrites = %q, want %q", rewrites, wantRewrites)
+	}
+
+	if _, rewrites := migrated(t, migrateSpecialOutbounds, `{"outbounds": [{"type": "direct", "tag": "direct"}]}`); rewrites != nil {
+		t.Errorf("rewrites without special outbounds = %v", rewrites)
+	}
+}
+
+func TestMigrateGeoRules(t *testing.T) {
+	got, rewrites := migrated(t, migrateGeoRules, `{
+		"dns": {"rules": [{"geosite": ["CN"], "server": "local"}]},
+		"route": {
+			"geoip": {"path": "geoip.db"},
+			"rules": [
+				{"geoip": ["private", "cn"], "outbound": "direct"},
+				{"source_geoip": "private", "outbound": "direct"},
+				{"type": "logical", "mode": "or", "rules": [{"geosite": "google"}, {"source_geoip": "us"}], "outbound": "proxy"},
+				{"domain": ["a.com"], "rule_set": ["custom"], "geosite": "cn", "outbound": "direct"}
+			],
+			"rule_set": [{"type": "local", "tag": "geosite-google", "path": "google.srs"}]
+		}
+	}`)
+	want := fmt.Sprintf(`{
+		"dns": {"rules": [{"rule_set": ["geosite-cn"], "server": "local"}]},
+		"route": {
+			"rules": [
+				{"ip_is_private": true, "outbound": "direct"},
+				{"rule_set": ["geoip-cn"], "outbound": "direct"},
+				{"source_ip_is_private": true, "outbound": "direct"},
+				{"type": "logical", "mode": "or", "rules": [{"rule_set": ["geosite-google"]}, {"rule_set": ["geoip-us"], "rule_set_ip_cidr_match_source": true}], "outbound": "proxy"},
+				{"domain": ["a.com"], "rule_set": ["custom", "geosite-cn"], "outbound": "direct"}
+			],
+			"rule_set": [
+				{"type": "local", "tag": "geosite-google", "path": "google.srs"},
+				{"type": "remote", "tag": "geoip-cn", "format": "binary", "url": %q},
+				{"type": "remote", "tag": "geoip-us", "format": "binary", "url": %q},
+				{"type": "remote", "tag": "geosite-cn", "format": "binary", "url": %q}
+			]
+		}
+	}`, fmt.Sprintf(geoipRuleSetURL, "cn"), fmt.Sprintf(geoipRuleSetURL, "us"), fmt.Sprintf(geositeRuleSetURL, "cn"))
+	if got != normalizeJSON(t, want) {
+		t.Errorf("migrateGeoRules() = %s", got)
+	}
+	wantRewrites := []string{
+		"route rules: geoip/geosite conditions replaced by rule sets (4 rules)",
+		"dns rules: geoip/geosite conditions replaced by rule sets (1 rules)",
+		"route.geoip removed",
+		"rule sets added: geoip-cn, geoip-us, geosite-cn",
+	}
+	if !reflect.DeepEqual(rewrites, wantRewrites) {
+		t.Errorf("rewrites = %q, want %q", rewrites, wantRewrites)
+	}
+}
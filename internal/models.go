@@ -2,6 +2,7 @@ package internal
 
 import (
 	"context"
+	"encoding/json"
 	"time"
 
 	wailsRuntime "github.com/wailsapp/wails/v2/pkg/runtime"
@@ -21,18 +22,270 @@ const DefaultTunConfig = `{
 const DefaultMixedConfig = `{
   "type": "mixed",
   "tag": "mixed-in",
-  "listen": "0.0.0.0",
+  "listen": "127.0.0.1",
   "listen_port": 7893,
   "set_system_proxy": true
 }`
+const DefaultDNSConfig = `{
+  "mode": "extend",
+  "servers": [],
+  "rules": [],
+  "strategy": "",
+  "fakeip": false,
+  "hosts": {}
+}`
+const DefaultSplitConfig = `{
+  "direct": [],
+  "proxy": [],
+  "proxy_outbound": "",
+  "exclude_address": []
+}`
+
+// DefaultLANPort is the port of the LAN sharing listener
+const DefaultLANPort = 7894
+
+// Profile types
+const (
+	ProfileTypeRemote = "remote" // Downloaded from a subscription URL
+	ProfileTypeLocal  = "local"  // Imported from a file on disk
+	ProfileTypeInline = "inline" // Pasted as raw content
+)
 
 // Profile represents a configuration profile
 type Profile struct {
+	ID               string    `json:"id"`
+	Name             string    `json:"name"`
+	Type             string    `json:"type"`
+	Url              string    `json:"url"`
+	Source           string    `json:"source,omitempty"` // Source file of a local profile
+	Path             string    `json:"path"`
+	Updated          time.Time `json:"updated"`
+	UpdateInterval   int       `json:"update_interval"`             // Auto-update interval in minutes, 0 uses the provider interval
+	ProviderInterval int       `json:"provider_interval,omitempty"` // Interval in minutes from the profile-update-interval header
+	ConvertWarnings  []string  `json:"convert_warnings,omitempty"`  // Entries skipped during subscription conversion
+
+	Subscription *SubscriptionInfo `json:"subscription,omitempty"`  // Quota from the subscription-userinfo header
+	Warned       []string          `json:"warned,omitempty"`        // Subscription warnings already shown, see subscriptionAlerts
+	Fetch        *FetchOptions     `json:"fetch,omitempty"`         // Download options for subscription profiles
+	ETag         string            `json:"etag,omitempty"`          // Validator for conditional requests
+	LastModified string            `json:"last_modified,omitempty"` // Validator for conditional requests
+	Filter       *NodeFilter       `json:"filter,omitempty"`        // Node rules applied on every update
+	Providers    []ProviderRule    `json:"providers,omitempty"`     // Makes the profile a template filled with nodes from other profiles
+	RegionGroups string            `json:"region_groups,omitempty"` // Group nodes by region into "urltest" or "selector" groups, empty to disable
+}
+
+// RegionRule maps node tags to a region by flag emoji or keyword
+type RegionRule struct {
+	Name     string   `json:"name"`              // Region code used as the group tag, such as "HK"
+	Flag     string   `json:"flag"`              // Flag emoji, also prefixed to the group tag
+	Keywords []string `json:"keywords"`          // Case-insensitive; ASCII keywords must stand alone in the tag
+	Country  string   `json:"country,omitempty"` // ISO 3166-1 alpha-2 code compared with GeoIP, the flag's country if empty
+}
+
+// ProviderRule injects the nodes of a provider profile into groups of a template profile
+type ProviderRule struct {
+	ProfileID string   `json:"profile_id"`        // Profile whose nodes are injected
+	Pattern   string   `json:"pattern,omitempty"` // Only nodes whose tag matches this regex, empty for all
+	Groups    []string `json:"groups"`            // Selector or urltest tags in the template that receive the nodes
+}
+
+// NodeFilter selects, renames and dedupes the nodes of a profile when it is updated
+type NodeFilter struct {
+	Include      string       `json:"include,omitempty"`       // Keep only nodes whose tag matches this regex
+	Exclude      string       `json:"exclude,omitempty"`       // Drop nodes whose tag matches this regex
+	Types        []string     `json:"types,omitempty"`         // Keep only these protocol types
+	ExcludeTypes []string     `json:"exclude_types,omitempty"` // Drop these protocol types
+	Rename       []RenameRule `json:"rename,omitempty"`        // Tag substitutions applied in order
+	Dedupe       bool         `json:"dedupe,omitempty"`        // Drop nodes with the same server, port and credentials
+	GeoFix       bool         `json:"geo_fix,omitempty"`       // Correct tag flags to the GeoIP country of each node
+}
+
+// NodeGeo records where a node's server is actually located
+type NodeGeo struct {
+	Tag      string `json:"tag"`
+	Server   string `json:"server"`
+	IP       string `json:"ip"`      // Resolved address, empty if resolution failed
+	Country  string `json:"country"` // ISO country code from the GeoIP database
+	ASN      uint   `json:"asn,omitempty"`
+	Org      string `json:"org,omitempty"`     // AS organization
+	Claimed  string `json:"claimed,omitempty"` // Country code the tag claims by flag or region keyword
+	Mismatch bool   `json:"mismatch"`          // The claimed country differs from the located one
+}
+
+// RenameRule replaces matches of Pattern in node tags with Replace, which may use $1 style groups
+type RenameRule struct {
+	Pattern string `json:"pattern"`
+	Replace string `json:"replace"`
+}
+
+// FetchOptions customizes how a subscription is downloaded
+type FetchOptions struct {
+	UserAgent    string            `json:"user_agent,omitempty"`    // Overrides the default "sing-box" user agent
+	Headers      map[string]string `json:"headers,omitempty"`       // Extra request headers
+	Username     string            `json:"username,omitempty"`      // Basic auth username
+	Password     string            `json:"password,omitempty"`      // Basic auth password
+	CACert       string            `json:"ca_cert,omitempty"`       // PEM-encoded CA certificate or path to one
+	Insecure     bool              `json:"insecure,omitempty"`      // Skip TLS certificate verification
+	FallbackURLs []string          `json:"fallback_urls,omitempty"` // Mirror URLs tried in order when the main URL fails
+}
+
+// SubscriptionInfo holds the traffic quota and expiry reported by a provider
+type SubscriptionInfo struct {
+	Upload   int64 `json:"upload"`   // Bytes uploaded
+	Download int64 `json:"download"` // Bytes downloaded
+	Total    int64 `json:"total"`    // Traffic quota in bytes, 0 if unlimited
+	Expire   int64 `json:"expire"`   // Unix expiry time, 0 if none
+}
+
+// UnmarshalJSON accepts the legacy "2006-01-02 15:04" format for Updated
+func (p *Profile) UnmarshalJSON(data []byte) error {
+	type profileAlias Profile
+	aux := struct {
+		*profileAlias
+		Updated string `json:"updated"`
+	}{profileAlias: (*profileAlias)(p)}
+
+	if err := json.Unmarshal(data, &aux); err != nil {
+		return err
+	}
+
+	if p.Type == "" {
+		p.Type = ProfileTypeRemote
+	}
+
+	p.Updated = time.Time{}
+	if aux.Updated != "" {
+		if t, err := time.Parse(time.RFC3339, aux.Updated); err == nil {
+			p.Updated = t
+		} else if t, err := time.ParseInLocation("2006-01-02 15:04", aux.Updated, time.Local); err == nil {
+			p.Updated = t
+		}
+	}
+	return nil
+}
+
+// IsRemote reports whether the profile is downloaded from a subscription URL
+func (p *Profile) IsRemote() bool {
+	return p.Type == "" || p.Type == ProfileTypeRemote
+}
+
+// EffectiveInterval returns the auto-update interval, or 0 if auto-update is disabled
+func (p *Profile) EffectiveInterval() time.Duration {
+	if p.UpdateInterval > 0 {
+		return time.Duration(p.UpdateInterval) * time.Minute
+	}
+	return time.Duration(p.ProviderInterval) * time.Minute
+}
+
+// NextUpdate returns when the profile is due for an automatic update
+func (p *Profile) NextUpdate() time.Time {
+	interval := p.EffectiveInterval()
+	if interval <= 0 || !p.IsRemote() {
+		return time.Time{}
+	}
+	return p.Updated.Add(interval)
+}
+
+// ProfileUpdateResult reports the outcome of updating a single profile
+type ProfileUpdateResult struct {
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	Success  bool   `json:"success"`
+	Changed  bool   `json:"changed"` // False if the subscription content was unchanged
+	Error    string `json:"error,omitempty"`
+	Duration int64  `json:"duration_ms"`
+}
+
+// ProfileRevision describes a stored previous version of a profile
+type ProfileRevision struct {
+	ID   string    `json:"id"`
+	Time time.Time `json:"time"`
+	Hash string    `json:"hash"` // Truncated SHA-256 of the content
+	Size int64     `json:"size"`
+}
+
+// RevisionDiff lists the outbound tags that differ between two revisions
+type RevisionDiff struct {
+	Added   []string `json:"added"`
+	Removed []string `json:"removed"`
+}
+
+// Patch document formats
+const (
+	PatchTypeJSONPatch  = "json-patch"  // RFC 6902 list of operations
+	PatchTypeMergePatch = "merge-patch" // RFC 7396 partial document
+)
+
+// ConfigPatch is a user-defined override applied to the runtime config before launch
+type ConfigPatch struct {
 	ID      string `json:"id"`
 	Name    string `json:"name"`
-	Url     string `json:"url"`
-	Path    string `json:"path"`
-	Updated string `json:"updated"`
+	Type    string `json:"type"` // PatchTypeJSONPatch or PatchTypeMergePatch
+	Enabled bool   `json:"enabled"`
+	Content string `json:"content"` // Patch document
+}
+
+// RouteRule is a custom route rule managed by WinBox and kept across profile updates
+type RouteRule struct {
+	ID       string   `json:"id"`
+	Type     string   `json:"type"` // domain, domain_suffix, domain_keyword, ip_cidr or process_name
+	Values   []string `json:"values"`
+	Outbound string   `json:"outbound"` // Outbound tag, RuleTargetDirect or RuleTargetBlock
+	Enabled  bool     `json:"enabled"`
+}
+
+// ManagedInbound is a user-defined listener added next to the TUN and mixed inbounds
+type ManagedInbound struct {
+	ID      string `json:"id"`
+	Name    string `json:"name"`
+	Enabled bool   `json:"enabled"`
+	Content string `json:"content"` // sing-box inbound object
+}
+
+// LANSharing holds the listener and credentials other devices use when LAN sharing is on
+type LANSharing struct {
+	Port     int    `json:"port"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// Kinds of config change
+const (
+	ChangeAdd     = "add"
+	ChangeRemove  = "remove"
+	ChangeReplace = "replace"
+)
+
+// ConfigChange is one difference between a profile and its runtime config.
+// Path is dotted, with tagged array elements as [tag] and others as [index]
+// into the original list for removals and into the new list for additions.
+type ConfigChange struct {
+	Path string      `json:"path"`
+	Op   string      `json:"op"`
+	Old  interface{} `json:"old,omitempty"`
+	New  interface{} `json:"new,omitempty"`
+}
+
+// PreviewRequest selects the profile, mode and overrides of a config preview.
+// Empty overrides use the stored ones.
+type PreviewRequest struct {
+	ProfileID   string `json:"profile_id"`
+	TunMode     bool   `json:"tun_mode"`
+	SysProxy    bool   `json:"sys_proxy"`
+	TunConfig   string `json:"tun_config"`
+	MixedConfig string `json:"mixed_config"`
+	DNSConfig   string `json:"dns_config"`
+	SplitConfig string `json:"split_config"`
+}
+
+// ConfigPreview is the runtime config WinBox would generate, without starting the core
+type ConfigPreview struct {
+	Config   string         `json:"config"`
+	Valid    bool           `json:"valid"`
+	Check    string         `json:"check,omitempty"` // sing-box check output when invalid
+	Changes  []ConfigChange `json:"changes"`
+	Warnings []string       `json:"warnings"`
+	Rewrites []string       `json:"rewrites"` // Migrations applied for the installed kernel
 }
 
 // MetaData represents the application metadata
@@ -44,6 +297,12 @@ type MetaData struct {
 	SysProxy        bool      `json:"sys_proxy"`
 	TunConfig       string    `json:"tun_config"`
 	MixedConfig     string    `json:"mixed_config"`
+	DNSConfig       string    `json:"dns_config"`
+	SplitConfig     string    `json:"split_config"`      // TUN split tunnelling lists
+	Patches         []ConfigPatch `json:"patches"`       // Ordered config patches
+	ProfileOverrides map[string]map[string]string `json:"profile_overrides"` // Profile ID -> override name -> content
+	RouteRules      []RouteRule `json:"route_rules"`     // Custom rules prepended to the profile's route rules
+	Inbounds        []ManagedInbound `json:"inbounds"`   // Extra listeners added at launch
 	AutoConnect     *bool     `json:"auto_connect,omitempty"`
 	AutoConnectState string   `json:"auto_connect_state"`
 	StartOnBoot     bool      `json:"start_on_boot"`
@@ -51,12 +310,50 @@ type MetaData struct {
 	ThemeMode       string    `json:"theme_mode"`        // "light" or "dark"
 	AccentColor     string    `json:"accent_color"`      // hex color code
 	IPv6Enabled     bool      `json:"ipv6_enabled"`      // IPv6 support toggle
+	StrictPorts     bool      `json:"strict_ports"`      // Fail on port conflicts instead of picking a free port
+	AllowLAN        bool      `json:"allow_lan"`         // Accept authenticated connections from other devices
+	LAN             LANSharing `json:"lan"`
 	LogLevel        string    `json:"log_level"`         // Log level: debug, info, warning, error
 	LogToFile       bool      `json:"log_to_file"`       // Save logs to file
 	PreRelease      bool      `json:"pre_release"`       // Receive pre-release updates
+	Regions         []RegionRule `json:"regions"`        // Region mapping table for region groups
 	Profiles        []Profile `json:"profiles"`
 }
 
+// Override returns the override content that applies to a profile: the
+// profile's own override, then the global override, then the built-in default.
+// An empty profileID resolves the global override.
+func (m *MetaData) Override(name, profileID string) string {
+	if content, ok := m.ProfileOverrides[profileID][name]; ok && profileID != "" {
+		return content
+	}
+
+	switch name {
+	case "tun":
+		if m.TunConfig != "" {
+			return m.TunConfig
+		}
+		return DefaultTunConfig
+	case "mixed":
+		if m.MixedConfig != "" {
+			return m.MixedConfig
+		}
+		return DefaultMixedConfig
+	case "dns":
+		if m.DNSConfig != "" {
+			return m.DNSConfig
+		}
+		return DefaultDNSConfig
+	case "split":
+		if m.SplitConfig != "" {
+			return m.SplitConfig
+		}
+		return DefaultSplitConfig
+	default:
+		return "{}"
+	}
+}
+
 // GlobalSettings represents user preferences
 type GlobalSettings struct {
 	Mirror          string `json:"mirror"`
@@ -68,9 +365,13 @@ type GlobalSettings struct {
 	ThemeMode       string `json:"theme_mode"`
 	AccentColor     string `json:"accent_color"`
 	IPv6Enabled     bool   `json:"ipv6_enabled"`
+	StrictPorts     bool   `json:"strict_ports"`
+	AllowLAN        bool   `json:"allow_lan"`
+	LAN             LANSharing `json:"lan"`
 	LogLevel        string `json:"log_level"`
 	LogToFile       bool   `json:"log_to_file"`
 	PreRelease      bool   `json:"pre_release"`
+	Regions         []RegionRule `json:"regions"`
 }
 
 // AppState represents UI runtime state
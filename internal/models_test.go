@@ -0,0 +1,45 @@
+package internal
+
+import "testing"
+
+func TestMetaDataOverride(t *testing.T) {
+	meta := &MetaData{
+		TunConfig: `{"global":"tun"}`,
+		DNSConfig: `{"global":"dns"}`,
+		ProfileOverrides: map[string]map[string]string{
+			"p": {"tun": `{"profile":"tun"}`, "split": `{"profile":"split"}`},
+			"":  {"tun": `{"empty id":"tun"}`},
+		},
+	}
+
+	tests := []struct {
+		name      string
+		profileID string
+		want      string
+	}{
+		// Profile override first
+		{"tun", "p", `{"profile":"tun"}`},
+		{"split", "p", `{"profile":"split"}`},
+		// Then the global override
+		{"dns", "p", `{"global":"dns"}`},
+		{"tun", "other", `{"global":"tun"}`},
+		{"tun", "", `{"global":"tun"}`}, // Entries under an empty ID are ignored
+		// Then the default
+		{"mixed", "p", DefaultMixedConfig},
+		{"split", "other", DefaultSplitConfig},
+		{"dns", "", `{"global":"dns"}`},
+		{"unknown", "p", "{}"},
+	}
+	for _, tt := range tests {
+		if got := meta.Override(tt.name, tt.profileID); got != tt.want {
+			t.Errorf("Override(%q, %q) = %s, want %s", tt.name, tt.profileID, got, tt.want)
+		}
+	}
+
+	empty := &MetaData{}
+	for name, want := range map[string]string{"tun": DefaultTunConfig, "mixed": DefaultMixedConfig, "dns": DefaultDNSConfig, "split": DefaultSplitConfig} {
+		if got := empty.Override(name, "p"); got != want {
+			t.Errorf("Override(%q) without overrides = %s, want the default", name, got)
+		}
+	}
+}
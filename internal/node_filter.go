@@ -0,0 +1,338 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// groupTypes are outbound types that reference other outbounds by tag
+var groupTypes = []string{"selector", "urltest"}
+
+// nonNodeTypes are outbound types that are not proxy servers
+var nonNodeTypes = []string{"selector", "urltest", "direct", "block", "dns"}
+
+// Validate checks that all patterns of the filter compile
+func (f *NodeFilter) Validate() error {
+	if _, err := f.compile(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// compiledFilter is a NodeFilter with its patterns compiled
+type compiledFilter struct {
+	*NodeFilter
+	include *regexp.Regexp
+	exclude *regexp.Regexp
+	rename  []*regexp.Regexp
+	relabel func(tag string) string // Applied before the rename rules if set
+}
+
+// compile compiles the patterns of the filter
+func (f *NodeFilter) compile() (*compiledFilter, error) {
+	c := &compiledFilter{NodeFilter: f}
+	var err error
+	if f.Include != "" {
+		if c.include, err = regexp.Compile(f.Include); err != nil {
+			return nil, fmt.Errorf("invalid include pattern: %w", err)
+		}
+	}
+	if f.Exclude != "" {
+		if c.exclude, err = regexp.Compile(f.Exclude); err != nil {
+			return nil, fmt.Errorf("invalid exclude pattern: %w", err)
+		}
+	}
+	for _, r := range f.Rename {
+		re, err := regexp.Compile(r.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rename pattern %q: %w", r.Pattern, err)
+		}
+		c.rename = append(c.rename, re)
+	}
+	return c, nil
+}
+
+// keeps reports whether a node passes the include and exclude rules
+func (c *compiledFilter) keeps(tag, nodeType string) bool {
+	if c.include != nil && !c.include.MatchString(tag) {
+		return false
+	}
+	if c.exclude != nil && c.exclude.MatchString(tag) {
+		return false
+	}
+	if len(c.Types) > 0 && !slices.Contains(c.Types, nodeType) {
+		return false
+	}
+	return !slices.Contains(c.ExcludeTypes, nodeType)
+}
+
+// renamed applies the relabel function and the rename rules to a tag in order
+func (c *compiledFilter) renamed(tag string) string {
+	if c.relabel != nil {
+		tag = c.relabel(tag)
+	}
+	for i, re := range c.rename {
+		tag = re.ReplaceAllString(tag, c.Rename[i].Replace)
+	}
+	return strings.TrimSpace(tag)
+}
+
+// applyNodeFilter filters, renames and dedupes the proxy outbounds of a
+// sing-box config. Groups, route rules, the final outbound and detours are
+// updated to follow renamed tags; references to removed nodes are dropped and
+// groups left empty are removed along with them. relabel, if not nil, maps
+// each kept node's tag before the rename rules run.
+func applyNodeFilter(content []byte, f *NodeFilter, relabel func(tag string) string) ([]byte, error) {
+	if f == nil || f.isEmpty() {
+		return content, nil
+	}
+
+	c, err := f.compile()
+	if err != nil {
+		return nil, err
+	}
+	c.relabel = relabel
+
+	var config map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	decoder.UseNumber()
+	if err := decoder.Decode(&config); err != nil {
+		return nil, fmt.Errorf("parse config failed: %w", err)
+	}
+
+	outbounds, _ := config["outbounds"].([]interface{})
+
+	// First pass: decide the fate of every node. renames maps an original
+	// tag to its new tag, or to "" if the node was removed.
+	renames := make(map[string]string)
+	used := make(map[string]bool)
+	for _, item := range outbounds {
+		if ob, ok := item.(map[string]interface{}); ok && !isNode(ob) {
+			tag, _ := ob["tag"].(string)
+			used[tag] = true
+		}
+	}
+
+	seen := make(map[string]string) // Dedupe key -> original tag of the kept node
+	var kept []interface{}
+	for _, item := range outbounds {
+		ob, ok := item.(map[string]interface{})
+		if !ok || !isNode(ob) {
+			kept = append(kept, item)
+			continue
+		}
+
+		tag, _ := ob["tag"].(string)
+		nodeType, _ := ob["type"].(string)
+		if !c.keeps(tag, nodeType) {
+			renames[tag] = ""
+			continue
+		}
+
+		if c.Dedupe {
+			key := nodeKey(ob)
+			if original, ok := seen[key]; ok {
+				renames[tag] = renames[original]
+				continue
+			}
+			seen[key] = tag
+		}
+
+		newTag := c.renamed(tag)
+		if newTag == "" {
+			newTag = tag
+		}
+		base := newTag
+		for i := 2; used[newTag]; i++ {
+			newTag = fmt.Sprintf("%s %d", base, i)
+		}
+		used[newTag] = true
+		renames[tag] = newTag
+		ob["tag"] = newTag
+		kept = append(kept, ob)
+	}
+
+	outbounds = updateGroups(kept, renames)
+	config["outbounds"] = outbounds
+
+	// Detours of remaining outbounds
+	for _, item := range outbounds {
+		if ob, ok := item.(map[string]interface{}); ok {
+			if detour, ok := ob["detour"].(string); ok {
+				if mapped, found := renames[detour]; found {
+					if mapped == "" {
+						delete(ob, "detour")
+					} else {
+						ob["detour"] = mapped
+					}
+				}
+			}
+		}
+	}
+
+	if route, ok := config["route"].(map[string]interface{}); ok {
+		if final, ok := route["final"].(string); ok {
+			if mapped, found := renames[final]; found {
+				if mapped == "" {
+					delete(route, "final")
+				} else {
+					route["final"] = mapped
+				}
+			}
+		}
+
+		if rules, ok := route["rules"].([]interface{}); ok {
+			var keptRules []interface{}
+			for _, item := range rules {
+				rule, ok := item.(map[string]interface{})
+				if !ok {
+					keptRules = append(keptRules, item)
+					continue
+				}
+				if target, ok := rule["outbound"].(string); ok {
+					if mapped, found := renames[target]; found {
+						if mapped == "" {
+							continue
+						}
+						rule["outbound"] = mapped
+					}
+				}
+				keptRules = append(keptRules, rule)
+			}
+			route["rules"] = keptRules
+		}
+	}
+
+	if dns, ok := config["dns"].(map[string]interface{}); ok {
+		if servers, ok := dns["servers"].([]interface{}); ok {
+			for _, item := range servers {
+				if server, ok := item.(map[string]interface{}); ok {
+					if detour, ok := server["detour"].(string); ok {
+						if mapped, found := renames[detour]; found {
+							if mapped == "" {
+								delete(server, "detour")
+							} else {
+								server["detour"] = mapped
+							}
+						}
+					}
+				}
+			}
+		}
+	}
+
+	return json.MarshalIndent(config, "", "  ")
+}
+
+// isEmpty reports whether the filter has no rules
+func (f *NodeFilter) isEmpty() bool {
+	return f.Include == "" && f.Exclude == "" && len(f.Types) == 0 &&
+		len(f.ExcludeTypes) == 0 && len(f.Rename) == 0 && !f.Dedupe && !f.GeoFix
+}
+
+// updateGroups rewrites the members of selector and urltest groups using
+// renames. Groups left without members are removed and recorded in renames
+// so that references to them are dropped as well.
+func updateGroups(outbounds []interface{}, renames map[string]string) []interface{} {
+	for _, item := range outbounds {
+		ob, ok := item.(map[string]interface{})
+		if !ok || !isGroup(ob) {
+			continue
+		}
+
+		members, _ := ob["outbounds"].([]interface{})
+		updated := make([]interface{}, 0, len(members))
+		present := make(map[string]bool)
+		for _, m := range members {
+			tag, _ := m.(string)
+			if mapped, found := renames[tag]; found {
+				tag = mapped
+			}
+			if tag == "" || present[tag] {
+				continue
+			}
+			present[tag] = true
+			updated = append(updated, tag)
+		}
+		ob["outbounds"] = updated
+
+		if def, ok := ob["default"].(string); ok {
+			if mapped, found := renames[def]; found {
+				def = mapped
+			}
+			if present[def] {
+				ob["default"] = def
+			} else {
+				delete(ob, "default")
+			}
+		}
+	}
+
+	// Removing an empty group may empty the groups that contain it
+	removedGroups := make(map[string]bool)
+	for {
+		removed := false
+		kept := outbounds[:0]
+		for _, item := range outbounds {
+			ob, ok := item.(map[string]interface{})
+			if !ok || !isGroup(ob) {
+				kept = append(kept, item)
+				continue
+			}
+
+			members, _ := ob["outbounds"].([]interface{})
+			remaining := members[:0]
+			for _, m := range members {
+				if tag, _ := m.(string); !removedGroups[tag] {
+					remaining = append(remaining, m)
+				}
+			}
+			ob["outbounds"] = remaining
+			if def, ok := ob["default"].(string); ok && removedGroups[def] {
+				delete(ob, "default")
+			}
+
+			if len(remaining) == 0 {
+				tag, _ := ob["tag"].(string)
+				removedGroups[tag] = true
+				removed = true
+				continue
+			}
+			kept = append(kept, ob)
+		}
+		outbounds = kept
+		if !removed {
+			break
+		}
+	}
+
+	for tag := range removedGroups {
+		renames[tag] = ""
+	}
+	return outbounds
+}
+
+// isNode reports whether an outbound is a proxy server
+func isNode(ob map[string]interface{}) bool {
+	t, _ := ob["type"].(string)
+	return !slices.Contains(nonNodeTypes, t)
+}
+
+// isGroup reports whether an outbound references other outbounds
+func isGroup(ob map[string]interface{}) bool {
+	t, _ := ob["type"].(string)
+	return slices.Contains(groupTypes, t)
+}
+
+// nodeKey identifies a node by its server, port and credentials
+func nodeKey(ob map[string]interface{}) string {
+	parts := make([]string, 0, 7)
+	for _, field := range []string{"type", "server", "server_port", "uuid", "password", "method", "username"} {
+		parts = append(parts, fmt.Sprint(ob[field]))
+	}
+	return strings.Join(parts, "|")
+}
@@ -0,0 +1,237 @@
+package internal
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/tidwall/gjson"
+)
+
+// filterFixture has nodes of several types, a duplicate server, nested groups
+// and references from detours, route rules, the final outbound and DNS
+const filterFixture = `{
+  "dns": {"servers": [
+    {"tag": "remote", "address": "tls://8.8.8.8", "detour": "US 01"},
+    {"tag": "hk", "address": "tls://1.1.1.1", "detour": "HK 01"}
+  ]},
+  "outbounds": [
+    {"type": "selector", "tag": "Proxy", "outbounds": ["Auto", "US", "HK 01", "US 01", "direct"], "default": "US 01"},
+    {"type": "urltest", "tag": "Auto", "outbounds": ["HK 01", "HK 02", "US 01", "JP 01"]},
+    {"type": "selector", "tag": "US", "outbounds": ["US 01", "US 02"], "default": "US 02"},
+    {"type": "shadowsocks", "tag": "HK 01", "server": "hk.example.com", "server_port": 443, "method": "aes-128-gcm", "password": "a"},
+    {"type": "trojan", "tag": "HK 02", "server": "hk.example.com", "server_port": 443, "password": "a"},
+    {"type": "vmess", "tag": "US 01", "server": "us.example.com", "server_port": 443, "uuid": "u"},
+    {"type": "vmess", "tag": "US 02", "server": "us.example.com", "server_port": 443, "uuid": "u", "detour": "HK 01"},
+    {"type": "hysteria2", "tag": "JP 01", "server": "jp.example.com", "server_port": 443, "password": "p"},
+    {"type": "direct", "tag": "direct"},
+    {"type": "block", "tag": "Ads"}
+  ],
+  "route": {
+    "rules": [
+      {"action": "sniff"},
+      {"domain_suffix": ["hk.example.org"], "outbound": "HK 01"},
+      {"domain_suffix": ["us.example.org"], "outbound": "US"},
+      {"domain_suffix": ["ads.example.org"], "outbound": "Ads"}
+    ],
+    "final": "US 01"
+  }
+}`
+
+// filterResult is the part of a filtered config the tests look at
+type filterResult struct {
+	tags    []string
+	members map[string][]string
+	def     map[string]string
+	detours map[string]string // Outbound or DNS server tag -> detour
+	rules   []string          // Outbound of each route rule, "" for actions
+	final   string
+}
+
+func filterFixtureWith(t *testing.T, f *NodeFilter, relabel func(string) string) filterResult {
+	t.Helper()
+	out, err := applyNodeFilter([]byte(filterFixture), f, relabel)
+	if err != nil {
+		t.Fatalf("applyNodeFilter() error = %v", err)
+	}
+	checkConfig(t, out)
+
+	r := filterResult{members: map[string][]string{}, def: map[string]string{}, detours: map[string]string{}}
+	for _, ob := range gjson.GetBytes(out, "outbounds").Array() {
+		tag := ob.Get("tag").String()
+		r.tags = append(r.tags, tag)
+		if members := ob.Get("outbounds"); members.Exists() {
+			r.members[tag] = []string{}
+			for _, m := range members.Array() {
+				r.members[tag] = append(r.members[tag], m.String())
+			}
+		}
+		if def := ob.Get("default"); def.Exists() {
+			r.def[tag] = def.String()
+		}
+		if detour := ob.Get("detour"); detour.Exists() {
+			r.detours[tag] = detour.String()
+		}
+	}
+	for _, server := range gjson.GetBytes(out, "dns.servers").Array() {
+		if detour := server.Get("detour"); detour.Exists() {
+			r.detours[server.Get("tag").String()] = detour.String()
+		}
+	}
+	for _, rule := range gjson.GetBytes(out, "route.rules").Array() {
+		r.rules = append(r.rules, rule.Get("outbound").String())
+	}
+	r.final = gjson.GetBytes(out, "route.final").String()
+	return r
+}
+
+func TestApplyNodeFilterSelection(t *testing.T) {
+	tests := []struct {
+		name   string
+		filter NodeFilter
+		nodes  []string
+	}{
+		{"include", NodeFilter{Include: "^HK"}, []string{"HK 01", "HK 02"}},
+		{"exclude", NodeFilter{Exclude: "01$"}, []string{"HK 02", "US 02"}},
+		{"include and exclude", NodeFilter{Include: "HK|US", Exclude: "02"}, []string{"HK 01", "US 01"}},
+		{"types", NodeFilter{Types: []string{"vmess", "hysteria2"}}, []string{"US 01", "US 02", "JP 01"}},
+		{"exclude types", NodeFilter{ExcludeTypes: []string{"vmess"}}, []string{"HK 01", "HK 02", "JP 01"}},
+		{"types and pattern", NodeFilter{Include: "0[12]", Types: []string{"trojan"}}, []string{"HK 02"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := filterFixtureWith(t, &tt.filter, nil)
+			var nodes []string
+			for _, tag := range r.tags {
+				if _, group := r.members[tag]; !group && tag != "direct" && tag != "Ads" {
+					nodes = append(nodes, tag)
+				}
+			}
+			if !reflect.DeepEqual(nodes, tt.nodes) {
+				t.Errorf("nodes = %v, want %v", nodes, tt.nodes)
+			}
+		})
+	}
+}
+
+func TestApplyNodeFilterReferences(t *testing.T) {
+	// Removing the US nodes empties the US group, which is dropped from Proxy too
+	r := filterFixtureWith(t, &NodeFilter{Exclude: "^US"}, nil)
+
+	wantTags := []string{"Proxy", "Auto", "HK 01", "HK 02", "JP 01", "direct", "Ads"}
+	if !reflect.DeepEqual(r.tags, wantTags) {
+		t.Errorf("tags = %v, want %v", r.tags, wantTags)
+	}
+	wantMembers := map[string][]string{
+		"Proxy": {"Auto", "HK 01", "direct"},
+		"Auto":  {"HK 01", "HK 02", "JP 01"},
+	}
+	if !reflect.DeepEqual(r.members, wantMembers) {
+		t.Errorf("members = %v, want %v", r.members, wantMembers)
+	}
+	if len(r.def) != 0 {
+		t.Errorf("default of a removed node kept: %v", r.def)
+	}
+	if want := map[string]string{"hk": "HK 01"}; !reflect.DeepEqual(r.detours, want) {
+		t.Errorf("detours = %v, want %v", r.detours, want)
+	}
+	// Rules to removed outbounds are dropped, and so is the final outbound
+	if want := []string{"", "HK 01", "Ads"}; !reflect.DeepEqual(r.rules, want) {
+		t.Errorf("rule outbounds = %v, want %v", r.rules, want)
+	}
+	if r.final != "" {
+		t.Errorf("final = %q, want it removed", r.final)
+	}
+}
+
+func TestApplyNodeFilterRename(t *testing.T) {
+	f := &NodeFilter{Rename: []RenameRule{
+		{Pattern: `^(\w+) 0(\d)$`, Replace: "$1-$2"},
+		{Pattern: `^HK`, Replace: "Hong Kong"},
+		{Pattern: `^JP-1$`, Replace: "  "}, // A blank result keeps the original tag
+	}}
+	r := filterFixtureWith(t, f, nil)
+
+	wantTags := []string{"Proxy", "Auto", "US", "Hong Kong-1", "Hong Kong-2", "US-1", "US-2", "JP 01", "direct", "Ads"}
+	if !reflect.DeepEqual(r.tags, wantTags) {
+		t.Errorf("tags = %v, want %v", r.tags, wantTags)
+	}
+	if got := r.members["Proxy"]; !reflect.DeepEqual(got, []string{"Auto", "US", "Hong Kong-1", "US-1", "direct"}) {
+		t.Errorf("Proxy members = %v", got)
+	}
+	if want := map[string]string{"Proxy": "US-1", "US": "US-2"}; !reflect.DeepEqual(r.def, want) {
+		t.Errorf("defaults = %v, want %v", r.def, want)
+	}
+	if want := map[string]string{"US-2": "Hong Kong-1", "remote": "US-1", "hk": "Hong Kong-1"}; !reflect.DeepEqual(r.detours, want) {
+		t.Errorf("detours = %v, want %v", r.detours, want)
+	}
+	if want := []string{"", "Hong Kong-1", "US", "Ads"}; !reflect.DeepEqual(r.rules, want) {
+		t.Errorf("rule outbounds = %v, want %v", r.rules, want)
+	}
+	if r.final != "US-1" {
+		t.Errorf("final = %q, want US-1", r.final)
+	}
+}
+
+func TestApplyNodeFilterRenameCollisions(t *testing.T) {
+	// Every node renamed to the same tag, and one to an existing group's tag
+	f := &NodeFilter{Rename: []RenameRule{{Pattern: `^(HK|JP).*`, Replace: "Node"}, {Pattern: `^US 01$`, Replace: "Auto"}}}
+	r := filterFixtureWith(t, f, nil)
+
+	wantTags := []string{"Proxy", "Auto", "US", "Node", "Node 2", "Auto 2", "US 02", "Node 3", "direct", "Ads"}
+	if !reflect.DeepEqual(r.tags, wantTags) {
+		t.Errorf("tags = %v, want %v", r.tags, wantTags)
+	}
+	if got := r.members["Auto"]; !reflect.DeepEqual(got, []string{"Node", "Node 2", "Auto 2", "Node 3"}) {
+		t.Errorf("Auto members = %v", got)
+	}
+}
+
+func TestApplyNodeFilterDedupe(t *testing.T) {
+	r := filterFixtureWith(t, &NodeFilter{Dedupe: true}, nil)
+
+	// HK 02 differs from HK 01 by type, US 02 only adds a detour
+	wantTags := []string{"Proxy", "Auto", "US", "HK 01", "HK 02", "US 01", "JP 01", "direct", "Ads"}
+	if !reflect.DeepEqual(r.tags, wantTags) {
+		t.Errorf("tags = %v, want %v", r.tags, wantTags)
+	}
+	// References to the duplicate follow the kept node, without repeating it
+	if got := r.members["US"]; !reflect.DeepEqual(got, []string{"US 01"}) {
+		t.Errorf("US members = %v, want [US 01]", got)
+	}
+	if got := r.def["US"]; got != "US 01" {
+		t.Errorf("US default = %q, want US 01", got)
+	}
+}
+
+func TestApplyNodeFilterRelabel(t *testing.T) {
+	relabel := func(tag string) string { return "[x] " + tag }
+	f := &NodeFilter{GeoFix: true, Rename: []RenameRule{{Pattern: `^\[x\] HK`, Replace: "HK!"}}}
+	r := filterFixtureWith(t, f, relabel)
+
+	// The relabel runs first, so rename rules see its output
+	if r.tags[3] != "HK! 01" || r.tags[5] != "[x] US 01" {
+		t.Errorf("tags = %v", r.tags)
+	}
+}
+
+func TestApplyNodeFilterNoop(t *testing.T) {
+	content := []byte(filterFixture)
+	for _, f := range []*NodeFilter{nil, {}} {
+		out, err := applyNodeFilter(content, f, nil)
+		if err != nil || string(out) != string(content) {
+			t.Errorf("applyNodeFilter(%v) changed the config", f)
+		}
+	}
+
+	if _, err := applyNodeFilter([]byte("{"), &NodeFilter{Dedupe: true}, nil); err == nil {
+		t.Error("applyNodeFilter() accepted invalid JSON")
+	}
+	for _, f := range []NodeFilter{{Include: "("}, {Exclude: "["}, {Rename: []RenameRule{{Pattern: "*"}}}} {
+		if err := f.Validate(); err == nil {
+			t.Errorf("Validate(%+v) accepted a bad pattern", f)
+		}
+		if _, err := applyNodeFilter(content, &f, nil); err == nil {
+			t.Errorf("applyNodeFilter(%+v) accepted a bad pattern", f)
+		}
+	}
+}
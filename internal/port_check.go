@@ -0,0 +1,149 @@
+package internal
+
+import (
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+// udpInboundTypes lists inbound types that listen on UDP only
+var udpInboundTypes = []string{"hysteria", "hysteria2", "tuic"}
+
+// dualInboundTypes lists inbound types that listen on both TCP and UDP
+var dualInboundTypes = []string{"mixed", "socks", "shadowsocks"}
+
+// listenNetworks returns the networks an inbound of the given type listens on
+func listenNetworks(inboundType string) []string {
+	if slices.Contains(udpInboundTypes, inboundType) {
+		return []string{"udp"}
+	}
+	if slices.Contains(dualInboundTypes, inboundType) {
+		return []string{"tcp", "udp"}
+	}
+	return []string{"tcp"}
+}
+
+// resolvePortConflicts checks the listen port of every inbound of a config
+// before launch. A port that is taken, by another program or by an earlier
+// inbound, is replaced by a free one, or reported as an error in strict mode.
+// The system proxy set by a mixed inbound follows its rewritten port.
+func resolvePortConflicts(content []byte, strict bool) ([]byte, []string, error) {
+	var warnings []string
+	claimed := make(map[string]bool) // network/port already used by an inbound
+
+	inbounds := gjson.GetBytes(content, "inbounds").Array()
+	for i, in := range inbounds {
+		port := int(in.Get("listen_port").Int())
+		if port <= 0 {
+			continue
+		}
+		tag := in.Get("tag").String()
+		if tag == "" {
+			tag = in.Get("type").String()
+		}
+		networks := listenNetworks(in.Get("type").String())
+		host := in.Get("listen").String()
+
+		if portsFree(claimed, networks, host, port) {
+			claimPort(claimed, networks, port)
+			continue
+		}
+
+		if strict {
+			return nil, nil, fmt.Errorf("port %d of inbound %q is already in use", port, tag)
+		}
+		newPort, err := freeInboundPort(claimed, networks, host)
+		if err != nil {
+			return nil, nil, fmt.Errorf("port %d of inbound %q is already in use and no free port was found: %w", port, tag, err)
+		}
+		if content, err = sjson.SetBytes(content, fmt.Sprintf("inbounds.%d.listen_port", i), newPort); err != nil {
+			return nil, nil, err
+		}
+		claimPort(claimed, networks, newPort)
+		warnings = append(warnings, fmt.Sprintf("port %d of inbound %q is already in use, using %d", port, tag, newPort))
+	}
+
+	return content, warnings, nil
+}
+
+// portsFree reports whether port is unclaimed and can be bound on host for every network
+func portsFree(claimed map[string]bool, networks []string, host string, port int) bool {
+	for _, network := range networks {
+		if claimed[network+"/"+strconv.Itoa(port)] || !portAvailable(network, host, port) {
+			return false
+		}
+	}
+	return true
+}
+
+// claimPort records port as used on every network
+func claimPort(claimed map[string]bool, networks []string, port int) {
+	for _, network := range networks {
+		claimed[network+"/"+strconv.Itoa(port)] = true
+	}
+}
+
+// freeInboundPort finds a port that is free on host for every network
+func freeInboundPort(claimed map[string]bool, networks []string, host string) (int, error) {
+	for attempt := 0; attempt < 10; attempt++ {
+		port, err := freeListenPort(networks[0], host)
+		if err != nil {
+			return 0, err
+		}
+		if portsFree(claimed, networks, host, port) {
+			return port, nil
+		}
+	}
+	return 0, fmt.Errorf("no port is free on %s", strings.Join(networks, " and "))
+}
+
+// listenHost returns the address to probe for an inbound's listen field
+func listenHost(host string) string {
+	if host == "" || host == "::" {
+		return "0.0.0.0"
+	}
+	return host
+}
+
+// portAvailable reports whether port can be bound on host
+func portAvailable(network, host string, port int) bool {
+	addr := net.JoinHostPort(listenHost(host), strconv.Itoa(port))
+	if network == "udp" {
+		conn, err := net.ListenPacket("udp", addr)
+		if err != nil {
+			return false
+		}
+		conn.Close()
+		return true
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return false
+	}
+	l.Close()
+	return true
+}
+
+// freeListenPort asks the system for a free port on host
+func freeListenPort(network, host string) (int, error) {
+	addr := net.JoinHostPort(listenHost(host), "0")
+	if network == "udp" {
+		conn, err := net.ListenPacket("udp", addr)
+		if err != nil {
+			return 0, err
+		}
+		defer conn.Close()
+		return conn.LocalAddr().(*net.UDPAddr).Port, nil
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return 0, err
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port, nil
+}
@@ -0,0 +1,151 @@
+package internal
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/tidwall/gjson"
+)
+
+// takenPort listens on a local TCP port for the rest of the test
+func takenPort(t *testing.T) int {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+// freePort returns a local TCP port that is free at the time of the call
+func freePort(t *testing.T) int {
+	t.Helper()
+	port, err := freeListenPort("tcp", "127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return port
+}
+
+func inboundConfig(inbounds ...string) []byte {
+	return []byte(`{"inbounds": [` + strings.Join(inbounds, ",") + `]}`)
+}
+
+func TestResolvePortConflicts(t *testing.T) {
+	taken := takenPort(t)
+	free := freePort(t)
+	content := inboundConfig(
+		fmt.Sprintf(`{"type": "mixed", "tag": "mixed-in", "listen": "127.0.0.1", "listen_port": %d}`, taken),
+		fmt.Sprintf(`{"type": "socks", "tag": "socks-in", "listen": "127.0.0.1", "listen_port": %d}`, free),
+		fmt.Sprintf(`{"type": "http", "listen": "127.0.0.1", "listen_port": %d}`, free),
+		// Same number, other network: no conflict with the TCP listener
+		fmt.Sprintf(`{"type": "tuic", "tag": "tuic-in", "listen": "127.0.0.1", "listen_port": %d}`, taken),
+		`{"type": "tun", "tag": "tun-in"}`,
+	)
+
+	out, warnings, err := resolvePortConflicts(content, false)
+	if err != nil {
+		t.Fatalf("resolvePortConflicts() error = %v", err)
+	}
+
+	ports := gjson.GetBytes(out, "inbounds.#.listen_port").Array()
+	if p := int(ports[0].Int()); p == taken || p == 0 {
+		t.Errorf("taken port kept: %d", p)
+	}
+	if p := int(ports[1].Int()); p != free {
+		t.Errorf("free port changed to %d", p)
+	}
+	// The second inbound on the same port moves, the first keeps it
+	if p := int(ports[2].Int()); p == free || p == 0 || p == int(ports[0].Int()) {
+		t.Errorf("duplicate port resolved to %d", p)
+	}
+	if p := int(ports[3].Int()); p != taken {
+		t.Errorf("UDP inbound moved to %d", p)
+	}
+	if gjson.GetBytes(out, "inbounds.4.listen_port").Exists() {
+		t.Error("listen port added to an inbound without one")
+	}
+
+	if len(warnings) != 2 || !strings.Contains(warnings[0], `"mixed-in"`) || !strings.Contains(warnings[1], `"http"`) {
+		t.Errorf("warnings = %v", warnings)
+	}
+	if !strings.Contains(warnings[0], fmt.Sprintf("port %d", taken)) || !strings.Contains(warnings[0], fmt.Sprintf("using %d", ports[0].Int())) {
+		t.Errorf("warning does not name both ports: %s", warnings[0])
+	}
+}
+
+func TestResolvePortConflictsStrict(t *testing.T) {
+	taken := takenPort(t)
+	free := freePort(t)
+
+	content := inboundConfig(fmt.Sprintf(`{"type": "mixed", "tag": "mixed-in", "listen": "127.0.0.1", "listen_port": %d}`, free))
+	out, warnings, err := resolvePortConflicts(content, true)
+	if err != nil || len(warnings) != 0 || string(out) != string(content) {
+		t.Errorf("strict mode changed a free config: %s, %v, %v", out, warnings, err)
+	}
+
+	content = inboundConfig(fmt.Sprintf(`{"type": "mixed", "tag": "mixed-in", "listen": "127.0.0.1", "listen_port": %d}`, taken))
+	if _, _, err := resolvePortConflicts(content, true); err == nil || !strings.Contains(err.Error(), `inbound "mixed-in"`) {
+		t.Errorf("strict mode error = %v", err)
+	}
+
+	// Two inbounds on one port conflict even if the port itself is free
+	content = inboundConfig(
+		fmt.Sprintf(`{"type": "mixed", "tag": "a", "listen": "127.0.0.1", "listen_port": %d}`, free),
+		fmt.Sprintf(`{"type": "socks", "tag": "b", "listen": "127.0.0.1", "listen_port": %d}`, free),
+	)
+	if _, _, err := resolvePortConflicts(content, true); err == nil || !strings.Contains(err.Error(), `inbound "b"`) {
+		t.Errorf("strict mode error for a shared port = %v", err)
+	}
+}
+
+func TestResolvePortConflictsUDP(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	udpTaken := conn.LocalAddr().(*net.UDPAddr).Port
+	free := freePort(t)
+
+	content := inboundConfig(
+		// Mixed and shadowsocks inbounds also listen on UDP
+		fmt.Sprintf(`{"type": "mixed", "tag": "mixed-in", "listen": "127.0.0.1", "listen_port": %d}`, udpTaken),
+		fmt.Sprintf(`{"type": "shadowsocks", "tag": "ss-in", "listen": "127.0.0.1", "listen_port": %d}`, free),
+		fmt.Sprintf(`{"type": "tuic", "tag": "tuic-in", "listen": "127.0.0.1", "listen_port": %d}`, free),
+		fmt.Sprintf(`{"type": "http", "tag": "http-in", "listen": "127.0.0.1", "listen_port": %d}`, udpTaken),
+	)
+	out, warnings, err := resolvePortConflicts(content, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ports := gjson.GetBytes(out, "inbounds.#.listen_port").Array()
+	if p := int(ports[0].Int()); p == udpTaken || p == 0 {
+		t.Errorf("mixed inbound kept a port taken on UDP: %d", p)
+	}
+	if p := int(ports[1].Int()); p != free {
+		t.Errorf("shadowsocks port changed to %d", p)
+	}
+	if p := int(ports[2].Int()); p == free || p == 0 {
+		t.Errorf("tuic inbound kept the shadowsocks UDP port: %d", p)
+	}
+	// TCP only, so the UDP listener is no conflict
+	if p := int(ports[3].Int()); p != udpTaken {
+		t.Errorf("http inbound moved to %d", p)
+	}
+	if len(warnings) != 2 || !strings.Contains(warnings[0], `"mixed-in"`) || !strings.Contains(warnings[1], `"tuic-in"`) {
+		t.Errorf("warnings = %v", warnings)
+	}
+}
+
+func TestListenHost(t *testing.T) {
+	for host, want := range map[string]string{"": "0.0.0.0", "::": "0.0.0.0", "127.0.0.1": "127.0.0.1", "192.168.1.2": "192.168.1.2"} {
+		if got := listenHost(host); got != want {
+			t.Errorf("listenHost(%q) = %q, want %q", host, got, want)
+		}
+	}
+}
@@ -0,0 +1,220 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"slices"
+
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+// SetProviders makes a profile a template whose groups receive the nodes of
+// the given provider profiles at launch. An empty list turns it back into a
+// standalone profile.
+func (pm *ProfileManager) SetProviders(id string, rules []ProviderRule) error {
+	template, err := pm.findProfile(id)
+	if err != nil {
+		return err
+	}
+
+	content, err := os.ReadFile(pm.profilePath(template.ID))
+	if err != nil {
+		return fmt.Errorf("read profile failed: %w", err)
+	}
+	groups := make(map[string]bool)
+	gjson.GetBytes(content, "outbounds").ForEach(func(_, ob gjson.Result) bool {
+		if slices.Contains(groupTypes, ob.Get("type").String()) {
+			groups[ob.Get("tag").String()] = true
+		}
+		return true
+	})
+
+	for _, rule := range rules {
+		if rule.ProfileID == id {
+			return fmt.Errorf("a profile cannot be its own provider")
+		}
+		provider, err := pm.findProfile(rule.ProfileID)
+		if err != nil {
+			return fmt.Errorf("provider %q: %w", rule.ProfileID, err)
+		}
+		if len(provider.Providers) > 0 {
+			return fmt.Errorf("provider %q is itself a template", provider.Name)
+		}
+		if _, err := regexp.Compile(rule.Pattern); err != nil {
+			return fmt.Errorf("invalid pattern %q: %w", rule.Pattern, err)
+		}
+		if len(rule.Groups) == 0 {
+			return fmt.Errorf("provider %q has no target groups", provider.Name)
+		}
+		for _, g := range rule.Groups {
+			if !groups[g] {
+				return fmt.Errorf("group %q not found in template", g)
+			}
+		}
+	}
+
+	return pm.storage.Update(func(meta *MetaData) error {
+		var target *Profile
+		for i := range meta.Profiles {
+			p := &meta.Profiles[i]
+			if p.ID == id {
+				target = p
+				continue
+			}
+			// Templates are not nested, so a provider cannot become a template
+			if len(rules) > 0 && slices.ContainsFunc(p.Providers, func(r ProviderRule) bool { return r.ProfileID == id }) {
+				return fmt.Errorf("profile is a provider of %q", p.Name)
+			}
+		}
+		if target == nil {
+			return fmt.Errorf("profile not found")
+		}
+		target.Providers = rules
+		return nil
+	})
+}
+
+// usesProfile reports whether the runtime config of the active profile is
+// built from profile id, either directly or as one of its providers
+func usesProfile(meta *MetaData, id string) bool {
+	if meta.ActiveID == id {
+		return true
+	}
+	for _, p := range meta.Profiles {
+		if p.ID != meta.ActiveID {
+			continue
+		}
+		for _, rule := range p.Providers {
+			if rule.ProfileID == id {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// composeProviders adds the nodes of each provider profile to a template
+// config and appends the tags matching each rule's pattern to its groups.
+// Node tags that clash with the template or another provider get a numeric
+// suffix.
+func composeProviders(content []byte, rules []ProviderRule, providerPaths map[string]string) ([]byte, error) {
+	if len(rules) == 0 {
+		return content, nil
+	}
+
+	used := make(map[string]bool)
+	groups := make(map[string]int)              // Group tag -> index in outbounds
+	members := make(map[string]map[string]bool) // Group tag -> current members
+	gjson.GetBytes(content, "outbounds").ForEach(func(i, ob gjson.Result) bool {
+		tag := ob.Get("tag").String()
+		used[tag] = true
+		if slices.Contains(groupTypes, ob.Get("type").String()) {
+			groups[tag] = int(i.Int())
+			members[tag] = make(map[string]bool)
+			for _, m := range ob.Get("outbounds").Array() {
+				members[tag][m.String()] = true
+			}
+		}
+		return true
+	})
+
+	injected := make(map[string][]string) // Provider ID -> node tags added to the config
+	for _, rule := range rules {
+		tags, ok := injected[rule.ProfileID]
+		if !ok {
+			path, found := providerPaths[rule.ProfileID]
+			if !found {
+				return nil, fmt.Errorf("provider %q not found", rule.ProfileID)
+			}
+			nodes, err := loadProviderNodes(path, used)
+			if err != nil {
+				return nil, fmt.Errorf("provider %q: %w", rule.ProfileID, err)
+			}
+			for _, node := range nodes {
+				raw, err := json.Marshal(node)
+				if err != nil {
+					return nil, err
+				}
+				if content, err = sjson.SetRawBytes(content, "outbounds.-1", raw); err != nil {
+					return nil, err
+				}
+				tags = append(tags, node["tag"].(string))
+			}
+			injected[rule.ProfileID] = tags
+		}
+
+		re, err := regexp.Compile(rule.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %w", rule.Pattern, err)
+		}
+
+		for _, group := range rule.Groups {
+			idx, ok := groups[group]
+			if !ok {
+				return nil, fmt.Errorf("group %q not found in template", group)
+			}
+			for _, tag := range tags {
+				if !re.MatchString(tag) || members[group][tag] {
+					continue
+				}
+				members[group][tag] = true
+				if content, err = sjson.SetBytes(content, fmt.Sprintf("outbounds.%d.outbounds.-1", idx), tag); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+
+	return content, nil
+}
+
+// loadProviderNodes returns the proxy outbounds of a provider config with
+// tags made unique against used. Detours between the provider's own nodes
+// follow the renamed tags; detours to anything else are dropped.
+func loadProviderNodes(path string, used map[string]bool) ([]map[string]interface{}, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read provider failed: %w", err)
+	}
+
+	var config struct {
+		Outbounds []map[string]interface{} `json:"outbounds"`
+	}
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	decoder.UseNumber()
+	if err := decoder.Decode(&config); err != nil {
+		return nil, fmt.Errorf("parse provider failed: %w", err)
+	}
+
+	var nodes []map[string]interface{}
+	renames := make(map[string]string)
+	for _, ob := range config.Outbounds {
+		if !isNode(ob) {
+			continue
+		}
+		tag, _ := ob["tag"].(string)
+		newTag := tag
+		for i := 2; newTag == "" || used[newTag]; i++ {
+			newTag = fmt.Sprintf("%s %d", tag, i)
+		}
+		used[newTag] = true
+		renames[tag] = newTag
+		ob["tag"] = newTag
+		nodes = append(nodes, ob)
+	}
+
+	for _, node := range nodes {
+		if detour, ok := node["detour"].(string); ok {
+			if mapped, found := renames[detour]; found {
+				node["detour"] = mapped
+			} else {
+				delete(node, "detour")
+			}
+		}
+	}
+	return nodes, nil
+}
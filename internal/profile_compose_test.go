@@ -0,0 +1,192 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/tidwall/gjson"
+)
+
+const composeTemplate = `{
+  "outbounds": [
+    {"type": "selector", "tag": "Proxy", "outbounds": ["Auto", "Local"]},
+    {"type": "urltest", "tag": "Auto", "outbounds": ["Local"]},
+    {"type": "selector", "tag": "HK", "outbounds": []},
+    {"type": "trojan", "tag": "Local", "server": "local.example.com", "server_port": 443, "password": "p"},
+    {"type": "direct", "tag": "direct"}
+  ],
+  "route": {"final": "Proxy"}
+}`
+
+// writeProvider writes a provider config and returns its path
+func writeProvider(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "provider.json")
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// groupMembers returns the members of each group in a config
+func groupMembers(content []byte) map[string][]string {
+	members := make(map[string][]string)
+	for _, ob := range gjson.GetBytes(content, "outbounds").Array() {
+		if isGroup(map[string]interface{}{"type": ob.Get("type").String()}) {
+			tag := ob.Get("tag").String()
+			members[tag] = []string{}
+			for _, m := range ob.Get("outbounds").Array() {
+				members[tag] = append(members[tag], m.String())
+			}
+		}
+	}
+	return members
+}
+
+func TestComposeProviders(t *testing.T) {
+	airport := writeProvider(t, `{"outbounds": [
+		{"type": "selector", "tag": "Airport", "outbounds": ["HK 01"]},
+		{"type": "shadowsocks", "tag": "HK 01", "server": "hk1.example.com", "server_port": 443, "method": "aes-128-gcm", "password": "a"},
+		{"type": "shadowsocks", "tag": "HK 02", "server": "hk2.example.com", "server_port": 443, "method": "aes-128-gcm", "password": "a", "detour": "HK 01"},
+		{"type": "vmess", "tag": "US 01", "server": "us.example.com", "server_port": 443, "uuid": "u", "detour": "Airport"},
+		{"type": "trojan", "tag": "Local", "server": "clash.example.com", "server_port": 443, "password": "p"},
+		{"type": "direct", "tag": "direct"}
+	]}`)
+	backup := writeProvider(t, `{"outbounds": [
+		{"type": "hysteria2", "tag": "HK 01", "server": "b.example.com", "server_port": 443, "password": "p"}
+	]}`)
+	paths := map[string]string{"airport": airport, "backup": backup}
+
+	rules := []ProviderRule{
+		{ProfileID: "airport", Groups: []string{"Proxy", "Auto"}},
+		{ProfileID: "airport", Pattern: "^HK", Groups: []string{"HK", "Proxy"}},
+		{ProfileID: "backup", Pattern: "HK", Groups: []string{"HK"}},
+	}
+	out, err := composeProviders([]byte(composeTemplate), rules, paths)
+	if err != nil {
+		t.Fatalf("composeProviders() error = %v", err)
+	}
+	checkConfig(t, out)
+
+	// Only nodes are injected, once per provider. Tags clashing with the
+	// template or an earlier provider get a suffix.
+	var tags []string
+	for _, ob := range gjson.GetBytes(out, "outbounds").Array() {
+		tags = append(tags, ob.Get("tag").String())
+	}
+	wantTags := []string{"Proxy", "Auto", "HK", "Local", "direct", "HK 01", "HK 02", "US 01", "Local 2", "HK 01 2"}
+	if !reflect.DeepEqual(tags, wantTags) {
+		t.Errorf("tags = %v, want %v", tags, wantTags)
+	}
+
+	wantMembers := map[string][]string{
+		"Proxy": {"Auto", "Local", "HK 01", "HK 02", "US 01", "Local 2"},
+		"Auto":  {"Local", "HK 01", "HK 02", "US 01", "Local 2"},
+		"HK":    {"HK 01", "HK 02", "HK 01 2"},
+	}
+	if got := groupMembers(out); !reflect.DeepEqual(got, wantMembers) {
+		t.Errorf("members = %v, want %v", got, wantMembers)
+	}
+
+	// Detours between provider nodes survive, detours to provider groups do not
+	if got := gjson.GetBytes(out, `outbounds.#(tag=="HK 02").detour`).String(); got != "HK 01" {
+		t.Errorf("HK 02 detour = %q, want HK 01", got)
+	}
+	if gjson.GetBytes(out, `outbounds.#(tag=="US 01").detour`).Exists() {
+		t.Error("detour to a provider group was kept")
+	}
+}
+
+func TestComposeProvidersErrors(t *testing.T) {
+	provider := writeProvider(t, `{"outbounds": [{"type": "trojan", "tag": "A", "server": "a.example.com", "server_port": 443, "password": "p"}]}`)
+	paths := map[string]string{"p": provider, "bad": writeProvider(t, "{"), "gone": filepath.Join(t.TempDir(), "gone.json")}
+
+	tests := []struct {
+		name string
+		rule ProviderRule
+		want string
+	}{
+		{"unknown provider", ProviderRule{ProfileID: "x", Groups: []string{"Proxy"}}, "not found"},
+		{"missing file", ProviderRule{ProfileID: "gone", Groups: []string{"Proxy"}}, "read provider failed"},
+		{"invalid provider", ProviderRule{ProfileID: "bad", Groups: []string{"Proxy"}}, "parse provider failed"},
+		{"bad pattern", ProviderRule{ProfileID: "p", Pattern: "(", Groups: []string{"Proxy"}}, "invalid pattern"},
+		{"unknown group", ProviderRule{ProfileID: "p", Groups: []string{"Local"}}, `group "Local" not found`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := composeProviders([]byte(composeTemplate), []ProviderRule{tt.rule}, paths)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("composeProviders() error = %v, want %q", err, tt.want)
+			}
+		})
+	}
+
+	if out, err := composeProviders([]byte(composeTemplate), nil, nil); err != nil || string(out) != composeTemplate {
+		t.Error("composeProviders() without rules changed the config")
+	}
+}
+
+func TestSetProviders(t *testing.T) {
+	pm := newTestProfileManager(t,
+		Profile{ID: "a", Name: "A", Type: ProfileTypeInline},
+		Profile{ID: "b", Name: "B", Type: ProfileTypeInline},
+		Profile{ID: "c", Name: "C", Type: ProfileTypeInline},
+	)
+	for _, id := range []string{"a", "b", "c"} {
+		if _, _, err := pm.install(id, []byte(composeTemplate), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	providers := func(id string) []ProviderRule {
+		p, _ := pm.findProfile(id)
+		return p.Providers
+	}
+
+	if err := pm.SetProviders("a", []ProviderRule{{ProfileID: "b", Groups: []string{"Proxy"}}}); err != nil {
+		t.Fatalf("SetProviders() error = %v", err)
+	}
+
+	tests := []struct {
+		name  string
+		id    string
+		rules []ProviderRule
+		want  string
+	}{
+		{"self", "c", []ProviderRule{{ProfileID: "c", Groups: []string{"Proxy"}}}, "its own provider"},
+		{"cycle", "b", []ProviderRule{{ProfileID: "a", Groups: []string{"Proxy"}}}, "itself a template"},
+		{"template as provider", "c", []ProviderRule{{ProfileID: "a", Groups: []string{"Proxy"}}}, "itself a template"},
+		{"provider as template", "b", []ProviderRule{{ProfileID: "c", Groups: []string{"Proxy"}}}, `provider of "A"`},
+		{"unknown provider", "c", []ProviderRule{{ProfileID: "x", Groups: []string{"Proxy"}}}, "profile not found"},
+		{"unknown profile", "x", nil, "profile not found"},
+		{"no groups", "c", []ProviderRule{{ProfileID: "b"}}, "no target groups"},
+		{"not a group", "c", []ProviderRule{{ProfileID: "b", Groups: []string{"Local"}}}, `group "Local" not found`},
+		{"bad pattern", "c", []ProviderRule{{ProfileID: "b", Pattern: "[", Groups: []string{"HK"}}}, "invalid pattern"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := pm.SetProviders(tt.id, tt.rules)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("SetProviders() error = %v, want %q", err, tt.want)
+			}
+			if tt.id != "x" && len(providers(tt.id)) != 0 {
+				t.Errorf("rejected providers were stored: %v", providers(tt.id))
+			}
+		})
+	}
+
+	// Clearing the providers turns the template back into a standalone
+	// profile, after which it can be used as a provider
+	if err := pm.SetProviders("a", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := pm.SetProviders("c", []ProviderRule{{ProfileID: "a", Groups: []string{"HK"}}}); err != nil {
+		t.Errorf("SetProviders() error = %v", err)
+	}
+	if got := providers("c"); len(got) != 1 || got[0].ProfileID != "a" {
+		t.Errorf("providers = %v", got)
+	}
+}
@@ -0,0 +1,189 @@
+package internal
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+// maxRevisions is the number of previous versions kept per profile
+const maxRevisions = 10
+
+// currentRevision refers to the live profile config in revision APIs
+const currentRevision = "current"
+
+// historyDir returns the directory holding a profile's previous versions
+func (pm *ProfileManager) historyDir(id string) string {
+	return filepath.Join(pm.appDir, "data", "profiles", "history", id)
+}
+
+// archiveRevision copies the live config of a profile into its history before
+// it is replaced by newContent. Nothing is archived if the content is unchanged.
+func (pm *ProfileManager) archiveRevision(id string, newContent []byte) error {
+	current, err := os.ReadFile(pm.profilePath(id))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	hash := contentHash(current)
+	if hash == contentHash(newContent) {
+		return nil
+	}
+
+	dir := pm.historyDir(id)
+	name := fmt.Sprintf("%d-%s.json", time.Now().UnixMilli(), hash[:12])
+	if err := atomicWrite(filepath.Join(dir, name), current); err != nil {
+		return err
+	}
+
+	revisions, err := pm.ListRevisions(id)
+	if err != nil {
+		return err
+	}
+	for _, rev := range revisions[min(len(revisions), maxRevisions):] {
+		os.Remove(filepath.Join(dir, rev.ID+".json"))
+	}
+	return nil
+}
+
+// ListRevisions returns the stored revisions of a profile, newest first
+func (pm *ProfileManager) ListRevisions(id string) ([]ProfileRevision, error) {
+	entries, err := os.ReadDir(pm.historyDir(id))
+	if os.IsNotExist(err) {
+		return []ProfileRevision{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	revisions := make([]ProfileRevision, 0, len(entries))
+	for _, e := range entries {
+		name := strings.TrimSuffix(e.Name(), ".json")
+		if e.IsDir() || name == e.Name() {
+			continue
+		}
+		stamp, hash, ok := strings.Cut(name, "-")
+		millis, err := strconv.ParseInt(stamp, 10, 64)
+		if !ok || err != nil {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		revisions = append(revisions, ProfileRevision{
+			ID:   name,
+			Time: time.UnixMilli(millis),
+			Hash: hash,
+			Size: info.Size(),
+		})
+	}
+
+	sort.Slice(revisions, func(i, j int) bool {
+		return revisions[i].Time.After(revisions[j].Time)
+	})
+	return revisions, nil
+}
+
+// DiffRevisions compares the outbound tags of two revisions. Either revision
+// may be "current" to refer to the live config.
+func (pm *ProfileManager) DiffRevisions(id, from, to string) (*RevisionDiff, error) {
+	fromContent, err := pm.readRevision(id, from)
+	if err != nil {
+		return nil, err
+	}
+	toContent, err := pm.readRevision(id, to)
+	if err != nil {
+		return nil, err
+	}
+
+	fromTags := outboundTags(fromContent)
+	toTags := outboundTags(toContent)
+
+	diff := &RevisionDiff{Added: []string{}, Removed: []string{}}
+	for tag := range toTags {
+		if !fromTags[tag] {
+			diff.Added = append(diff.Added, tag)
+		}
+	}
+	for tag := range fromTags {
+		if !toTags[tag] {
+			diff.Removed = append(diff.Removed, tag)
+		}
+	}
+	sort.Strings(diff.Added)
+	sort.Strings(diff.Removed)
+	return diff, nil
+}
+
+// Rollback restores a stored revision as the live config of a profile.
+// The config being replaced is archived, so a rollback can itself be undone.
+func (pm *ProfileManager) Rollback(id, revision string) error {
+	if revision == currentRevision {
+		return fmt.Errorf("cannot roll back to the current revision")
+	}
+
+	content, err := pm.readRevision(id, revision)
+	if err != nil {
+		return err
+	}
+
+	lock := pm.profileLock(id)
+	lock.Lock()
+	defer lock.Unlock()
+
+	if _, _, err := pm.install(id, content, nil); err != nil {
+		return err
+	}
+
+	return pm.storage.UpdateProfile(id, func(p *Profile) {
+		p.Updated = time.Now()
+		p.ConvertWarnings = nil
+	})
+}
+
+// readRevision returns the content of a stored revision or of the live config
+func (pm *ProfileManager) readRevision(id, revision string) ([]byte, error) {
+	if _, err := pm.findProfile(id); err != nil {
+		return nil, err
+	}
+
+	if revision == currentRevision {
+		return os.ReadFile(pm.profilePath(id))
+	}
+	if strings.ContainsAny(revision, `/\.`) {
+		return nil, fmt.Errorf("invalid revision")
+	}
+
+	content, err := os.ReadFile(filepath.Join(pm.historyDir(id), revision+".json"))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("revision not found")
+	}
+	return content, err
+}
+
+// contentHash returns the hex SHA-256 of content
+func contentHash(content []byte) string {
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+// outboundTags returns the set of outbound tags in a config
+func outboundTags(content []byte) map[string]bool {
+	tags := make(map[string]bool)
+	for _, tag := range gjson.GetBytes(content, "outbounds.#.tag").Array() {
+		tags[tag.String()] = true
+	}
+	return tags
+}
@@ -0,0 +1,163 @@
+package internal
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func installRevisions(t *testing.T, pm *ProfileManager, id string, n int) [][]byte {
+	t.Helper()
+	var contents [][]byte
+	for i := 0; i < n; i++ {
+		content := nodeConfig(fmt.Sprintf("node-%d", i))
+		if _, changed, err := pm.install(id, content, nil); err != nil || !changed {
+			t.Fatalf("install %d: changed = %v, err = %v", i, changed, err)
+		}
+		contents = append(contents, content)
+		time.Sleep(2 * time.Millisecond) // Revisions are ordered by millisecond
+	}
+	return contents
+}
+
+func TestArchiveRevisionPrunes(t *testing.T) {
+	pm := newTestProfileManager(t, Profile{ID: "p", Type: ProfileTypeInline})
+
+	contents := installRevisions(t, pm, "p", maxRevisions+3)
+	revisions, err := pm.ListRevisions("p")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(revisions) != maxRevisions {
+		t.Fatalf("kept %d revisions, want %d", len(revisions), maxRevisions)
+	}
+
+	// Newest first: the config replaced last is the second to last install
+	for i, rev := range revisions {
+		want := contents[len(contents)-2-i]
+		got, err := pm.readRevision("p", rev.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("revision %d = %s, want %s", i, got, want)
+		}
+		if rev.Hash != contentHash(want)[:12] || rev.Size != int64(len(want)) {
+			t.Errorf("revision %d metadata = %+v", i, rev)
+		}
+	}
+
+	// Reinstalling the same content neither changes nor archives anything
+	if _, changed, err := pm.install("p", contents[len(contents)-1], nil); err != nil || changed {
+		t.Errorf("identical install: changed = %v, err = %v", changed, err)
+	}
+	if again, _ := pm.ListRevisions("p"); !reflect.DeepEqual(again, revisions) {
+		t.Error("identical install archived a revision")
+	}
+}
+
+func TestListRevisionsSkipsForeignFiles(t *testing.T) {
+	pm := newTestProfileManager(t, Profile{ID: "p", Type: ProfileTypeInline})
+	if revisions, err := pm.ListRevisions("p"); err != nil || len(revisions) != 0 {
+		t.Fatalf("ListRevisions() without history = %v, %v", revisions, err)
+	}
+
+	dir := pm.historyDir("p")
+	os.MkdirAll(filepath.Join(dir, "sub"), 0755)
+	os.WriteFile(filepath.Join(dir, "notes.txt"), nil, 0644)
+	os.WriteFile(filepath.Join(dir, "latest.json"), nil, 0644)
+	os.WriteFile(filepath.Join(dir, "1700000000000-abc.json"), []byte("{}"), 0644)
+
+	revisions, err := pm.ListRevisions("p")
+	if err != nil || len(revisions) != 1 || revisions[0].ID != "1700000000000-abc" {
+		t.Errorf("ListRevisions() = %v, %v", revisions, err)
+	}
+}
+
+func TestDiffRevisions(t *testing.T) {
+	pm := newTestProfileManager(t, Profile{ID: "p", Type: ProfileTypeInline})
+	if _, _, err := pm.install("p", nodeConfig("HK", "JP", "US"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := pm.install("p", nodeConfig("HK", "SG", "TW", "US"), nil); err != nil {
+		t.Fatal(err)
+	}
+	revisions, _ := pm.ListRevisions("p")
+	if len(revisions) != 1 {
+		t.Fatalf("got %d revisions, want 1", len(revisions))
+	}
+
+	diff, err := pm.DiffRevisions("p", revisions[0].ID, currentRevision)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &RevisionDiff{Added: []string{"SG", "TW"}, Removed: []string{"JP"}}
+	if !reflect.DeepEqual(diff, want) {
+		t.Errorf("DiffRevisions() = %+v, want %+v", diff, want)
+	}
+
+	same, _ := pm.DiffRevisions("p", currentRevision, currentRevision)
+	if len(same.Added) != 0 || len(same.Removed) != 0 {
+		t.Errorf("diff of a revision with itself = %+v", same)
+	}
+
+	for _, rev := range []string{"../../etc/passwd", "a.b", "missing"} {
+		if _, err := pm.DiffRevisions("p", rev, currentRevision); err == nil {
+			t.Errorf("DiffRevisions(%q) succeeded", rev)
+		}
+	}
+	if _, err := pm.DiffRevisions("other", currentRevision, currentRevision); err == nil {
+		t.Error("DiffRevisions() of an unknown profile succeeded")
+	}
+}
+
+func TestRollback(t *testing.T) {
+	pm := newTestProfileManager(t, Profile{ID: "p", Type: ProfileTypeInline})
+	contents := installRevisions(t, pm, "p", 3)
+	revisions, _ := pm.ListRevisions("p")
+	oldest := revisions[len(revisions)-1]
+
+	before := time.Now()
+	if err := pm.Rollback("p", oldest.ID); err != nil {
+		t.Fatalf("Rollback() error = %v", err)
+	}
+	live, _ := os.ReadFile(pm.profilePath("p"))
+	if !bytes.Equal(live, contents[0]) {
+		t.Errorf("live config = %s, want the first revision", live)
+	}
+
+	// The replaced config is archived so the rollback can be undone
+	after, _ := pm.ListRevisions("p")
+	if len(after) != len(revisions)+1 || after[0].Hash != contentHash(contents[2])[:12] {
+		t.Errorf("revisions after rollback = %+v", after)
+	}
+	if p, _ := pm.findProfile("p"); p.Updated.Before(before) {
+		t.Error("Rollback() did not set the update time")
+	}
+
+	if err := pm.Rollback("p", currentRevision); err == nil {
+		t.Error("Rollback() to the current revision succeeded")
+	}
+}
+
+func TestRollbackChecksConfig(t *testing.T) {
+	pm := newTestProfileManager(t, Profile{ID: "p", Type: ProfileTypeInline})
+	contents := installRevisions(t, pm, "p", 1)
+
+	// A stored revision the installed kernel rejects is not restored
+	broken := "1700000000000-broken"
+	os.MkdirAll(pm.historyDir("p"), 0755)
+	os.WriteFile(filepath.Join(pm.historyDir("p"), broken+".json"), []byte(`{"outbounds":[{"type":"invalid","tag":"x"}]}`), 0644)
+
+	if err := pm.Rollback("p", broken); err == nil {
+		t.Fatal("Rollback() of a rejected config succeeded")
+	}
+	live, _ := os.ReadFile(pm.profilePath("p"))
+	if !bytes.Equal(live, contents[0]) {
+		t.Errorf("live config changed to %s", live)
+	}
+}
@@ -1,21 +1,36 @@
 package internal
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"net/http"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/google/uuid"
 )
 
+// maxConcurrentUpdates bounds the number of parallel subscription downloads
+const maxConcurrentUpdates = 4
+
 // ProfileManager manages profile operations
 type ProfileManager struct {
 	storage    *Storage
 	httpClient *HTTPClient
 	coreManager *CoreManager
 	appDir     string
+
+	locksMu    sync.Mutex
+	locks      map[string]*sync.Mutex // Serializes downloads of the same profile
+
+	resolvedMu sync.Mutex
+	resolved   map[string]string // Server -> address used to relabel nodes
 }
 
 // NewProfileManager creates a new profile manager
@@ -25,202 +40,620 @@ func NewProfileManager(storage *Storage, httpClient *HTTPClient, coreManager *Co
 		httpClient: httpClient,
 		coreManager: coreManager,
 		appDir:     appDir,
+		locks:      make(map[string]*sync.Mutex),
+		resolved:   make(map[string]string),
 	}
 }
 
-// Add adds a new profile
-func (pm *ProfileManager) Add(name, url string) error {
-	if name == "" || url == "" {
-		return fmt.Errorf("name and url cannot be empty")
+// Add adds a new profile and returns its ID. If name is empty, the filename
+// from the provider's content-disposition header is used. opts may be nil.
+func (pm *ProfileManager) Add(name, url string, opts *FetchOptions) (string, error) {
+	if url == "" {
+		return "", fmt.Errorf("url cannot be empty")
+	}
+	if opts != nil {
+		if err := opts.Validate(); err != nil {
+			return "", err
+		}
 	}
 
-	resp, err := pm.httpClient.Get(url)
+	id := uuid.New().String()
+	realPath := pm.profilePath(id)
+
+	result, err := pm.download(id, url, opts, nil)
 	if err != nil {
-		return fmt.Errorf("download failed: %w", err)
+		return "", err
 	}
-	defer resp.Body.Close()
 
-	id := uuid.New().String()
-	realPath := filepath.Join(pm.appDir, "data", "profiles", id+".json")
-	tmpPath := realPath + ".tmp"
+	if name == "" {
+		name = defaultProfileName(result.Header, url)
+	}
 
-	os.MkdirAll(filepath.Dir(realPath), 0755)
+	profile := Profile{
+		ID:    id,
+		Name:  name,
+		Type:  ProfileTypeRemote,
+		Url:   url,
+		Path:  realPath,
+		Fetch: opts,
+	}
+	result.apply(&profile)
 
-	out, err := os.Create(tmpPath)
-	if err != nil {
-		return fmt.Errorf("create file failed: %w", err)
+	return id, pm.appendProfile(profile)
+}
+
+// ImportFile adds a local profile read from a sing-box or Clash config file on disk
+func (pm *ProfileManager) ImportFile(name, sourcePath string) error {
+	if name == "" || sourcePath == "" {
+		return fmt.Errorf("name and file path cannot be empty")
 	}
 
-	if _, err := io.Copy(out, resp.Body); err != nil {
-		out.Close()
-		os.Remove(tmpPath)
-		return fmt.Errorf("copy failed: %w", err)
+	raw, err := os.ReadFile(sourcePath)
+	if err != nil {
+		return fmt.Errorf("read file failed: %w", err)
 	}
-	out.Close()
 
-	if err := pm.coreManager.CheckConfig(tmpPath); err != nil {
-		os.Remove(tmpPath)
-		return fmt.Errorf("invalid profile config: %w", err)
+	id := uuid.New().String()
+	realPath := pm.profilePath(id)
+
+	warnings, _, err := pm.install(id, raw, nil)
+	if err != nil {
+		return err
 	}
 
-	if err := os.Rename(tmpPath, realPath); err != nil {
-		os.Remove(tmpPath)
-		return fmt.Errorf("save profile failed: %w", err)
+	return pm.appendProfile(Profile{
+		ID:              id,
+		Name:            name,
+		Type:            ProfileTypeLocal,
+		Source:          sourcePath,
+		Path:            realPath,
+		Updated:         time.Now(),
+		ConvertWarnings: warnings,
+	})
+}
+
+// ImportContent adds an inline profile from pasted config content
+func (pm *ProfileManager) ImportContent(name, content string) error {
+	if name == "" || strings.TrimSpace(content) == "" {
+		return fmt.Errorf("name and content cannot be empty")
 	}
 
-	meta, err := pm.storage.LoadMeta()
+	id := uuid.New().String()
+	realPath := pm.profilePath(id)
+
+	warnings, _, err := pm.install(id, []byte(content), nil)
 	if err != nil {
 		return err
 	}
 
-	now := time.Now().Format("2006-01-02 15:04")
-	meta.Profiles = append(meta.Profiles, Profile{
-		ID:      id,
-		Name:    name,
-		Url:     url,
-		Path:    realPath,
-		Updated: now,
+	return pm.appendProfile(Profile{
+		ID:              id,
+		Name:            name,
+		Type:            ProfileTypeInline,
+		Path:            realPath,
+		Updated:         time.Now(),
+		ConvertWarnings: warnings,
 	})
+}
 
-	if len(meta.Profiles) == 1 {
-		meta.ActiveID = id
+// GetContent returns the stored config of a profile
+func (pm *ProfileManager) GetContent(id string) (string, error) {
+	if _, err := pm.findProfile(id); err != nil {
+		return "", err
 	}
 
-	return pm.storage.SaveMeta(meta)
+	content, err := os.ReadFile(pm.profilePath(id))
+	if err != nil {
+		return "", fmt.Errorf("read profile failed: %w", err)
+	}
+	return string(content), nil
 }
 
-// Delete deletes a profile
-func (pm *ProfileManager) Delete(id string) error {
+// SaveContent validates and replaces the stored config of a profile.
+// Subscription and local profiles keep their source, so the next update overwrites manual edits.
+func (pm *ProfileManager) SaveContent(id, content string) error {
+	if !json.Valid([]byte(content)) {
+		return fmt.Errorf("invalid JSON")
+	}
+	if _, err := pm.findProfile(id); err != nil {
+		return err
+	}
+
+	lock := pm.profileLock(id)
+	lock.Lock()
+	defer lock.Unlock()
+
+	realPath := pm.profilePath(id)
+	if _, _, err := pm.install(id, []byte(content), nil); err != nil {
+		return err
+	}
+
+	return pm.storage.UpdateProfile(id, func(p *Profile) {
+		p.Path = realPath
+		p.Updated = time.Now()
+		p.ConvertWarnings = nil
+	})
+}
+
+// appendProfile stores a new profile and selects it if it is the only one
+func (pm *ProfileManager) appendProfile(profile Profile) error {
+	return pm.storage.Update(func(meta *MetaData) error {
+		meta.Profiles = append(meta.Profiles, profile)
+		if len(meta.Profiles) == 1 {
+			meta.ActiveID = profile.ID
+		}
+		return nil
+	})
+}
+
+// findProfile returns a copy of the profile with the given ID
+func (pm *ProfileManager) findProfile(id string) (Profile, error) {
 	meta, err := pm.storage.LoadMeta()
 	if err != nil {
-		return err
+		return Profile{}, err
 	}
 
-	newProfiles := []Profile{}
 	for _, p := range meta.Profiles {
 		if p.ID == id {
-			realPath := filepath.Join(pm.appDir, "data", "profiles", p.ID+".json")
-			if err := os.Remove(realPath); err != nil && !os.IsNotExist(err) {
-				return fmt.Errorf("failed to delete profile file: %w", err)
-			}
-			continue
+			return p, nil
 		}
-		newProfiles = append(newProfiles, p)
 	}
+	return Profile{}, fmt.Errorf("profile not found")
+}
 
-	meta.Profiles = newProfiles
-	if meta.ActiveID == id {
-		meta.ActiveID = ""
+// Delete deletes a profile
+func (pm *ProfileManager) Delete(id string) error {
+	if _, err := pm.findProfile(id); err == nil {
+		if err := os.Remove(pm.profilePath(id)); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to delete profile file: %w", err)
+		}
+		os.RemoveAll(pm.historyDir(id))
+		os.Remove(filepath.Join(pm.geoDir(), id+".json"))
 	}
 
-	return pm.storage.SaveMeta(meta)
+	return pm.storage.Update(func(meta *MetaData) error {
+		newProfiles := []Profile{}
+		for _, p := range meta.Profiles {
+			if p.ID == id {
+				continue
+			}
+			if len(p.Providers) > 0 {
+				// Drop the deleted profile from templates that use it
+				rules := make([]ProviderRule, 0, len(p.Providers))
+				for _, rule := range p.Providers {
+					if rule.ProfileID != id {
+						rules = append(rules, rule)
+					}
+				}
+				p.Providers = rules
+			}
+			newProfiles = append(newProfiles, p)
+		}
+
+		meta.Profiles = newProfiles
+		delete(meta.ProfileOverrides, id)
+		if meta.ActiveID == id {
+			meta.ActiveID = ""
+		}
+		return nil
+	})
 }
 
 // Select selects a profile as active
 func (pm *ProfileManager) Select(id string) error {
+	return pm.storage.Update(func(meta *MetaData) error {
+		for _, p := range meta.Profiles {
+			if p.ID == id {
+				meta.ActiveID = id
+				return nil
+			}
+		}
+		return fmt.Errorf("profile not found")
+	})
+}
+
+// Update updates the active profile and reports whether its config changed
+func (pm *ProfileManager) Update() (bool, error) {
 	meta, err := pm.storage.LoadMeta()
 	if err != nil {
-		return err
+		return false, err
 	}
 
-	found := false
-	for _, p := range meta.Profiles {
-		if p.ID == id {
-			found = true
-			break
+	if meta.ActiveID == "" {
+		return false, fmt.Errorf("no active profile")
+	}
+
+	return pm.UpdateByID(meta.ActiveID)
+}
+
+// UpdateByID downloads the latest version of a profile and reports whether its config changed
+func (pm *ProfileManager) UpdateByID(id string) (bool, error) {
+	lock := pm.profileLock(id)
+	lock.Lock()
+	defer lock.Unlock()
+
+	target, err := pm.findProfile(id)
+	if err != nil {
+		return false, err
+	}
+
+	realPath := pm.profilePath(target.ID)
+
+	switch target.Type {
+	case ProfileTypeInline:
+		// Inline profiles have no source to refresh from
+		return false, nil
+	case ProfileTypeLocal:
+		raw, err := os.ReadFile(target.Source)
+		if err != nil {
+			return false, fmt.Errorf("read source file failed: %w", err)
 		}
+		warnings, changed, err := pm.install(id, raw, target.Filter)
+		if err != nil {
+			return false, err
+		}
+		return changed, pm.storage.UpdateProfile(id, func(p *Profile) {
+			p.Path = realPath
+			p.Updated = time.Now()
+			if changed {
+				p.ConvertWarnings = warnings
+			}
+		})
 	}
 
-	if !found {
-		return fmt.Errorf("profile not found")
+	result, err := pm.download(id, target.Url, target.Fetch, &target)
+	if err != nil {
+		return false, err
 	}
 
-	meta.ActiveID = id
-	return pm.storage.SaveMeta(meta)
+	return result.Changed, pm.storage.UpdateProfile(id, func(p *Profile) {
+		p.Path = realPath
+		result.apply(p)
+	})
 }
 
-// Update updates the active profile
-func (pm *ProfileManager) Update() error {
+// UpdateAll updates all subscription profiles concurrently and reports the outcome of each
+func (pm *ProfileManager) UpdateAll() ([]ProfileUpdateResult, error) {
 	meta, err := pm.storage.LoadMeta()
+	if err != nil {
+		return nil, err
+	}
+
+	targets := make([]Profile, 0, len(meta.Profiles))
+	for _, p := range meta.Profiles {
+		if p.Type != ProfileTypeInline {
+			targets = append(targets, p)
+		}
+	}
+
+	results := make([]ProfileUpdateResult, len(targets))
+	sem := make(chan struct{}, maxConcurrentUpdates)
+	var wg sync.WaitGroup
+
+	for i, p := range targets {
+		wg.Add(1)
+		go func(i int, p Profile) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			start := time.Now()
+			changed, err := pm.UpdateByID(p.ID)
+
+			results[i] = ProfileUpdateResult{
+				ID:       p.ID,
+				Name:     p.Name,
+				Success:  err == nil,
+				Changed:  changed,
+				Duration: time.Since(start).Milliseconds(),
+			}
+			if err != nil {
+				results[i].Error = err.Error()
+			}
+		}(i, p)
+	}
+
+	wg.Wait()
+	return results, nil
+}
+
+// SetFetchOptions sets the options used to download a profile
+func (pm *ProfileManager) SetFetchOptions(id string, opts *FetchOptions) error {
+	if opts != nil {
+		if err := opts.Validate(); err != nil {
+			return err
+		}
+	}
+
+	return pm.storage.UpdateProfile(id, func(p *Profile) {
+		p.Fetch = opts
+	})
+}
+
+// SetFilter sets a profile's node filter, which takes effect on its next update
+func (pm *ProfileManager) SetFilter(id string, filter *NodeFilter) error {
+	if filter != nil {
+		if err := filter.Validate(); err != nil {
+			return err
+		}
+	}
+
+	return pm.storage.UpdateProfile(id, func(p *Profile) {
+		p.Filter = filter
+		// Force a full download so the new filter sees unchanged content too
+		p.ETag = ""
+		p.LastModified = ""
+	})
+}
+
+// SetRegionGroups sets how a profile's nodes are grouped by region at launch
+func (pm *ProfileManager) SetRegionGroups(id, mode string) error {
+	switch mode {
+	case RegionGroupsOff, RegionGroupsURLTest, RegionGroupsSelector:
+	default:
+		return fmt.Errorf("unknown region group mode %q", mode)
+	}
+
+	return pm.storage.UpdateProfile(id, func(p *Profile) {
+		p.RegionGroups = mode
+	})
+}
+
+// SetUpdateInterval sets a profile's auto-update interval in minutes (0 uses the provider interval)
+func (pm *ProfileManager) SetUpdateInterval(id string, minutes int) error {
+	if minutes < 0 {
+		return fmt.Errorf("interval cannot be negative")
+	}
+
+	return pm.storage.UpdateProfile(id, func(p *Profile) {
+		p.UpdateInterval = minutes
+	})
+}
+
+// Edit edits a profile's name and source. url is the subscription URL for
+// remote profiles and the source file path for local profiles.
+func (pm *ProfileManager) Edit(id, name, url string) error {
+	if name == "" {
+		return fmt.Errorf("name cannot be empty")
+	}
+
+	target, err := pm.findProfile(id)
 	if err != nil {
 		return err
 	}
 
-	var target *Profile
-	for i := range meta.Profiles {
-		if meta.Profiles[i].ID == meta.ActiveID {
-			target = &meta.Profiles[i]
+	if target.IsRemote() && url == "" {
+		return fmt.Errorf("name and url cannot be empty")
+	}
+
+	return pm.storage.UpdateProfile(id, func(p *Profile) {
+		p.Name = name
+		switch p.Type {
+		case ProfileTypeLocal:
+			if url != "" {
+				p.Source = url
+			}
+		case ProfileTypeInline:
+		default:
+			if p.Url != url {
+				// Validators from the old URL do not apply to the new one
+				p.ETag = ""
+				p.LastModified = ""
+			}
+			p.Url = url
+		}
+	})
+}
+
+// profileLock returns the mutex guarding downloads of a profile
+func (pm *ProfileManager) profileLock(id string) *sync.Mutex {
+	pm.locksMu.Lock()
+	defer pm.locksMu.Unlock()
+
+	lock, ok := pm.locks[id]
+	if !ok {
+		lock = &sync.Mutex{}
+		pm.locks[id] = lock
+	}
+	return lock
+}
+
+// errNotModified is returned by fetchWithHeader for a 304 response
+var errNotModified = errors.New("not modified")
+
+// downloadResult holds the metadata of a downloaded subscription
+type downloadResult struct {
+	Warnings []string
+	Header   http.Header
+	Changed  bool // False if the server returned 304 or the content matched the stored config
+}
+
+// apply records the download result on a profile
+func (r *downloadResult) apply(p *Profile) {
+	p.Updated = time.Now()
+	if r.Changed {
+		p.ConvertWarnings = r.Warnings
+	}
+	if etag := r.Header.Get("ETag"); etag != "" {
+		p.ETag = etag
+	}
+	if lastModified := r.Header.Get("Last-Modified"); lastModified != "" {
+		p.LastModified = lastModified
+	}
+	if interval := parseUpdateInterval(r.Header.Get("profile-update-interval")); interval > 0 {
+		p.ProviderInterval = interval
+	}
+	if info := parseSubscriptionUserinfo(r.Header.Get("subscription-userinfo")); info != nil {
+		p.Subscription = info
+	}
+}
+
+// download fetches a subscription, trying the fallback URLs from opts in
+// order, and installs it as the profile's config. If prev is given and its
+// config exists on disk, the request to the primary URL is made conditional
+// on prev's ETag and Last-Modified validators. Fallback URLs are other
+// servers, whose validators are not known, so they are fetched in full.
+func (pm *ProfileManager) download(id, url string, opts *FetchOptions, prev *Profile) (*downloadResult, error) {
+	urls := []string{url}
+	if opts != nil {
+		urls = append(urls, opts.FallbackURLs...)
+	}
+
+	primaryOpts := opts
+	if prev != nil && (prev.ETag != "" || prev.LastModified != "") {
+		if _, err := os.Stat(pm.profilePath(id)); err == nil {
+			primaryOpts = withConditionalHeaders(opts, prev.ETag, prev.LastModified)
+		}
+	}
+
+	var body []byte
+	var header http.Header
+	var err error
+	for i, u := range urls {
+		if i == 0 {
+			body, header, err = pm.fetchWithHeader(u, primaryOpts)
+		} else {
+			body, header, err = pm.fetchWithHeader(u, opts)
+		}
+		if err == nil || errors.Is(err, errNotModified) {
 			break
 		}
 	}
+	if errors.Is(err, errNotModified) {
+		return &downloadResult{Header: header}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("download failed: %w", err)
+	}
 
-	if target == nil {
-		return fmt.Errorf("no active profile")
+	var filter *NodeFilter
+	if prev != nil {
+		filter = prev.Filter
+	}
+	warnings, changed, err := pm.install(id, body, filter)
+	if err != nil {
+		return nil, err
 	}
 
-	resp, err := pm.httpClient.Get(target.Url)
+	return &downloadResult{Warnings: warnings, Header: header, Changed: changed}, nil
+}
+
+// withConditionalHeaders returns a copy of opts carrying If-None-Match and If-Modified-Since
+func withConditionalHeaders(opts *FetchOptions, etag, lastModified string) *FetchOptions {
+	conditional := FetchOptions{}
+	if opts != nil {
+		conditional = *opts
+	}
+
+	headers := make(map[string]string, len(conditional.Headers)+2)
+	for k, v := range conditional.Headers {
+		headers[k] = v
+	}
+	if etag != "" {
+		headers["If-None-Match"] = etag
+	}
+	if lastModified != "" {
+		headers["If-Modified-Since"] = lastModified
+	}
+	conditional.Headers = headers
+	return &conditional
+}
+
+// install converts raw profile content to a sing-box config if needed,
+// applies the node filter, validates it and atomically replaces the
+// profile's config file. The replaced version is kept in the profile's
+// revision history. Content identical to the stored config is not validated
+// or written again, and changed is false.
+func (pm *ProfileManager) install(id string, raw []byte, filter *NodeFilter) (warnings []string, changed bool, err error) {
+	content, warnings, err := convertSubscription(raw, pm.fetch)
 	if err != nil {
-		return fmt.Errorf("download failed: %w", err)
+		return nil, false, fmt.Errorf("convert failed: %w", err)
+	}
+
+	var relabel func(tag string) string
+	if filter != nil && filter.GeoFix {
+		if relabel, err = pm.geoRelabeler(id, content); err != nil {
+			warnings = append(warnings, "Node tags not fixed: "+err.Error())
+		}
+	}
+
+	if content, err = applyNodeFilter(content, filter, relabel); err != nil {
+		return nil, false, fmt.Errorf("filter nodes failed: %w", err)
+	}
+
+	realPath := pm.profilePath(id)
+	if current, err := os.ReadFile(realPath); err == nil && contentHash(current) == contentHash(content) {
+		return warnings, false, nil
 	}
-	defer resp.Body.Close()
 
-	realPath := filepath.Join(pm.appDir, "data", "profiles", target.ID+".json")
 	tmpPath := realPath + ".tmp"
+	os.MkdirAll(filepath.Dir(realPath), 0755)
 
-	out, err := os.Create(tmpPath)
-	if err != nil {
-		return fmt.Errorf("create file failed: %w", err)
+	if err := os.WriteFile(tmpPath, content, 0644); err != nil {
+		return nil, false, fmt.Errorf("create file failed: %w", err)
 	}
 
-	if _, err := io.Copy(out, resp.Body); err != nil {
-		out.Close()
+	if err := pm.coreManager.CheckConfig(tmpPath); err != nil {
 		os.Remove(tmpPath)
-		return fmt.Errorf("copy failed: %w", err)
+		if !isSingBoxConfig(raw) {
+			return nil, false, fmt.Errorf("invalid profile config (converted subscriptions need sing-box %s or later, installed: %s): %w",
+				convertedKernelVersion, pm.coreManager.GetLocalVersion(), err)
+		}
+		return nil, false, fmt.Errorf("invalid profile config: %w", err)
 	}
-	out.Close()
 
-	if err := pm.coreManager.CheckConfig(tmpPath); err != nil {
+	if err := pm.archiveRevision(id, content); err != nil {
 		os.Remove(tmpPath)
-		return fmt.Errorf("invalid profile config: %w", err)
+		return nil, false, fmt.Errorf("archive revision failed: %w", err)
 	}
 
 	if err := os.Rename(tmpPath, realPath); err != nil {
 		os.Remove(tmpPath)
-		return fmt.Errorf("save profile failed: %w", err)
+		return nil, false, fmt.Errorf("save profile failed: %w", err)
 	}
 
-	target.Updated = time.Now().Format("2006-01-02 15:04")
-	target.Path = realPath
+	return warnings, true, nil
+}
 
-	return pm.storage.SaveMeta(meta)
+// profilePath returns the path of a profile's stored config
+func (pm *ProfileManager) profilePath(id string) string {
+	return filepath.Join(pm.appDir, "data", "profiles", id+".json")
 }
 
-// Edit edits a profile's name and URL
-func (pm *ProfileManager) Edit(id, name, url string) error {
-	if name == "" || url == "" {
-		return fmt.Errorf("name and url cannot be empty")
-	}
+// fetch downloads a URL and returns the response body
+func (pm *ProfileManager) fetch(url string) ([]byte, error) {
+	body, _, err := pm.fetchWithHeader(url, nil)
+	return body, err
+}
 
-	meta, err := pm.storage.LoadMeta()
+// fetchWithHeader downloads a URL and returns the response body and headers
+func (pm *ProfileManager) fetchWithHeader(url string, opts *FetchOptions) ([]byte, http.Header, error) {
+	resp, err := pm.httpClient.GetWithOptions(url, opts)
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
+	defer resp.Body.Close()
 
-	var target *Profile
-	for i := range meta.Profiles {
-		if meta.Profiles[i].ID == id {
-			target = &meta.Profiles[i]
-			break
-		}
+	if resp.StatusCode == http.StatusNotModified {
+		return nil, resp.Header, errNotModified
 	}
 
-	if target == nil {
-		return fmt.Errorf("profile not found")
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("bad status: %s", resp.Status)
 	}
 
-	// Update name and URL
-	target.Name = name
-	target.Url = url
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	return body, resp.Header, nil
+}
 
-	return pm.storage.SaveMeta(meta)
+// parseUpdateInterval converts a profile-update-interval header (hours) to minutes
+func parseUpdateInterval(value string) int {
+	hours, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+	if err != nil || hours <= 0 {
+		return 0
+	}
+	return int(hours * 60)
 }
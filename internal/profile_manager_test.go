@@ -0,0 +1,287 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newTestProfileManager returns a profile manager with a fake kernel and the given profiles
+func newTestProfileManager(t *testing.T, profiles ...Profile) *ProfileManager {
+	t.Helper()
+	appDir := t.TempDir()
+	installFakeKernel(t, appDir, "1.12.0")
+
+	storage := newTestStorage(t)
+	storage.Update(func(meta *MetaData) error {
+		meta.Profiles = profiles
+		return nil
+	})
+	return NewProfileManager(storage, NewHTTPClient(), NewCoreManager(appDir, context.Background()), appDir)
+}
+
+// nodeConfig returns a sing-box config with one trojan outbound per tag
+func nodeConfig(tags ...string) []byte {
+	var b bytes.Buffer
+	b.WriteString(`{"outbounds":[`)
+	for i, tag := range tags {
+		if i > 0 {
+			b.WriteString(",")
+		}
+		fmt.Fprintf(&b, `{"type":"trojan","tag":%q,"server":"%s.example.com","server_port":443,"password":"pw"}`, tag, tag)
+	}
+	b.WriteString(`]}`)
+	return b.Bytes()
+}
+
+// onlyProfile returns the only profile of pm
+func onlyProfile(t *testing.T, pm *ProfileManager) Profile {
+	t.Helper()
+	meta, err := pm.storage.LoadMeta()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(meta.Profiles) != 1 {
+		t.Fatalf("profiles = %+v, want one", meta.Profiles)
+	}
+	return meta.Profiles[0]
+}
+
+func TestImportFile(t *testing.T) {
+	pm := newTestProfileManager(t)
+	source := filepath.Join(t.TempDir(), "local.json")
+	if err := os.WriteFile(source, nodeConfig("HK"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := pm.ImportFile("Local", source); err != nil {
+		t.Fatalf("ImportFile() error = %v", err)
+	}
+	p := onlyProfile(t, pm)
+	if p.Type != ProfileTypeLocal || p.Source != source || p.Url != "" {
+		t.Errorf("profile = %+v", p)
+	}
+	if stored, _ := pm.GetContent(p.ID); stored != string(nodeConfig("HK")) {
+		t.Errorf("stored config = %s", stored)
+	}
+
+	// Updating reads the source file again
+	if err := os.WriteFile(source, nodeConfig("JP"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	changed, err := pm.UpdateByID(p.ID)
+	if err != nil || !changed {
+		t.Fatalf("UpdateByID() = %v, %v, want a change", changed, err)
+	}
+	if stored, _ := pm.GetContent(p.ID); stored != string(nodeConfig("JP")) {
+		t.Errorf("config after update = %s", stored)
+	}
+	if changed, err := pm.UpdateByID(p.ID); err != nil || changed {
+		t.Errorf("UpdateByID() of an unchanged file = %v, %v", changed, err)
+	}
+
+	// A missing source fails the update and keeps the stored config
+	os.Remove(source)
+	if _, err := pm.UpdateByID(p.ID); err == nil || !strings.Contains(err.Error(), "read source file failed") {
+		t.Errorf("UpdateByID() with a missing source = %v", err)
+	}
+	if stored, _ := pm.GetContent(p.ID); stored != string(nodeConfig("JP")) {
+		t.Errorf("config after a failed update = %s", stored)
+	}
+
+	if err := pm.ImportFile("Missing", source); err == nil {
+		t.Error("ImportFile() accepted a missing file")
+	}
+}
+
+func TestImportContent(t *testing.T) {
+	pm := newTestProfileManager(t)
+	if err := pm.ImportContent("Inline", "  "); err == nil {
+		t.Error("ImportContent() accepted empty content")
+	}
+	if err := pm.ImportContent("Inline", string(nodeConfig("HK"))); err != nil {
+		t.Fatalf("ImportContent() error = %v", err)
+	}
+
+	p := onlyProfile(t, pm)
+	if p.Type != ProfileTypeInline || p.Source != "" || p.Url != "" {
+		t.Errorf("profile = %+v", p)
+	}
+
+	// Inline profiles have nothing to update from
+	if changed, err := pm.UpdateByID(p.ID); err != nil || changed {
+		t.Errorf("UpdateByID() of an inline profile = %v, %v", changed, err)
+	}
+	if stored, _ := pm.GetContent(p.ID); stored != string(nodeConfig("HK")) {
+		t.Errorf("stored config = %s", stored)
+	}
+}
+
+func TestImportChecksConfig(t *testing.T) {
+	pm := newTestProfileManager(t)
+	invalid := `{"outbounds": [{"type": "invalid", "tag": "x"}]}`
+	if err := pm.ImportContent("Broken", invalid); err == nil {
+		t.Error("ImportContent() accepted a config the kernel rejects")
+	}
+
+	source := filepath.Join(t.TempDir(), "broken.json")
+	os.WriteFile(source, []byte(invalid), 0644)
+	if err := pm.ImportFile("Broken", source); err == nil {
+		t.Error("ImportFile() accepted a config the kernel rejects")
+	}
+
+	meta, _ := pm.storage.LoadMeta()
+	if len(meta.Profiles) != 0 {
+		t.Errorf("rejected profiles were added: %+v", meta.Profiles)
+	}
+}
+
+func TestSaveContent(t *testing.T) {
+	pm := newTestProfileManager(t)
+	if err := pm.ImportContent("Inline", string(nodeConfig("HK"))); err != nil {
+		t.Fatal(err)
+	}
+	p := onlyProfile(t, pm)
+
+	if err := pm.SaveContent(p.ID, string(nodeConfig("JP"))); err != nil {
+		t.Fatalf("SaveContent() error = %v", err)
+	}
+	if stored, _ := pm.GetContent(p.ID); stored != string(nodeConfig("JP")) {
+		t.Errorf("stored config = %s", stored)
+	}
+
+	// Invalid JSON and configs the kernel rejects keep the stored config
+	for _, content := range []string{`{"outbounds": [`, `{"outbounds": [{"type": "invalid", "tag": "x"}]}`} {
+		if err := pm.SaveContent(p.ID, content); err == nil {
+			t.Errorf("SaveContent(%s) succeeded", content)
+		}
+	}
+	if stored, _ := pm.GetContent(p.ID); stored != string(nodeConfig("JP")) {
+		t.Errorf("config after rejected saves = %s", stored)
+	}
+
+	if err := pm.SaveContent("missing", string(nodeConfig("JP"))); err == nil {
+		t.Error("SaveContent() of a missing profile succeeded")
+	}
+}
+
+// subscriptionServer serves body with an ETag, answering 304 to a matching
+// If-None-Match. It records the validators of every request.
+func subscriptionServer(t *testing.T, body []byte, etag string, validators *[]string) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*validators = append(*validators, r.Header.Get("If-None-Match")+"|"+r.Header.Get("If-Modified-Since"))
+		if etag != "" && r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", etag)
+		w.Write(body)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// subscribedProfile stores a subscription profile of url whose config is content
+func subscribedProfile(t *testing.T, pm *ProfileManager, url string, content []byte, etag string) {
+	t.Helper()
+	if err := pm.storage.Update(func(meta *MetaData) error {
+		meta.Profiles = []Profile{{ID: "p", Name: "Sub", Url: url, ETag: etag, LastModified: "Mon, 01 Jan 2024 00:00:00 GMT"}}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	os.MkdirAll(filepath.Dir(pm.profilePath("p")), 0755)
+	if err := os.WriteFile(pm.profilePath("p"), content, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUpdateNotModified(t *testing.T) {
+	pm := newTestProfileManager(t)
+	var validators []string
+	server := subscriptionServer(t, nodeConfig("JP"), `"v1"`, &validators)
+	subscribedProfile(t, pm, server.URL, nodeConfig("HK"), `"v1"`)
+
+	changed, err := pm.UpdateByID("p")
+	if err != nil || changed {
+		t.Fatalf("UpdateByID() = %v, %v, want unchanged", changed, err)
+	}
+	if len(validators) != 1 || validators[0] != `"v1"|Mon, 01 Jan 2024 00:00:00 GMT` {
+		t.Errorf("request validators = %q", validators)
+	}
+	if stored, _ := pm.GetContent("p"); stored != string(nodeConfig("HK")) {
+		t.Errorf("config after 304 = %s", stored)
+	}
+	if revisions, _ := pm.ListRevisions("p"); len(revisions) != 0 {
+		t.Errorf("304 archived %d revisions", len(revisions))
+	}
+
+	// Without the stored config the validators are not sent
+	os.Remove(pm.profilePath("p"))
+	validators = nil
+	if changed, err := pm.UpdateByID("p"); err != nil || !changed {
+		t.Errorf("UpdateByID() without a stored config = %v, %v", changed, err)
+	}
+	if len(validators) != 1 || validators[0] != "|" {
+		t.Errorf("request validators = %q, want none", validators)
+	}
+}
+
+func TestUpdateSameContent(t *testing.T) {
+	pm := newTestProfileManager(t)
+	var validators []string
+	server := subscriptionServer(t, nodeConfig("HK"), `"v2"`, &validators)
+	subscribedProfile(t, pm, server.URL, nodeConfig("HK"), `"v1"`)
+
+	// The server ignores the old ETag but sends the stored config again
+	changed, err := pm.UpdateByID("p")
+	if err != nil || changed {
+		t.Fatalf("UpdateByID() = %v, %v, want unchanged", changed, err)
+	}
+	if revisions, _ := pm.ListRevisions("p"); len(revisions) != 0 {
+		t.Errorf("unchanged content archived %d revisions", len(revisions))
+	}
+	if p := onlyProfile(t, pm); p.ETag != `"v2"` {
+		t.Errorf("ETag = %q, want the new one", p.ETag)
+	}
+}
+
+func TestUpdateFallbackNotConditional(t *testing.T) {
+	pm := newTestProfileManager(t)
+	var primary, fallback []string
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		primary = append(primary, r.Header.Get("If-None-Match"))
+		http.NotFound(w, r)
+	}))
+	t.Cleanup(broken.Close)
+	// The fallback would answer 304 to the primary's validator
+	mirror := subscriptionServer(t, nodeConfig("JP"), `"v1"`, &fallback)
+
+	subscribedProfile(t, pm, broken.URL, nodeConfig("HK"), `"v1"`)
+	if err := pm.storage.UpdateProfile("p", func(p *Profile) {
+		p.Fetch = &FetchOptions{FallbackURLs: []string{mirror.URL}}
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	changed, err := pm.UpdateByID("p")
+	if err != nil || !changed {
+		t.Fatalf("UpdateByID() = %v, %v, want the fallback content", changed, err)
+	}
+	if len(primary) != 1 || primary[0] != `"v1"` {
+		t.Errorf("primary validators = %q", primary)
+	}
+	if len(fallback) != 1 || fallback[0] != "|" {
+		t.Errorf("fallback validators = %q, want none", fallback)
+	}
+	if stored, _ := pm.GetContent("p"); stored != string(nodeConfig("JP")) {
+		t.Errorf("config = %s", stored)
+	}
+}
@@ -0,0 +1,95 @@
+package internal
+
+import (
+	"time"
+
+	wailsRuntime "github.com/wailsapp/wails/v2/pkg/runtime"
+)
+
+const (
+	schedulerTick       = 1 * time.Minute
+	schedulerRetryDelay = 15 * time.Minute
+)
+
+// startProfileScheduler starts the background loop that refreshes due profiles.
+// Due times are derived from the persisted Updated timestamp, so overdue
+// profiles are picked up on the first tick after a restart.
+func (a *App) startProfileScheduler() {
+	a.schedulerStop = make(chan struct{})
+	a.schedulerFailures = make(map[string]time.Time)
+
+	go func(stop chan struct{}) {
+		ticker := time.NewTicker(schedulerTick)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				a.refreshDueProfiles()
+				a.refreshDueResources()
+			}
+		}
+	}(a.schedulerStop)
+}
+
+// stopProfileScheduler stops the background refresh loop
+func (a *App) stopProfileScheduler() {
+	if a.schedulerStop != nil {
+		close(a.schedulerStop)
+		a.schedulerStop = nil
+	}
+}
+
+// dueProfiles returns the profiles to update at now. A profile is due once
+// its interval has elapsed since the last update; after a failed attempt it
+// waits schedulerRetryDelay before the next try.
+func dueProfiles(profiles []Profile, failures map[string]time.Time, now time.Time) []Profile {
+	var due []Profile
+	for _, p := range profiles {
+		next := p.NextUpdate()
+		if next.IsZero() || now.Before(next) {
+			continue
+		}
+		if failed, ok := failures[p.ID]; ok && now.Sub(failed) < schedulerRetryDelay {
+			continue
+		}
+		due = append(due, p)
+	}
+	return due
+}
+
+// refreshDueProfiles updates every profile whose auto-update interval has elapsed
+func (a *App) refreshDueProfiles() {
+	meta, err := a.storage.LoadMeta()
+	if err != nil {
+		return
+	}
+
+	now := time.Now()
+	for _, p := range dueProfiles(meta.Profiles, a.schedulerFailures, now) {
+		a.appLogger.Info("Auto-updating profile: " + p.Name)
+		changed, err := a.profileManager.UpdateByID(p.ID)
+		if err != nil {
+			a.schedulerFailures[p.ID] = now
+			a.appLogger.Warn("Auto-update failed for " + p.Name + ": " + err.Error())
+			continue
+		}
+		delete(a.schedulerFailures, p.ID)
+		wailsRuntime.EventsEmit(a.ctx, "profile-updated", p.ID)
+		a.checkSubscriptionWarnings(p.ID)
+		if changed {
+			a.prefetchResources(a.profileManager.profilePath(p.ID))
+		}
+
+		if changed && usesProfile(meta, p.ID) && a.coreManager.IsRunning() {
+			a.stateMutex.Lock()
+			autoConnecting := a.isAutoConnecting
+			a.stateMutex.Unlock()
+			if !autoConnecting {
+				a.RestartCore()
+			}
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package internal
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestProfileNextUpdate(t *testing.T) {
+	updated := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name    string
+		profile Profile
+		want    time.Time
+	}{
+		{"disabled", Profile{Type: ProfileTypeRemote, Updated: updated}, time.Time{}},
+		{"own interval", Profile{Type: ProfileTypeRemote, Updated: updated, UpdateInterval: 60}, updated.Add(time.Hour)},
+		{"provider interval", Profile{Updated: updated, ProviderInterval: 720}, updated.Add(12 * time.Hour)},
+		{"own interval wins", Profile{Updated: updated, UpdateInterval: 30, ProviderInterval: 720}, updated.Add(30 * time.Minute)},
+		{"local profile", Profile{Type: ProfileTypeLocal, Updated: updated, UpdateInterval: 60}, time.Time{}},
+		{"inline profile", Profile{Type: ProfileTypeInline, Updated: updated, UpdateInterval: 60}, time.Time{}},
+	}
+	for _, tt := range tests {
+		if got := tt.profile.NextUpdate(); !got.Equal(tt.want) {
+			t.Errorf("%s: NextUpdate() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestDueProfiles(t *testing.T) {
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	profiles := []Profile{
+		{ID: "fresh", Updated: now.Add(-30 * time.Minute), UpdateInterval: 60},
+		{ID: "due", Updated: now.Add(-61 * time.Minute), UpdateInterval: 60},
+		{ID: "exact", Updated: now.Add(-60 * time.Minute), UpdateInterval: 60},
+		{ID: "overdue", Updated: now.Add(-72 * time.Hour), UpdateInterval: 60},
+		{ID: "disabled", Updated: now.Add(-72 * time.Hour)},
+		{ID: "local", Type: ProfileTypeLocal, Updated: now.Add(-72 * time.Hour), UpdateInterval: 60},
+		{ID: "never", UpdateInterval: 60},
+		{ID: "failed-recently", Updated: now.Add(-2 * time.Hour), UpdateInterval: 60},
+		{ID: "failed-before", Updated: now.Add(-2 * time.Hour), UpdateInterval: 60},
+	}
+	failures := map[string]time.Time{
+		"failed-recently": now.Add(-schedulerRetryDelay + time.Minute),
+		"failed-before":   now.Add(-schedulerRetryDelay),
+	}
+
+	var ids []string
+	for _, p := range dueProfiles(profiles, failures, now) {
+		ids = append(ids, p.ID)
+	}
+	want := []string{"due", "exact", "overdue", "never", "failed-before"}
+	if !reflect.DeepEqual(ids, want) {
+		t.Errorf("dueProfiles() = %v, want %v", ids, want)
+	}
+
+	// The retry backoff ends one tick later
+	ids = nil
+	for _, p := range dueProfiles(profiles, failures, now.Add(schedulerTick)) {
+		ids = append(ids, p.ID)
+	}
+	want = []string{"due", "exact", "overdue", "never", "failed-recently", "failed-before"}
+	if !reflect.DeepEqual(ids, want) {
+		t.Errorf("after the retry delay dueProfiles() = %v", ids)
+	}
+}
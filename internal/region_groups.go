@@ -0,0 +1,224 @@
+package internal
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+// Region group modes of a profile
+const (
+	RegionGroupsOff      = ""
+	RegionGroupsURLTest  = "urltest"
+	RegionGroupsSelector = "selector"
+)
+
+// DefaultRegions returns the built-in region mapping table
+func DefaultRegions() []RegionRule {
+	return []RegionRule{
+		{Name: "HK", Flag: "🇭🇰", Keywords: []string{"HK", "Hong Kong", "HongKong", "香港", "港"}, Country: "HK"},
+		{Name: "TW", Flag: "🇹🇼", Keywords: []string{"TW", "Taiwan", "台湾", "台灣", "臺灣"}, Country: "TW"},
+		{Name: "JP", Flag: "🇯🇵", Keywords: []string{"JP", "Japan", "Tokyo", "Osaka", "日本", "东京", "大阪"}, Country: "JP"},
+		{Name: "KR", Flag: "🇰🇷", Keywords: []string{"KR", "Korea", "Seoul", "韩国", "韓國", "首尔"}, Country: "KR"},
+		{Name: "SG", Flag: "🇸🇬", Keywords: []string{"SG", "Singapore", "新加坡", "狮城"}, Country: "SG"},
+		{Name: "US", Flag: "🇺🇸", Keywords: []string{"US", "USA", "United States", "America", "Los Angeles", "San Jose", "Seattle", "美国", "美國"}, Country: "US"},
+		{Name: "GB", Flag: "🇬🇧", Keywords: []string{"UK", "GB", "United Kingdom", "Britain", "London", "英国", "英國"}, Country: "GB"},
+		{Name: "DE", Flag: "🇩🇪", Keywords: []string{"DE", "Germany", "Frankfurt", "德国", "德國"}, Country: "DE"},
+	}
+}
+
+// Validate checks that the region has a name and something to match on
+func (r *RegionRule) Validate() error {
+	if strings.TrimSpace(r.Name) == "" {
+		return fmt.Errorf("region name cannot be empty")
+	}
+	if r.Flag == "" && len(r.Keywords) == 0 {
+		return fmt.Errorf("region %q has no flag or keywords", r.Name)
+	}
+	if r.Country != "" && !isCountryCode(r.Country) {
+		return fmt.Errorf("region %q: country must be a two-letter code", r.Name)
+	}
+	return nil
+}
+
+// country returns the ISO country code of the region, or "" if it has none
+func (r *RegionRule) country() string {
+	if r.Country != "" {
+		return strings.ToUpper(r.Country)
+	}
+	return flagCountry(r.Flag)
+}
+
+// isCountryCode reports whether s is a two-letter ASCII code
+func isCountryCode(s string) bool {
+	if len(s) != 2 {
+		return false
+	}
+	for _, c := range strings.ToUpper(s) {
+		if c < 'A' || c > 'Z' {
+			return false
+		}
+	}
+	return true
+}
+
+// groupTag returns the tag of the generated group for the region
+func (r *RegionRule) groupTag() string {
+	if r.Flag != "" {
+		return r.Flag + " " + r.Name
+	}
+	return r.Name
+}
+
+// matches reports whether a node tag belongs to the region
+func (r *RegionRule) matches(tag string) bool {
+	if r.Flag != "" && strings.Contains(tag, r.Flag) {
+		return true
+	}
+	lower := strings.ToLower(tag)
+	for _, kw := range r.Keywords {
+		if kw != "" && containsKeyword(lower, strings.ToLower(kw)) {
+			return true
+		}
+	}
+	return false
+}
+
+// containsKeyword reports whether s contains kw. Keywords made of ASCII
+// letters must stand alone, so "US" matches "US-01" but not "Russia".
+func containsKeyword(s, kw string) bool {
+	if !isASCIIWord(kw) {
+		return strings.Contains(s, kw)
+	}
+	for start := 0; ; {
+		i := strings.Index(s[start:], kw)
+		if i < 0 {
+			return false
+		}
+		i += start
+		end := i + len(kw)
+		if (i == 0 || !isASCIILetter(s[i-1])) && (end == len(s) || !isASCIILetter(s[end])) {
+			return true
+		}
+		start = i + 1
+	}
+}
+
+func isASCIIWord(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if !isASCIILetter(s[i]) && s[i] != ' ' {
+			return false
+		}
+	}
+	return true
+}
+
+func isASCIILetter(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+// addRegionGroups groups the nodes of a config by region into groups of the
+// given mode and adds them to the main selector, which is route.final if that
+// is a selector and otherwise the first selector. Each node joins the first
+// region it matches; regions without nodes get no group. A region whose group
+// tag is already used in the profile is skipped with a warning.
+func addRegionGroups(content []byte, mode string, regions []RegionRule) ([]byte, []string, error) {
+	if mode == RegionGroupsOff {
+		return content, nil, nil
+	}
+
+	outbounds := gjson.GetBytes(content, "outbounds").Array()
+	used := make(map[string]bool)
+	var nodes []string
+	for _, ob := range outbounds {
+		tag := ob.Get("tag").String()
+		used[tag] = true
+		if !slices.Contains(nonNodeTypes, ob.Get("type").String()) {
+			nodes = append(nodes, tag)
+		}
+	}
+
+	members := make([][]string, len(regions))
+	for _, node := range nodes {
+		for i := range regions {
+			if regions[i].matches(node) {
+				members[i] = append(members[i], node)
+				break
+			}
+		}
+	}
+
+	var groupTags, warnings []string
+	var err error
+	for i := range regions {
+		if len(members[i]) == 0 {
+			continue
+		}
+		tag := regions[i].groupTag()
+		if used[tag] {
+			warnings = append(warnings, fmt.Sprintf("region group %q skipped, the profile already has an outbound with this tag", tag))
+			continue
+		}
+		used[tag] = true
+
+		group := map[string]interface{}{
+			"type":      mode,
+			"tag":       tag,
+			"outbounds": members[i],
+		}
+		if mode == RegionGroupsURLTest {
+			group["url"] = urltestURL
+			group["interval"] = "3m"
+		}
+		if content, err = sjson.SetBytes(content, "outbounds.-1", group); err != nil {
+			return nil, nil, err
+		}
+		groupTags = append(groupTags, tag)
+	}
+
+	if len(groupTags) == 0 {
+		return content, warnings, nil
+	}
+
+	main := -1
+	final := gjson.GetBytes(content, "route.final").String()
+	for i, ob := range outbounds {
+		if ob.Get("type").String() != "selector" {
+			continue
+		}
+		if main < 0 || ob.Get("tag").String() == final {
+			main = i
+		}
+		if ob.Get("tag").String() == final {
+			break
+		}
+	}
+	if main < 0 {
+		return content, warnings, nil
+	}
+
+	// Region groups go after the selector's leading groups, such as "auto",
+	// and before the individual nodes
+	current := outbounds[main].Get("outbounds").Array()
+	pos := 0
+	for pos < len(current) && !slices.Contains(nodes, current[pos].String()) {
+		pos++
+	}
+	updated := make([]string, 0, len(current)+len(groupTags))
+	for _, m := range current[:pos] {
+		updated = append(updated, m.String())
+	}
+	updated = append(updated, groupTags...)
+	for _, m := range current[pos:] {
+		updated = append(updated, m.String())
+	}
+
+	content, err = sjson.SetBytes(content, fmt.Sprintf("outbounds.%d.outbounds", main), updated)
+	if err != nil {
+		return nil, nil, err
+	}
+	return content, warnings, nil
+}
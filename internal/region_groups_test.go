@@ -0,0 +1,206 @@
+package internal
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/tidwall/gjson"
+)
+
+func TestRegionMatches(t *testing.T) {
+	regions := DefaultRegions()
+	region := func(name string) *RegionRule {
+		for i := range regions {
+			if regions[i].Name == name {
+				return &regions[i]
+			}
+		}
+		t.Fatalf("no region %s", name)
+		return nil
+	}
+
+	tests := []struct {
+		region string
+		tag    string
+		want   bool
+	}{
+		{"HK", "🇭🇰 Node 01", true},
+		{"HK", "HK-01", true},
+		{"HK", "hk 01", true},
+		{"HK", "Hong Kong IPLC", true},
+		{"HK", "香港 01", true},
+		{"HK", "港专线", true},
+		{"HK", "HKT Premium", false}, // Keyword is part of a longer word
+		{"HK", "Shanghai-Hk", true},
+		{"US", "US 01", true},
+		{"US", "[US]Node", true},
+		{"US", "us2", true}, // Digits do not join a word
+		{"US", "Russia 01", false},
+		{"US", "Status", false},
+		{"US", "Los Angeles 02", true},
+		{"US", "美国 03", true},
+		{"GB", "UK London", true},
+		{"GB", "Ukraine", false},
+		{"JP", "Tokyo|Osaka", true},
+		{"JP", "JPN 01", false},
+		{"SG", "🇸🇬", true},
+		{"SG", "Singapore-Premium", true},
+	}
+	for _, tt := range tests {
+		if got := region(tt.region).matches(tt.tag); got != tt.want {
+			t.Errorf("%s.matches(%q) = %v, want %v", tt.region, tt.tag, got, tt.want)
+		}
+	}
+
+	custom := RegionRule{Name: "X", Keywords: []string{"", "Some Place"}}
+	if custom.matches("anything") || !custom.matches("node some place 1") {
+		t.Error("custom keywords did not match as expected")
+	}
+}
+
+func TestRegionRuleValidate(t *testing.T) {
+	for _, r := range DefaultRegions() {
+		if err := r.Validate(); err != nil {
+			t.Errorf("default region %s: %v", r.Name, err)
+		}
+	}
+	bad := []RegionRule{
+		{Name: " ", Flag: "🇭🇰"}, {Name: "XX"}, {Name: "XX", Keywords: []string{}},
+		{Name: "UK", Keywords: []string{"London"}, Country: "GBR"},
+		{Name: "UK", Keywords: []string{"London"}, Country: "G1"},
+	}
+	for _, r := range bad {
+		if err := r.Validate(); err == nil {
+			t.Errorf("Validate(%+v) succeeded", r)
+		}
+	}
+	if tag := (&RegionRule{Name: "XX"}).groupTag(); tag != "XX" {
+		t.Errorf("groupTag() without flag = %q", tag)
+	}
+}
+
+const regionFixture = `{
+  "outbounds": [
+    {"type": "selector", "tag": "Other", "outbounds": ["US 01"]},
+    {"type": "selector", "tag": "Proxy", "outbounds": ["auto", "direct", "HK 01", "US 01"]},
+    {"type": "urltest", "tag": "auto", "outbounds": ["HK 01", "HK 02 🇯🇵", "US 01", "JP 01"]},
+    {"type": "trojan", "tag": "HK 01", "server": "a.example.com", "server_port": 443, "password": "p"},
+    {"type": "trojan", "tag": "HK 02 🇯🇵", "server": "b.example.com", "server_port": 443, "password": "p"},
+    {"type": "trojan", "tag": "US 01", "server": "c.example.com", "server_port": 443, "password": "p"},
+    {"type": "trojan", "tag": "JP 01", "server": "d.example.com", "server_port": 443, "password": "p"},
+    {"type": "trojan", "tag": "Misc", "server": "e.example.com", "server_port": 443, "password": "p"},
+    {"type": "direct", "tag": "direct"}
+  ],
+  "route": {"final": "Proxy"}
+}`
+
+func TestAddRegionGroups(t *testing.T) {
+	out, warnings, err := addRegionGroups([]byte(regionFixture), RegionGroupsURLTest, DefaultRegions())
+	if err != nil {
+		t.Fatalf("addRegionGroups() error = %v", err)
+	}
+	if len(warnings) != 0 {
+		t.Errorf("warnings = %v", warnings)
+	}
+
+	// Each node joins the first region it matches, in table order
+	groups := map[string][]string{}
+	for _, ob := range gjson.GetBytes(out, "outbounds").Array()[9:] {
+		if ob.Get("type").String() != "urltest" || ob.Get("url").String() != urltestURL {
+			t.Errorf("group %s = %s", ob.Get("tag"), ob.Raw)
+		}
+		for _, m := range ob.Get("outbounds").Array() {
+			groups[ob.Get("tag").String()] = append(groups[ob.Get("tag").String()], m.String())
+		}
+	}
+	want := map[string][]string{
+		"🇭🇰 HK": {"HK 01", "HK 02 🇯🇵"},
+		"🇯🇵 JP": {"JP 01"},
+		"🇺🇸 US": {"US 01"},
+	}
+	if !reflect.DeepEqual(groups, want) {
+		t.Errorf("groups = %v, want %v", groups, want)
+	}
+
+	// The groups join route.final after its leading groups, before the nodes
+	var proxy []string
+	for _, m := range gjson.GetBytes(out, `outbounds.#(tag=="Proxy").outbounds`).Array() {
+		proxy = append(proxy, m.String())
+	}
+	wantProxy := []string{"auto", "direct", "🇭🇰 HK", "🇯🇵 JP", "🇺🇸 US", "HK 01", "US 01"}
+	if !reflect.DeepEqual(proxy, wantProxy) {
+		t.Errorf("Proxy = %v, want %v", proxy, wantProxy)
+	}
+	if got := gjson.GetBytes(out, `outbounds.#(tag=="Other").outbounds.#`).Int(); got != 1 {
+		t.Errorf("other selector changed to %d members", got)
+	}
+	checkConfig(t, out)
+}
+
+func TestAddRegionGroupsMainSelector(t *testing.T) {
+	regions := []RegionRule{{Name: "HK", Keywords: []string{"HK"}}}
+
+	// Without a selector as route.final, the first selector is used
+	content := strings.Replace(regionFixture, `"final": "Proxy"`, `"final": "auto"`, 1)
+	out, _, err := addRegionGroups([]byte(content), RegionGroupsSelector, regions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := gjson.GetBytes(out, `outbounds.0.outbounds`).Raw; got != `["HK","US 01"]` {
+		t.Errorf("first selector = %s", got)
+	}
+	if ob := gjson.GetBytes(out, `outbounds.#(tag=="HK")`); ob.Get("type").String() != "selector" || ob.Get("url").Exists() {
+		t.Errorf("selector group = %s", ob.Raw)
+	}
+
+	// Without any selector the groups are still added
+	noSelector := `{"outbounds": [{"type": "trojan", "tag": "HK 01", "server": "a.example.com", "server_port": 443, "password": "p"}]}`
+	out, _, err = addRegionGroups([]byte(noSelector), RegionGroupsSelector, regions)
+	if err != nil || gjson.GetBytes(out, "outbounds.#").Int() != 2 {
+		t.Errorf("addRegionGroups() without selector = %s, %v", out, err)
+	}
+}
+
+func TestAddRegionGroupsSkips(t *testing.T) {
+	// A region tag taken by the profile is reported; regions without nodes are silent
+	regions := []RegionRule{{Name: "Proxy", Keywords: []string{"HK"}}, {Name: "KR", Keywords: []string{"KR"}}, {Name: "US", Keywords: []string{"US"}}}
+	out, warnings, err := addRegionGroups([]byte(regionFixture), RegionGroupsURLTest, regions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(warnings) != 1 || !strings.Contains(warnings[0], `"Proxy"`) {
+		t.Errorf("warnings = %v", warnings)
+	}
+	if gjson.GetBytes(out, "outbounds.#").Int() != 10 || gjson.GetBytes(out, "outbounds.9.tag").String() != "US" {
+		t.Errorf("outbounds = %s", gjson.GetBytes(out, "outbounds.#.tag").Raw)
+	}
+
+	out, warnings, err = addRegionGroups([]byte(regionFixture), RegionGroupsOff, regions)
+	if err != nil || warnings != nil || string(out) != regionFixture {
+		t.Error("addRegionGroups() changed the config with region groups off")
+	}
+}
+
+func TestRegionsCleared(t *testing.T) {
+	dir := t.TempDir()
+	s := NewStorage(dir)
+	if meta, _ := s.LoadMeta(); !reflect.DeepEqual(meta.Regions, DefaultRegions()) {
+		t.Fatalf("new storage regions = %v, want the defaults", meta.Regions)
+	}
+
+	if err := NewSettingsManager(s).SaveRegions(nil); err != nil {
+		t.Fatal(err)
+	}
+	s.Flush()
+
+	// An emptied table stays empty after a restart
+	reloaded := NewStorage(dir)
+	meta, err := reloaded.LoadMeta()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.Regions == nil || len(meta.Regions) != 0 {
+		t.Errorf("reloaded regions = %v, want an empty table", meta.Regions)
+	}
+}
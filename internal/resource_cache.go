@@ -0,0 +1,592 @@
+package internal
+
+import (
+	"archive/zip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+// Kinds of cached resource
+const (
+	ResourceRuleSet = "rule_set"
+	ResourceUI      = "external_ui"
+)
+
+const (
+	// resourceRefreshInterval is how old a cached resource gets before it is downloaded again
+	resourceRefreshInterval = 24 * time.Hour
+	// defaultExternalUIURL is where sing-box downloads the external UI from when no URL is set
+	defaultExternalUIURL = "https://github.com/MetaCubeX/Yacd-meta/archive/gh-pages.zip"
+)
+
+// CachedResource is a remote rule set or external UI stored in data/resources
+type CachedResource struct {
+	URL     string    `json:"url"`
+	Kind    string    `json:"kind"`
+	Path    string    `json:"path"` // File or directory name in the cache directory
+	Updated time.Time `json:"updated"`
+}
+
+// resourceRef is a remote resource referenced by a config
+type resourceRef struct {
+	URL  string
+	Kind string
+}
+
+// ResourceCache downloads the remote resources of configs ahead of time so
+// the core can start without fetching anything
+type ResourceCache struct {
+	mu         sync.Mutex
+	fetchMu    sync.Mutex // Serializes downloads
+	dir        string
+	coreDir    string
+	httpClient *HTTPClient
+	index      map[string]*CachedResource // URL -> entry
+	failures   map[string]time.Time       // URL -> last failed refresh
+}
+
+// NewResourceCache creates a resource cache and loads its index
+func NewResourceCache(appDir string, httpClient *HTTPClient) *ResourceCache {
+	rc := &ResourceCache{
+		dir:        filepath.Join(appDir, "data", "resources"),
+		coreDir:    filepath.Join(appDir, "data", "core"),
+		httpClient: httpClient,
+		index:      make(map[string]*CachedResource),
+		failures:   make(map[string]time.Time),
+	}
+
+	if data, err := os.ReadFile(rc.indexPath()); err == nil {
+		var entries []*CachedResource
+		if json.Unmarshal(data, &entries) == nil {
+			for _, e := range entries {
+				rc.index[e.URL] = e
+			}
+		}
+	}
+	return rc
+}
+
+func (rc *ResourceCache) indexPath() string {
+	return filepath.Join(rc.dir, "index.json")
+}
+
+// saveIndex writes the index. The caller must hold rc.mu.
+func (rc *ResourceCache) saveIndex() error {
+	data, err := json.MarshalIndent(rc.list(), "", "  ")
+	if err != nil {
+		return err
+	}
+	return atomicWrite(rc.indexPath(), data)
+}
+
+// list returns the entries sorted by URL. The caller must hold rc.mu.
+func (rc *ResourceCache) list() []CachedResource {
+	entries := make([]CachedResource, 0, len(rc.index))
+	for _, e := range rc.index {
+		entries = append(entries, *e)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].URL < entries[j].URL })
+	return entries
+}
+
+// List returns the cached resources
+func (rc *ResourceCache) List() []CachedResource {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return rc.list()
+}
+
+// Lookup returns the local path of a cached resource
+func (rc *ResourceCache) Lookup(rawURL string) (string, bool) {
+	rc.mu.Lock()
+	entry, ok := rc.index[rawURL]
+	rc.mu.Unlock()
+	if !ok {
+		return "", false
+	}
+
+	p := filepath.Join(rc.dir, entry.Path)
+	if _, err := os.Stat(p); err != nil {
+		return "", false
+	}
+	return p, true
+}
+
+// Sync downloads the resources that are not cached yet and returns the ones that failed
+func (rc *ResourceCache) Sync(refs []resourceRef, mirror string) map[string]error {
+	failed := make(map[string]error)
+	for _, ref := range refs {
+		if _, ok := rc.Lookup(ref.URL); ok {
+			continue
+		}
+		if err := rc.Fetch(ref, mirror); err != nil {
+			failed[ref.URL] = err
+		}
+	}
+	return failed
+}
+
+// RefreshDue downloads again every resource older than the refresh interval
+// and returns the ones that failed. A failed resource is retried after
+// schedulerRetryDelay.
+func (rc *ResourceCache) RefreshDue(mirror string) map[string]error {
+	rc.mu.Lock()
+	var due []resourceRef
+	for _, e := range rc.index {
+		if failed, ok := rc.failures[e.URL]; ok && time.Since(failed) < schedulerRetryDelay {
+			continue
+		}
+		if time.Since(e.Updated) >= resourceRefreshInterval {
+			due = append(due, resourceRef{URL: e.URL, Kind: e.Kind})
+		}
+	}
+	rc.mu.Unlock()
+
+	failed := make(map[string]error)
+	for _, ref := range due {
+		if err := rc.Fetch(ref, mirror); err != nil {
+			failed[ref.URL] = err
+			rc.mu.Lock()
+			rc.failures[ref.URL] = time.Now()
+			rc.mu.Unlock()
+		}
+	}
+	return failed
+}
+
+// RefreshAll downloads every cached resource and refs again and returns the ones that failed
+func (rc *ResourceCache) RefreshAll(refs []resourceRef, mirror string) map[string]error {
+	rc.mu.Lock()
+	seen := make(map[string]bool)
+	for _, ref := range refs {
+		seen[ref.URL] = true
+	}
+	for _, e := range rc.index {
+		if !seen[e.URL] {
+			refs = append(refs, resourceRef{URL: e.URL, Kind: e.Kind})
+		}
+	}
+	rc.mu.Unlock()
+
+	failed := make(map[string]error)
+	for _, ref := range refs {
+		if err := rc.Fetch(ref, mirror); err != nil {
+			failed[ref.URL] = err
+		}
+	}
+	return failed
+}
+
+// Prune drops the index entries whose URL is not in keep, and every file in
+// the cache directory that no remaining entry owns. It returns the URLs dropped.
+func (rc *ResourceCache) Prune(keep map[string]bool) []string {
+	rc.fetchMu.Lock()
+	defer rc.fetchMu.Unlock()
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	var dropped []string
+	owned := map[string]bool{"index.json": true}
+	for u, e := range rc.index {
+		if keep[u] {
+			owned[e.Path] = true
+			continue
+		}
+		delete(rc.index, u)
+		delete(rc.failures, u)
+		dropped = append(dropped, u)
+	}
+	sort.Strings(dropped)
+
+	// No download is running while fetchMu is held, so leftover .tmp and
+	// .new files go too
+	if files, err := os.ReadDir(rc.dir); err == nil {
+		for _, f := range files {
+			if !owned[f.Name()] {
+				os.RemoveAll(filepath.Join(rc.dir, f.Name()))
+			}
+		}
+	}
+
+	if len(dropped) > 0 {
+		rc.saveIndex()
+	}
+	return dropped
+}
+
+// inUse returns the URLs of the cached resources a localized config points at
+func (rc *ResourceCache) inUse(content []byte) []string {
+	paths := make(map[string]bool)
+	gjson.GetBytes(content, "route.rule_set").ForEach(func(_, rs gjson.Result) bool {
+		if rs.Get("type").String() == "local" {
+			paths[filepath.Clean(rs.Get("path").String())] = true
+		}
+		return true
+	})
+	if ui := gjson.GetBytes(content, "experimental.clash_api.external_ui").String(); ui != "" {
+		paths[filepath.Clean(ui)] = true
+	}
+
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	var urls []string
+	for u, e := range rc.index {
+		if paths[filepath.Join(rc.dir, e.Path)] {
+			urls = append(urls, u)
+		}
+	}
+	return urls
+}
+
+// Fetch downloads a resource into the cache, replacing any previous copy
+func (rc *ResourceCache) Fetch(ref resourceRef, mirror string) error {
+	rc.fetchMu.Lock()
+	defer rc.fetchMu.Unlock()
+
+	os.MkdirAll(rc.dir, 0755)
+	name := resourceName(ref)
+	dest := filepath.Join(rc.dir, name)
+	tmpFile := dest + ".tmp"
+	defer os.Remove(tmpFile)
+
+	if err := rc.download(mirrorURL(ref.URL, mirror), tmpFile); err != nil {
+		return err
+	}
+
+	if ref.Kind == ResourceUI {
+		if err := extractUI(tmpFile, dest); err != nil {
+			return err
+		}
+	} else if err := os.Rename(tmpFile, dest); err != nil {
+		return err
+	}
+
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	rc.index[ref.URL] = &CachedResource{URL: ref.URL, Kind: ref.Kind, Path: name, Updated: time.Now()}
+	delete(rc.failures, ref.URL)
+	return rc.saveIndex()
+}
+
+func (rc *ResourceCache) download(rawURL, dest string) error {
+	resp, err := rc.httpClient.Get(rawURL)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("bad status: %s", resp.Status)
+	}
+
+	out, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, resp.Body); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// resourceName returns the cache file name of a resource, derived from its URL
+func resourceName(ref resourceRef) string {
+	sum := sha256.Sum256([]byte(ref.URL))
+	name := hex.EncodeToString(sum[:8])
+	if ref.Kind == ResourceUI {
+		return "ui-" + name
+	}
+
+	ext := ".srs"
+	if u, err := url.Parse(ref.URL); err == nil && strings.EqualFold(path.Ext(u.Path), ".json") {
+		ext = ".json"
+	}
+	return name + ext
+}
+
+// mirrorURL routes GitHub downloads through the mirror, if one is set
+func mirrorURL(rawURL, mirror string) string {
+	if mirror == "" {
+		return rawURL
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Host != "github.com" && u.Host != "raw.githubusercontent.com") {
+		return rawURL
+	}
+	if !strings.HasSuffix(mirror, "/") {
+		mirror += "/"
+	}
+	return mirror + rawURL
+}
+
+// extractUI unpacks an external UI archive into dir. Like sing-box, it drops
+// the archive's single top-level directory.
+func extractUI(zipPath, dir string) error {
+	zipReader, err := zip.OpenReader(zipPath)
+	if err != nil {
+		return fmt.Errorf("invalid archive: %w", err)
+	}
+	defer zipReader.Close()
+
+	prefix := ""
+	if len(zipReader.File) > 0 {
+		first := strings.SplitN(zipReader.File[0].Name, "/", 2)[0] + "/"
+		prefix = first
+		for _, f := range zipReader.File {
+			if !strings.HasPrefix(f.Name, first) {
+				prefix = ""
+				break
+			}
+		}
+	}
+
+	tmpDir := dir + ".new"
+	os.RemoveAll(tmpDir)
+	for _, f := range zipReader.File {
+		name := strings.TrimPrefix(f.Name, prefix)
+		if name == "" || f.FileInfo().IsDir() {
+			continue
+		}
+		target := filepath.Join(tmpDir, filepath.FromSlash(name))
+		if !strings.HasPrefix(target, tmpDir+string(os.PathSeparator)) {
+			os.RemoveAll(tmpDir)
+			return fmt.Errorf("invalid path in archive: %s", f.Name)
+		}
+		if err := extractFile(f, target); err != nil {
+			os.RemoveAll(tmpDir)
+			return err
+		}
+	}
+
+	os.RemoveAll(dir)
+	return os.Rename(tmpDir, dir)
+}
+
+func extractFile(f *zip.File, target string) error {
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	src, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.Create(target)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		return err
+	}
+	return dst.Close()
+}
+
+// remoteResources lists the remote rule sets and the external UI of a config
+func remoteResources(content []byte) []resourceRef {
+	var refs []resourceRef
+	gjson.GetBytes(content, "route.rule_set").ForEach(func(_, rs gjson.Result) bool {
+		if rs.Get("type").String() == "remote" && rs.Get("url").String() != "" {
+			refs = append(refs, resourceRef{URL: rs.Get("url").String(), Kind: ResourceRuleSet})
+		}
+		return true
+	})
+
+	clashAPI := gjson.GetBytes(content, "experimental.clash_api")
+	if clashAPI.Get("external_ui").String() != "" {
+		uiURL := clashAPI.Get("external_ui_download_url").String()
+		if uiURL == "" {
+			uiURL = defaultExternalUIURL
+		}
+		refs = append(refs, resourceRef{URL: uiURL, Kind: ResourceUI})
+	}
+	return refs
+}
+
+// localizeResources rewrites the remote rule sets and external UI of a config
+// to their cached copies. It returns the resources that are not cached; those
+// stay remote and are fetched by the core.
+func (rc *ResourceCache) localizeResources(content []byte) ([]byte, []resourceRef, error) {
+	var missing []resourceRef
+	var err error
+
+	for i, rs := range gjson.GetBytes(content, "route.rule_set").Array() {
+		rawURL := rs.Get("url").String()
+		if rs.Get("type").String() != "remote" || rawURL == "" {
+			continue
+		}
+		local, ok := rc.Lookup(rawURL)
+		if !ok {
+			missing = append(missing, resourceRef{URL: rawURL, Kind: ResourceRuleSet})
+			continue
+		}
+
+		entry := map[string]interface{}{
+			"type": "local",
+			"tag":  rs.Get("tag").String(),
+			"path": local,
+		}
+		if format := rs.Get("format").String(); format != "" {
+			entry["format"] = format
+		}
+		if content, err = sjson.SetBytes(content, fmt.Sprintf("route.rule_set.%d", i), entry); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	clashAPI := gjson.GetBytes(content, "experimental.clash_api")
+	if ui := clashAPI.Get("external_ui").String(); ui != "" {
+		uiURL := clashAPI.Get("external_ui_download_url").String()
+		if uiURL == "" {
+			uiURL = defaultExternalUIURL
+		}
+		if local, ok := rc.Lookup(uiURL); ok {
+			if content, err = sjson.SetBytes(content, "experimental.clash_api.external_ui", local); err != nil {
+				return nil, nil, err
+			}
+			if content, err = sjson.DeleteBytes(content, "experimental.clash_api.external_ui_download_url"); err != nil {
+				return nil, nil, err
+			}
+		} else if !filepath.IsAbs(ui) {
+			// An external UI already unpacked next to the core is not downloaded again
+			if _, statErr := os.Stat(filepath.Join(rc.coreDir, ui)); statErr != nil {
+				missing = append(missing, resourceRef{URL: uiURL, Kind: ResourceUI})
+			}
+		}
+	}
+
+	return content, missing, nil
+}
+
+// resourceMirror returns the GitHub mirror for resource downloads, if enabled
+func (a *App) resourceMirror() string {
+	meta, err := a.storage.LoadMeta()
+	if err != nil || !meta.MirrorEnabled {
+		return ""
+	}
+	return meta.Mirror
+}
+
+// prefetchResources caches the remote resources referenced by the given
+// configs in the background, so the next start does not need to fetch them
+func (a *App) prefetchResources(paths ...string) {
+	go func() {
+		var refs []resourceRef
+		for _, p := range paths {
+			if content, err := os.ReadFile(p); err == nil {
+				refs = append(refs, remoteResources(content)...)
+			}
+		}
+		a.pruneResources()
+		if len(refs) == 0 {
+			return
+		}
+
+		for u, err := range a.resourceCache.Sync(refs, a.resourceMirror()) {
+			a.appLogger.Warn("Failed to cache " + u + ": " + err.Error())
+		}
+	}()
+}
+
+// refreshDueResources downloads cached resources that are due for a refresh
+func (a *App) refreshDueResources() {
+	a.pruneResources()
+	for u, err := range a.resourceCache.RefreshDue(a.resourceMirror()) {
+		a.appLogger.Warn("Failed to refresh " + u + ": " + err.Error())
+	}
+}
+
+// pruneResources drops the cached resources that neither a profile nor the
+// running config references. It does nothing when a config cannot be read,
+// so a transient error never empties the cache.
+func (a *App) pruneResources() {
+	keep, ok := a.referencedResources()
+	if !ok {
+		return
+	}
+	for _, u := range a.resourceCache.Prune(keep) {
+		a.appLogger.Info("Removed unused resource " + u)
+	}
+}
+
+// referencedResources returns the URLs of the remote resources referenced by
+// any profile or by the running config
+func (a *App) referencedResources() (map[string]bool, bool) {
+	meta, err := a.storage.LoadMeta()
+	if err != nil {
+		return nil, false
+	}
+
+	keep := make(map[string]bool)
+	read := func(path string) ([]byte, bool) {
+		content, err := os.ReadFile(path)
+		if os.IsNotExist(err) {
+			return nil, true
+		}
+		return content, err == nil
+	}
+	for _, p := range meta.Profiles {
+		content, ok := read(a.profileManager.profilePath(p.ID))
+		if !ok {
+			return nil, false
+		}
+		for _, ref := range remoteResources(content) {
+			keep[ref.URL] = true
+		}
+	}
+
+	// Patches can add resources of their own, which only the runtime config
+	// shows, already rewritten to the cache
+	runtime, ok := read(filepath.Join(a.getAppDir(), "data", "core", "config.json"))
+	if !ok {
+		return nil, false
+	}
+	for _, ref := range remoteResources(runtime) {
+		keep[ref.URL] = true
+	}
+	for _, u := range a.resourceCache.inUse(runtime) {
+		keep[u] = true
+	}
+	return keep, true
+}
+
+func (a *App) GetCachedResources() []CachedResource {
+	return a.resourceCache.List()
+}
+
+func (a *App) RefreshResources() string {
+	var refs []resourceRef
+	if meta, err := a.storage.LoadMeta(); err == nil {
+		if path, err := a.findActiveProfilePath(meta); err == nil {
+			if content, err := os.ReadFile(path); err == nil {
+				refs = remoteResources(content)
+			}
+		}
+	}
+
+	failed := a.resourceCache.RefreshAll(refs, a.resourceMirror())
+	for u, err := range failed {
+		a.appLogger.Warn("Failed to refresh " + u + ": " + err.Error())
+	}
+	if len(failed) > 0 {
+		return fmt.Sprintf("Error: %d resources failed to download", len(failed))
+	}
+	return "Success"
+}
@@ -0,0 +1,173 @@
+package internal
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+// cacheResource stores ref in rc as if it had been downloaded
+func cacheResource(t *testing.T, rc *ResourceCache, ref resourceRef) string {
+	t.Helper()
+	name := resourceName(ref)
+	dest := filepath.Join(rc.dir, name)
+	if err := os.MkdirAll(rc.dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	var err error
+	if ref.Kind == ResourceUI {
+		err = os.Mkdir(dest, 0755)
+	} else {
+		err = os.WriteFile(dest, []byte("rules"), 0644)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rc.mu.Lock()
+	rc.index[ref.URL] = &CachedResource{URL: ref.URL, Kind: ref.Kind, Path: name, Updated: time.Now()}
+	rc.saveIndex()
+	rc.mu.Unlock()
+	return dest
+}
+
+// jsonString quotes s as a JSON string
+func jsonString(s string) string {
+	data, _ := json.Marshal(s)
+	return string(data)
+}
+
+func TestMirrorURL(t *testing.T) {
+	tests := []struct {
+		url, mirror, want string
+	}{
+		{"https://github.com/a/b/raw/main/x.srs", "", "https://github.com/a/b/raw/main/x.srs"},
+		{"https://github.com/a/b/raw/main/x.srs", "https://mirror.example", "https://mirror.example/https://github.com/a/b/raw/main/x.srs"},
+		{"https://raw.githubusercontent.com/a/b/main/x.srs", "https://mirror.example/", "https://mirror.example/https://raw.githubusercontent.com/a/b/main/x.srs"},
+		{"https://example.com/x.srs", "https://mirror.example/", "https://example.com/x.srs"},
+		{"https://api.github.com/x", "https://mirror.example/", "https://api.github.com/x"},
+		{"://bad", "https://mirror.example/", "://bad"},
+	}
+	for _, tt := range tests {
+		if got := mirrorURL(tt.url, tt.mirror); got != tt.want {
+			t.Errorf("mirrorURL(%q, %q) = %q, want %q", tt.url, tt.mirror, got, tt.want)
+		}
+	}
+}
+
+func TestLocalizeResources(t *testing.T) {
+	appDir := t.TempDir()
+	rc := NewResourceCache(appDir, nil)
+	geosite := cacheResource(t, rc, resourceRef{URL: "https://example.com/geosite-cn.srs", Kind: ResourceRuleSet})
+	ui := cacheResource(t, rc, resourceRef{URL: "https://example.com/ui.zip", Kind: ResourceUI})
+
+	content := `{
+		"route": {"rule_set": [
+			{"type": "remote", "tag": "geosite-cn", "format": "binary", "url": "https://example.com/geosite-cn.srs", "download_detour": "proxy"},
+			{"type": "remote", "tag": "geoip-cn", "url": "https://example.com/geoip-cn.srs"},
+			{"type": "local", "tag": "own", "path": "own.srs"}
+		]},
+		"experimental": {"clash_api": {"external_ui": "ui", "external_ui_download_url": "https://example.com/ui.zip"}}
+	}`
+	out, missing, err := rc.localizeResources([]byte(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := `{"type":"local","tag":"geosite-cn","path":` + jsonString(geosite) + `,"format":"binary"}`
+	if got := gjson.GetBytes(out, "route.rule_set.0").Raw; normalizeJSON(t, got) != normalizeJSON(t, want) {
+		t.Errorf("cached rule set = %s, want %s", got, want)
+	}
+	if got := gjson.GetBytes(out, "route.rule_set.1.type").String(); got != "remote" {
+		t.Errorf("uncached rule set type = %q, want remote", got)
+	}
+	if got := gjson.GetBytes(out, "route.rule_set.2.path").String(); got != "own.srs" {
+		t.Errorf("local rule set path = %q", got)
+	}
+
+	clash := gjson.GetBytes(out, "experimental.clash_api")
+	if clash.Get("external_ui").String() != ui || clash.Get("external_ui_download_url").Exists() {
+		t.Errorf("clash_api = %s, want external_ui %s", clash.Raw, ui)
+	}
+
+	wantMissing := []resourceRef{{URL: "https://example.com/geoip-cn.srs", Kind: ResourceRuleSet}}
+	if !reflect.DeepEqual(missing, wantMissing) {
+		t.Errorf("missing = %v, want %v", missing, wantMissing)
+	}
+}
+
+func TestLocalizeResourcesUI(t *testing.T) {
+	appDir := t.TempDir()
+	rc := NewResourceCache(appDir, nil)
+	content := []byte(`{"experimental": {"clash_api": {"external_ui": "ui"}}}`)
+
+	// Without a download URL the core fetches its default UI
+	_, missing, err := rc.localizeResources(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(missing) != 1 || missing[0].URL != defaultExternalUIURL || missing[0].Kind != ResourceUI {
+		t.Errorf("missing = %v, want the default UI", missing)
+	}
+
+	// A UI already unpacked next to the core is used as is
+	if err := os.MkdirAll(filepath.Join(rc.coreDir, "ui"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	out, missing, err := rc.localizeResources(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(missing) != 0 || gjson.GetBytes(out, "experimental.clash_api.external_ui").String() != "ui" {
+		t.Errorf("missing = %v, config = %s", missing, out)
+	}
+}
+
+func TestPrune(t *testing.T) {
+	appDir := t.TempDir()
+	rc := NewResourceCache(appDir, nil)
+	kept := cacheResource(t, rc, resourceRef{URL: "https://example.com/kept.srs", Kind: ResourceRuleSet})
+	dropped := cacheResource(t, rc, resourceRef{URL: "https://example.com/dropped.srs", Kind: ResourceRuleSet})
+	ui := cacheResource(t, rc, resourceRef{URL: "https://example.com/ui.zip", Kind: ResourceUI})
+	orphan := filepath.Join(rc.dir, "0123456789abcdef.srs.tmp")
+	if err := os.WriteFile(orphan, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	got := rc.Prune(map[string]bool{"https://example.com/kept.srs": true})
+	want := []string{"https://example.com/dropped.srs", "https://example.com/ui.zip"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Prune() = %v, want %v", got, want)
+	}
+	if _, err := os.Stat(kept); err != nil {
+		t.Errorf("kept resource removed: %v", err)
+	}
+	for _, p := range []string{dropped, ui, orphan} {
+		if _, err := os.Stat(p); !os.IsNotExist(err) {
+			t.Errorf("%s not removed", filepath.Base(p))
+		}
+	}
+
+	// The index on disk matches
+	reloaded := NewResourceCache(appDir, nil)
+	if list := reloaded.List(); len(list) != 1 || list[0].URL != "https://example.com/kept.srs" {
+		t.Errorf("reloaded index = %v", list)
+	}
+}
+
+func TestInUse(t *testing.T) {
+	appDir := t.TempDir()
+	rc := NewResourceCache(appDir, nil)
+	local := cacheResource(t, rc, resourceRef{URL: "https://example.com/patched.srs", Kind: ResourceRuleSet})
+	cacheResource(t, rc, resourceRef{URL: "https://example.com/other.srs", Kind: ResourceRuleSet})
+
+	content := `{"route": {"rule_set": [{"type": "local", "tag": "patched", "path": ` + jsonString(local) + `}]}}`
+	if got := rc.inUse([]byte(content)); !reflect.DeepEqual(got, []string{"https://example.com/patched.srs"}) {
+		t.Errorf("inUse() = %v", got)
+	}
+}
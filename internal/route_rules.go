@@ -0,0 +1,220 @@
+package internal
+
+import (
+	"fmt"
+	"net/netip"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+// Special route rule targets
+const (
+	RuleTargetDirect = "direct" // Bypass the proxy through a direct outbound
+	RuleTargetBlock  = "block"  // Reject the connection
+)
+
+// routeRuleTypes are the match fields supported by custom route rules
+var routeRuleTypes = []string{"domain", "domain_suffix", "domain_keyword", "ip_cidr", "process_name"}
+
+// leadingActions are rule actions kept ahead of the custom rules, since
+// sniffing and DNS hijacking must happen before anything is routed
+var leadingActions = []string{"sniff", "hijack-dns", "resolve"}
+
+// Validate checks the rule's type, values and target
+func (r *RouteRule) Validate() error {
+	if !slices.Contains(routeRuleTypes, r.Type) {
+		return fmt.Errorf("unknown rule type %q", r.Type)
+	}
+	if len(r.Values) == 0 {
+		return fmt.Errorf("%s rule has no values", r.Type)
+	}
+	for _, v := range r.Values {
+		if strings.TrimSpace(v) == "" {
+			return fmt.Errorf("%s rule has an empty value", r.Type)
+		}
+		if r.Type == "ip_cidr" {
+			if _, err := netip.ParsePrefix(v); err != nil {
+				if _, err := netip.ParseAddr(v); err != nil {
+					return fmt.Errorf("invalid ip_cidr %q", v)
+				}
+			}
+		}
+	}
+	if strings.TrimSpace(r.Outbound) == "" {
+		return fmt.Errorf("%s rule has no target outbound", r.Type)
+	}
+	return nil
+}
+
+// missingRuleTargets returns the targets of enabled rules that are not outbounds of the config
+func missingRuleTargets(content []byte, rules []RouteRule) []string {
+	tags := outboundTagSet(content)
+	var missing []string
+	for _, r := range rules {
+		if !r.Enabled || r.Outbound == RuleTargetDirect || r.Outbound == RuleTargetBlock {
+			continue
+		}
+		if !tags[r.Outbound] && !slices.Contains(missing, r.Outbound) {
+			missing = append(missing, r.Outbound)
+		}
+	}
+	return missing
+}
+
+// outboundTagSet returns the tags of all outbounds in a config
+func outboundTagSet(content []byte) map[string]bool {
+	tags := make(map[string]bool)
+	gjson.GetBytes(content, "outbounds.#.tag").ForEach(func(_, tag gjson.Result) bool {
+		tags[tag.String()] = true
+		return true
+	})
+	return tags
+}
+
+// applyRouteRules inserts the enabled custom rules at the front of the
+// config's route rules, after any leading sniff and DNS hijack rules.
+// "block" maps to a reject action and "direct" to the config's direct
+// outbound, which is added if the profile has none. Rules whose target is
+// not an outbound of the profile are skipped with a warning.
+func applyRouteRules(content []byte, rules []RouteRule) ([]byte, []string, error) {
+	var enabled []RouteRule
+	for _, r := range rules {
+		if r.Enabled {
+			enabled = append(enabled, r)
+		}
+	}
+
+	var warnings []string
+	if missing := missingRuleTargets(content, enabled); len(missing) > 0 {
+		kept := enabled[:0]
+		for _, r := range enabled {
+			if !slices.Contains(missing, r.Outbound) {
+				kept = append(kept, r)
+			}
+		}
+		enabled = kept
+		warnings = append(warnings, "route rules skipped, target not found in profile outbounds: "+strings.Join(missing, ", "))
+	}
+	if len(enabled) == 0 {
+		return content, warnings, nil
+	}
+
+	directOut := ""
+	var err error
+	for _, r := range enabled {
+		if r.Outbound != RuleTargetDirect {
+			continue
+		}
+		if directOut, err = ensureDirectOutbound(&content); err != nil {
+			return nil, nil, err
+		}
+		break
+	}
+
+	generated := make([]interface{}, 0, len(enabled))
+	for _, r := range enabled {
+		rule := map[string]interface{}{r.Type: r.Values}
+		switch r.Outbound {
+		case RuleTargetBlock:
+			rule["action"] = "reject"
+		case RuleTargetDirect:
+			rule["outbound"] = directOut
+		default:
+			rule["outbound"] = r.Outbound
+		}
+		generated = append(generated, rule)
+	}
+
+	content, err = insertRouteRules(content, generated)
+	return content, warnings, err
+}
+
+// insertRouteRules inserts rules at the front of the config's route rules,
+// after any leading sniff and DNS hijack rules
+func insertRouteRules(content []byte, generated []interface{}) ([]byte, error) {
+	existing := gjson.GetBytes(content, "route.rules").Array()
+	pos := 0
+	for pos < len(existing) && slices.Contains(leadingActions, existing[pos].Get("action").String()) {
+		pos++
+	}
+
+	merged := make([]interface{}, 0, len(existing)+len(generated))
+	for _, r := range existing[:pos] {
+		merged = append(merged, r.Value())
+	}
+	merged = append(merged, generated...)
+	for _, r := range existing[pos:] {
+		merged = append(merged, r.Value())
+	}
+
+	return sjson.SetBytes(content, "route.rules", merged)
+}
+
+// ensureDirectOutbound returns the tag of the config's direct outbound, adding one if needed
+func ensureDirectOutbound(content *[]byte) (string, error) {
+	var tag string
+	gjson.GetBytes(*content, "outbounds").ForEach(func(_, ob gjson.Result) bool {
+		if ob.Get("type").String() == "direct" {
+			tag = ob.Get("tag").String()
+			return false
+		}
+		return true
+	})
+	if tag != "" {
+		return tag, nil
+	}
+
+	tags := outboundTagSet(*content)
+	tag = directTag
+	for i := 2; tags[tag]; i++ {
+		tag = fmt.Sprintf("%s-%d", directTag, i)
+	}
+
+	updated, err := sjson.SetBytes(*content, "outbounds.-1", map[string]interface{}{
+		"type": "direct",
+		"tag":  tag,
+	})
+	if err != nil {
+		return "", err
+	}
+	*content = updated
+	return tag, nil
+}
+
+// CheckRouteRules returns the custom rule targets missing from a profile's outbounds
+func (pm *ProfileManager) CheckRouteRules(id string, rules []RouteRule) ([]string, error) {
+	if _, err := pm.findProfile(id); err != nil {
+		return nil, err
+	}
+
+	content, err := os.ReadFile(pm.profilePath(id))
+	if err != nil {
+		return nil, fmt.Errorf("read profile failed: %w", err)
+	}
+	return missingRuleTargets(content, rules), nil
+}
+
+// CheckActiveRouteRules fails if a custom rule target is missing from the
+// active profile's outbounds. Other profiles skip such rules at launch.
+func (pm *ProfileManager) CheckActiveRouteRules(rules []RouteRule) error {
+	meta, err := pm.storage.LoadMeta()
+	if err != nil {
+		return err
+	}
+	if meta.ActiveID == "" {
+		return nil
+	}
+
+	missing, err := pm.CheckRouteRules(meta.ActiveID, rules)
+	if err != nil {
+		return err
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("route rule target not found in profile outbounds: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,197 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/tidwall/gjson"
+)
+
+const routeFixture = `{
+  "outbounds": [
+    {"type": "selector", "tag": "Proxy", "outbounds": ["HK"]},
+    {"type": "trojan", "tag": "HK", "server": "hk.example.com", "server_port": 443, "password": "p"},
+    {"type": "direct", "tag": "bypass"}
+  ],
+  "route": {
+    "rules": [
+      {"action": "sniff"},
+      {"protocol": "dns", "action": "hijack-dns"},
+      {"action": "resolve"},
+      {"domain_suffix": ["profile.example.com"], "outbound": "HK"},
+      {"action": "sniff", "inbound": "late"}
+    ],
+    "final": "Proxy"
+  }
+}`
+
+// ruleSummaries returns a short form of each route rule: its action, or its outbound
+func ruleSummaries(content []byte) []string {
+	var out []string
+	for _, r := range gjson.GetBytes(content, "route.rules").Array() {
+		if action := r.Get("action").String(); action != "" && action != "route" {
+			out = append(out, action)
+		} else {
+			out = append(out, "->"+r.Get("outbound").String())
+		}
+	}
+	return out
+}
+
+func TestApplyRouteRules(t *testing.T) {
+	rules := []RouteRule{
+		{Type: "domain_suffix", Values: []string{"ads.example.com"}, Outbound: RuleTargetBlock, Enabled: true},
+		{Type: "ip_cidr", Values: []string{"10.0.0.0/8"}, Outbound: RuleTargetDirect, Enabled: true},
+		{Type: "domain", Values: []string{"off.example.com"}, Outbound: "HK"},
+		{Type: "process_name", Values: []string{"game.exe"}, Outbound: "Proxy", Enabled: true},
+	}
+	out, warnings, err := applyRouteRules([]byte(routeFixture), rules)
+	if err != nil || len(warnings) != 0 {
+		t.Fatalf("applyRouteRules() warnings = %v, error = %v", warnings, err)
+	}
+	checkConfig(t, out)
+
+	// After the leading actions, before the profile's rules, in order; only
+	// leading actions stay ahead, so the late sniff keeps its place
+	got := strings.Join(ruleSummaries(out), " ")
+	want := "sniff hijack-dns resolve reject ->bypass ->Proxy ->HK sniff"
+	if got != want {
+		t.Errorf("rules = %s, want %s", got, want)
+	}
+
+	// Block becomes a reject action without an outbound
+	block := gjson.GetBytes(out, "route.rules.3")
+	if block.Get("outbound").Exists() || block.Get("domain_suffix.0").String() != "ads.example.com" {
+		t.Errorf("block rule = %s", block.Raw)
+	}
+	if got := gjson.GetBytes(out, "route.rules.5.process_name.0").String(); got != "game.exe" {
+		t.Errorf("process rule = %s", gjson.GetBytes(out, "route.rules.5").Raw)
+	}
+	// The existing direct outbound is reused
+	if n := gjson.GetBytes(out, "outbounds.#").Int(); n != 3 {
+		t.Errorf("outbounds = %d, want 3", n)
+	}
+}
+
+func TestApplyRouteRulesDirectOutbound(t *testing.T) {
+	// Without a direct outbound one is added, avoiding taken tags
+	content := `{"outbounds": [{"type": "selector", "tag": "direct", "outbounds": ["HK"]}, {"type": "trojan", "tag": "HK", "server": "a", "server_port": 1, "password": "p"}]}`
+	rules := []RouteRule{{Type: "domain", Values: []string{"lan.example.com"}, Outbound: RuleTargetDirect, Enabled: true}}
+	out, _, err := applyRouteRules([]byte(content), rules)
+	if err != nil {
+		t.Fatal(err)
+	}
+	added := gjson.GetBytes(out, "outbounds.2")
+	if added.Get("type").String() != "direct" || added.Get("tag").String() != directTag+"-2" {
+		t.Errorf("added outbound = %s", added.Raw)
+	}
+	if got := strings.Join(ruleSummaries(out), " "); got != "->"+directTag+"-2" {
+		t.Errorf("rules = %s", got)
+	}
+	checkConfig(t, out)
+
+	// Rules only to block need no direct outbound
+	rules[0].Outbound = RuleTargetBlock
+	out, _, _ = applyRouteRules([]byte(content), rules)
+	if n := gjson.GetBytes(out, "outbounds.#").Int(); n != 2 {
+		t.Errorf("block rule added an outbound, got %d", n)
+	}
+}
+
+func TestApplyRouteRulesMissingTargets(t *testing.T) {
+	rules := []RouteRule{
+		{Type: "domain", Values: []string{"a.example.com"}, Outbound: "Missing", Enabled: true},
+		{Type: "domain", Values: []string{"b.example.com"}, Outbound: "Gone", Enabled: true},
+		{Type: "domain", Values: []string{"c.example.com"}, Outbound: "HK", Enabled: true},
+		{Type: "domain", Values: []string{"d.example.com"}, Outbound: "Missing", Enabled: true},
+		{Type: "domain", Values: []string{"e.example.com"}, Outbound: "Disabled"},
+	}
+
+	// Rules to missing outbounds are skipped, the others still apply
+	out, warnings, err := applyRouteRules([]byte(routeFixture), rules)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(warnings) != 1 || !strings.HasSuffix(warnings[0], ": Missing, Gone") {
+		t.Errorf("warnings = %v", warnings)
+	}
+	if got := strings.Join(ruleSummaries(out), " "); got != "sniff hijack-dns resolve ->HK ->HK sniff" {
+		t.Errorf("rules = %s", got)
+	}
+	checkConfig(t, out)
+
+	// Nothing left to apply leaves the config untouched
+	out, warnings, err = applyRouteRules([]byte(routeFixture), append(rules[:2:2], rules[4]))
+	if err != nil || len(warnings) != 1 || string(out) != routeFixture {
+		t.Errorf("applyRouteRules() without valid rules = %v, %v", warnings, err)
+	}
+	out, warnings, err = applyRouteRules([]byte(routeFixture), rules[4:])
+	if err != nil || len(warnings) != 0 || string(out) != routeFixture {
+		t.Error("applyRouteRules() changed the config without enabled rules")
+	}
+}
+
+func TestCheckActiveRouteRules(t *testing.T) {
+	pm := newTestProfileManager(t, Profile{ID: "a", Name: "Active"}, Profile{ID: "b", Name: "Other"})
+	rules := []RouteRule{{Type: "domain", Values: []string{"a.example.com"}, Outbound: "JP", Enabled: true}}
+
+	// Without an active profile there is nothing to check against
+	if err := pm.CheckActiveRouteRules(rules); err != nil {
+		t.Errorf("CheckActiveRouteRules() without an active profile = %v", err)
+	}
+
+	os.MkdirAll(filepath.Dir(pm.profilePath("a")), 0755)
+	os.WriteFile(pm.profilePath("a"), nodeConfig("HK"), 0644)
+	os.WriteFile(pm.profilePath("b"), nodeConfig("JP"), 0644)
+	pm.storage.Update(func(meta *MetaData) error {
+		meta.ActiveID = "a"
+		return nil
+	})
+
+	if err := pm.CheckActiveRouteRules(rules); err == nil || !strings.HasSuffix(err.Error(), ": JP") {
+		t.Errorf("CheckActiveRouteRules() = %v, want JP missing", err)
+	}
+	if missing, err := pm.CheckRouteRules("b", rules); err != nil || len(missing) != 0 {
+		t.Errorf("CheckRouteRules(b) = %v, %v", missing, err)
+	}
+	rules[0].Outbound = "HK"
+	if err := pm.CheckActiveRouteRules(rules); err != nil {
+		t.Errorf("CheckActiveRouteRules() = %v", err)
+	}
+}
+
+func TestInsertRouteRulesWithoutRoute(t *testing.T) {
+	out, err := insertRouteRules([]byte(`{"outbounds": []}`), []interface{}{map[string]interface{}{"action": "reject"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := gjson.GetBytes(out, "route.rules").Raw; got != `[{"action":"reject"}]` {
+		t.Errorf("route.rules = %s", got)
+	}
+}
+
+func TestRouteRuleValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		rule    RouteRule
+		wantErr bool
+	}{
+		{"domain", RouteRule{Type: "domain", Values: []string{"a.com"}, Outbound: "x"}, false},
+		{"cidr", RouteRule{Type: "ip_cidr", Values: []string{"10.0.0.0/8", "fd00::/8"}, Outbound: "x"}, false},
+		{"single ip", RouteRule{Type: "ip_cidr", Values: []string{"1.1.1.1"}, Outbound: "x"}, false},
+		{"bad cidr", RouteRule{Type: "ip_cidr", Values: []string{"10.0.0.0/33"}, Outbound: "x"}, true},
+		{"unknown type", RouteRule{Type: "geosite", Values: []string{"cn"}, Outbound: "x"}, true},
+		{"no values", RouteRule{Type: "domain", Outbound: "x"}, true},
+		{"blank value", RouteRule{Type: "domain", Values: []string{" "}, Outbound: "x"}, true},
+		{"no target", RouteRule{Type: "domain", Values: []string{"a.com"}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.rule.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -6,6 +6,8 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+
+	"github.com/google/uuid"
 )
 
 // SettingsManager manages application settings
@@ -22,15 +24,11 @@ func NewSettingsManager(storage *Storage) *SettingsManager {
 
 // SaveMirror saves mirror settings
 func (sm *SettingsManager) SaveMirror(mirror string, enabled bool) error {
-	meta, err := sm.storage.LoadMeta()
-	if err != nil {
-		return err
-	}
-
-	meta.Mirror = mirror
-	meta.MirrorEnabled = enabled
-
-	return sm.storage.SaveMeta(meta)
+	return sm.storage.Update(func(meta *MetaData) error {
+		meta.Mirror = mirror
+		meta.MirrorEnabled = enabled
+		return nil
+	})
 }
 
 // SetStartOnBoot sets start on boot
@@ -98,135 +96,296 @@ func (sm *SettingsManager) SetStartOnBoot(enabled bool) error {
 		cmd.Run()
 	}
 
-	meta, err := sm.storage.LoadMeta()
-	if err != nil {
-		return err
-	}
-
-	meta.StartOnBoot = enabled
-	return sm.storage.SaveMeta(meta)
+	return sm.storage.Update(func(meta *MetaData) error {
+		meta.StartOnBoot = enabled
+		return nil
+	})
 }
 
 // SetAutoConnect sets auto connect settings
 func (sm *SettingsManager) SetAutoConnect(state string) error {
-	meta, err := sm.storage.LoadMeta()
-	if err != nil {
-		return err
-	}
-
-	meta.AutoConnectState = state
-
-	return sm.storage.SaveMeta(meta)
+	return sm.storage.Update(func(meta *MetaData) error {
+		meta.AutoConnectState = state
+		return nil
+	})
 }
 
-// GetOverride gets override configuration
-func (sm *SettingsManager) GetOverride(name string) (string, error) {
+// GetOverride gets the override configuration that applies to a profile, or the global one if profileID is empty
+func (sm *SettingsManager) GetOverride(name, profileID string) (string, error) {
 	meta, err := sm.storage.LoadMeta()
 	if err != nil {
 		return "", err
 	}
 
-	switch name {
-	case "tun":
-		return meta.TunConfig, nil
-	case "mixed":
-		return meta.MixedConfig, nil
-	default:
-		return "{}", nil
-	}
+	return meta.Override(name, profileID), nil
 }
 
-// SaveOverride saves override configuration
-func (sm *SettingsManager) SaveOverride(name, content string) error {
+// SaveOverride saves override configuration for a profile, or globally if profileID is empty
+func (sm *SettingsManager) SaveOverride(name, profileID, content string) error {
 	if !json.Valid([]byte(content)) {
 		return fmt.Errorf("invalid JSON")
 	}
+	if name == "dns" {
+		if _, err := parseDNSOverride(content); err != nil {
+			return err
+		}
+	}
+	if name == "split" {
+		if _, err := parseSplitTunnel(content); err != nil {
+			return err
+		}
+	}
 
-	meta, err := sm.storage.LoadMeta()
-	if err != nil {
-		return err
+	return sm.storage.Update(func(meta *MetaData) error {
+		if profileID != "" {
+			if !isOverrideName(name) {
+				return fmt.Errorf("unknown type")
+			}
+			if !hasProfile(meta, profileID) {
+				return fmt.Errorf("profile not found")
+			}
+			if meta.ProfileOverrides[profileID] == nil {
+				meta.ProfileOverrides[profileID] = make(map[string]string)
+			}
+			meta.ProfileOverrides[profileID][name] = content
+			if name == "mixed" {
+				return checkInboundConflicts(meta.Inbounds, meta)
+			}
+			return nil
+		}
+
+		switch name {
+		case "tun":
+			meta.TunConfig = content
+		case "mixed":
+			meta.MixedConfig = content
+			return checkInboundConflicts(meta.Inbounds, meta)
+		case "dns":
+			meta.DNSConfig = content
+		case "split":
+			meta.SplitConfig = content
+		default:
+			return fmt.Errorf("unknown type")
+		}
+		return nil
+	})
+}
+
+// ClearProfileOverride removes a profile's own override so it falls back to the global one
+func (sm *SettingsManager) ClearProfileOverride(name, profileID string) error {
+	return sm.storage.Update(func(meta *MetaData) error {
+		delete(meta.ProfileOverrides[profileID], name)
+		if len(meta.ProfileOverrides[profileID]) == 0 {
+			delete(meta.ProfileOverrides, profileID)
+		}
+		return nil
+	})
+}
+
+// isOverrideName reports whether name is a known override
+func isOverrideName(name string) bool {
+	return name == "tun" || name == "mixed" || name == "dns" || name == "split"
+}
+
+// hasProfile reports whether a profile with the given ID exists
+func hasProfile(meta *MetaData, id string) bool {
+	for _, p := range meta.Profiles {
+		if p.ID == id {
+			return true
+		}
 	}
+	return false
+}
 
-	switch name {
-	case "tun":
-		meta.TunConfig = content
-	case "mixed":
-		meta.MixedConfig = content
-	default:
-		return fmt.Errorf("unknown type")
+// SetAllowLAN turns LAN sharing on or off. Credentials are generated the
+// first time it is turned on; a port of 0 keeps the current one.
+func (sm *SettingsManager) SetAllowLAN(enabled bool, port int) error {
+	if port < 0 || port > 65535 {
+		return fmt.Errorf("port must be between 1 and 65535")
 	}
 
-	return sm.storage.SaveMeta(meta)
+	return sm.storage.Update(func(meta *MetaData) error {
+		meta.AllowLAN = enabled
+		if port > 0 {
+			meta.LAN.Port = port
+		}
+		if enabled && meta.LAN.Password == "" {
+			if err := newLANCredentials(&meta.LAN); err != nil {
+				return err
+			}
+		}
+		return checkInboundConflicts(meta.Inbounds, meta)
+	})
+}
+
+// ResetLANCredentials replaces the LAN sharing password
+func (sm *SettingsManager) ResetLANCredentials() error {
+	return sm.storage.Update(func(meta *MetaData) error {
+		return newLANCredentials(&meta.LAN)
+	})
 }
 
-// SaveMode saves the run mode configuration
-func (sm *SettingsManager) SaveMode(tunMode, sysProxy bool) error {
-	meta, err := sm.storage.LoadMeta()
-	if err != nil {
-		return err
+// SaveRegions saves the region mapping table used for region groups
+func (sm *SettingsManager) SaveRegions(regions []RegionRule) error {
+	for i := range regions {
+		if err := regions[i].Validate(); err != nil {
+			return err
+		}
 	}
 
-	meta.TunMode = tunMode
-	meta.SysProxy = sysProxy
+	if regions == nil {
+		// Saved as an empty table; only a missing one gets the defaults
+		regions = []RegionRule{}
+	}
+	return sm.storage.Update(func(meta *MetaData) error {
+		meta.Regions = regions
+		return nil
+	})
+}
 
-	return sm.storage.SaveMeta(meta)
+// SavePatches validates and saves the ordered list of config patches.
+// Patches without an ID are assigned one.
+func (sm *SettingsManager) SavePatches(patches []ConfigPatch) error {
+	seen := make(map[string]bool)
+	for i := range patches {
+		if err := patches[i].Validate(); err != nil {
+			return err
+		}
+		if patches[i].ID == "" {
+			patches[i].ID = uuid.New().String()
+		}
+		if seen[patches[i].ID] {
+			return fmt.Errorf("duplicate patch id %q", patches[i].ID)
+		}
+		seen[patches[i].ID] = true
+	}
+
+	return sm.storage.Update(func(meta *MetaData) error {
+		meta.Patches = patches
+		return nil
+	})
 }
 
-// SaveTheme saves theme settings
-func (sm *SettingsManager) SaveTheme(mode, accentColor string) error {
-	meta, err := sm.storage.LoadMeta()
-	if err != nil {
-		return err
+// SetPatchEnabled enables or disables a single config patch
+func (sm *SettingsManager) SetPatchEnabled(id string, enabled bool) error {
+	return sm.storage.Update(func(meta *MetaData) error {
+		for i := range meta.Patches {
+			if meta.Patches[i].ID == id {
+				meta.Patches[i].Enabled = enabled
+				return nil
+			}
+		}
+		return fmt.Errorf("patch not found")
+	})
+}
+
+// SaveRouteRules validates and saves the ordered list of custom route rules.
+// Rules without an ID are assigned one.
+func (sm *SettingsManager) SaveRouteRules(rules []RouteRule) error {
+	for i := range rules {
+		if err := rules[i].Validate(); err != nil {
+			return err
+		}
+		if rules[i].ID == "" {
+			rules[i].ID = uuid.New().String()
+		}
+	}
+
+	return sm.storage.Update(func(meta *MetaData) error {
+		meta.RouteRules = rules
+		return nil
+	})
+}
+
+// SaveInbounds validates and saves the extra managed inbounds.
+// Inbounds without an ID are assigned one.
+func (sm *SettingsManager) SaveInbounds(inbounds []ManagedInbound) error {
+	for i := range inbounds {
+		if err := inbounds[i].Validate(); err != nil {
+			return err
+		}
+		if inbounds[i].ID == "" {
+			inbounds[i].ID = uuid.New().String()
+		}
 	}
 
-	meta.ThemeMode = mode
-	meta.AccentColor = accentColor
+	return sm.storage.Update(func(meta *MetaData) error {
+		if err := checkInboundConflicts(inbounds, meta); err != nil {
+			return err
+		}
+		meta.Inbounds = inbounds
+		return nil
+	})
+}
+
+// SetInboundEnabled enables or disables a single managed inbound
+func (sm *SettingsManager) SetInboundEnabled(id string, enabled bool) error {
+	return sm.storage.Update(func(meta *MetaData) error {
+		for i := range meta.Inbounds {
+			if meta.Inbounds[i].ID != id {
+				continue
+			}
+			meta.Inbounds[i].Enabled = enabled
+			return checkInboundConflicts(meta.Inbounds, meta)
+		}
+		return fmt.Errorf("inbound not found")
+	})
+}
 
-	return sm.storage.SaveMeta(meta)
+// SaveMode saves the run mode configuration
+func (sm *SettingsManager) SaveMode(tunMode, sysProxy bool) error {
+	return sm.storage.Update(func(meta *MetaData) error {
+		meta.TunMode = tunMode
+		meta.SysProxy = sysProxy
+		return nil
+	})
+}
+
+// SaveTheme saves theme settings
+func (sm *SettingsManager) SaveTheme(mode, accentColor string) error {
+	return sm.storage.Update(func(meta *MetaData) error {
+		meta.ThemeMode = mode
+		meta.AccentColor = accentColor
+		return nil
+	})
 }
 
 // SetIPv6Enabled sets IPv6 support (dynamic injection happens in processConfig)
 func (sm *SettingsManager) SetIPv6Enabled(enabled bool) error {
-	meta, err := sm.storage.LoadMeta()
-	if err != nil {
-		return err
-	}
-
-	meta.IPv6Enabled = enabled
+	return sm.storage.Update(func(meta *MetaData) error {
+		meta.IPv6Enabled = enabled
+		return nil
+	})
+}
 
-	return sm.storage.SaveMeta(meta)
+// SetStrictPorts sets whether port conflicts fail the launch instead of picking a free port
+func (sm *SettingsManager) SetStrictPorts(enabled bool) error {
+	return sm.storage.Update(func(meta *MetaData) error {
+		meta.StrictPorts = enabled
+		return nil
+	})
 }
 
 // SetLogConfig sets log configuration
 func (sm *SettingsManager) SetLogConfig(level string, toFile bool) error {
-	meta, err := sm.storage.LoadMeta()
-	if err != nil {
-		return err
-	}
-
-	meta.LogLevel = level
-	meta.LogToFile = toFile
-
-	return sm.storage.SaveMeta(meta)
+	return sm.storage.Update(func(meta *MetaData) error {
+		meta.LogLevel = level
+		meta.LogToFile = toFile
+		return nil
+	})
 }
 
 // SetPreRelease sets pre-release update channel
 func (sm *SettingsManager) SetPreRelease(enabled bool) error {
-	meta, err := sm.storage.LoadMeta()
-	if err != nil {
-		return err
-	}
-	meta.PreRelease = enabled
-	return sm.storage.SaveMeta(meta)
+	return sm.storage.Update(func(meta *MetaData) error {
+		meta.PreRelease = enabled
+		return nil
+	})
 }
-
 // SetCloseBehavior sets the close window behavior (ask, tray, quit)
 func (sm *SettingsManager) SetCloseBehavior(behavior string) error {
-	meta, err := sm.storage.LoadMeta()
-	if err != nil {
-		return err
-	}
-
-	meta.CloseBehavior = behavior
-	return sm.storage.SaveMeta(meta)
-}
\ No newline at end of file
+	return sm.storage.Update(func(meta *MetaData) error {
+		meta.CloseBehavior = behavior
+		return nil
+	})
+}
@@ -0,0 +1,161 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"slices"
+	"strings"
+
+	"github.com/tidwall/gjson"
+)
+
+// splitTunnel is the content of the "split" override
+type splitTunnel struct {
+	Direct         []string `json:"direct"`          // Executables that bypass the proxy
+	Proxy          []string `json:"proxy"`           // Executables that always use the proxy
+	ProxyOutbound  string   `json:"proxy_outbound"`  // Outbound for Proxy, the route's final outbound if empty
+	ExcludeAddress []string `json:"exclude_address"` // CIDRs routed outside the TUN
+}
+
+// parseSplitTunnel parses and validates the content of a "split" override
+func parseSplitTunnel(content string) (*splitTunnel, error) {
+	var s splitTunnel
+	if err := json.Unmarshal([]byte(content), &s); err != nil {
+		return nil, fmt.Errorf("invalid split tunnel config: %w", err)
+	}
+
+	seen := make(map[string]string) // Lowercased executable -> list
+	lists := []struct {
+		name   string
+		values []string
+	}{{"direct", s.Direct}, {"proxy", s.Proxy}}
+	for _, l := range lists {
+		for _, v := range l.values {
+			if strings.TrimSpace(v) == "" {
+				return nil, fmt.Errorf("%s list has an empty entry", l.name)
+			}
+			// Windows file names are case-insensitive
+			key := strings.ToLower(v)
+			if other, ok := seen[key]; ok {
+				if other == l.name {
+					return nil, fmt.Errorf("%q is listed twice", v)
+				}
+				return nil, fmt.Errorf("%q is in both the direct and proxy lists", v)
+			}
+			seen[key] = l.name
+		}
+	}
+
+	for _, cidr := range s.ExcludeAddress {
+		if _, err := netip.ParsePrefix(cidr); err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q", cidr)
+		}
+	}
+	return &s, nil
+}
+
+// isProcessPath reports whether an entry is a full path rather than an executable name
+func isProcessPath(v string) bool {
+	return strings.ContainsAny(v, `\/`)
+}
+
+// processRules returns the route rules sending the executables to an
+// outbound. Names and paths need separate rules, since sing-box requires
+// every kind of process match in a rule to hold.
+func processRules(values []string, outbound string) []interface{} {
+	var names, paths []string
+	for _, v := range values {
+		if isProcessPath(v) {
+			paths = append(paths, v)
+		} else {
+			names = append(names, v)
+		}
+	}
+
+	var rules []interface{}
+	if len(names) > 0 {
+		rules = append(rules, map[string]interface{}{"process_name": names, "outbound": outbound})
+	}
+	if len(paths) > 0 {
+		rules = append(rules, map[string]interface{}{"process_path": paths, "outbound": outbound})
+	}
+	return rules
+}
+
+// nonProxyOutboundTypes are the outbound types that never reach a proxy
+var nonProxyOutboundTypes = []string{"direct", "block", "dns"}
+
+// proxyOutbound returns the outbound that proxied executables use: the
+// configured one, else the route's final outbound, else the first outbound.
+// The fallbacks skip direct, block and DNS outbounds, which would send the
+// applications anywhere but through the proxy.
+func proxyOutbound(content []byte, configured string) (string, error) {
+	if configured != "" {
+		if !outboundTagSet(content)[configured] {
+			return "", fmt.Errorf("split tunnel outbound not found in profile outbounds: %s", configured)
+		}
+		return configured, nil
+	}
+
+	types := make(map[string]string) // Tag -> outbound type
+	var first string
+	gjson.GetBytes(content, "outbounds").ForEach(func(_, ob gjson.Result) bool {
+		tag, typ := ob.Get("tag").String(), ob.Get("type").String()
+		types[tag] = typ
+		if first == "" && tag != "" && !slices.Contains(nonProxyOutboundTypes, typ) {
+			first = tag
+		}
+		return true
+	})
+
+	// The final outbound may also be an endpoint, which has no outbound type
+	if final := gjson.GetBytes(content, "route.final").String(); final != "" && !slices.Contains(nonProxyOutboundTypes, types[final]) {
+		return final, nil
+	}
+	if first != "" {
+		return first, nil
+	}
+	return "", fmt.Errorf("profile has no proxy outbound for proxied applications")
+}
+
+// applySplitTunnel inserts the per-application rules ahead of all other
+// route rules except the leading sniff and DNS hijack rules, so they also
+// win over custom route rules.
+func applySplitTunnel(content []byte, split *splitTunnel) ([]byte, error) {
+	if len(split.Direct) == 0 && len(split.Proxy) == 0 {
+		return content, nil
+	}
+
+	var generated []interface{}
+	if len(split.Direct) > 0 {
+		directOut, err := ensureDirectOutbound(&content)
+		if err != nil {
+			return nil, err
+		}
+		generated = append(generated, processRules(split.Direct, directOut)...)
+	}
+	if len(split.Proxy) > 0 {
+		proxyOut, err := proxyOutbound(content, split.ProxyOutbound)
+		if err != nil {
+			return nil, err
+		}
+		generated = append(generated, processRules(split.Proxy, proxyOut)...)
+	}
+
+	return insertRouteRules(content, generated)
+}
+
+// excludeTunAddresses adds the excluded CIDRs to the TUN inbound's route_exclude_address
+func excludeTunAddresses(tun map[string]interface{}, cidrs []string) {
+	if len(cidrs) == 0 {
+		return
+	}
+	excluded := stringList(tun["route_exclude_address"])
+	for _, cidr := range cidrs {
+		if !slices.Contains(excluded, cidr) {
+			excluded = append(excluded, cidr)
+		}
+	}
+	tun["route_exclude_address"] = excluded
+}
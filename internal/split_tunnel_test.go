@@ -0,0 +1,138 @@
+package internal
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/tidwall/gjson"
+)
+
+func TestParseSplitTunnel(t *testing.T) {
+	s, err := parseSplitTunnel(`{"direct": ["game.exe"], "proxy": ["C:\\Apps\\chat.exe"], "proxy_outbound": "HK", "exclude_address": ["192.168.0.0/16", "fd00::/8"]}`)
+	if err != nil {
+		t.Fatalf("parseSplitTunnel() error = %v", err)
+	}
+	want := &splitTunnel{
+		Direct:         []string{"game.exe"},
+		Proxy:          []string{`C:\Apps\chat.exe`},
+		ProxyOutbound:  "HK",
+		ExcludeAddress: []string{"192.168.0.0/16", "fd00::/8"},
+	}
+	if !reflect.DeepEqual(s, want) {
+		t.Errorf("parseSplitTunnel() = %+v, want %+v", s, want)
+	}
+
+	if _, err := parseSplitTunnel(DefaultSplitConfig); err != nil {
+		t.Errorf("default config rejected: %v", err)
+	}
+
+	tests := []struct {
+		content, want string
+	}{
+		{`{"direct": "game.exe"}`, "invalid split tunnel config"},
+		{`{"direct": [" "]}`, "direct list has an empty entry"},
+		{`{"proxy": ["a.exe", "A.EXE"]}`, `"A.EXE" is listed twice`},
+		{`{"direct": ["Game.exe"], "proxy": ["game.exe"]}`, `"game.exe" is in both the direct and proxy lists`},
+		{`{"exclude_address": ["192.168.0.1"]}`, `invalid CIDR "192.168.0.1"`},
+	}
+	for _, tt := range tests {
+		if _, err := parseSplitTunnel(tt.content); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("parseSplitTunnel(%s) error = %v, want %q", tt.content, err, tt.want)
+		}
+	}
+}
+
+func TestProcessRules(t *testing.T) {
+	rules := processRules([]string{"game.exe", `C:\Apps\chat.exe`, "tool.exe", "/opt/bin/app"}, "Proxy")
+	want := []interface{}{
+		map[string]interface{}{"process_name": []string{"game.exe", "tool.exe"}, "outbound": "Proxy"},
+		map[string]interface{}{"process_path": []string{`C:\Apps\chat.exe`, "/opt/bin/app"}, "outbound": "Proxy"},
+	}
+	if !reflect.DeepEqual(rules, want) {
+		t.Errorf("processRules() = %v, want %v", rules, want)
+	}
+	if rules := processRules([]string{"game.exe"}, "direct"); len(rules) != 1 {
+		t.Errorf("processRules() with names only = %v", rules)
+	}
+}
+
+func TestApplySplitTunnel(t *testing.T) {
+	// Custom route rules are already in place when the split tunnel is applied
+	content, _, err := applyRouteRules([]byte(routeFixture), []RouteRule{
+		{Type: "domain_suffix", Values: []string{"ads.example.com"}, Outbound: RuleTargetBlock, Enabled: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := applySplitTunnel(content, &splitTunnel{
+		Direct: []string{"game.exe", `C:\Games\launcher.exe`},
+		Proxy:  []string{"chat.exe"},
+	})
+	if err != nil {
+		t.Fatalf("applySplitTunnel() error = %v", err)
+	}
+	checkConfig(t, out)
+
+	// Per-application rules come right after the leading actions, ahead of
+	// the custom and profile rules; the direct rules use the profile's own
+	// direct outbound and the proxy rules the final outbound
+	got := strings.Join(ruleSummaries(out), " ")
+	want := "sniff hijack-dns resolve ->bypass ->bypass ->Proxy reject ->HK sniff"
+	if got != want {
+		t.Errorf("rules = %s, want %s", got, want)
+	}
+	if got := gjson.GetBytes(out, "route.rules.4.process_path.0").String(); got != `C:\Games\launcher.exe` {
+		t.Errorf("process path rule = %s", gjson.GetBytes(out, "route.rules.4").Raw)
+	}
+
+	// An empty split tunnel leaves the config alone
+	if out, err := applySplitTunnel(content, &splitTunnel{}); err != nil || string(out) != string(content) {
+		t.Errorf("empty split tunnel changed the config: %v", err)
+	}
+	// A configured outbound must exist
+	if _, err := applySplitTunnel(content, &splitTunnel{Proxy: []string{"chat.exe"}, ProxyOutbound: "missing"}); err == nil {
+		t.Error("applySplitTunnel() accepted a missing proxy outbound")
+	}
+}
+
+func TestProxyOutbound(t *testing.T) {
+	tests := []struct {
+		name, content, configured, want string
+	}{
+		{"configured", routeFixture, "HK", "HK"},
+		{"final", routeFixture, "", "Proxy"},
+		{"final is an endpoint", `{"endpoints": [{"type": "wireguard", "tag": "wg"}], "outbounds": [{"type": "direct", "tag": "direct"}], "route": {"final": "wg"}}`, "", "wg"},
+		{"final is direct", `{"outbounds": [{"type": "direct", "tag": "direct"}, {"type": "block", "tag": "block"}, {"type": "vless", "tag": "JP"}], "route": {"final": "direct"}}`, "", "JP"},
+		{"final is block", `{"outbounds": [{"type": "block", "tag": "block"}, {"type": "selector", "tag": "Proxy", "outbounds": ["JP"]}, {"type": "vless", "tag": "JP"}], "route": {"final": "block"}}`, "", "Proxy"},
+		{"no final", `{"outbounds": [{"type": "direct", "tag": "direct"}, {"type": "dns", "tag": "dns-out"}, {"type": "trojan", "tag": "HK"}]}`, "", "HK"},
+	}
+	for _, tt := range tests {
+		got, err := proxyOutbound([]byte(tt.content), tt.configured)
+		if err != nil || got != tt.want {
+			t.Errorf("%s: proxyOutbound() = %q, %v, want %q", tt.name, got, err, tt.want)
+		}
+	}
+
+	// Only direct, block and DNS outbounds: nowhere to proxy to
+	_, err := proxyOutbound([]byte(`{"outbounds": [{"type": "direct", "tag": "direct"}, {"type": "block", "tag": "block"}], "route": {"final": "direct"}}`), "")
+	if err == nil {
+		t.Error("proxyOutbound() picked a non-proxy outbound")
+	}
+}
+
+func TestExcludeTunAddresses(t *testing.T) {
+	tun := map[string]interface{}{"route_exclude_address": []interface{}{"10.0.0.0/8"}}
+	excludeTunAddresses(tun, []string{"192.168.0.0/16", "10.0.0.0/8"})
+	want := []string{"10.0.0.0/8", "192.168.0.0/16"}
+	if got := tun["route_exclude_address"]; !reflect.DeepEqual(got, want) {
+		t.Errorf("route_exclude_address = %v, want %v", got, want)
+	}
+
+	empty := map[string]interface{}{}
+	excludeTunAddresses(empty, nil)
+	if _, ok := empty["route_exclude_address"]; ok {
+		t.Error("route_exclude_address added without excluded addresses")
+	}
+}
@@ -4,8 +4,10 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"maps"
 	"os"
 	"path/filepath"
+	"slices"
 	"sync"
 	"time"
 )
@@ -18,14 +20,21 @@ type Storage struct {
 	cacheValid bool
 
 	// Fingerprints for smart dirty-checking
-	lastSettings []byte
-	lastState    []byte
-	lastProfiles []byte
-	lastTun      []byte
-	lastMixed    []byte
+	lastSettings         []byte
+	lastState            []byte
+	lastProfiles         []byte
+	lastTun              []byte
+	lastMixed            []byte
+	lastDNS              []byte
+	lastSplit            []byte
+	lastPatches          []byte
+	lastProfileOverrides []byte
+	lastRules            []byte
+	lastInbounds         []byte
 
 	saveTimer *time.Timer
 	saveMu    sync.Mutex
+	flushMu   sync.Mutex // Serializes flushToDisk, which a firing timer and Flush can run at once
 }
 
 // NewStorage creates a new storage instance
@@ -55,18 +64,79 @@ func atomicWrite(path string, data []byte) error {
 func (s *Storage) LoadMeta() (*MetaData, error) {
 	s.mu.RLock()
 	if s.cacheValid {
-		meta := *s.cache
+		meta := s.cloneCache()
 		s.mu.RUnlock()
-		return &meta, nil
+		return meta, nil
 	}
 	s.mu.RUnlock()
 
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	s.ensureLoaded()
+	return s.cloneCache(), nil
+}
+
+// cloneCache returns a deep copy of the cache that callers may modify freely; the caller must hold s.mu
+func (s *Storage) cloneCache() *MetaData {
+	meta := *s.cache
+	if s.cache.AutoConnect != nil {
+		autoConnect := *s.cache.AutoConnect
+		meta.AutoConnect = &autoConnect
+	}
+	meta.Patches = slices.Clone(s.cache.Patches)
+	meta.RouteRules = slices.Clone(s.cache.RouteRules)
+	for i := range meta.RouteRules {
+		meta.RouteRules[i].Values = slices.Clone(meta.RouteRules[i].Values)
+	}
+	meta.Inbounds = slices.Clone(s.cache.Inbounds)
+	meta.Regions = slices.Clone(s.cache.Regions)
+	for i := range meta.Regions {
+		meta.Regions[i].Keywords = slices.Clone(meta.Regions[i].Keywords)
+	}
+	meta.Profiles = slices.Clone(s.cache.Profiles)
+	for i := range meta.Profiles {
+		meta.Profiles[i] = meta.Profiles[i].clone()
+	}
+	meta.ProfileOverrides = make(map[string]map[string]string, len(s.cache.ProfileOverrides))
+	for id, overrides := range s.cache.ProfileOverrides {
+		meta.ProfileOverrides[id] = maps.Clone(overrides)
+	}
+	return &meta
+}
+
+// clone returns a copy of the profile that shares no slices, maps or pointers with it
+func (p Profile) clone() Profile {
+	p.ConvertWarnings = slices.Clone(p.ConvertWarnings)
+	p.Warned = slices.Clone(p.Warned)
+	if p.Subscription != nil {
+		info := *p.Subscription
+		p.Subscription = &info
+	}
+	if p.Fetch != nil {
+		fetch := *p.Fetch
+		fetch.Headers = maps.Clone(fetch.Headers)
+		fetch.FallbackURLs = slices.Clone(fetch.FallbackURLs)
+		p.Fetch = &fetch
+	}
+	if p.Filter != nil {
+		filter := *p.Filter
+		filter.Types = slices.Clone(filter.Types)
+		filter.ExcludeTypes = slices.Clone(filter.ExcludeTypes)
+		filter.Rename = slices.Clone(filter.Rename)
+		p.Filter = &filter
+	}
+	p.Providers = slices.Clone(p.Providers)
+	for i := range p.Providers {
+		p.Providers[i].Groups = slices.Clone(p.Providers[i].Groups)
+	}
+	return p
+}
+
+// ensureLoaded reads metadata from disk into the cache if needed; the caller must hold s.mu for writing
+func (s *Storage) ensureLoaded() {
 	if s.cacheValid {
-		meta := *s.cache
-		return &meta, nil
+		return
 	}
 
 	meta := s.getDefaultMeta()
@@ -84,9 +154,13 @@ func (s *Storage) LoadMeta() (*MetaData, error) {
 			meta.ThemeMode = gs.ThemeMode
 			meta.AccentColor = gs.AccentColor
 			meta.IPv6Enabled = gs.IPv6Enabled
+			meta.StrictPorts = gs.StrictPorts
+			meta.AllowLAN = gs.AllowLAN
+			meta.LAN = gs.LAN
 			meta.LogLevel = gs.LogLevel
 			meta.LogToFile = gs.LogToFile
 			meta.PreRelease = gs.PreRelease
+			meta.Regions = gs.Regions
 		}
 	}
 
@@ -110,6 +184,15 @@ func (s *Storage) LoadMeta() (*MetaData, error) {
 		}
 	}
 
+	// Load Route Rules
+	if data, err := os.ReadFile(filepath.Join(s.configDir, "rules.json")); err == nil {
+		s.lastRules = data
+		var rules []RouteRule
+		if json.Unmarshal(data, &rules) == nil {
+			meta.RouteRules = rules
+		}
+	}
+
 	// Load Tun Override
 	if data, err := os.ReadFile(filepath.Join(s.configDir, "overrides", "tun.json")); err == nil {
 		s.lastTun = data
@@ -122,6 +205,45 @@ func (s *Storage) LoadMeta() (*MetaData, error) {
 		meta.MixedConfig = string(data)
 	}
 
+	// Load DNS Override
+	if data, err := os.ReadFile(filepath.Join(s.configDir, "overrides", "dns.json")); err == nil {
+		s.lastDNS = data
+		meta.DNSConfig = string(data)
+	}
+
+	// Load Split Tunnel Override
+	if data, err := os.ReadFile(filepath.Join(s.configDir, "overrides", "split.json")); err == nil {
+		s.lastSplit = data
+		meta.SplitConfig = string(data)
+	}
+
+	// Load Patch Overrides
+	if data, err := os.ReadFile(filepath.Join(s.configDir, "overrides", "patches.json")); err == nil {
+		s.lastPatches = data
+		var patches []ConfigPatch
+		if json.Unmarshal(data, &patches) == nil {
+			meta.Patches = patches
+		}
+	}
+
+	// Load Managed Inbounds
+	if data, err := os.ReadFile(filepath.Join(s.configDir, "overrides", "inbounds.json")); err == nil {
+		s.lastInbounds = data
+		var inbounds []ManagedInbound
+		if json.Unmarshal(data, &inbounds) == nil {
+			meta.Inbounds = inbounds
+		}
+	}
+
+	// Load Profile Overrides
+	if data, err := os.ReadFile(filepath.Join(s.configDir, "overrides", "profiles.json")); err == nil {
+		s.lastProfileOverrides = data
+		var overrides map[string]map[string]string
+		if json.Unmarshal(data, &overrides) == nil {
+			meta.ProfileOverrides = overrides
+		}
+	}
+
 	// Apply defaults for fields that might be missing
 	if meta.Mirror == "" {
 		meta.Mirror = "https://gh-proxy.com/"
@@ -133,6 +255,12 @@ func (s *Storage) LoadMeta() (*MetaData, error) {
 	if meta.MixedConfig == "" {
 		meta.MixedConfig = DefaultMixedConfig
 	}
+	if meta.DNSConfig == "" {
+		meta.DNSConfig = DefaultDNSConfig
+	}
+	if meta.SplitConfig == "" {
+		meta.SplitConfig = DefaultSplitConfig
+	}
 	if meta.AutoConnectState == "" {
 		meta.AutoConnectState = "smart"
 	}
@@ -145,20 +273,52 @@ func (s *Storage) LoadMeta() (*MetaData, error) {
 	if meta.LogLevel == "" {
 		meta.LogLevel = "warning"
 	}
+	if meta.Regions == nil {
+		meta.Regions = DefaultRegions()
+	}
+	if meta.LAN.Port == 0 {
+		meta.LAN.Port = DefaultLANPort
+	}
 
 	s.cache = meta
 	s.cacheValid = true
-
-	return meta, nil
 }
 
-// SaveMeta saves metadata to cache and debounces disk write
-func (s *Storage) SaveMeta(meta *MetaData) error {
+// Update applies fn to a copy of the metadata under the storage lock and
+// saves it unless fn returns an error, debouncing the disk write. Changing
+// a LoadMeta result and writing it back could overwrite concurrent updates,
+// so all writes go through here. fn must not call back into the storage.
+func (s *Storage) Update(fn func(meta *MetaData) error) error {
 	s.mu.Lock()
+	s.ensureLoaded()
+
+	meta := s.cloneCache()
+	if err := fn(meta); err != nil {
+		s.mu.Unlock()
+		return err
+	}
 	s.cache = meta
-	s.cacheValid = true
 	s.mu.Unlock()
 
+	s.scheduleSave()
+	return nil
+}
+
+// UpdateProfile applies fn to a single profile under the storage lock
+func (s *Storage) UpdateProfile(id string, fn func(p *Profile)) error {
+	return s.Update(func(meta *MetaData) error {
+		for i := range meta.Profiles {
+			if meta.Profiles[i].ID == id {
+				fn(&meta.Profiles[i])
+				return nil
+			}
+		}
+		return fmt.Errorf("profile not found")
+	})
+}
+
+// scheduleSave debounces writing the cache to disk
+func (s *Storage) scheduleSave() {
 	s.saveMu.Lock()
 	if s.saveTimer != nil {
 		s.saveTimer.Stop()
@@ -167,11 +327,12 @@ func (s *Storage) SaveMeta(meta *MetaData) error {
 		s.flushToDisk()
 	})
 	s.saveMu.Unlock()
-
-	return nil
 }
 
 func (s *Storage) flushToDisk() error {
+	s.flushMu.Lock()
+	defer s.flushMu.Unlock()
+
 	s.mu.RLock()
 	if !s.cacheValid || s.cache == nil {
 		s.mu.RUnlock()
@@ -190,9 +351,13 @@ func (s *Storage) flushToDisk() error {
 		ThemeMode:        metaCopy.ThemeMode,
 		AccentColor:      metaCopy.AccentColor,
 		IPv6Enabled:      metaCopy.IPv6Enabled,
+		StrictPorts:      metaCopy.StrictPorts,
+		AllowLAN:         metaCopy.AllowLAN,
+		LAN:              metaCopy.LAN,
 		LogLevel:         metaCopy.LogLevel,
 		LogToFile:        metaCopy.LogToFile,
 		PreRelease:       metaCopy.PreRelease,
+		Regions:          metaCopy.Regions,
 	}
 	if settingsBytes, err := json.MarshalIndent(gs, "", "  "); err == nil {
 		if !bytes.Equal(settingsBytes, s.lastSettings) {
@@ -239,6 +404,64 @@ func (s *Storage) flushToDisk() error {
 		s.lastMixed = mixedBytes
 	}
 
+	// 6. Save Patch Overrides
+	if metaCopy.Patches == nil {
+		metaCopy.Patches = []ConfigPatch{}
+	}
+	if patchesBytes, err := json.MarshalIndent(metaCopy.Patches, "", "  "); err == nil {
+		if !bytes.Equal(patchesBytes, s.lastPatches) {
+			atomicWrite(filepath.Join(s.configDir, "overrides", "patches.json"), patchesBytes)
+			s.lastPatches = patchesBytes
+		}
+	}
+
+	// 7. Save Profile Overrides
+	if metaCopy.ProfileOverrides == nil {
+		metaCopy.ProfileOverrides = map[string]map[string]string{}
+	}
+	if overridesBytes, err := json.MarshalIndent(metaCopy.ProfileOverrides, "", "  "); err == nil {
+		if !bytes.Equal(overridesBytes, s.lastProfileOverrides) {
+			atomicWrite(filepath.Join(s.configDir, "overrides", "profiles.json"), overridesBytes)
+			s.lastProfileOverrides = overridesBytes
+		}
+	}
+
+	// 8. Save DNS Override
+	dnsBytes := []byte(metaCopy.DNSConfig)
+	if !bytes.Equal(dnsBytes, s.lastDNS) {
+		atomicWrite(filepath.Join(s.configDir, "overrides", "dns.json"), dnsBytes)
+		s.lastDNS = dnsBytes
+	}
+
+	// 9. Save Route Rules
+	if metaCopy.RouteRules == nil {
+		metaCopy.RouteRules = []RouteRule{}
+	}
+	if rulesBytes, err := json.MarshalIndent(metaCopy.RouteRules, "", "  "); err == nil {
+		if !bytes.Equal(rulesBytes, s.lastRules) {
+			atomicWrite(filepath.Join(s.configDir, "rules.json"), rulesBytes)
+			s.lastRules = rulesBytes
+		}
+	}
+
+	// 10. Save Managed Inbounds
+	if metaCopy.Inbounds == nil {
+		metaCopy.Inbounds = []ManagedInbound{}
+	}
+	if inboundsBytes, err := json.MarshalIndent(metaCopy.Inbounds, "", "  "); err == nil {
+		if !bytes.Equal(inboundsBytes, s.lastInbounds) {
+			atomicWrite(filepath.Join(s.configDir, "overrides", "inbounds.json"), inboundsBytes)
+			s.lastInbounds = inboundsBytes
+		}
+	}
+
+	// 11. Save Split Tunnel Override
+	splitBytes := []byte(metaCopy.SplitConfig)
+	if !bytes.Equal(splitBytes, s.lastSplit) {
+		atomicWrite(filepath.Join(s.configDir, "overrides", "split.json"), splitBytes)
+		s.lastSplit = splitBytes
+	}
+
 	return nil
 }
 
@@ -269,6 +492,8 @@ func (s *Storage) getDefaultMeta() *MetaData {
 		Mirror:           "https://gh-proxy.com/",
 		TunConfig:        DefaultTunConfig,
 		MixedConfig:      DefaultMixedConfig,
+		DNSConfig:        DefaultDNSConfig,
+		SplitConfig:      DefaultSplitConfig,
 		AutoConnectState: "smart",
 		StartOnBoot:      false,
 		ThemeMode:        "system",
@@ -276,5 +501,7 @@ func (s *Storage) getDefaultMeta() *MetaData {
 		IPv6Enabled:      true,
 		LogLevel:         "warning",
 		LogToFile:        true,
+		Regions:          DefaultRegions(),
+		LAN:              LANSharing{Port: DefaultLANPort},
 	}
 }
@@ -0,0 +1,122 @@
+package internal
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func newTestStorage(t *testing.T) *Storage {
+	t.Helper()
+	s := NewStorage(t.TempDir())
+	t.Cleanup(s.Flush)
+	return s
+}
+
+func TestStorageConcurrentUpdates(t *testing.T) {
+	s := newTestStorage(t)
+	const n = 20
+	if err := s.Update(func(meta *MetaData) error {
+		for i := 0; i < n; i++ {
+			meta.Profiles = append(meta.Profiles, Profile{ID: fmt.Sprint(i)})
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Profile updates racing with whole-settings writers must all survive
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			s.UpdateProfile(fmt.Sprint(i), func(p *Profile) { p.Name = "updated" })
+		}(i)
+		go func(i int) {
+			defer wg.Done()
+			s.Update(func(meta *MetaData) error {
+				meta.RouteRules = append(meta.RouteRules, RouteRule{ID: fmt.Sprint(i)})
+				return nil
+			})
+		}(i)
+	}
+	wg.Wait()
+
+	meta, _ := s.LoadMeta()
+	for _, p := range meta.Profiles {
+		if p.Name != "updated" {
+			t.Errorf("update of profile %s was lost", p.ID)
+		}
+	}
+	if len(meta.RouteRules) != n {
+		t.Errorf("got %d route rules, want %d", len(meta.RouteRules), n)
+	}
+}
+
+func TestStorageUpdateError(t *testing.T) {
+	s := newTestStorage(t)
+	err := s.Update(func(meta *MetaData) error {
+		meta.ActiveID = "changed"
+		return fmt.Errorf("rejected")
+	})
+	if err == nil {
+		t.Fatal("Update() error = nil")
+	}
+	if meta, _ := s.LoadMeta(); meta.ActiveID == "changed" {
+		t.Error("failed update was saved")
+	}
+	if err := s.UpdateProfile("missing", func(*Profile) {}); err == nil {
+		t.Error("UpdateProfile() of a missing profile succeeded")
+	}
+}
+
+func TestStorageLoadMetaIsDeepCopy(t *testing.T) {
+	s := newTestStorage(t)
+	autoConnect := true
+	s.Update(func(meta *MetaData) error {
+		meta.AutoConnect = &autoConnect
+		meta.Patches = []ConfigPatch{{ID: "p"}}
+		meta.RouteRules = []RouteRule{{ID: "r", Values: []string{"a.com"}}}
+		meta.Inbounds = []ManagedInbound{{ID: "i"}}
+		meta.Regions = []RegionRule{{Name: "HK", Keywords: []string{"hk"}}}
+		meta.ProfileOverrides = map[string]map[string]string{"x": {"tun": "{}"}}
+		meta.Profiles = []Profile{{
+			ID:              "x",
+			ConvertWarnings: []string{"w"},
+			Subscription:    &SubscriptionInfo{Total: 1},
+			Fetch:           &FetchOptions{Headers: map[string]string{"a": "b"}, FallbackURLs: []string{"u"}},
+			Filter:          &NodeFilter{Types: []string{"vless"}, Rename: []RenameRule{{Pattern: "a"}}},
+			Providers:       []ProviderRule{{ProfileID: "y", Groups: []string{"g"}}},
+		}}
+		return nil
+	})
+
+	meta, _ := s.LoadMeta()
+	*meta.AutoConnect = false
+	meta.Patches[0].Enabled = true
+	meta.RouteRules[0].Values[0] = "changed"
+	meta.Inbounds[0].Enabled = true
+	meta.Regions[0].Keywords[0] = "changed"
+	meta.ProfileOverrides["x"]["tun"] = "changed"
+	p := &meta.Profiles[0]
+	p.ConvertWarnings[0] = "changed"
+	p.Subscription.Total = 2
+	p.Fetch.Headers["a"] = "changed"
+	p.Fetch.FallbackURLs[0] = "changed"
+	p.Filter.Types[0] = "changed"
+	p.Filter.Rename[0].Pattern = "changed"
+	p.Providers[0].Groups[0] = "changed"
+
+	fresh, _ := s.LoadMeta()
+	fp := fresh.Profiles[0]
+	if !*fresh.AutoConnect || fresh.Patches[0].Enabled || fresh.RouteRules[0].Values[0] != "a.com" ||
+		fresh.Inbounds[0].Enabled || fresh.Regions[0].Keywords[0] != "hk" || fresh.ProfileOverrides["x"]["tun"] != "{}" {
+		t.Error("settings changed through a LoadMeta result")
+	}
+	if fp.ConvertWarnings[0] != "w" || fp.Subscription.Total != 1 || fp.Fetch.Headers["a"] != "b" ||
+		fp.Fetch.FallbackURLs[0] != "u" || fp.Filter.Types[0] != "vless" || fp.Filter.Rename[0].Pattern != "a" ||
+		fp.Providers[0].Groups[0] != "g" {
+		t.Error("profile changed through a LoadMeta result")
+	}
+}
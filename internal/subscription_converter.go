@@ -0,0 +1,587 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// convertedKernelVersion is the oldest sing-box that runs converted
+// subscriptions: their DNS servers use the typed schema of sing-box 1.12
+const convertedKernelVersion = "1.12"
+
+const (
+	selectorTag = "proxy"
+	urltestTag  = "auto"
+	directTag   = "direct"
+	urltestURL  = "https://www.gstatic.com/generate_204"
+)
+
+// convertSubscription turns a downloaded subscription into a sing-box config.
+// Complete sing-box JSON configs are returned unchanged; Clash YAML profiles and
+// base64 or plain share-link lists are converted. fetch is used to download
+// resources referenced by the subscription, such as Clash rule-providers. The
+// returned warnings list the entries that could not be converted.
+func convertSubscription(content []byte, fetch func(url string) ([]byte, error)) ([]byte, []string, error) {
+	content = bytes.TrimPrefix(content, []byte("\xef\xbb\xbf"))
+	trimmed := bytes.TrimSpace(content)
+	if len(trimmed) == 0 {
+		return nil, nil, fmt.Errorf("empty subscription")
+	}
+
+	if isSingBoxConfig(trimmed) {
+		return content, nil, nil
+	}
+
+	if clash, ok := parseClashConfig(trimmed); ok {
+		return convertClash(clash, fetch)
+	}
+
+	links := extractShareLinks(string(trimmed))
+	if len(links) == 0 {
+		if decoded, ok := decodeBase64(string(trimmed)); ok {
+			links = extractShareLinks(decoded)
+		}
+	}
+	if len(links) == 0 {
+		return nil, nil, fmt.Errorf("unrecognized subscription format")
+	}
+
+	var outbounds []map[string]interface{}
+	var warnings []string
+	for _, link := range links {
+		outbound, err := parseShareLink(link)
+		if err != nil {
+			warnings = append(warnings, fmt.Sprintf("skipped %s: %v", linkScheme(link), err))
+			continue
+		}
+		outbounds = append(outbounds, outbound)
+	}
+
+	if len(outbounds) == 0 {
+		return nil, warnings, fmt.Errorf("no supported nodes found in subscription")
+	}
+
+	config, err := json.MarshalIndent(buildNodeConfig(outbounds), "", "  ")
+	if err != nil {
+		return nil, warnings, err
+	}
+	return config, warnings, nil
+}
+
+// isSingBoxConfig reports whether subscription content is already a sing-box
+// JSON config, which is used as is
+func isSingBoxConfig(content []byte) bool {
+	trimmed := bytes.TrimSpace(bytes.TrimPrefix(content, []byte("\xef\xbb\xbf")))
+	return len(trimmed) > 0 && trimmed[0] == '{' && json.Valid(trimmed)
+}
+
+// buildNodeConfig wraps node outbounds into a runnable config with a selector and an urltest group
+func buildNodeConfig(nodes []map[string]interface{}) map[string]interface{} {
+	tags := uniqueTags(nodes)
+
+	outbounds := []interface{}{
+		map[string]interface{}{
+			"type":      "selector",
+			"tag":       selectorTag,
+			"outbounds": append([]string{urltestTag}, tags...),
+			"default":   urltestTag,
+		},
+		map[string]interface{}{
+			"type":      "urltest",
+			"tag":       urltestTag,
+			"outbounds": tags,
+			"url":       urltestURL,
+			"interval":  "3m",
+		},
+	}
+	for _, n := range nodes {
+		outbounds = append(outbounds, n)
+	}
+
+	rules := []interface{}{
+		map[string]interface{}{"ip_is_private": true, "outbound": directTag},
+	}
+	return buildBaseConfig(outbounds, rules, selectorTag)
+}
+
+// buildBaseConfig assembles DNS and route sections around the given outbounds.
+// A direct outbound is appended, and the route rules are preceded by sniffing
+// and DNS hijacking so the config works in TUN mode. The DNS section needs
+// sing-box convertedKernelVersion or later.
+func buildBaseConfig(outbounds []interface{}, rules []interface{}, final string) map[string]interface{} {
+	outbounds = append(outbounds, map[string]interface{}{
+		"type": "direct",
+		"tag":  directTag,
+	})
+
+	routeRules := []interface{}{
+		map[string]interface{}{"action": "sniff"},
+		map[string]interface{}{"protocol": "dns", "action": "hijack-dns"},
+	}
+	routeRules = append(routeRules, rules...)
+
+	remoteDNS := map[string]interface{}{"type": "https", "tag": "remote", "server": "1.1.1.1"}
+	if final != directTag {
+		remoteDNS["detour"] = final
+	}
+
+	return map[string]interface{}{
+		"dns": map[string]interface{}{
+			"servers": []interface{}{
+				remoteDNS,
+				map[string]interface{}{"type": "local", "tag": "local"},
+			},
+			"final": "remote",
+		},
+		"outbounds": outbounds,
+		"route": map[string]interface{}{
+			"rules":                   routeRules,
+			"final":                   final,
+			"auto_detect_interface":   true,
+			"default_domain_resolver": "local",
+		},
+	}
+}
+
+// uniqueTags makes node tags unique in place and returns them in order
+func uniqueTags(nodes []map[string]interface{}) []string {
+	seen := make(map[string]int)
+	tags := make([]string, 0, len(nodes))
+	for _, n := range nodes {
+		tag, _ := n["tag"].(string)
+		if tag == "" {
+			tag = fmt.Sprintf("%s-%s", n["type"], n["server"])
+		}
+		base := tag
+		for seen[tag] > 0 {
+			seen[base]++
+			tag = fmt.Sprintf("%s %d", base, seen[base])
+		}
+		seen[tag]++
+		n["tag"] = tag
+		tags = append(tags, tag)
+	}
+	return tags
+}
+
+// extractShareLinks returns all lines that look like a supported share link
+func extractShareLinks(text string) []string {
+	var links []string
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		switch linkScheme(line) {
+		case "vmess", "vless", "trojan", "ss", "hysteria2", "hy2", "tuic":
+			links = append(links, line)
+		}
+	}
+	return links
+}
+
+func linkScheme(link string) string {
+	if i := strings.Index(link, "://"); i > 0 {
+		return strings.ToLower(link[:i])
+	}
+	return "unknown"
+}
+
+// decodeBase64 tries standard and URL-safe alphabets, with or without padding
+func decodeBase64(s string) (string, bool) {
+	s = strings.Map(func(r rune) rune {
+		if r == '\n' || r == '\r' || r == ' ' || r == '\t' {
+			return -1
+		}
+		return r
+	}, s)
+	for _, enc := range []*base64.Encoding{base64.StdEncoding, base64.RawStdEncoding, base64.URLEncoding, base64.RawURLEncoding} {
+		if data, err := enc.DecodeString(s); err == nil {
+			return string(data), true
+		}
+	}
+	return "", false
+}
+
+// parseShareLink converts a single share link into a sing-box outbound
+func parseShareLink(link string) (map[string]interface{}, error) {
+	switch linkScheme(link) {
+	case "vmess":
+		return parseVMess(link)
+	case "vless":
+		return parseVLESS(link)
+	case "trojan":
+		return parseTrojan(link)
+	case "ss":
+		return parseShadowsocks(link)
+	case "hysteria2", "hy2":
+		return parseHysteria2(link)
+	case "tuic":
+		return parseTUIC(link)
+	default:
+		return nil, fmt.Errorf("unsupported scheme")
+	}
+}
+
+func parseVMess(link string) (map[string]interface{}, error) {
+	decoded, ok := decodeBase64(link[len("vmess://"):])
+	if !ok {
+		return nil, fmt.Errorf("invalid base64 payload")
+	}
+
+	var v map[string]interface{}
+	if err := json.Unmarshal([]byte(decoded), &v); err != nil {
+		return nil, fmt.Errorf("invalid vmess json: %w", err)
+	}
+
+	field := func(key string) string {
+		switch val := v[key].(type) {
+		case string:
+			return val
+		case float64:
+			return strconv.FormatFloat(val, 'f', -1, 64)
+		}
+		return ""
+	}
+
+	port, err := strconv.Atoi(field("port"))
+	if err != nil || field("add") == "" || field("id") == "" {
+		return nil, fmt.Errorf("missing server, port or id")
+	}
+
+	security := field("scy")
+	if security == "" {
+		security = "auto"
+	}
+	alterID, _ := strconv.Atoi(field("aid"))
+
+	out := map[string]interface{}{
+		"type":        "vmess",
+		"tag":         field("ps"),
+		"server":      field("add"),
+		"server_port": port,
+		"uuid":        field("id"),
+		"security":    security,
+		"alter_id":    alterID,
+	}
+
+	netType := field("net")
+	if netType == "tcp" && field("type") == "http" {
+		netType = "http"
+	}
+	if transport := buildTransport(netType, field("host"), field("path"), field("path")); transport != nil {
+		out["transport"] = transport
+	}
+	if field("tls") == "tls" {
+		sni := field("sni")
+		if sni == "" {
+			sni = field("host")
+		}
+		out["tls"] = buildTLS(sni, field("alpn"), field("fp"), false, "", "")
+	}
+	return out, nil
+}
+
+func parseVLESS(link string) (map[string]interface{}, error) {
+	u, err := url.Parse(link)
+	if err != nil {
+		return nil, err
+	}
+	server, port, err := hostPort(u)
+	if err != nil {
+		return nil, err
+	}
+	if u.User == nil || u.User.Username() == "" {
+		return nil, fmt.Errorf("missing uuid")
+	}
+
+	q := u.Query()
+	out := map[string]interface{}{
+		"type":        "vless",
+		"tag":         u.Fragment,
+		"server":      server,
+		"server_port": port,
+		"uuid":        u.User.Username(),
+	}
+	if flow := q.Get("flow"); flow != "" {
+		out["flow"] = flow
+	}
+	if transport := buildTransport(q.Get("type"), q.Get("host"), q.Get("path"), q.Get("serviceName")); transport != nil {
+		out["transport"] = transport
+	}
+	switch q.Get("security") {
+	case "tls", "xtls":
+		out["tls"] = buildTLS(q.Get("sni"), q.Get("alpn"), q.Get("fp"), isTruthy(q.Get("allowInsecure")), "", "")
+	case "reality":
+		out["tls"] = buildTLS(q.Get("sni"), q.Get("alpn"), q.Get("fp"), false, q.Get("pbk"), q.Get("sid"))
+	}
+	return out, nil
+}
+
+func parseTrojan(link string) (map[string]interface{}, error) {
+	u, err := url.Parse(link)
+	if err != nil {
+		return nil, err
+	}
+	server, port, err := hostPort(u)
+	if err != nil {
+		return nil, err
+	}
+	if u.User == nil || u.User.Username() == "" {
+		return nil, fmt.Errorf("missing password")
+	}
+
+	q := u.Query()
+	out := map[string]interface{}{
+		"type":        "trojan",
+		"tag":         u.Fragment,
+		"server":      server,
+		"server_port": port,
+		"password":    u.User.Username(),
+	}
+	if transport := buildTransport(q.Get("type"), q.Get("host"), q.Get("path"), q.Get("serviceName")); transport != nil {
+		out["transport"] = transport
+	}
+	sni := q.Get("sni")
+	if sni == "" {
+		sni = q.Get("peer")
+	}
+	if q.Get("security") == "reality" {
+		out["tls"] = buildTLS(sni, q.Get("alpn"), q.Get("fp"), false, q.Get("pbk"), q.Get("sid"))
+	} else {
+		out["tls"] = buildTLS(sni, q.Get("alpn"), q.Get("fp"), isTruthy(q.Get("allowInsecure")), "", "")
+	}
+	return out, nil
+}
+
+func parseShadowsocks(link string) (map[string]interface{}, error) {
+	body := link[len("ss://"):]
+	tag := ""
+	if i := strings.Index(body, "#"); i >= 0 {
+		tag, _ = url.PathUnescape(body[i+1:])
+		body = body[:i]
+	}
+	query := ""
+	if i := strings.Index(body, "?"); i >= 0 {
+		query = body[i+1:]
+		body = body[:i]
+	}
+	body = strings.TrimSuffix(body, "/")
+
+	// SIP002: base64(method:password)@host:port, legacy: base64(method:password@host:port)
+	if !strings.Contains(body, "@") {
+		decoded, ok := decodeBase64(body)
+		if !ok {
+			return nil, fmt.Errorf("invalid base64 payload")
+		}
+		body = decoded
+	}
+
+	at := strings.LastIndex(body, "@")
+	if at < 0 {
+		return nil, fmt.Errorf("missing server")
+	}
+	userInfo, address := body[:at], body[at+1:]
+	if decoded, ok := decodeBase64(userInfo); ok && strings.Contains(decoded, ":") {
+		userInfo = decoded
+	} else if unescaped, err := url.PathUnescape(userInfo); err == nil {
+		userInfo = unescaped
+	}
+
+	method, password, found := strings.Cut(userInfo, ":")
+	if !found {
+		return nil, fmt.Errorf("missing method or password")
+	}
+
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, fmt.Errorf("invalid address: %w", err)
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port")
+	}
+
+	out := map[string]interface{}{
+		"type":        "shadowsocks",
+		"tag":         tag,
+		"server":      host,
+		"server_port": port,
+		"method":      method,
+		"password":    password,
+	}
+
+	if query != "" {
+		q, _ := url.ParseQuery(query)
+		if plugin := q.Get("plugin"); plugin != "" {
+			name, opts, _ := strings.Cut(plugin, ";")
+			switch name {
+			case "obfs-local", "simple-obfs":
+				out["plugin"] = "obfs-local"
+				out["plugin_opts"] = opts
+			case "v2ray-plugin":
+				out["plugin"] = "v2ray-plugin"
+				out["plugin_opts"] = opts
+			default:
+				return nil, fmt.Errorf("unsupported plugin %q", name)
+			}
+		}
+	}
+	return out, nil
+}
+
+func parseHysteria2(link string) (map[string]interface{}, error) {
+	u, err := url.Parse(link)
+	if err != nil {
+		return nil, err
+	}
+	server, port, err := hostPort(u)
+	if err != nil {
+		return nil, err
+	}
+
+	password := ""
+	if u.User != nil {
+		password = u.User.String()
+		if p, err := url.PathUnescape(password); err == nil {
+			password = p
+		}
+	}
+
+	q := u.Query()
+	out := map[string]interface{}{
+		"type":        "hysteria2",
+		"tag":         u.Fragment,
+		"server":      server,
+		"server_port": port,
+		"password":    password,
+		"tls":         buildTLS(q.Get("sni"), q.Get("alpn"), "", isTruthy(q.Get("insecure")), "", ""),
+	}
+	if obfs := q.Get("obfs"); obfs != "" {
+		out["obfs"] = map[string]interface{}{
+			"type":     obfs,
+			"password": q.Get("obfs-password"),
+		}
+	}
+	return out, nil
+}
+
+func parseTUIC(link string) (map[string]interface{}, error) {
+	u, err := url.Parse(link)
+	if err != nil {
+		return nil, err
+	}
+	server, port, err := hostPort(u)
+	if err != nil {
+		return nil, err
+	}
+	if u.User == nil || u.User.Username() == "" {
+		return nil, fmt.Errorf("missing uuid")
+	}
+	password, _ := u.User.Password()
+
+	q := u.Query()
+	out := map[string]interface{}{
+		"type":        "tuic",
+		"tag":         u.Fragment,
+		"server":      server,
+		"server_port": port,
+		"uuid":        u.User.Username(),
+		"password":    password,
+		"tls":         buildTLS(q.Get("sni"), q.Get("alpn"), "", isTruthy(q.Get("allow_insecure")) || isTruthy(q.Get("insecure")), "", ""),
+	}
+	if cc := q.Get("congestion_control"); cc != "" {
+		out["congestion_control"] = cc
+	}
+	if mode := q.Get("udp_relay_mode"); mode != "" {
+		out["udp_relay_mode"] = mode
+	}
+	return out, nil
+}
+
+// hostPort extracts the server address and port from a parsed link
+func hostPort(u *url.URL) (string, int, error) {
+	host := u.Hostname()
+	if host == "" {
+		return "", 0, fmt.Errorf("missing server")
+	}
+	port, err := strconv.Atoi(u.Port())
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid port")
+	}
+	return host, port, nil
+}
+
+// buildTransport maps a share-link network type to a sing-box transport
+func buildTransport(netType, host, path, serviceName string) map[string]interface{} {
+	switch netType {
+	case "ws":
+		t := map[string]interface{}{"type": "ws"}
+		if path != "" {
+			t["path"] = path
+		}
+		if host != "" {
+			t["headers"] = map[string]interface{}{"Host": host}
+		}
+		return t
+	case "grpc":
+		return map[string]interface{}{"type": "grpc", "service_name": serviceName}
+	case "http", "h2":
+		t := map[string]interface{}{"type": "http"}
+		if host != "" {
+			t["host"] = strings.Split(host, ",")
+		}
+		if path != "" {
+			t["path"] = path
+		}
+		return t
+	case "httpupgrade":
+		t := map[string]interface{}{"type": "httpupgrade"}
+		if host != "" {
+			t["host"] = host
+		}
+		if path != "" {
+			t["path"] = path
+		}
+		return t
+	}
+	return nil
+}
+
+// buildTLS builds an outbound TLS block, enabling reality when a public key is given
+func buildTLS(sni, alpn, fingerprint string, insecure bool, publicKey, shortID string) map[string]interface{} {
+	tls := map[string]interface{}{"enabled": true}
+	if sni != "" {
+		tls["server_name"] = sni
+	}
+	if alpn != "" {
+		tls["alpn"] = strings.Split(alpn, ",")
+	}
+	if insecure {
+		tls["insecure"] = true
+	}
+	if fingerprint != "" || publicKey != "" {
+		if fingerprint == "" {
+			fingerprint = "chrome"
+		}
+		tls["utls"] = map[string]interface{}{"enabled": true, "fingerprint": fingerprint}
+	}
+	if publicKey != "" {
+		tls["reality"] = map[string]interface{}{
+			"enabled":    true,
+			"public_key": publicKey,
+			"short_id":   shortID,
+		}
+	}
+	return tls
+}
+
+func isTruthy(s string) bool {
+	return s == "1" || strings.EqualFold(s, "true")
+}
@@ -0,0 +1,331 @@
+package internal
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/tidwall/gjson"
+)
+
+func vmessLink(t *testing.T, fields map[string]interface{}) string {
+	t.Helper()
+	data, err := json.Marshal(fields)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return "vmess://" + base64.StdEncoding.EncodeToString(data)
+}
+
+// normalize round-trips a value through JSON so that it compares equal to decoded JSON
+func normalize(t *testing.T, v interface{}) interface{} {
+	t.Helper()
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out interface{}
+	if err := json.Unmarshal(data, &out); err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+// checkConfig verifies that a generated config is one sing-box can load:
+// unique outbound tags, and every group member, route target and detour
+// naming an existing outbound
+func checkConfig(t *testing.T, config []byte) {
+	t.Helper()
+	if !json.Valid(config) {
+		t.Fatalf("config is not valid JSON: %s", config)
+	}
+
+	tags := make(map[string]bool)
+	for _, tag := range gjson.GetBytes(config, "outbounds.#.tag").Array() {
+		if tag.String() == "" || tags[tag.String()] {
+			t.Fatalf("empty or duplicate outbound tag %q", tag.String())
+		}
+		tags[tag.String()] = true
+	}
+
+	check := func(where, tag string) {
+		if tag != "" && !tags[tag] {
+			t.Errorf("%s references unknown outbound %q", where, tag)
+		}
+	}
+	for _, ob := range gjson.GetBytes(config, "outbounds").Array() {
+		for _, member := range ob.Get("outbounds").Array() {
+			check("group "+ob.Get("tag").String(), member.String())
+		}
+		check("default of "+ob.Get("tag").String(), ob.Get("default").String())
+		check("detour of "+ob.Get("tag").String(), ob.Get("detour").String())
+	}
+	for i, rule := range gjson.GetBytes(config, "route.rules").Array() {
+		if !rule.Get("outbound").Exists() && !rule.Get("action").Exists() {
+			t.Errorf("route rule %d has neither outbound nor action", i)
+		}
+		check("route rule", rule.Get("outbound").String())
+	}
+	check("route.final", gjson.GetBytes(config, "route.final").String())
+	for _, server := range gjson.GetBytes(config, "dns.servers").Array() {
+		check("dns server "+server.Get("tag").String(), server.Get("detour").String())
+	}
+}
+
+func TestParseShareLink(t *testing.T) {
+	uuid := "b831381d-6324-4d53-ad4f-8cda48b30811"
+	tests := []struct {
+		name string
+		link string
+		want map[string]interface{}
+	}{
+		{
+			name: "vmess ws tls",
+			link: vmessLink(t, map[string]interface{}{
+				"v": "2", "ps": "HK 01", "add": "hk.example.com", "port": "443", "id": uuid,
+				"aid": "0", "net": "ws", "host": "cdn.example.com", "path": "/ws", "tls": "tls",
+			}),
+			want: map[string]interface{}{
+				"type": "vmess", "tag": "HK 01", "server": "hk.example.com", "server_port": 443,
+				"uuid": uuid, "security": "auto", "alter_id": 0,
+				"transport": map[string]interface{}{"type": "ws", "path": "/ws", "headers": map[string]interface{}{"Host": "cdn.example.com"}},
+				"tls":       map[string]interface{}{"enabled": true, "server_name": "cdn.example.com"},
+			},
+		},
+		{
+			name: "vmess numeric port and tcp http",
+			link: vmessLink(t, map[string]interface{}{
+				"ps": "SG", "add": "1.2.3.4", "port": 8080, "id": uuid, "aid": 2, "scy": "aes-128-gcm",
+				"net": "tcp", "type": "http", "host": "a.com,b.com", "path": "/",
+			}),
+			want: map[string]interface{}{
+				"type": "vmess", "tag": "SG", "server": "1.2.3.4", "server_port": 8080,
+				"uuid": uuid, "security": "aes-128-gcm", "alter_id": 2,
+				"transport": map[string]interface{}{"type": "http", "host": []interface{}{"a.com", "b.com"}, "path": "/"},
+			},
+		},
+		{
+			name: "vless reality",
+			link: "vless://" + uuid + "@1.2.3.4:443?encryption=none&flow=xtls-rprx-vision&security=reality&sni=www.microsoft.com&fp=firefox&pbk=pubkey&sid=6ba8&type=tcp#JP%2001",
+			want: map[string]interface{}{
+				"type": "vless", "tag": "JP 01", "server": "1.2.3.4", "server_port": 443,
+				"uuid": uuid, "flow": "xtls-rprx-vision",
+				"tls": map[string]interface{}{
+					"enabled": true, "server_name": "www.microsoft.com",
+					"utls":    map[string]interface{}{"enabled": true, "fingerprint": "firefox"},
+					"reality": map[string]interface{}{"enabled": true, "public_key": "pubkey", "short_id": "6ba8"},
+				},
+			},
+		},
+		{
+			name: "vless grpc tls",
+			link: "vless://" + uuid + "@vl.example.com:8443?security=tls&type=grpc&serviceName=svc&alpn=h2,http/1.1&allowInsecure=1#VL",
+			want: map[string]interface{}{
+				"type": "vless", "tag": "VL", "server": "vl.example.com", "server_port": 8443, "uuid": uuid,
+				"transport": map[string]interface{}{"type": "grpc", "service_name": "svc"},
+				"tls":       map[string]interface{}{"enabled": true, "alpn": []interface{}{"h2", "http/1.1"}, "insecure": true},
+			},
+		},
+		{
+			name: "trojan with peer",
+			link: "trojan://secret@tr.example.com:443?peer=sni.example.com&type=httpupgrade&host=up.example.com&path=%2Fup#US",
+			want: map[string]interface{}{
+				"type": "trojan", "tag": "US", "server": "tr.example.com", "server_port": 443, "password": "secret",
+				"transport": map[string]interface{}{"type": "httpupgrade", "host": "up.example.com", "path": "/up"},
+				"tls":       map[string]interface{}{"enabled": true, "server_name": "sni.example.com"},
+			},
+		},
+		{
+			name: "shadowsocks SIP002",
+			link: "ss://" + base64.RawURLEncoding.EncodeToString([]byte("aes-256-gcm:password")) + "@ss.example.com:8388#SS%20Node",
+			want: map[string]interface{}{
+				"type": "shadowsocks", "tag": "SS Node", "server": "ss.example.com", "server_port": 8388,
+				"method": "aes-256-gcm", "password": "password",
+			},
+		},
+		{
+			name: "shadowsocks legacy",
+			link: "ss://" + base64.StdEncoding.EncodeToString([]byte("chacha20-ietf-poly1305:pw@10.0.0.1:443")) + "#Legacy",
+			want: map[string]interface{}{
+				"type": "shadowsocks", "tag": "Legacy", "server": "10.0.0.1", "server_port": 443,
+				"method": "chacha20-ietf-poly1305", "password": "pw",
+			},
+		},
+		{
+			name: "shadowsocks 2022 plain user info with plugin",
+			link: "ss://2022-blake3-aes-128-gcm:a%2Bb%3D@[2001:db8::1]:8443/?plugin=obfs-local%3Bobfs%3Dhttp%3Bobfs-host%3Dexample.com#v6",
+			want: map[string]interface{}{
+				"type": "shadowsocks", "tag": "v6", "server": "2001:db8::1", "server_port": 8443,
+				"method": "2022-blake3-aes-128-gcm", "password": "a+b=",
+				"plugin": "obfs-local", "plugin_opts": "obfs=http;obfs-host=example.com",
+			},
+		},
+		{
+			name: "hysteria2",
+			link: "hysteria2://p%40ss@hy.example.com:8443?sni=hy.example.com&insecure=1&obfs=salamander&obfs-password=ob#HY",
+			want: map[string]interface{}{
+				"type": "hysteria2", "tag": "HY", "server": "hy.example.com", "server_port": 8443, "password": "p@ss",
+				"tls":  map[string]interface{}{"enabled": true, "server_name": "hy.example.com", "insecure": true},
+				"obfs": map[string]interface{}{"type": "salamander", "password": "ob"},
+			},
+		},
+		{
+			name: "hy2 short scheme",
+			link: "hy2://pw@5.6.7.8:443#H2",
+			want: map[string]interface{}{
+				"type": "hysteria2", "tag": "H2", "server": "5.6.7.8", "server_port": 443, "password": "pw",
+				"tls": map[string]interface{}{"enabled": true},
+			},
+		},
+		{
+			name: "tuic",
+			link: "tuic://" + uuid + ":pw@tu.example.com:443?congestion_control=bbr&alpn=h3&udp_relay_mode=native&allow_insecure=1#TU",
+			want: map[string]interface{}{
+				"type": "tuic", "tag": "TU", "server": "tu.example.com", "server_port": 443, "uuid": uuid, "password": "pw",
+				"congestion_control": "bbr", "udp_relay_mode": "native",
+				"tls": map[string]interface{}{"enabled": true, "alpn": []interface{}{"h3"}, "insecure": true},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseShareLink(tt.link)
+			if err != nil {
+				t.Fatalf("parseShareLink() error = %v", err)
+			}
+			if g, w := normalize(t, got), normalize(t, tt.want); !reflect.DeepEqual(g, w) {
+				t.Errorf("parseShareLink()\n got %v\nwant %v", g, w)
+			}
+		})
+	}
+}
+
+func TestParseShareLinkErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		link string
+	}{
+		{"vmess bad base64", "vmess://!!!"},
+		{"vmess bad json", "vmess://" + base64.StdEncoding.EncodeToString([]byte("not json"))},
+		{"vmess missing id", "vmess://" + base64.StdEncoding.EncodeToString([]byte(`{"add":"a.com","port":"443"}`))},
+		{"vless missing uuid", "vless://@a.com:443"},
+		{"trojan bad port", "trojan://pw@a.com:port"},
+		{"trojan missing server", "trojan://pw@:443"},
+		{"ss missing method", "ss://" + base64.StdEncoding.EncodeToString([]byte("nopassword")) + "@a.com:443"},
+		{"ss unsupported plugin", "ss://" + base64.StdEncoding.EncodeToString([]byte("aes-128-gcm:pw")) + "@a.com:443/?plugin=kcptun"},
+		{"tuic missing uuid", "tuic://a.com:443"},
+		{"unknown scheme", "socks://a.com:1080"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := parseShareLink(tt.link); err == nil {
+				t.Errorf("parseShareLink(%q) succeeded, want error", tt.link)
+			}
+		})
+	}
+}
+
+func TestConvertSubscription(t *testing.T) {
+	links := []string{
+		"trojan://secret@tr.example.com:443#Node",
+		"ss://" + base64.StdEncoding.EncodeToString([]byte("aes-128-gcm:pw")) + "@ss.example.com:8388#Node",
+		"hy2://pw@hy.example.com:443",
+		"vless://@broken.example.com:443#Broken",
+	}
+	plain := strings.Join(links, "\r\n")
+
+	tests := []struct {
+		name     string
+		body     string
+		tags     []string
+		warnings int
+	}{
+		{"plain list", plain, []string{"Node", "Node 2", "hysteria2-hy.example.com"}, 1},
+		{"base64 body", base64.StdEncoding.EncodeToString([]byte(plain)), []string{"Node", "Node 2", "hysteria2-hy.example.com"}, 1},
+		{"wrapped base64 body", "\xef\xbb\xbf" + strings.Join(strings.SplitAfter(base64.StdEncoding.EncodeToString([]byte(links[0])), "AAAA"), "\n"), []string{"Node"}, 0},
+		{"url-safe base64 body", base64.RawURLEncoding.EncodeToString([]byte(links[2])), []string{"hysteria2-hy.example.com"}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config, warnings, err := convertSubscription([]byte(tt.body), nil)
+			if err != nil {
+				t.Fatalf("convertSubscription() error = %v", err)
+			}
+			if len(warnings) != tt.warnings {
+				t.Errorf("warnings = %v, want %d", warnings, tt.warnings)
+			}
+			checkConfig(t, config)
+
+			var tags []string
+			for _, ob := range gjson.GetBytes(config, "outbounds").Array() {
+				switch ob.Get("type").String() {
+				case "selector", "urltest", "direct":
+				default:
+					tags = append(tags, ob.Get("tag").String())
+				}
+			}
+			if !reflect.DeepEqual(tags, tt.tags) {
+				t.Errorf("node tags = %v, want %v", tags, tt.tags)
+			}
+
+			members := gjson.GetBytes(config, `outbounds.#(tag=="`+selectorTag+`").outbounds`).Array()
+			if len(members) != len(tt.tags)+1 || members[0].String() != urltestTag {
+				t.Errorf("selector members = %v, want %s and the nodes", members, urltestTag)
+			}
+			if got := gjson.GetBytes(config, "route.final").String(); got != selectorTag {
+				t.Errorf("route.final = %q, want %q", got, selectorTag)
+			}
+		})
+	}
+}
+
+func TestConvertSubscriptionPassthroughAndErrors(t *testing.T) {
+	singBox := []byte(`{"outbounds":[{"type":"direct","tag":"direct"}]}`)
+	config, warnings, err := convertSubscription(singBox, nil)
+	if err != nil || warnings != nil || string(config) != string(singBox) {
+		t.Errorf("sing-box config not returned unchanged: %s, %v, %v", config, warnings, err)
+	}
+	if !isSingBoxConfig(append([]byte("\xef\xbb\xbf\n"), singBox...)) || isSingBoxConfig([]byte("{broken")) || isSingBoxConfig([]byte("vmess://x")) {
+		t.Error("isSingBoxConfig() misclassified content")
+	}
+
+	for _, body := range []string{"", "   \n", "hello world", "vless://@broken.example.com:443"} {
+		if _, _, err := convertSubscription([]byte(body), nil); err == nil {
+			t.Errorf("convertSubscription(%q) succeeded, want error", body)
+		}
+	}
+}
+
+func TestBuildBaseConfig(t *testing.T) {
+	outbounds := []interface{}{
+		map[string]interface{}{"type": "selector", "tag": "proxy", "outbounds": []string{"a"}},
+		map[string]interface{}{"type": "trojan", "tag": "a", "server": "a.com", "server_port": 443, "password": "pw"},
+	}
+	rules := []interface{}{map[string]interface{}{"domain_suffix": []string{"cn"}, "outbound": directTag}}
+
+	for _, final := range []string{"proxy", directTag} {
+		data, err := json.Marshal(buildBaseConfig(outbounds, rules, final))
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkConfig(t, data)
+
+		actions := gjson.GetBytes(data, "route.rules.#.action").Array()
+		if len(actions) != 2 || actions[0].String() != "sniff" || actions[1].String() != "hijack-dns" {
+			t.Errorf("leading actions = %v, want sniff and hijack-dns", actions)
+		}
+		if got := gjson.GetBytes(data, "route.rules.2.outbound").String(); got != directTag {
+			t.Errorf("custom rule not kept after the leading actions")
+		}
+		detour := gjson.GetBytes(data, `dns.servers.#(tag=="remote").detour`)
+		if final == directTag && detour.Exists() {
+			t.Errorf("remote DNS detours through direct")
+		}
+		if final != directTag && detour.String() != final {
+			t.Errorf("remote DNS detour = %q, want %q", detour.String(), final)
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package internal
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	wailsRuntime "github.com/wailsapp/wails/v2/pkg/runtime"
+)
+
+const (
+	quotaWarnRatio   = 0.9            // Warn when this share of the traffic quota is used
+	expiryWarnWindow = 72 * time.Hour // Warn when the subscription expires within this window
+)
+
+// parseSubscriptionUserinfo parses a "upload=..; download=..; total=..; expire=.." header
+func parseSubscriptionUserinfo(value string) *SubscriptionInfo {
+	if strings.TrimSpace(value) == "" {
+		return nil
+	}
+
+	info := &SubscriptionInfo{}
+	found := false
+	for _, part := range strings.Split(value, ";") {
+		key, val, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok {
+			continue
+		}
+		n, err := strconv.ParseFloat(strings.TrimSpace(val), 64)
+		if err != nil {
+			continue
+		}
+		switch strings.ToLower(strings.TrimSpace(key)) {
+		case "upload":
+			info.Upload = int64(n)
+		case "download":
+			info.Download = int64(n)
+		case "total":
+			info.Total = int64(n)
+		case "expire":
+			info.Expire = int64(n)
+		default:
+			continue
+		}
+		found = true
+	}
+
+	if !found {
+		return nil
+	}
+	return info
+}
+
+// filenameFromDisposition returns the filename of a content-disposition header without its extension
+func filenameFromDisposition(value string) string {
+	_, params, err := mime.ParseMediaType(value)
+	if err != nil {
+		return ""
+	}
+	name := strings.TrimSpace(params["filename"])
+	return strings.TrimSuffix(name, path.Ext(name))
+}
+
+// defaultProfileName picks a profile name from response headers, falling back to the URL host
+func defaultProfileName(header http.Header, rawURL string) string {
+	if name := filenameFromDisposition(header.Get("content-disposition")); name != "" {
+		return name
+	}
+	if u, err := url.Parse(rawURL); err == nil && u.Hostname() != "" {
+		return u.Hostname()
+	}
+	return "Profile"
+}
+
+// subscriptionAlert is a warning about a subscription's quota or expiry
+type subscriptionAlert struct {
+	Key     string // Stable state, remembered in Profile.Warned so each state is reported once
+	Message string
+}
+
+// subscriptionAlerts returns the warnings that apply to a subscription at now
+func subscriptionAlerts(info *SubscriptionInfo, now time.Time) []subscriptionAlert {
+	if info == nil {
+		return nil
+	}
+
+	var alerts []subscriptionAlert
+	if info.Total > 0 {
+		used := float64(info.Upload+info.Download) / float64(info.Total)
+		if used >= 1 {
+			alerts = append(alerts, subscriptionAlert{"quota-exhausted", "traffic quota used up"})
+		} else if used >= quotaWarnRatio {
+			alerts = append(alerts, subscriptionAlert{"quota", fmt.Sprintf("%.0f%% of traffic quota used", used*100)})
+		}
+	}
+	if info.Expire > 0 {
+		remaining := time.Unix(info.Expire, 0).Sub(now)
+		if remaining <= 0 {
+			alerts = append(alerts, subscriptionAlert{"expired", "subscription has expired"})
+		} else if remaining <= expiryWarnWindow {
+			alerts = append(alerts, subscriptionAlert{"expiring", fmt.Sprintf("subscription expires in %.0f hours", remaining.Hours())})
+		}
+	}
+	return alerts
+}
+
+// newSubscriptionAlerts returns the alerts whose state was not warned about
+// yet, and the keys to remember for the next check. A state that clears, such
+// as a quota reset, is forgotten so it is reported again when it returns.
+func newSubscriptionAlerts(alerts []subscriptionAlert, warned []string) ([]subscriptionAlert, []string) {
+	var fresh []subscriptionAlert
+	var keys []string
+	for _, alert := range alerts {
+		keys = append(keys, alert.Key)
+		if !slices.Contains(warned, alert.Key) {
+			fresh = append(fresh, alert)
+		}
+	}
+	return fresh, keys
+}
+
+// checkSubscriptionWarnings emits a warning event for profiles whose traffic
+// quota is nearly used up or whose subscription is about to expire. Each
+// state is reported once, not on every refresh or startup.
+func (a *App) checkSubscriptionWarnings(ids ...string) {
+	wanted := make(map[string]bool)
+	for _, id := range ids {
+		wanted[id] = true
+	}
+
+	type pending struct {
+		profile Profile
+		alerts  []subscriptionAlert
+	}
+	var emit []pending
+	now := time.Now()
+	err := a.storage.Update(func(meta *MetaData) error {
+		for i := range meta.Profiles {
+			p := &meta.Profiles[i]
+			if len(wanted) > 0 && !wanted[p.ID] {
+				continue
+			}
+			fresh, keys := newSubscriptionAlerts(subscriptionAlerts(p.Subscription, now), p.Warned)
+			p.Warned = keys
+			if len(fresh) > 0 {
+				emit = append(emit, pending{*p, fresh})
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return
+	}
+
+	for _, e := range emit {
+		for _, alert := range e.alerts {
+			a.appLogger.Warn("Profile " + e.profile.Name + ": " + alert.Message)
+			wailsRuntime.EventsEmit(a.ctx, "subscription-warning", map[string]interface{}{
+				"id":      e.profile.ID,
+				"name":    e.profile.Name,
+				"message": alert.Message,
+			})
+		}
+	}
+}
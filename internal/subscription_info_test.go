@@ -0,0 +1,127 @@
+package internal
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseSubscriptionUserinfo(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		want  *SubscriptionInfo
+	}{
+		{"full", "upload=1024; download=2048; total=10737418240; expire=1893456000",
+			&SubscriptionInfo{Upload: 1024, Download: 2048, Total: 10737418240, Expire: 1893456000}},
+		{"no spaces", "upload=1;download=2;total=3;expire=4", &SubscriptionInfo{Upload: 1, Download: 2, Total: 3, Expire: 4}},
+		{"upper case and padding", " Upload = 5 ; DOWNLOAD=6 ", &SubscriptionInfo{Upload: 5, Download: 6}},
+		{"partial", "total=100", &SubscriptionInfo{Total: 100}},
+		{"float values", "upload=1.5e3; download=2.0; total=1e10", &SubscriptionInfo{Upload: 1500, Download: 2, Total: 10000000000}},
+		{"trailing separator", "upload=1; download=2;", &SubscriptionInfo{Upload: 1, Download: 2}},
+		{"bad values skipped", "upload=abc; download=; total=100; expire", &SubscriptionInfo{Total: 100}},
+		{"unknown keys skipped", "plan=pro; total=100", &SubscriptionInfo{Total: 100}},
+		{"empty", "", nil},
+		{"blank", "   ", nil},
+		{"only garbage", "garbage", nil},
+		{"only unknown keys", "plan=1; user=2", nil},
+		{"only bad values", "upload=; download=x", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := parseSubscriptionUserinfo(tt.value)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseSubscriptionUserinfo(%q) = %+v, want %+v", tt.value, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDefaultProfileName(t *testing.T) {
+	tests := []struct {
+		disposition string
+		url         string
+		want        string
+	}{
+		{`attachment; filename="My Sub.yaml"`, "https://sub.example.com/x", "My Sub"},
+		{`attachment; filename=plain`, "https://sub.example.com/x", "plain"},
+		{`attachment; filename*=UTF-8''%E6%9C%BA%E5%9C%BA.json`, "https://sub.example.com/x", "机场"},
+		{"", "https://sub.example.com:8443/x", "sub.example.com"},
+		{"not a disposition;;", "https://sub.example.com/x", "sub.example.com"},
+		{"", "::bad", "Profile"},
+	}
+	for _, tt := range tests {
+		header := http.Header{}
+		if tt.disposition != "" {
+			header.Set("Content-Disposition", tt.disposition)
+		}
+		if got := defaultProfileName(header, tt.url); got != tt.want {
+			t.Errorf("defaultProfileName(%q, %q) = %q, want %q", tt.disposition, tt.url, got, tt.want)
+		}
+	}
+}
+
+func TestSubscriptionAlerts(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	tests := []struct {
+		name string
+		info *SubscriptionInfo
+		want []string
+	}{
+		{"none", nil, nil},
+		{"unlimited", &SubscriptionInfo{Upload: 100}, nil},
+		{"below quota", &SubscriptionInfo{Upload: 40, Download: 49, Total: 100}, nil},
+		{"near quota", &SubscriptionInfo{Upload: 40, Download: 50, Total: 100}, []string{"quota"}},
+		{"quota used up", &SubscriptionInfo{Download: 120, Total: 100}, []string{"quota-exhausted"}},
+		{"far expiry", &SubscriptionInfo{Expire: now.Add(expiryWarnWindow + time.Hour).Unix()}, nil},
+		{"expiring", &SubscriptionInfo{Expire: now.Add(24 * time.Hour).Unix()}, []string{"expiring"}},
+		{"expired", &SubscriptionInfo{Expire: now.Unix()}, []string{"expired"}},
+		{"both", &SubscriptionInfo{Download: 95, Total: 100, Expire: now.Add(time.Hour).Unix()}, []string{"quota", "expiring"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var keys []string
+			for _, alert := range subscriptionAlerts(tt.info, now) {
+				keys = append(keys, alert.Key)
+			}
+			if !reflect.DeepEqual(keys, tt.want) {
+				t.Errorf("subscriptionAlerts() = %v, want %v", keys, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewSubscriptionAlerts(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	near := &SubscriptionInfo{Download: 95, Total: 100}
+	expiring := &SubscriptionInfo{Download: 95, Total: 100, Expire: now.Add(time.Hour).Unix()}
+	reset := &SubscriptionInfo{Total: 100, Expire: now.Add(time.Hour).Unix()}
+
+	// Each step feeds the remembered keys of the previous one, like repeated refreshes
+	steps := []struct {
+		info  *SubscriptionInfo
+		fresh []string
+		keys  []string
+	}{
+		{near, []string{"quota"}, []string{"quota"}},
+		{near, nil, []string{"quota"}},
+		{expiring, []string{"expiring"}, []string{"quota", "expiring"}},
+		{expiring, nil, []string{"quota", "expiring"}},
+		{reset, nil, []string{"expiring"}},
+		{expiring, []string{"quota"}, []string{"quota", "expiring"}},
+		{nil, nil, nil},
+	}
+	var warned []string
+	for i, step := range steps {
+		fresh, keys := newSubscriptionAlerts(subscriptionAlerts(step.info, now), warned)
+		var freshKeys []string
+		for _, alert := range fresh {
+			freshKeys = append(freshKeys, alert.Key)
+		}
+		if !reflect.DeepEqual(freshKeys, step.fresh) || !reflect.DeepEqual(keys, step.keys) {
+			t.Errorf("step %d: fresh = %v, keys = %v, want %v, %v", i, freshKeys, keys, step.fresh, step.keys)
+		}
+		warned = keys
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"net/http"
 	"strings"
 	"sync"
 	"time"
@@ -19,7 +20,7 @@ type TrafficMonitor struct {
 	ipcPaused bool
 	mu        sync.RWMutex
 	conn      *websocket.Conn
-	apiURL    string
+	api       ClashAPI
 }
 
 // TrafficData represents the traffic statistics from WebSocket
@@ -29,10 +30,10 @@ type TrafficData struct {
 }
 
 // NewTrafficMonitor creates a new traffic monitor
-func NewTrafficMonitor(ctx context.Context, apiURL string) *TrafficMonitor {
+func NewTrafficMonitor(ctx context.Context, api ClashAPI) *TrafficMonitor {
 	return &TrafficMonitor{
-		ctx:    ctx,
-		apiURL: apiURL,
+		ctx: ctx,
+		api: api,
 	}
 }
 
@@ -46,13 +47,14 @@ func (tm *TrafficMonitor) Start() error {
 	}
 
 	// Parse and construct WebSocket URL safely
-	wsURL := tm.apiURL
-	wsURL = strings.Replace(wsURL, "http://0.0.0.0", "http://127.0.0.1", 1)
-	wsURL = strings.Replace(wsURL, "https://0.0.0.0", "https://127.0.0.1", 1)
+	wsURL := tm.api.URL
 	wsURL = strings.Replace(wsURL, "http://", "ws://", 1)
 	wsURL = strings.Replace(wsURL, "https://", "wss://", 1)
 	wsURL = strings.TrimSuffix(wsURL, "/") + "/traffic"
 
+	header := http.Header{}
+	tm.api.authorize(header)
+
 	// Mark as running before starting goroutine to avoid race
 	tm.running = true
 
@@ -78,7 +80,7 @@ func (tm *TrafficMonitor) Start() error {
 				return
 			}
 
-			conn, _, err = dialer.Dial(wsURL, nil)
+			conn, _, err = dialer.Dial(wsURL, header)
 			if err == nil {
 				break
 			}